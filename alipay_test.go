@@ -0,0 +1,46 @@
+package idp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smart-unicom/idp"
+)
+
+// TestAlipayValidateSecretReference 应用私钥为密钥引用时Validate不解析私钥，创建提供者时解析引用
+func TestAlipayValidateSecretReference(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "alipay.pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	idpInfo := &idp.ProviderInfo{
+		Type:         idp.IDP_ALIPAY,
+		ClientId:     "2021000000000000",
+		ClientSecret: "file:" + path,
+	}
+	if err = idpInfo.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if _, err = idp.GetIdProvider(idpInfo, "https://example.com/callback"); err != nil {
+		t.Fatalf("GetIdProvider: %v", err)
+	}
+
+	idpInfo.ClientSecret = "literal:file:" + path
+	if err = idpInfo.Validate(); err == nil {
+		t.Error("literal:转义的无效私钥应校验失败")
+	}
+}
@@ -0,0 +1,261 @@
+// 授权URL构建
+// 提供各登录提供者生成授权跳转地址时共用的选项和工具函数
+package idp
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrAuthURLNotSupported 登录提供者不支持生成授权URL
+var ErrAuthURLNotSupported = errors.New("登录提供者不支持生成授权URL")
+
+// AuthURLProvider 可选的授权URL生成接口
+type AuthURLProvider interface {
+	// GetAuthURL 生成跳转到第三方平台的授权URL
+	// 参数:
+	//   - state: 防CSRF的状态参数，回调时原样返回
+	//   - opts: 授权URL构建选项（如授权范围、附加参数）
+	// 返回:
+	//   - string: 授权URL，无法生成时为空字符串
+	GetAuthURL(state string, opts ...AuthOption) string
+}
+
+// AuthURLContextProvider 可选的授权URL生成接口，生成前需要访问平台接口的提供者（如需要加载发现文档的OIDC）实现
+type AuthURLContextProvider interface {
+	// GetAuthURLContext 生成跳转到第三方平台的授权URL，请求受上下文控制
+	// 参数:
+	//   - ctx: 请求上下文
+	//   - state: 防CSRF的状态参数，回调时原样返回
+	//   - opts: 授权URL构建选项
+	// 返回:
+	//   - string: 授权URL
+	//   - error: 无法生成时返回具体错误
+	GetAuthURLContext(ctx context.Context, state string, opts ...AuthOption) (string, error)
+}
+
+// GetAuthURL 生成跳转到第三方平台的授权URL
+// 参数:
+//   - provider: 登录提供者
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+//
+// 返回:
+//   - string: 授权URL
+//   - error: 提供者未实现AuthURLProvider时返回ErrAuthURLNotSupported
+func GetAuthURL(provider IdProvider, state string, opts ...AuthOption) (string, error) {
+	return GetAuthURLContext(context.Background(), provider, state, opts...)
+}
+
+// GetAuthURLContext 生成跳转到第三方平台的授权URL，请求受上下文控制
+// 提供者实现AuthURLContextProvider时优先使用，可获得无法生成授权URL的具体原因
+// 参数:
+//   - ctx: 请求上下文
+//   - provider: 登录提供者
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+//
+// 返回:
+//   - string: 授权URL
+//   - error: 提供者未实现AuthURLProvider时返回ErrAuthURLNotSupported
+func GetAuthURLContext(ctx context.Context, provider IdProvider, state string, opts ...AuthOption) (string, error) {
+	if p, ok := provider.(AuthURLContextProvider); ok {
+		return p.GetAuthURLContext(ctx, state, opts...)
+	}
+	p, ok := provider.(AuthURLProvider)
+	if !ok {
+		return "", ErrAuthURLNotSupported
+	}
+	authUrl := p.GetAuthURL(state, opts...)
+	if authUrl == "" {
+		return "", errors.New("登录提供者无法生成授权URL")
+	}
+	return authUrl, nil
+}
+
+// AuthOption 授权URL构建选项
+type AuthOption func(*authOptions)
+
+// authOptions 授权URL构建参数
+type authOptions struct {
+	scopes       []string   // 授权范围
+	redirectUrl  string     // 重定向URL
+	params       url.Values // 附加查询参数
+	codeVerifier string     // PKCE code_verifier，见WithPKCE
+}
+
+// WithScopes 覆盖提供者默认的授权范围
+// 参数:
+//   - scopes: 授权范围列表
+//
+// 返回:
+//   - AuthOption: 授权URL构建选项
+func WithScopes(scopes ...string) AuthOption {
+	return func(o *authOptions) {
+		o.scopes = scopes
+	}
+}
+
+// WithRedirectUrl 覆盖提供者配置的重定向URL
+// 换取令牌时发送redirect_uri的平台（QQ、微博、GitLab、Gitee、百度、通用OAuth2、OIDC）要求与授权时一致，
+// 回调时需通过WithTokenRedirectUrl在上下文中传入相同的值
+// 参数:
+//   - redirectUrl: 重定向URL
+//
+// 返回:
+//   - AuthOption: 授权URL构建选项
+func WithRedirectUrl(redirectUrl string) AuthOption {
+	return func(o *authOptions) {
+		o.redirectUrl = redirectUrl
+	}
+}
+
+// redirectUrlKey 上下文中保存换取令牌时使用的重定向URL的键
+type redirectUrlKey struct{}
+
+// WithTokenRedirectUrl 在上下文中设置换取令牌时发送的redirect_uri，GetTokenContext和RefreshToken会使用该值代替提供者配置的重定向URL
+// 参数:
+//   - ctx: 请求上下文
+//   - redirectUrl: 生成授权URL时通过WithRedirectUrl传入的重定向URL
+//
+// 返回:
+//   - context.Context: 新的上下文
+func WithTokenRedirectUrl(ctx context.Context, redirectUrl string) context.Context {
+	return context.WithValue(ctx, redirectUrlKey{}, redirectUrl)
+}
+
+// tokenRedirectUrl 获取换取令牌时发送的重定向URL
+// 参数:
+//   - ctx: 请求上下文
+//   - config: OAuth2配置
+//
+// 返回:
+//   - string: 上下文中通过WithTokenRedirectUrl设置的值，未设置时为配置的重定向URL
+func tokenRedirectUrl(ctx context.Context, config *oauth2.Config) string {
+	if redirectUrl, _ := ctx.Value(redirectUrlKey{}).(string); redirectUrl != "" {
+		return redirectUrl
+	}
+	return config.RedirectURL
+}
+
+// redirectUrlOptions 获取golang.org/x/oauth2换取令牌时覆盖redirect_uri的选项
+// 参数:
+//   - ctx: 请求上下文
+//
+// 返回:
+//   - []oauth2.AuthCodeOption: 上下文中设置了重定向URL时包含对应选项
+func redirectUrlOptions(ctx context.Context) []oauth2.AuthCodeOption {
+	if redirectUrl, _ := ctx.Value(redirectUrlKey{}).(string); redirectUrl != "" {
+		return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("redirect_uri", redirectUrl)}
+	}
+	return nil
+}
+
+// WithAuthParam 设置授权URL的附加查询参数，同名参数将覆盖提供者生成的值
+// 参数:
+//   - key: 参数名
+//   - value: 参数值
+//
+// 返回:
+//   - AuthOption: 授权URL构建选项
+func WithAuthParam(key string, value string) AuthOption {
+	return func(o *authOptions) {
+		o.params.Set(key, value)
+	}
+}
+
+// WithNonce 设置OpenID Connect的nonce参数，用于将ID令牌与本次授权请求绑定
+// 参数:
+//   - nonce: 随机字符串，回调时需通过WithOidcNonce传入以校验ID令牌
+//
+// 返回:
+//   - AuthOption: 授权URL构建选项
+func WithNonce(nonce string) AuthOption {
+	return WithAuthParam("nonce", nonce)
+}
+
+// newAuthOptions 以OAuth2配置为默认值创建授权URL构建参数
+// 参数:
+//   - config: OAuth2配置
+//   - opts: 授权URL构建选项
+//
+// 返回:
+//   - *authOptions: 授权URL构建参数
+func newAuthOptions(config *oauth2.Config, opts []AuthOption) *authOptions {
+	o := &authOptions{
+		scopes:      config.Scopes,
+		redirectUrl: config.RedirectURL,
+		params:      url.Values{},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// scope 使用指定分隔符拼接非空的授权范围
+// 参数:
+//   - sep: 分隔符
+//
+// 返回:
+//   - string: 拼接后的授权范围
+func (o *authOptions) scope(sep string) string {
+	scopes := make([]string, 0, len(o.scopes))
+	for _, s := range o.scopes {
+		if s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, sep)
+}
+
+// buildAuthURL 合并附加参数并生成授权URL
+// 参数:
+//   - base: 授权地址
+//   - params: 提供者生成的查询参数
+//   - o: 授权URL构建参数
+//
+// 返回:
+//   - string: 授权URL
+func buildAuthURL(base string, params url.Values, o *authOptions) string {
+	for k, v := range o.params {
+		params[k] = v
+	}
+
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return base + sep + params.Encode()
+}
+
+// standardAuthURL 生成符合OAuth2规范的授权URL
+// 参数:
+//   - config: OAuth2配置
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+//   - pkce: 平台是否支持PKCE，支持时按WithPKCE加入code_challenge
+//
+// 返回:
+//   - string: 授权URL
+func standardAuthURL(config *oauth2.Config, state string, opts []AuthOption, pkce bool) string {
+	o := newAuthOptions(config, opts)
+
+	params := url.Values{}
+	params.Set("client_id", config.ClientID)
+	params.Set("redirect_uri", o.redirectUrl)
+	params.Set("response_type", "code")
+	params.Set("state", state)
+	if scope := o.scope(" "); scope != "" {
+		params.Set("scope", scope)
+	}
+	if pkce {
+		o.setCodeChallenge(params)
+	}
+
+	return buildAuthURL(config.Endpoint.AuthURL, params, o)
+}
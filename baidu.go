@@ -1,132 +1,254 @@
-// 百度OAuth2登录提供者实现
-// 支持百度网页登录和用户信息获取
-package idp
-
-import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-
-	"golang.org/x/oauth2"
-)
-
-// BaiduIdProvider 百度登录提供者
-// 实现百度OAuth2登录功能
-type BaiduIdProvider struct {
-	Client *http.Client    // HTTP客户端
-	Config *oauth2.Config // OAuth2配置
-}
-
-// NewBaiduIdProvider 创建百度登录提供者实例
-// 参数:
-//   - clientId: 百度应用的API Key
-//   - clientSecret: 百度应用的Secret Key
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *BaiduIdProvider: 百度登录提供者实例
-func NewBaiduIdProvider(clientId string, clientSecret string, redirectUrl string) *BaiduIdProvider {
-	idp := &BaiduIdProvider{}
-
-	config := idp.getConfig()
-	config.ClientID = clientId
-	config.ClientSecret = clientSecret
-	config.RedirectURL = redirectUrl
-	idp.Config = config
-
-	return idp
-}
-
-// SetHttpClient 设置HTTP客户端
-// 参数:
-//   - client: HTTP客户端实例
-func (idp *BaiduIdProvider) SetHttpClient(client *http.Client) {
-	idp.Client = client
-}
-
-// getConfig 获取百度OAuth2配置
-// 返回:
-//   - *oauth2.Config: OAuth2配置实例
-func (idp *BaiduIdProvider) getConfig() *oauth2.Config {
-	endpoint := oauth2.Endpoint{
-		AuthURL:  "https://openapi.baidu.com/oauth/2.0/authorize",
-		TokenURL: "https://openapi.baidu.com/oauth/2.0/token",
-	}
-
-	config := &oauth2.Config{
-		Scopes:   []string{"email"},
-		Endpoint: endpoint,
-	}
-
-	return config
-}
-
-// GetToken 通过授权码获取百度访问令牌
-// 参数:
-//   - code: 百度返回的授权码
-// 返回:
-//   - *oauth2.Token: OAuth2访问令牌
-//   - error: 错误信息
-func (idp *BaiduIdProvider) GetToken(code string) (*oauth2.Token, error) {
-	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, idp.Client)
-	return idp.Config.Exchange(ctx, code)
-}
-
-/*
-{
-    "userid":"2097322476",
-    "username":"wl19871011",
-    "realname":"阳光",
-    "userdetail":"喜欢自由",
-    "birthday":"1987-01-01",
-    "marriage":"恋爱",
-    "sex":"男",
-    "blood":"O",
-    "constellation":"射手",
-    "figure":"小巧",
-    "education":"大学/专科",
-    "trade":"计算机/电子产品",
-    "job":"未知",
-    "birthday_year":"1987",
-    "birthday_month":"01",
-    "birthday_day":"01",
-}
-*/
-
-// BaiduUserInfo 百度用户信息结构体
-type BaiduUserInfo struct {
-	OpenId   string `json:"openid"`   // 用户的OpenID
-	Username string `json:"username"` // 用户名
-	Portrait string `json:"portrait"` // 用户头像标识
-}
-
-// GetUserInfo 通过访问令牌获取百度用户信息
-// 参数:
-//   - token: OAuth2访问令牌
-// 返回:
-//   - *UserInfo: 标准化用户信息
-//   - error: 错误信息
-func (idp *BaiduIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
-	resp, err := idp.Client.Get(fmt.Sprintf("https://openapi.baidu.com/rest/2.0/passport/users/getInfo?access_token=%s", token.AccessToken))
-	if err != nil {
-		return nil, err
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	baiduUser := BaiduUserInfo{}
-	if err = json.Unmarshal(data, &baiduUser); err != nil {
-		return nil, err
-	}
-
-	userInfo := UserInfo{
-		Id:          baiduUser.OpenId,
-		Username:    baiduUser.Username,
-		DisplayName: baiduUser.Username,
-		AvatarUrl:   fmt.Sprintf("https://himg.bdimg.com/sys/portrait/item/%s", baiduUser.Portrait),
-	}
-	return &userInfo, nil
-}
+// 百度OAuth2登录提供者实现
+// 支持百度网页登录和用户信息获取
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// BaiduIdProvider 百度登录提供者
+// 实现百度OAuth2登录功能
+type BaiduIdProvider struct {
+	providerBase
+
+	Client *http.Client    // HTTP客户端
+	Config *oauth2.Config // OAuth2配置
+}
+
+func init() {
+	RegisterProvider(IDP_BAIDU, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		idp := NewBaiduIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl)
+		idp.applyProviderInfo(idpInfo, idp.Config, false)
+		return idp, nil
+	})
+	RegisterProviderValidator(IDP_BAIDU, requireClientSecret)
+}
+
+// NewBaiduIdProvider 创建百度登录提供者实例
+// 参数:
+//   - clientId: 百度应用的API Key
+//   - clientSecret: 百度应用的Secret Key
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *BaiduIdProvider: 百度登录提供者实例
+func NewBaiduIdProvider(clientId string, clientSecret string, redirectUrl string) *BaiduIdProvider {
+	idp := &BaiduIdProvider{Client: DefaultHttpClient(), providerBase: providerBase{providerType: IDP_BAIDU, clientId: clientId}}
+
+	config := idp.getConfig()
+	config.ClientID = clientId
+	config.ClientSecret = clientSecret
+	config.RedirectURL = redirectUrl
+	idp.Config = config
+
+	return idp
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *BaiduIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// getConfig 获取百度OAuth2配置
+// 返回:
+//   - *oauth2.Config: OAuth2配置实例
+func (idp *BaiduIdProvider) getConfig() *oauth2.Config {
+	endpoint := oauth2.Endpoint{
+		AuthURL:  "https://openapi.baidu.com/oauth/2.0/authorize",
+		TokenURL: "https://openapi.baidu.com/oauth/2.0/token",
+	}
+
+	config := &oauth2.Config{
+		Scopes:   []string{"email"},
+		Endpoint: endpoint,
+	}
+
+	return config
+}
+
+// GetAuthURL 生成百度授权跳转URL
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+// 返回:
+//   - string: 授权URL
+func (idp *BaiduIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	return standardAuthURL(idp.Config, state, opts, false)
+}
+
+// Capabilities 获取百度登录的能力描述
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *BaiduIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		RefreshToken: true,
+	})
+}
+
+// GetToken 通过授权码获取百度访问令牌
+// 参数:
+//   - code: 百度返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *BaiduIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取百度访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - code: 百度返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *BaiduIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *BaiduIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, idp.Client)
+	return idp.observeToken(ctx, OpToken, idp.Config.Endpoint.TokenURL, func() (*oauth2.Token, error) {
+		return idp.Config.Exchange(ctx, code, redirectUrlOptions(ctx)...)
+	})
+}
+
+// RefreshToken 使用刷新令牌获取新的百度访问令牌
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: GetToken返回的OAuth2令牌
+// 返回:
+//   - *oauth2.Token: 新的OAuth2令牌
+//   - error: 错误信息
+func (idp *BaiduIdProvider) RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	start := time.Now()
+	newToken, err := idp.refreshToken(ctx, token)
+	idp.finishOperation(ctx, OpRefreshToken, start, err)
+	return newToken, err
+}
+
+// refreshToken 刷新令牌，见RefreshToken
+func (idp *BaiduIdProvider) refreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	return idp.refreshStandardToken(ctx, idp.Client, idp.Config, token)
+}
+
+/*
+{
+    "userid":"2097322476",
+    "username":"wl19871011",
+    "realname":"阳光",
+    "userdetail":"喜欢自由",
+    "birthday":"1987-01-01",
+    "marriage":"恋爱",
+    "sex":"男",
+    "blood":"O",
+    "constellation":"射手",
+    "figure":"小巧",
+    "education":"大学/专科",
+    "trade":"计算机/电子产品",
+    "job":"未知",
+    "birthday_year":"1987",
+    "birthday_month":"01",
+    "birthday_day":"01",
+}
+*/
+
+// BaiduUserInfo 百度用户信息结构体
+type BaiduUserInfo struct {
+	OpenId   string `json:"openid"`   // 用户的OpenID
+	Username string `json:"username"` // 用户名
+	Portrait string `json:"portrait"` // 用户头像标识
+}
+
+// GetUserInfo 通过访问令牌获取百度用户信息
+// 参数:
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *BaiduIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 通过访问令牌获取百度用户信息，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *BaiduIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *BaiduIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	userInfoUrl := fmt.Sprintf("%s?access_token=%s", idp.resolveUserInfoUrl("https://openapi.baidu.com/rest/2.0/passport/users/getInfo"), token.AccessToken)
+	req, err := http.NewRequestWithContext(withIdempotent(ctx), "GET", userInfoUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := idp.doRequest(idp.Client, req, OpUserInfo, baiduCheck(OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	baiduUser := BaiduUserInfo{}
+	if err = json.Unmarshal(data, &baiduUser); err != nil {
+		return nil, err
+	}
+
+	userInfo := UserInfo{
+		Id:          baiduUser.OpenId,
+		Username:    baiduUser.Username,
+		DisplayName: baiduUser.Username,
+		AvatarUrl:   fmt.Sprintf("https://himg.bdimg.com/sys/portrait/item/%s", baiduUser.Portrait),
+		Identity:    idp.identity("", IdentityKey{Kind: "openid", Scope: IdentityScopeApp, Value: baiduUser.OpenId}),
+	}
+
+	if err = idp.completeUserInfo(&userInfo, data); err != nil {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
+
+// baiduCheck 创建百度开放平台接口响应检查函数
+// 百度接口失败时返回{"error_code":110,"error_msg":"..."}
+// 参数:
+//   - op: 操作类型
+// 返回:
+//   - responseCheck: 响应检查函数
+func baiduCheck(op string) responseCheck {
+	return func(resp *http.Response, data []byte) error {
+		var e struct {
+			ErrorCode int    `json:"error_code"`
+			ErrorMsg  string `json:"error_msg"`
+		}
+		if err := json.Unmarshal(data, &e); err == nil && e.ErrorCode != 0 {
+			return newProviderError(IDP_BAIDU, op, resp.StatusCode, strconv.Itoa(e.ErrorCode), e.ErrorMsg)
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return newProviderError(IDP_BAIDU, op, resp.StatusCode, "", string(data))
+		}
+		return nil
+	}
+}
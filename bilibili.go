@@ -1,220 +1,366 @@
-// 哔哩哔哩OAuth2登录提供者实现
-// 支持哔哩哔哩网页登录和用户信息获取
-package idp
-
-import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"strings"
-	"time"
-
-	"golang.org/x/oauth2"
-)
-
-// BilibiliIdProvider 哔哩哔哩登录提供者
-// 实现哔哩哔哩OAuth2登录功能
-type BilibiliIdProvider struct {
-	Client *http.Client    // HTTP客户端
-	Config *oauth2.Config // OAuth2配置
-}
-
-// NewBilibiliIdProvider 创建哔哩哔哩登录提供者实例
-// 参数:
-//   - clientId: 哔哩哔哩应用的Client ID
-//   - clientSecret: 哔哩哔哩应用的Client Secret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *BilibiliIdProvider: 哔哩哔哩登录提供者实例
-func NewBilibiliIdProvider(clientId string, clientSecret string, redirectUrl string) *BilibiliIdProvider {
-	idp := &BilibiliIdProvider{}
-
-	config := idp.getConfig(clientId, clientSecret, redirectUrl)
-	idp.Config = config
-
-	return idp
-}
-
-// SetHttpClient 设置HTTP客户端
-// 参数:
-//   - client: HTTP客户端实例
-func (idp *BilibiliIdProvider) SetHttpClient(client *http.Client) {
-	idp.Client = client
-}
-
-// getConfig 获取哔哩哔哩OAuth2配置
-// 参数:
-//   - clientId: 哔哩哔哩应用的Client ID
-//   - clientSecret: 哔哩哔哩应用的Client Secret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *oauth2.Config: OAuth2配置实例
-func (idp *BilibiliIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
-	endpoint := oauth2.Endpoint{
-		TokenURL: "https://api.bilibili.com/x/account-oauth2/v1/token",
-		AuthURL:  "http://member.bilibili.com/arcopen/fn/user/account/info",
-	}
-
-	config := &oauth2.Config{
-		Scopes:       []string{"", ""},
-		Endpoint:     endpoint,
-		ClientID:     clientId,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectUrl,
-	}
-
-	return config
-}
-
-// BilibiliProviderToken 哔哩哔哩访问令牌结构体
-type BilibiliProviderToken struct {
-	AccessToken  string `json:"access_token"`  // 访问令牌
-	ExpiresIn    int    `json:"expires_in"`    // 访问令牌的有效时间，单位是秒
-	RefreshToken string `json:"refresh_token"` // 刷新令牌
-}
-
-// BilibiliIdProviderTokenResponse 哔哩哔哩令牌响应结构体
-type BilibiliIdProviderTokenResponse struct {
-	Code    int                   `json:"code"`    // 响应码，0表示成功
-	Message string                `json:"message"` // 响应消息
-	TTL     int                   `json:"ttl"`     // 生存时间
-	Data    BilibiliProviderToken `json:"data"`    // 令牌数据
-}
-
-// GetToken 通过授权码获取哔哩哔哩访问令牌
-// 参数:
-//   - code: 哔哩哔哩返回的授权码
-// 返回:
-//   - *oauth2.Token: OAuth2访问令牌
-//   - error: 错误信息
-// 详细文档: https://openhome.bilibili.com/doc/4/eaf0e2b5-bde9-b9a0-9be1-019bb455701c
-func (idp *BilibiliIdProvider) GetToken(code string) (*oauth2.Token, error) {
-	pTokenParams := &struct {
-		ClientId     string `json:"client_id"`
-		ClientSecret string `json:"client_secret"`
-		GrantType    string `json:"grant_type"`
-		Code         string `json:"code"`
-	}{
-		idp.Config.ClientID,
-		idp.Config.ClientSecret,
-		"authorization_code",
-		code,
-	}
-
-	data, err := idp.postWithBody(pTokenParams, idp.Config.Endpoint.TokenURL)
-	if err != nil {
-		return nil, err
-	}
-
-	response := &BilibiliIdProviderTokenResponse{}
-	err = json.Unmarshal(data, response)
-	if err != nil {
-		return nil, err
-	}
-
-	if response.Code != 0 {
-		return nil, fmt.Errorf("pToken.Errcode = %d, pToken.Errmsg = %s", response.Code, response.Message)
-	}
-
-	token := &oauth2.Token{
-		AccessToken:  response.Data.AccessToken,
-		Expiry:       time.Unix(time.Now().Unix()+int64(response.Data.ExpiresIn), 0),
-		RefreshToken: response.Data.RefreshToken,
-	}
-
-	return token, nil
-}
-
-// BilibiliUserInfo 哔哩哔哩用户信息结构体
-type BilibiliUserInfo struct {
-	Name   string `json:"name"`   // 用户昵称
-	Face   string `json:"face"`   // 用户头像URL
-	OpenId string `json:"openid"` // 用户OpenID
-}
-
-// BilibiliUserInfoResponse 哔哩哔哩用户信息响应结构体
-type BilibiliUserInfoResponse struct {
-	Code    int              `json:"code"`    // 响应码，0表示成功
-	Message string           `json:"message"` // 响应消息
-	TTL     int              `json:"ttl"`     // 生存时间
-	Data    BilibiliUserInfo `json:"data"`    // 用户信息数据
-}
-
-// GetUserInfo 通过访问令牌获取哔哩哔哩用户信息
-// 参数:
-//   - token: OAuth2访问令牌
-// 返回:
-//   - *UserInfo: 标准化用户信息
-//   - error: 错误信息
-// 详细文档: https://openhome.bilibili.com/doc/4/feb66f99-7d87-c206-00e7-d84164cd701c
-func (idp *BilibiliIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
-	accessToken := token.AccessToken
-	clientId := idp.Config.ClientID
-
-	params := url.Values{}
-	params.Add("client_id", clientId)
-	params.Add("access_token", accessToken)
-
-	userInfoUrl := fmt.Sprintf("%s?%s", idp.Config.Endpoint.AuthURL, params.Encode())
-
-	resp, err := idp.Client.Get(userInfoUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	bUserInfoResponse := &BilibiliUserInfoResponse{}
-	if err = json.Unmarshal(data, bUserInfoResponse); err != nil {
-		return nil, err
-	}
-
-	if bUserInfoResponse.Code != 0 {
-		return nil, fmt.Errorf("userinfo.Errcode = %d, userinfo.Errmsg = %s", bUserInfoResponse.Code, bUserInfoResponse.Message)
-	}
-
-	userInfo := &UserInfo{
-		Id:          bUserInfoResponse.Data.OpenId,
-		Username:    bUserInfoResponse.Data.Name,
-		DisplayName: bUserInfoResponse.Data.Name,
-		AvatarUrl:   bUserInfoResponse.Data.Face,
-	}
-
-	return userInfo, nil
-}
-
-// postWithBody 发送POST请求并获取响应内容
-// 参数:
-//   - body: 请求体数据
-//   - url: 请求URL
-// 返回:
-//   - []byte: 响应内容
-//   - error: 错误信息
-func (idp *BilibiliIdProvider) postWithBody(body interface{}, url string) ([]byte, error) {
-	bs, err := json.Marshal(body)
-	if err != nil {
-		return nil, err
-	}
-	r := strings.NewReader(string(bs))
-	resp, err := idp.Client.Post(url, "application/json;charset=UTF-8", r)
-	if err != nil {
-		return nil, err
-	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			return
-		}
-	}(resp.Body)
-
-	return data, nil
-}
+// 哔哩哔哩OAuth2登录提供者实现
+// 支持哔哩哔哩网页登录和用户信息获取
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// bilibiliUserInfoUrl 哔哩哔哩获取用户公开信息接口地址
+const bilibiliUserInfoUrl = "http://member.bilibili.com/arcopen/fn/user/account/info"
+
+// BilibiliIdProvider 哔哩哔哩登录提供者
+// 实现哔哩哔哩OAuth2登录功能
+type BilibiliIdProvider struct {
+	providerBase
+
+	Client *http.Client    // HTTP客户端
+	Config *oauth2.Config // OAuth2配置
+}
+
+func init() {
+	RegisterProvider(IDP_BILIBILI, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		idp := NewBilibiliIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl)
+		idp.applyProviderInfo(idpInfo, idp.Config, false)
+		return idp, nil
+	})
+	RegisterProviderValidator(IDP_BILIBILI, requireClientSecret)
+}
+
+// NewBilibiliIdProvider 创建哔哩哔哩登录提供者实例
+// 参数:
+//   - clientId: 哔哩哔哩应用的Client ID
+//   - clientSecret: 哔哩哔哩应用的Client Secret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *BilibiliIdProvider: 哔哩哔哩登录提供者实例
+func NewBilibiliIdProvider(clientId string, clientSecret string, redirectUrl string) *BilibiliIdProvider {
+	idp := &BilibiliIdProvider{Client: DefaultHttpClient(), providerBase: providerBase{providerType: IDP_BILIBILI, clientId: clientId}}
+
+	config := idp.getConfig(clientId, clientSecret, redirectUrl)
+	idp.Config = config
+
+	return idp
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *BilibiliIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// getConfig 获取哔哩哔哩OAuth2配置
+// 参数:
+//   - clientId: 哔哩哔哩应用的Client ID
+//   - clientSecret: 哔哩哔哩应用的Client Secret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *oauth2.Config: OAuth2配置实例
+func (idp *BilibiliIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
+	endpoint := oauth2.Endpoint{
+		TokenURL: "https://api.bilibili.com/x/account-oauth2/v1/token",
+		AuthURL:  "https://account.bilibili.com/pc/account-pc/auth/oauth",
+	}
+
+	config := &oauth2.Config{
+		Scopes:       []string{"", ""},
+		Endpoint:     endpoint,
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectUrl,
+	}
+
+	return config
+}
+
+// GetAuthURL 生成哔哩哔哩授权跳转URL
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+// 返回:
+//   - string: 授权URL
+func (idp *BilibiliIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	o := newAuthOptions(idp.Config, opts)
+
+	params := url.Values{}
+	params.Set("client_id", idp.Config.ClientID)
+	params.Set("gourl", o.redirectUrl)
+	params.Set("state", state)
+
+	return buildAuthURL(idp.Config.Endpoint.AuthURL, params, o)
+}
+
+// Capabilities 获取哔哩哔哩登录的能力描述
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *BilibiliIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		RefreshToken: true,
+	})
+}
+
+// BilibiliProviderToken 哔哩哔哩访问令牌结构体
+type BilibiliProviderToken struct {
+	AccessToken  string `json:"access_token"`  // 访问令牌
+	ExpiresIn    int    `json:"expires_in"`    // 访问令牌的有效时间，单位是秒
+	RefreshToken string `json:"refresh_token"` // 刷新令牌
+}
+
+// BilibiliIdProviderTokenResponse 哔哩哔哩令牌响应结构体
+type BilibiliIdProviderTokenResponse struct {
+	Code    int                   `json:"code"`    // 响应码，0表示成功
+	Message string                `json:"message"` // 响应消息
+	TTL     int                   `json:"ttl"`     // 生存时间
+	Data    BilibiliProviderToken `json:"data"`    // 令牌数据
+}
+
+// GetToken 通过授权码获取哔哩哔哩访问令牌
+// 参数:
+//   - code: 哔哩哔哩返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+// 详细文档: https://openhome.bilibili.com/doc/4/eaf0e2b5-bde9-b9a0-9be1-019bb455701c
+func (idp *BilibiliIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取哔哩哔哩访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - code: 哔哩哔哩返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *BilibiliIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *BilibiliIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	pTokenParams := &struct {
+		ClientId     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		GrantType    string `json:"grant_type"`
+		Code         string `json:"code"`
+	}{
+		idp.Config.ClientID,
+		idp.Config.ClientSecret,
+		"authorization_code",
+		code,
+	}
+
+	return idp.requestToken(ctx, OpToken, idp.Config.Endpoint.TokenURL, pTokenParams)
+}
+
+// RefreshToken 使用刷新令牌获取新的哔哩哔哩访问令牌
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: GetToken返回的OAuth2令牌
+// 返回:
+//   - *oauth2.Token: 新的OAuth2令牌
+//   - error: 错误信息
+// 详细文档: https://openhome.bilibili.com/doc/4/eaf0e2b5-bde9-b9a0-9be1-019bb455701c
+func (idp *BilibiliIdProvider) RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	start := time.Now()
+	newToken, err := idp.refreshToken(ctx, token)
+	idp.finishOperation(ctx, OpRefreshToken, start, err)
+	return newToken, err
+}
+
+// refreshToken 刷新令牌，见RefreshToken
+func (idp *BilibiliIdProvider) refreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	if err := checkRefreshToken(token); err != nil {
+		return nil, err
+	}
+
+	pRefreshParams := &struct {
+		ClientId     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		GrantType    string `json:"grant_type"`
+		RefreshToken string `json:"refresh_token"`
+	}{
+		idp.Config.ClientID,
+		idp.Config.ClientSecret,
+		"refresh_token",
+		token.RefreshToken,
+	}
+
+	newToken, err := idp.requestToken(ctx, OpRefreshToken, idp.resolveUrl("https://api.bilibili.com/x/account-oauth2/v1/refresh_token"), pRefreshParams)
+	if err != nil {
+		return nil, err
+	}
+	return inheritTokenFields(newToken, token), nil
+}
+
+// requestToken 请求哔哩哔哩令牌接口并解析访问令牌，获取和刷新令牌共用
+// 参数:
+//   - ctx: 请求上下文
+//   - op: 操作类型，OpToken或OpRefreshToken
+//   - tokenUrl: 令牌接口地址
+//   - body: 请求体数据
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *BilibiliIdProvider) requestToken(ctx context.Context, op string, tokenUrl string, body interface{}) (*oauth2.Token, error) {
+	data, err := idp.postWithBody(ctx, op, body, tokenUrl, bilibiliCheck(op))
+	if err != nil {
+		return nil, err
+	}
+
+	response := &BilibiliIdProviderTokenResponse{}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  response.Data.AccessToken,
+		Expiry:       time.Unix(time.Now().Unix()+int64(response.Data.ExpiresIn), 0),
+		RefreshToken: response.Data.RefreshToken,
+	}
+
+	return idp.checkToken(op, token)
+}
+
+// BilibiliUserInfo 哔哩哔哩用户信息结构体
+type BilibiliUserInfo struct {
+	Name   string `json:"name"`   // 用户昵称
+	Face   string `json:"face"`   // 用户头像URL
+	OpenId string `json:"openid"` // 用户OpenID
+}
+
+// BilibiliUserInfoResponse 哔哩哔哩用户信息响应结构体
+type BilibiliUserInfoResponse struct {
+	Code    int              `json:"code"`    // 响应码，0表示成功
+	Message string           `json:"message"` // 响应消息
+	TTL     int              `json:"ttl"`     // 生存时间
+	Data    BilibiliUserInfo `json:"data"`    // 用户信息数据
+}
+
+// GetUserInfo 通过访问令牌获取哔哩哔哩用户信息
+// 参数:
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+// 详细文档: https://openhome.bilibili.com/doc/4/feb66f99-7d87-c206-00e7-d84164cd701c
+func (idp *BilibiliIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 通过访问令牌获取哔哩哔哩用户信息，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *BilibiliIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *BilibiliIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	accessToken := token.AccessToken
+	clientId := idp.Config.ClientID
+
+	params := url.Values{}
+	params.Add("client_id", clientId)
+	params.Add("access_token", accessToken)
+
+	userInfoUrl := fmt.Sprintf("%s?%s", idp.resolveUserInfoUrl(bilibiliUserInfoUrl), params.Encode())
+
+	req, err := http.NewRequestWithContext(withIdempotent(ctx), "GET", userInfoUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := idp.doRequest(idp.Client, req, OpUserInfo, bilibiliCheck(OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	bUserInfoResponse := &BilibiliUserInfoResponse{}
+	if err = json.Unmarshal(data, bUserInfoResponse); err != nil {
+		return nil, err
+	}
+
+	userInfo := &UserInfo{
+		Id:          bUserInfoResponse.Data.OpenId,
+		Username:    bUserInfoResponse.Data.Name,
+		DisplayName: bUserInfoResponse.Data.Name,
+		AvatarUrl:   bUserInfoResponse.Data.Face,
+		Identity:    idp.identity("", IdentityKey{Kind: "openid", Scope: IdentityScopeApp, Value: bUserInfoResponse.Data.OpenId}),
+	}
+
+	if err = idp.completeUserInfo(userInfo, data); err != nil {
+		return nil, err
+	}
+
+	return userInfo, nil
+}
+
+// postWithBody 发送POST请求并获取响应内容
+// 参数:
+//   - ctx: 请求上下文
+//   - endpoint: 接口名称，用于观察事件
+//   - body: 请求体数据
+//   - url: 请求URL
+//   - check: 平台响应检查
+// 返回:
+//   - []byte: 响应内容
+//   - error: 错误信息
+func (idp *BilibiliIdProvider) postWithBody(ctx context.Context, endpoint string, body interface{}, url string, check responseCheck) ([]byte, error) {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	r := strings.NewReader(string(bs))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
+	_, data, err := idp.doRequest(idp.Client, req, endpoint, check)
+	return data, err
+}
+
+// bilibiliCheck 创建检查哔哩哔哩接口响应的responseCheck
+// 参数:
+//   - op: 操作类型
+// 返回:
+//   - responseCheck: 响应检查函数
+func bilibiliCheck(op string) responseCheck {
+	return func(resp *http.Response, data []byte) error {
+		var result struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(data, &result); err == nil && result.Code != 0 {
+			return newProviderError(IDP_BILIBILI, op, resp.StatusCode, strconv.Itoa(result.Code), result.Message)
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return newProviderError(IDP_BILIBILI, op, resp.StatusCode, "", string(data))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+// 提供者能力描述
+// 登录界面和账号服务可在调用前了解提供者能返回哪些用户信息、支持哪些登录方式
+package idp
+
+import (
+	"strings"
+)
+
+// Capabilities 登录提供者的能力描述
+type Capabilities struct {
+	Email        bool // 用户信息中返回邮箱地址（用户未设置或未授权时仍可能为空）
+	Phone        bool // 用户信息中返回手机号码
+	UnionId      bool // 用户信息中返回跨应用的联合ID（如微信UnionId、钉钉unionId），应用需绑定到对应的开放平台
+	RefreshToken bool // 支持使用刷新令牌获取新的访问令牌，见RefreshToken
+	PKCE         bool // 授权码流程支持PKCE（S256），见WithPKCE和WithCodeVerifier
+	QRCodeLogin  bool // 支持用户使用手机客户端扫码登录
+	SilentLogin  bool // 支持在平台客户端内（如微信、钉钉、企业微信、支付宝）无需用户确认直接获取授权码
+	Nonce        bool // 支持OpenID Connect nonce，见WithNonce和WithOidcNonce
+}
+
+// CapabilitiesProvider 可选的能力描述接口
+type CapabilitiesProvider interface {
+	// Capabilities 获取提供者的能力描述
+	// 可在调用前判断提供者能否返回邮箱、手机号、联合ID，以及支持的登录方式
+	// 返回:
+	//   - Capabilities: 能力描述，已根据用户字段映射补充
+	Capabilities() Capabilities
+}
+
+// GetCapabilities 获取提供者的能力描述
+// 参数:
+//   - provider: 登录提供者
+//
+// 返回:
+//   - Capabilities: 能力描述，提供者未实现CapabilitiesProvider时各项均为false
+func GetCapabilities(provider IdProvider) Capabilities {
+	if p, ok := provider.(CapabilitiesProvider); ok {
+		return p.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// capabilities 根据用户字段映射补充提供者的能力描述
+// 配置中映射了email、phone或unionId字段时，即使平台默认不返回该字段也认为可以获取
+// 参数:
+//   - c: 提供者本身的能力描述
+//
+// 返回:
+//   - Capabilities: 补充后的能力描述
+func (b *providerBase) capabilities(c Capabilities) Capabilities {
+	for field, expr := range b.userMapping {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		switch strings.ToLower(field) {
+		case "email":
+			c.Email = true
+		case "phone":
+			c.Phone = true
+		case "unionid":
+			c.UnionId = true
+		}
+	}
+	return c
+}
@@ -0,0 +1,20 @@
+package idp_test
+
+import (
+	"testing"
+
+	"github.com/smart-unicom/idp"
+	"github.com/smart-unicom/idp/idptest"
+)
+
+// TestConformance 对所有已注册且有模拟实现的提供者运行一致性检查
+func TestConformance(t *testing.T) {
+	for _, typ := range idp.RegisteredProviders() {
+		t.Run(typ, func(t *testing.T) {
+			if !idptest.Supported(typ) {
+				t.Skipf("idptest不支持模拟%s", typ)
+			}
+			idptest.RunConformance(t, idptest.BuiltinFactory(typ))
+		})
+	}
+}
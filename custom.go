@@ -0,0 +1,322 @@
+// 通用OAuth2登录提供者实现
+// 完全由ProviderInfo配置驱动，用于对接合作方自建的标准OAuth2服务
+package idp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// 令牌接口的客户端认证方式，对应ProviderInfo.TokenAuthStyle
+const (
+	TOKEN_AUTH_STYLE_AUTO   string = ""       // 自动探测，先尝试HTTP Basic认证，失败后改用请求参数
+	TOKEN_AUTH_STYLE_HEADER string = "header" // 使用HTTP Basic认证传递client_id和client_secret
+	TOKEN_AUTH_STYLE_PARAMS string = "params" // 在请求体中传递client_id和client_secret
+)
+
+// customDefaultUserMapping 通用提供者的默认用户字段映射
+// 兼容OIDC标准声明和常见OAuth2服务的字段命名，可被ProviderInfo.UserMapping中的同名键覆盖
+var customDefaultUserMapping = map[string]string{
+	"id":          "sub|id|user_id|userid|openid|uid",
+	"username":    "preferred_username|username|login|name",
+	"displayName": "name|nickname|preferred_username|username|login",
+	"email":       "email",
+	"phone":       "phone_number|phone|mobile",
+	"avatarUrl":   "picture|avatar_url|avatar",
+}
+
+// CustomIdProvider 通用OAuth2登录提供者
+// 授权、令牌、用户信息接口及字段映射均来自ProviderInfo配置
+type CustomIdProvider struct {
+	providerBase
+
+	Client         *http.Client   // HTTP客户端
+	Config         *oauth2.Config // OAuth2配置
+	UserInfoMethod string         // 获取用户信息的HTTP方法
+}
+
+func init() {
+	RegisterProvider(IDP_CUSTOM, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		return NewCustomIdProvider(idpInfo, redirectUrl)
+	})
+	RegisterProviderValidator(IDP_CUSTOM, validateCustomInfo)
+}
+
+// validateCustomInfo 校验通用OAuth2提供者配置
+// 公共客户端使用PKCE换取令牌，不要求配置ClientSecret
+// 参数:
+//   - idpInfo: 提供者配置信息
+//
+// 返回:
+//   - error: 错误信息
+func validateCustomInfo(idpInfo *ProviderInfo) error {
+	var errs []error
+	if idpInfo.AuthURL == "" {
+		errs = append(errs, errors.New("AuthURL: Custom提供者必须配置"))
+	}
+	if idpInfo.TokenURL == "" {
+		errs = append(errs, errors.New("TokenURL: Custom提供者必须配置"))
+	}
+	if idpInfo.UserInfoURL == "" {
+		errs = append(errs, errors.New("UserInfoURL: Custom提供者必须配置"))
+	}
+	switch strings.ToLower(idpInfo.TokenAuthStyle) {
+	case TOKEN_AUTH_STYLE_AUTO, TOKEN_AUTH_STYLE_HEADER, TOKEN_AUTH_STYLE_PARAMS:
+	default:
+		errs = append(errs, fmt.Errorf("TokenAuthStyle: 不支持的令牌认证方式: %s", idpInfo.TokenAuthStyle))
+	}
+	switch strings.ToUpper(idpInfo.UserInfoMethod) {
+	case "", http.MethodGet, http.MethodPost:
+	default:
+		errs = append(errs, fmt.Errorf("UserInfoMethod: 不支持的用户信息请求方法: %s", idpInfo.UserInfoMethod))
+	}
+	return errors.Join(errs...)
+}
+
+// NewCustomIdProvider 创建通用OAuth2登录提供者实例
+// AuthURL、TokenURL、UserInfoURL为必填项，以"/"开头时视为相对HostUrl的路径
+// 参数:
+//   - idpInfo: 提供者配置信息
+//   - redirectUrl: OAuth2重定向URL
+//
+// 返回:
+//   - *CustomIdProvider: 通用OAuth2登录提供者实例
+//   - error: 配置不完整或无效时返回错误
+func NewCustomIdProvider(idpInfo *ProviderInfo, redirectUrl string) (*CustomIdProvider, error) {
+	hostUrl := strings.TrimSuffix(idpInfo.HostUrl, "/")
+	resolve := func(u string) string {
+		if hostUrl != "" && strings.HasPrefix(u, "/") {
+			return hostUrl + u
+		}
+		return u
+	}
+
+	authUrl := resolve(idpInfo.AuthURL)
+	tokenUrl := resolve(idpInfo.TokenURL)
+	userInfoUrl := resolve(idpInfo.UserInfoURL)
+	if authUrl == "" || tokenUrl == "" || userInfoUrl == "" {
+		return nil, fmt.Errorf("Custom提供者必须配置AuthURL、TokenURL和UserInfoURL")
+	}
+
+	var authStyle oauth2.AuthStyle
+	switch strings.ToLower(idpInfo.TokenAuthStyle) {
+	case TOKEN_AUTH_STYLE_AUTO:
+		authStyle = oauth2.AuthStyleAutoDetect
+	case TOKEN_AUTH_STYLE_HEADER:
+		authStyle = oauth2.AuthStyleInHeader
+	case TOKEN_AUTH_STYLE_PARAMS:
+		authStyle = oauth2.AuthStyleInParams
+	default:
+		return nil, fmt.Errorf("不支持的令牌认证方式: %s", idpInfo.TokenAuthStyle)
+	}
+
+	method := strings.ToUpper(idpInfo.UserInfoMethod)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if method != http.MethodGet && method != http.MethodPost {
+		return nil, fmt.Errorf("不支持的用户信息请求方法: %s", idpInfo.UserInfoMethod)
+	}
+
+	userMapping := mergeUserMapping(customDefaultUserMapping, idpInfo.UserMapping)
+	if err := ValidateUserMapping(userMapping); err != nil {
+		return nil, err
+	}
+
+	idp := &CustomIdProvider{
+		Client: DefaultHttpClient(),
+		Config: &oauth2.Config{
+			ClientID:     idpInfo.ClientId,
+			ClientSecret: idpInfo.ClientSecret,
+			RedirectURL:  redirectUrl,
+			Scopes:       idpInfo.Scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   authUrl,
+				TokenURL:  tokenUrl,
+				AuthStyle: authStyle,
+			},
+		},
+		UserInfoMethod: method,
+	}
+	idp.providerType = IDP_CUSTOM
+	idp.subType = idpInfo.SubType
+	idp.clientId = idpInfo.ClientId
+	idp.hostUrl = hostUrl
+	idp.userInfoUrl = userInfoUrl
+	idp.userMapping = userMapping
+
+	return idp, nil
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *CustomIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// GetAuthURL 生成授权跳转URL
+// 支持通过WithPKCE加入code_challenge
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+//
+// 返回:
+//   - string: 授权URL
+func (idp *CustomIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	return standardAuthURL(idp.Config, state, opts, true)
+}
+
+// Capabilities 获取通用OAuth2登录的能力描述
+// 邮箱、手机号和联合ID取决于用户字段映射
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *CustomIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		RefreshToken: true,
+		PKCE:         true,
+	})
+}
+
+// GetToken 通过授权码获取访问令牌
+// 参数:
+//   - code: 授权码
+//
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *CustomIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制，可通过WithCodeVerifier设置PKCE code_verifier
+//   - code: 授权码
+//
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *CustomIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *CustomIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, idp.Client)
+	return idp.observeToken(ctx, OpToken, idp.Config.Endpoint.TokenURL, func() (*oauth2.Token, error) {
+		return idp.Config.Exchange(ctx, code, exchangeOptions(ctx)...)
+	})
+}
+
+// RefreshToken 使用刷新令牌获取新的访问令牌
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: GetToken返回的OAuth2令牌
+//
+// 返回:
+//   - *oauth2.Token: 新的OAuth2令牌
+//   - error: 错误信息
+func (idp *CustomIdProvider) RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	start := time.Now()
+	newToken, err := idp.refreshToken(ctx, token)
+	idp.finishOperation(ctx, OpRefreshToken, start, err)
+	return newToken, err
+}
+
+// refreshToken 刷新令牌，见RefreshToken
+func (idp *CustomIdProvider) refreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	return idp.refreshStandardToken(ctx, idp.Client, idp.Config, token)
+}
+
+// GetUserInfo 通过访问令牌获取用户信息
+// 参数:
+//   - token: OAuth2访问令牌
+//
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *CustomIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 通过访问令牌获取用户信息，请求受上下文控制
+// 访问令牌通过Authorization请求头传递，POST方式时同时在表单中携带access_token
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: OAuth2访问令牌
+//
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *CustomIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *CustomIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	var body io.Reader
+	if idp.UserInfoMethod == http.MethodPost {
+		form := url.Values{}
+		form.Set("access_token", token.AccessToken)
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(withIdempotent(ctx), idp.UserInfoMethod, idp.userInfoUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	_, data, err := idp.doRequest(idp.Client, req, OpUserInfo, func(resp *http.Response, data []byte) error {
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return newProviderError(IDP_CUSTOM, OpUserInfo, resp.StatusCode, "", string(data))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo := UserInfo{}
+	if err = idp.completeUserInfo(&userInfo, data); err != nil {
+		return nil, err
+	}
+	if userInfo.Username == "" {
+		userInfo.Username = userInfo.Id
+	}
+	if userInfo.DisplayName == "" {
+		userInfo.DisplayName = userInfo.Username
+	}
+	// 用户ID在令牌签发服务内唯一，使用令牌接口的主机作为命名空间
+	var issuerHost string
+	if u, err := url.Parse(idp.Config.Endpoint.TokenURL); err == nil {
+		issuerHost = u.Host
+	}
+	userInfo.Identity = idp.identity("",
+		IdentityKey{Kind: "id", Scope: IdentityScopeGlobal, Namespace: issuerHost, Value: userInfo.Id},
+		IdentityKey{Kind: "unionid", Scope: IdentityScopeDeveloper, Namespace: issuerHost, Value: userInfo.UnionId},
+	)
+
+	return &userInfo, nil
+}
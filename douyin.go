@@ -1,217 +1,390 @@
-// 抖音OAuth2登录提供者实现
-// 支持抖音网页登录和用户信息获取
-package idp
-
-import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"time"
-
-	"golang.org/x/oauth2"
-)
-
-// DouyinIdProvider 抖音登录提供者
-// 实现抖音OAuth2登录功能
-type DouyinIdProvider struct {
-	Client *http.Client    // HTTP客户端
-	Config *oauth2.Config // OAuth2配置
-}
-
-// NewDouyinIdProvider 创建抖音登录提供者实例
-// 参数:
-//   - clientId: 抖音应用的Client Key
-//   - clientSecret: 抖音应用的Client Secret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *DouyinIdProvider: 抖音登录提供者实例
-func NewDouyinIdProvider(clientId string, clientSecret string, redirectUrl string) *DouyinIdProvider {
-	idp := &DouyinIdProvider{}
-	idp.Config = idp.getConfig(clientId, clientSecret, redirectUrl)
-	return idp
-}
-
-// SetHttpClient 设置HTTP客户端
-// 参数:
-//   - client: HTTP客户端实例
-func (idp *DouyinIdProvider) SetHttpClient(client *http.Client) {
-	idp.Client = client
-}
-
-// getConfig 获取抖音OAuth2配置
-// 参数:
-//   - clientId: 抖音应用的Client Key
-//   - clientSecret: 抖音应用的Client Secret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *oauth2.Config: OAuth2配置实例
-func (idp *DouyinIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
-	endpoint := oauth2.Endpoint{
-		TokenURL: "https://open.douyin.com/oauth/access_token",
-		AuthURL:  "https://open.douyin.com/platform/oauth/connect",
-	}
-
-	config := &oauth2.Config{
-		Scopes:       []string{"user_info"},
-		Endpoint:     endpoint,
-		ClientID:     clientId,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectUrl,
-	}
-
-	return config
-}
-
-// get more details via: https://open.douyin.com/platform/doc?doc=docs/openapi/account-permission/get-access-token
-/*
-{
-  "data": {
-    "access_token": "access_token",
-    "description": "",
-    "error_code": "0",
-    "expires_in": "86400",
-    "open_id": "aaa-bbb-ccc",
-    "refresh_expires_in": "86400",
-    "refresh_token": "refresh_token",
-    "scope": "user_info"
-  },
-  "message": "<nil>"
-}
-*/
-
-// DouyinTokenResp 抖音令牌响应结构体
-type DouyinTokenResp struct {
-	Data struct {
-		AccessToken  string `json:"access_token"`  // 访问令牌
-		ExpiresIn    int64  `json:"expires_in"`    // 访问令牌的有效时间，单位是秒
-		OpenId       string `json:"open_id"`       // 用户OpenID
-		RefreshToken string `json:"refresh_token"` // 刷新令牌
-		Scope        string `json:"scope"`         // 授权范围
-	} `json:"data"`    // 响应数据
-	Message string `json:"message"` // 响应消息
-}
-
-// GetToken 通过授权码获取抖音访问令牌
-// 参数:
-//   - code: 抖音返回的授权码
-// 返回:
-//   - *oauth2.Token: OAuth2访问令牌
-//   - error: 错误信息
-// 详细文档: https://open.douyin.com/platform/doc?doc=docs/openapi/account-permission/get-access-token
-func (idp *DouyinIdProvider) GetToken(code string) (*oauth2.Token, error) {
-	payload := url.Values{}
-	payload.Set("code", code)
-	payload.Set("grant_type", "authorization_code")
-	payload.Set("client_key", idp.Config.ClientID)
-	payload.Set("client_secret", idp.Config.ClientSecret)
-	resp, err := idp.Client.PostForm(idp.Config.Endpoint.TokenURL, payload)
-	if err != nil {
-		return nil, err
-	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	tokenResp := &DouyinTokenResp{}
-	err = json.Unmarshal(data, tokenResp)
-	if err != nil {
-		return nil, fmt.Errorf("fail to unmarshal token response: %s", err.Error())
-	}
-
-	token := &oauth2.Token{
-		AccessToken:  tokenResp.Data.AccessToken,
-		RefreshToken: tokenResp.Data.RefreshToken,
-		Expiry:       time.Unix(time.Now().Unix()+tokenResp.Data.ExpiresIn, 0),
-	}
-
-	raw := make(map[string]interface{})
-	raw["open_id"] = tokenResp.Data.OpenId
-	token = token.WithExtra(raw)
-
-	return token, nil
-}
-
-// get more details via: https://open.douyin.com/platform/doc?doc=docs/openapi/account-management/get-account-open-info
-/*
-{
-  "data": {
-    "avatar": "https://example.com/x.jpeg",
-    "city": "上海",
-    "country": "中国",
-    "description": "",
-    "e_account_role": "<nil>",
-    "error_code": "0",
-    "gender": "<nil>",
-    "nickname": "张伟",
-    "open_id": "0da22181-d833-447f-995f-1beefea5bef3",
-    "province": "上海",
-    "union_id": "1ad4e099-4a0c-47d1-a410-bffb4f2f64a4"
-  }
-}
-*/
-
-// DouyinUserInfo 抖音用户信息结构体
-type DouyinUserInfo struct {
-	Data struct {
-		Avatar  string `json:"avatar"`   // 用户头像URL
-		City    string `json:"city"`     // 城市
-		Country string `json:"country"`  // 国家
-		// 性别：0->未知, 1->男, 2->女
-		Gender   int64  `json:"gender"`   // 性别
-		Nickname string `json:"nickname"` // 用户昵称
-		OpenId   string `json:"open_id"`  // 用户OpenID
-		Province string `json:"province"` // 省份
-	} `json:"data"` // 用户信息数据
-}
-
-// GetUserInfo 通过访问令牌获取抖音用户信息
-// 参数:
-//   - token: OAuth2访问令牌
-// 返回:
-//   - *UserInfo: 标准化用户信息
-//   - error: 错误信息
-func (idp *DouyinIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
-	body := &struct {
-		AccessToken string `json:"access_token"`
-		OpenId      string `json:"open_id"`
-	}{token.AccessToken, token.Extra("open_id").(string)}
-	data, err := json.Marshal(body)
-	if err != nil {
-		return nil, err
-	}
-	req, err := http.NewRequest("GET", "https://open.douyin.com/oauth/userinfo/", bytes.NewReader(data))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("access-token", token.AccessToken)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := idp.Client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var douyinUserInfo DouyinUserInfo
-	err = json.Unmarshal(respBody, &douyinUserInfo)
-	if err != nil {
-		return nil, err
-	}
-
-	userInfo := UserInfo{
-		Id:          douyinUserInfo.Data.OpenId,
-		Username:    douyinUserInfo.Data.Nickname,
-		DisplayName: douyinUserInfo.Data.Nickname,
-		AvatarUrl:   douyinUserInfo.Data.Avatar,
-	}
-	return &userInfo, nil
-}
+// 抖音OAuth2登录提供者实现
+// 支持抖音网页登录和用户信息获取
+package idp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DouyinIdProvider 抖音登录提供者
+// 实现抖音OAuth2登录功能
+type DouyinIdProvider struct {
+	providerBase
+
+	Client *http.Client    // HTTP客户端
+	Config *oauth2.Config // OAuth2配置
+}
+
+func init() {
+	RegisterProvider(IDP_DOUYIN, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		idp := NewDouyinIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl)
+		idp.applyProviderInfo(idpInfo, idp.Config, false)
+		return idp, nil
+	})
+	RegisterProviderValidator(IDP_DOUYIN, requireClientSecret)
+}
+
+// NewDouyinIdProvider 创建抖音登录提供者实例
+// 参数:
+//   - clientId: 抖音应用的Client Key
+//   - clientSecret: 抖音应用的Client Secret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *DouyinIdProvider: 抖音登录提供者实例
+func NewDouyinIdProvider(clientId string, clientSecret string, redirectUrl string) *DouyinIdProvider {
+	idp := &DouyinIdProvider{Client: DefaultHttpClient(), providerBase: providerBase{providerType: IDP_DOUYIN, clientId: clientId}}
+	idp.Config = idp.getConfig(clientId, clientSecret, redirectUrl)
+	return idp
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *DouyinIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// getConfig 获取抖音OAuth2配置
+// 参数:
+//   - clientId: 抖音应用的Client Key
+//   - clientSecret: 抖音应用的Client Secret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *oauth2.Config: OAuth2配置实例
+func (idp *DouyinIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
+	endpoint := oauth2.Endpoint{
+		TokenURL: "https://open.douyin.com/oauth/access_token",
+		AuthURL:  "https://open.douyin.com/platform/oauth/connect/",
+	}
+
+	config := &oauth2.Config{
+		Scopes:       []string{"user_info"},
+		Endpoint:     endpoint,
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectUrl,
+	}
+
+	return config
+}
+
+// GetAuthURL 生成抖音授权跳转URL
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+// 返回:
+//   - string: 授权URL
+func (idp *DouyinIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	o := newAuthOptions(idp.Config, opts)
+
+	params := url.Values{}
+	params.Set("client_key", idp.Config.ClientID)
+	params.Set("redirect_uri", o.redirectUrl)
+	params.Set("response_type", "code")
+	params.Set("scope", o.scope(","))
+	params.Set("state", state)
+
+	return buildAuthURL(idp.Config.Endpoint.AuthURL, params, o)
+}
+
+// Capabilities 获取抖音登录的能力描述
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *DouyinIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		UnionId:      true,
+		RefreshToken: true,
+		QRCodeLogin:  true,
+	})
+}
+
+// get more details via: https://open.douyin.com/platform/doc?doc=docs/openapi/account-permission/get-access-token
+/*
+{
+  "data": {
+    "access_token": "access_token",
+    "description": "",
+    "error_code": "0",
+    "expires_in": "86400",
+    "open_id": "aaa-bbb-ccc",
+    "refresh_expires_in": "86400",
+    "refresh_token": "refresh_token",
+    "scope": "user_info"
+  },
+  "message": "<nil>"
+}
+*/
+
+// DouyinTokenResp 抖音令牌响应结构体
+type DouyinTokenResp struct {
+	Data struct {
+		AccessToken  string `json:"access_token"`  // 访问令牌
+		ExpiresIn    int64  `json:"expires_in"`    // 访问令牌的有效时间，单位是秒
+		OpenId       string `json:"open_id"`       // 用户OpenID
+		RefreshToken string `json:"refresh_token"` // 刷新令牌
+		Scope        string `json:"scope"`         // 授权范围
+	} `json:"data"`    // 响应数据
+	Message string `json:"message"` // 响应消息
+}
+
+// GetToken 通过授权码获取抖音访问令牌
+// 参数:
+//   - code: 抖音返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+// 详细文档: https://open.douyin.com/platform/doc?doc=docs/openapi/account-permission/get-access-token
+func (idp *DouyinIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取抖音访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - code: 抖音返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *DouyinIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *DouyinIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	payload := url.Values{}
+	payload.Set("code", code)
+	payload.Set("grant_type", "authorization_code")
+	payload.Set("client_key", idp.Config.ClientID)
+	payload.Set("client_secret", idp.Config.ClientSecret)
+
+	return idp.requestToken(ctx, OpToken, idp.Config.Endpoint.TokenURL, payload)
+}
+
+// RefreshToken 使用刷新令牌获取新的抖音访问令牌
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: GetToken返回的OAuth2令牌
+// 返回:
+//   - *oauth2.Token: 新的OAuth2令牌
+//   - error: 错误信息
+// 详细文档: https://developer.open-douyin.com/docs/resource/zh-CN/dop/develop/openapi/account-permission/refresh-access-token
+func (idp *DouyinIdProvider) RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	start := time.Now()
+	newToken, err := idp.refreshToken(ctx, token)
+	idp.finishOperation(ctx, OpRefreshToken, start, err)
+	return newToken, err
+}
+
+// refreshToken 刷新令牌，见RefreshToken
+func (idp *DouyinIdProvider) refreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	if err := checkRefreshToken(token); err != nil {
+		return nil, err
+	}
+
+	payload := url.Values{}
+	payload.Set("grant_type", "refresh_token")
+	payload.Set("client_key", idp.Config.ClientID)
+	payload.Set("refresh_token", token.RefreshToken)
+
+	newToken, err := idp.requestToken(ctx, OpRefreshToken, idp.resolveUrl("https://open.douyin.com/oauth/refresh_token/"), payload)
+	if err != nil {
+		return nil, err
+	}
+	return inheritTokenFields(newToken, token, "open_id"), nil
+}
+
+// requestToken 请求抖音令牌接口并解析访问令牌，获取和刷新令牌共用
+// 参数:
+//   - ctx: 请求上下文
+//   - op: 操作类型，OpToken或OpRefreshToken
+//   - tokenUrl: 令牌接口地址
+//   - payload: 表单参数
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌，Extra中包含open_id
+//   - error: 错误信息
+func (idp *DouyinIdProvider) requestToken(ctx context.Context, op string, tokenUrl string, payload url.Values) (*oauth2.Token, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenUrl, strings.NewReader(payload.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, data, err := idp.doRequest(idp.Client, req, op, douyinCheck(op))
+	if err != nil {
+		return nil, err
+	}
+	tokenResp := &DouyinTokenResp{}
+	err = json.Unmarshal(data, tokenResp)
+	if err != nil {
+		return nil, fmt.Errorf("fail to unmarshal token response: %s", err.Error())
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tokenResp.Data.AccessToken,
+		RefreshToken: tokenResp.Data.RefreshToken,
+		Expiry:       time.Unix(time.Now().Unix()+tokenResp.Data.ExpiresIn, 0),
+	}
+
+	raw := make(map[string]interface{})
+	raw["open_id"] = tokenResp.Data.OpenId
+	token = token.WithExtra(raw)
+
+	return idp.checkToken(op, token)
+}
+
+// get more details via: https://open.douyin.com/platform/doc?doc=docs/openapi/account-management/get-account-open-info
+/*
+{
+  "data": {
+    "avatar": "https://example.com/x.jpeg",
+    "city": "上海",
+    "country": "中国",
+    "description": "",
+    "e_account_role": "<nil>",
+    "error_code": "0",
+    "gender": "<nil>",
+    "nickname": "张伟",
+    "open_id": "0da22181-d833-447f-995f-1beefea5bef3",
+    "province": "上海",
+    "union_id": "1ad4e099-4a0c-47d1-a410-bffb4f2f64a4"
+  }
+}
+*/
+
+// DouyinUserInfo 抖音用户信息结构体
+type DouyinUserInfo struct {
+	Data struct {
+		Avatar  string `json:"avatar"`   // 用户头像URL
+		City    string `json:"city"`     // 城市
+		Country string `json:"country"`  // 国家
+		// 性别：0->未知, 1->男, 2->女
+		Gender   int64  `json:"gender"`   // 性别
+		Nickname string `json:"nickname"` // 用户昵称
+		OpenId   string `json:"open_id"`  // 用户OpenID
+		UnionId  string `json:"union_id"` // 用户在同一开发者主体下的UnionID
+		Province string `json:"province"` // 省份
+	} `json:"data"` // 用户信息数据
+}
+
+// GetUserInfo 通过访问令牌获取抖音用户信息
+// 参数:
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *DouyinIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 通过访问令牌获取抖音用户信息，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *DouyinIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *DouyinIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	openId, _ := token.Extra("open_id").(string)
+	body := &struct {
+		AccessToken string `json:"access_token"`
+		OpenId      string `json:"open_id"`
+	}{token.AccessToken, openId}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(withIdempotent(ctx), "GET", idp.resolveUserInfoUrl("https://open.douyin.com/oauth/userinfo/"), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("access-token", token.AccessToken)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	_, respBody, err := idp.doRequest(idp.Client, req, OpUserInfo, douyinCheck(OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	var douyinUserInfo DouyinUserInfo
+	err = json.Unmarshal(respBody, &douyinUserInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo := UserInfo{
+		Id:          douyinUserInfo.Data.OpenId,
+		Username:    douyinUserInfo.Data.Nickname,
+		DisplayName: douyinUserInfo.Data.Nickname,
+		UnionId:     douyinUserInfo.Data.UnionId,
+		AvatarUrl:   douyinUserInfo.Data.Avatar,
+		Identity: idp.identity("",
+			IdentityKey{Kind: "open_id", Scope: IdentityScopeApp, Value: douyinUserInfo.Data.OpenId},
+			IdentityKey{Kind: "union_id", Scope: IdentityScopeDeveloper, Value: douyinUserInfo.Data.UnionId},
+		),
+	}
+
+	if err = idp.completeUserInfo(&userInfo, respBody); err != nil {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
+
+// douyinCheck 创建检查抖音接口响应的responseCheck
+// 参数:
+//   - op: 操作类型
+// 返回:
+//   - responseCheck: 响应检查函数
+func douyinCheck(op string) responseCheck {
+	return func(resp *http.Response, data []byte) error {
+		return checkDouyinResponse(op, resp.StatusCode, data)
+	}
+}
+
+// checkDouyinResponse 检查抖音接口的错误响应
+// 抖音在data.error_code中返回错误码，不同接口的错误码可能是数字或字符串
+// 参数:
+//   - op: 操作类型
+//   - statusCode: HTTP状态码
+//   - data: 响应内容
+// 返回:
+//   - error: 错误码非0或HTTP状态码表示失败时返回*ProviderError
+func checkDouyinResponse(op string, statusCode int, data []byte) error {
+	var resp struct {
+		Data struct {
+			ErrorCode   json.RawMessage `json:"error_code"`
+			Description string          `json:"description"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &resp); err == nil && len(resp.Data.ErrorCode) > 0 {
+		if code := strings.Trim(string(resp.Data.ErrorCode), `"`); code != "0" && code != "null" {
+			return newProviderError(IDP_DOUYIN, op, statusCode, code, resp.Data.Description)
+		}
+	}
+	if statusCode >= http.StatusBadRequest {
+		return newProviderError(IDP_DOUYIN, op, statusCode, "", string(data))
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+// 登录提供者错误
+// 第三方平台返回的错误统一包装为ProviderError，并按错误码归类，便于调用方使用errors.Is/As判断
+package idp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// 提供者操作类型，对应ProviderError.Op
+const (
+	OpToken        string = "token"        // 通过授权码获取访问令牌
+	OpRefreshToken string = "refreshToken" // 刷新访问令牌
+	OpUserInfo     string = "userinfo"     // 获取用户信息
+	OpDiscovery    string = "discovery"    // 加载OIDC发现文档和JWKS
+)
+
+// 错误分类，ProviderError通过Unwrap返回对应分类
+var (
+	ErrCodeExpiredOrUsed  = errors.New("授权码无效、已过期或已被使用")
+	ErrInvalidCredentials = errors.New("应用凭证无效")
+	ErrInvalidToken       = errors.New("访问令牌或刷新令牌无效、已过期")
+	ErrNotCorpMember      = errors.New("用户不属于该企业")
+	ErrRateLimited        = errors.New("接口调用频率超限")
+)
+
+// ProviderError 第三方平台返回的错误
+type ProviderError struct {
+	Provider   string        // 提供者类型（如WeChat、GitHub等）
+	Op         string        // 操作类型：token、refreshToken、userinfo、discovery
+	Code       string        // 平台错误码（如微信errcode、支付宝sub_code、OAuth2 error）
+	Message    string        // 平台错误信息
+	StatusCode int           // HTTP状态码
+	Retryable  bool          // 是否可以重试（如平台繁忙、频率超限）
+	RetryAfter time.Duration // 频率超限时建议的等待时间，未知时为0
+	Err        error         // 错误分类，无法归类时为nil
+}
+
+// Error 实现error接口
+func (e *ProviderError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("idp: ")
+	sb.WriteString(e.Provider)
+	sb.WriteString(" ")
+	sb.WriteString(e.Op)
+	sb.WriteString(" failed")
+	if e.Code != "" {
+		sb.WriteString(": code=")
+		sb.WriteString(e.Code)
+	}
+	if e.Message != "" {
+		sb.WriteString(", message=")
+		sb.WriteString(e.Message)
+	}
+	if e.StatusCode != 0 && e.StatusCode != http.StatusOK {
+		sb.WriteString(", status=")
+		sb.WriteString(strconv.Itoa(e.StatusCode))
+	}
+	if e.RetryAfter > 0 {
+		sb.WriteString(", retryAfter=")
+		sb.WriteString(e.RetryAfter.String())
+	}
+	if e.Err != nil {
+		sb.WriteString(" (")
+		sb.WriteString(e.Err.Error())
+		sb.WriteString(")")
+	}
+	return sb.String()
+}
+
+// Unwrap 返回错误分类，支持errors.Is(err, ErrCodeExpiredOrUsed)等判断
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// errorClass 平台错误码的分类
+type errorClass struct {
+	category   error         // 错误分类
+	retryable  bool          // 是否可以重试
+	retryAfter time.Duration // 频率超限时建议的等待时间
+	dailyQuota bool          // 是否为每日调用量超限，为true时等待到北京时间次日零点
+}
+
+// providerErrorClasses 各平台错误码分类表
+var providerErrorClasses = map[string]map[string]errorClass{
+	IDP_WECHAT: {
+		"-1":    {retryable: true},                                                    // 系统繁忙
+		"40029": {category: ErrCodeExpiredOrUsed},                                     // 无效的code
+		"40163": {category: ErrCodeExpiredOrUsed},                                     // code已被使用
+		"40013": {category: ErrInvalidCredentials},                                    // 无效的AppID
+		"40125": {category: ErrInvalidCredentials},                                    // 无效的AppSecret
+		"40001": {category: ErrInvalidCredentials},                                    // AppSecret错误或access_token无效
+		"40014": {category: ErrInvalidToken},                                          // 不合法的access_token
+		"42001": {category: ErrInvalidToken},                                          // access_token超时
+		"40030": {category: ErrInvalidToken},                                          // 不合法的refresh_token
+		"42002": {category: ErrInvalidToken},                                          // refresh_token超时
+		"45009": {category: ErrRateLimited, retryable: true, dailyQuota: true},        // 接口调用超过每日限额
+		"45011": {category: ErrRateLimited, retryable: true, retryAfter: time.Minute}, // API调用太频繁
+	},
+	IDP_WECHAT_MINI_PROGRAM: {
+		"-1":    {retryable: true},
+		"40029": {category: ErrCodeExpiredOrUsed},
+		"40163": {category: ErrCodeExpiredOrUsed},
+		"40013": {category: ErrInvalidCredentials},
+		"40125": {category: ErrInvalidCredentials},
+		"45011": {category: ErrRateLimited, retryable: true, retryAfter: time.Minute},
+	},
+	IDP_WECOM: {
+		"-1":    {retryable: true},
+		"40029": {category: ErrCodeExpiredOrUsed},  // 不合法的oauth_code
+		"40001": {category: ErrInvalidCredentials}, // 不合法的secret参数
+		"40013": {category: ErrInvalidCredentials}, // 不合法的CorpID
+		"40091": {category: ErrInvalidCredentials}, // secret不合法
+		"40014": {category: ErrInvalidToken},
+		"42001": {category: ErrInvalidToken},
+		"45009": {category: ErrRateLimited, retryable: true, retryAfter: time.Minute}, // 接口调用超过频率限制
+	},
+	IDP_WECOM_INTERNAL: {
+		"-1":    {retryable: true},
+		"40029": {category: ErrCodeExpiredOrUsed},
+		"40001": {category: ErrInvalidCredentials},
+		"40013": {category: ErrInvalidCredentials},
+		"40091": {category: ErrInvalidCredentials},
+		"40014": {category: ErrInvalidToken},
+		"42001": {category: ErrInvalidToken},
+		"60111": {category: ErrNotCorpMember}, // UserID不存在
+		"45009": {category: ErrRateLimited, retryable: true, retryAfter: time.Minute},
+	},
+	IDP_DING_TALK: {
+		"-1":    {retryable: true},
+		"40078": {category: ErrCodeExpiredOrUsed},  // 不存在的临时授权码
+		"40089": {category: ErrInvalidCredentials}, // 不合法的corpid或corpsecret
+		"40014": {category: ErrInvalidToken},
+		"60121": {category: ErrNotCorpMember},                                         // 找不到该用户
+		"90018": {category: ErrRateLimited, retryable: true, retryAfter: time.Second}, // 调用频率超过QPS限制
+
+		"invalidAuthCode":                       {category: ErrCodeExpiredOrUsed},
+		"InvalidAuthentication":                 {category: ErrInvalidToken},
+		"invalidClientId":                       {category: ErrInvalidCredentials},
+		"invalidClientSecret":                   {category: ErrInvalidCredentials},
+		"Forbidden.AccessDenied.QpsLimitForApi": {category: ErrRateLimited, retryable: true, retryAfter: time.Second},
+	},
+	IDP_ALIPAY: {
+		"isv.code-invalid":           {category: ErrCodeExpiredOrUsed},
+		"isv.refresh-token-invalid":  {category: ErrInvalidToken},
+		"isv.refresh-token-time-out": {category: ErrInvalidToken},
+		"aop.invalid-auth-token":     {category: ErrInvalidToken},
+		"aop.auth-token-time-out":    {category: ErrInvalidToken},
+		"isv.invalid-app-id":         {category: ErrInvalidCredentials},
+		"isv.invalid-signature":      {category: ErrInvalidCredentials},
+		"isv.missing-signature-key":  {category: ErrInvalidCredentials},
+		"isp.unknow-error":           {retryable: true},
+		"aop.ACQ.SYSTEM_ERROR":       {retryable: true},
+		"isp.call-limited":           {category: ErrRateLimited, retryable: true},
+		"aop.call-limited":           {category: ErrRateLimited, retryable: true},
+	},
+	IDP_QQ: {
+		"100019": {category: ErrCodeExpiredOrUsed},  // code换取access_token失败
+		"100020": {category: ErrCodeExpiredOrUsed},  // code被重复使用
+		"100014": {category: ErrInvalidToken},       // access_token过期
+		"100015": {category: ErrInvalidToken},       // access_token被回收
+		"100016": {category: ErrInvalidToken},       // access_token验证失败
+		"100013": {category: ErrInvalidToken},       // access_token无效
+		"100010": {category: ErrInvalidCredentials}, // 回调地址不合法
+		"100008": {category: ErrInvalidCredentials}, // client_id不存在
+		"100009": {category: ErrInvalidCredentials}, // client_secret错误
+	},
+	IDP_WEIBO: {
+		"21324": {category: ErrInvalidCredentials},                                  // invalid_client
+		"21326": {category: ErrInvalidCredentials},                                  // unauthorized_client
+		"21325": {category: ErrCodeExpiredOrUsed},                                   // invalid_grant
+		"21327": {category: ErrInvalidToken},                                        // expired_token
+		"21332": {category: ErrInvalidToken},                                        // invalid_access_token
+		"21331": {retryable: true},                                                  // temporarily_unavailable
+		"10022": {category: ErrRateLimited, retryable: true, retryAfter: time.Hour}, // IP请求频次超过上限
+		"10023": {category: ErrRateLimited, retryable: true, retryAfter: time.Hour}, // 用户请求频次超过上限
+		"10024": {category: ErrRateLimited, retryable: true, retryAfter: time.Hour}, // 用户请求特殊接口频次超过上限
+	},
+	IDP_DOUYIN: {
+		"2100004": {retryable: true},                 // 系统繁忙
+		"10007":   {category: ErrCodeExpiredOrUsed},  // 授权码过期
+		"10013":   {category: ErrInvalidCredentials}, // client_key或client_secret错误
+		"10008":   {category: ErrInvalidToken},       // access_token过期
+		"10010":   {category: ErrInvalidToken},       // refresh_token过期
+		"2190002": {category: ErrInvalidToken},       // access_token无效
+		"2190008": {category: ErrInvalidToken},       // access_token过期
+	},
+	IDP_BAIDU: {
+		"110": {category: ErrInvalidToken},                                          // access_token无效
+		"111": {category: ErrInvalidToken},                                          // access_token过期
+		"18":  {category: ErrRateLimited, retryable: true, retryAfter: time.Second}, // QPS超过限制
+	},
+	IDP_GITHUB: {
+		"bad_verification_code":        {category: ErrCodeExpiredOrUsed},
+		"incorrect_client_credentials": {category: ErrInvalidCredentials},
+	},
+}
+
+// oauth2ErrorClasses OAuth2规范定义的错误码分类，适用于所有平台
+var oauth2ErrorClasses = map[string]errorClass{
+	"invalid_grant":           {category: ErrCodeExpiredOrUsed},
+	"invalid_client":          {category: ErrInvalidCredentials},
+	"unauthorized_client":     {category: ErrInvalidCredentials},
+	"invalid_token":           {category: ErrInvalidToken},
+	"slow_down":               {category: ErrRateLimited, retryable: true},
+	"temporarily_unavailable": {retryable: true},
+	"server_error":            {retryable: true},
+}
+
+// newProviderError 创建第三方平台错误并按错误码和HTTP状态码归类
+// 参数:
+//   - provider: 提供者类型
+//   - op: 操作类型
+//   - statusCode: HTTP状态码，未知时为0
+//   - code: 平台错误码
+//   - message: 平台错误信息
+//
+// 返回:
+//   - *ProviderError: 平台错误
+func newProviderError(provider string, op string, statusCode int, code string, message string) *ProviderError {
+	e := &ProviderError{
+		Provider:   provider,
+		Op:         op,
+		Code:       code,
+		Message:    message,
+		StatusCode: statusCode,
+	}
+
+	class, ok := providerErrorClasses[provider][code]
+	if !ok {
+		class, ok = oauth2ErrorClasses[code]
+	}
+	if ok {
+		e.Err = class.category
+		e.Retryable = class.retryable
+		e.RetryAfter = class.retryAfter
+		if class.dailyQuota {
+			e.RetryAfter = untilNextChinaDay(time.Now())
+		}
+	}
+	// 刷新令牌时invalid_grant表示刷新令牌失效，而不是授权码失效
+	if op == OpRefreshToken && e.Err == ErrCodeExpiredOrUsed {
+		e.Err = ErrInvalidToken
+	}
+
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		e.Err = ErrRateLimited
+		e.Retryable = true
+	case statusCode >= http.StatusInternalServerError:
+		e.Retryable = true
+	case statusCode == http.StatusUnauthorized && e.Err == nil && op != OpToken:
+		e.Err = ErrInvalidToken
+	}
+	return e
+}
+
+// chinaTimeZone 北京时间，国内平台的每日调用限额按北京时间零点重置
+var chinaTimeZone = time.FixedZone("CST", 8*60*60)
+
+// untilNextChinaDay 计算距北京时间次日零点的时长
+// 参数:
+//   - now: 当前时间
+//
+// 返回:
+//   - time.Duration: 距次日零点的时长
+func untilNextChinaDay(now time.Time) time.Duration {
+	local := now.In(chinaTimeZone)
+	next := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, chinaTimeZone)
+	return next.Sub(now)
+}
+
+// parseRetryAfter 解析Retry-After响应头，支持秒数和HTTP日期两种格式
+// 参数:
+//   - header: 响应头
+//
+// 返回:
+//   - time.Duration: 建议的等待时间，未设置或无法解析时为0
+func parseRetryAfter(header http.Header) time.Duration {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// RetryAfter 获取错误中建议的等待时间
+// 参数:
+//   - err: 登录提供者返回的错误
+//
+// 返回:
+//   - time.Duration: 建议的等待时间，不是*ProviderError或未知时为0
+func RetryAfter(err error) time.Duration {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.RetryAfter
+	}
+	return 0
+}
+
+// newProviderErrorf 创建不带平台错误码的错误，用于响应内容不符合预期等情况
+// 参数:
+//   - provider: 提供者类型
+//   - op: 操作类型
+//   - category: 错误分类，可为nil
+//   - format: 错误信息格式
+//   - args: 格式化参数
+//
+// 返回:
+//   - *ProviderError: 平台错误
+func newProviderErrorf(provider string, op string, category error, format string, args ...interface{}) *ProviderError {
+	return &ProviderError{
+		Provider: provider,
+		Op:       op,
+		Message:  fmt.Sprintf(format, args...),
+		Err:      category,
+	}
+}
+
+// wrapOAuth2Error 将golang.org/x/oauth2返回的令牌接口错误转换为ProviderError
+// 参数:
+//   - provider: 提供者类型
+//   - op: 操作类型
+//   - err: oauth2库返回的错误
+//
+// 返回:
+//   - error: 令牌接口返回错误时为*ProviderError，其他错误原样返回
+func wrapOAuth2Error(provider string, op string, err error) error {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return err
+	}
+
+	statusCode := 0
+	if retrieveErr.Response != nil {
+		statusCode = retrieveErr.Response.StatusCode
+	}
+	message := retrieveErr.ErrorDescription
+	if message == "" && retrieveErr.ErrorCode == "" {
+		message = string(retrieveErr.Body)
+	}
+	return newProviderError(provider, op, statusCode, retrieveErr.ErrorCode, message)
+}
+
+// checkOAuth2Response 检查OAuth2规范风格的平台响应
+// 令牌接口失败时返回{"error":"invalid_grant","error_description":"..."}，API接口失败时通常返回{"message":"..."}
+// 参数:
+//   - provider: 提供者类型
+//   - op: 操作类型
+//   - statusCode: HTTP状态码，未知时为0
+//   - data: 响应内容
+//
+// 返回:
+//   - error: 响应包含error字段或HTTP状态码表示失败时返回*ProviderError
+func checkOAuth2Response(provider string, op string, statusCode int, data []byte) error {
+	var resp struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+		Message          string `json:"message"`
+	}
+	_ = json.Unmarshal(data, &resp)
+	if resp.Error != "" {
+		return newProviderError(provider, op, statusCode, resp.Error, resp.ErrorDescription)
+	}
+	if statusCode >= http.StatusBadRequest {
+		message := resp.Message
+		if message == "" {
+			message = string(data)
+		}
+		return newProviderError(provider, op, statusCode, "", message)
+	}
+	return nil
+}
+
+// oauth2Check 创建检查OAuth2规范风格响应的responseCheck
+// 参数:
+//   - provider: 提供者类型
+//   - op: 操作类型
+//
+// 返回:
+//   - responseCheck: 响应检查函数
+func oauth2Check(provider string, op string) responseCheck {
+	return func(resp *http.Response, data []byte) error {
+		return checkOAuth2Response(provider, op, resp.StatusCode, data)
+	}
+}
+
+// errcodeResponse 微信、企业微信、钉钉等平台通用的错误响应
+type errcodeResponse struct {
+	Errcode int    `json:"errcode"` // 错误码，0表示成功
+	Errmsg  string `json:"errmsg"`  // 错误信息
+}
+
+// checkErrcodeResponse 检查errcode风格的平台响应
+// 参数:
+//   - provider: 提供者类型
+//   - op: 操作类型
+//   - statusCode: HTTP状态码，未知时为0
+//   - data: 响应内容
+//
+// 返回:
+//   - error: errcode非0或HTTP状态码表示失败时返回*ProviderError
+func checkErrcodeResponse(provider string, op string, statusCode int, data []byte) error {
+	var resp errcodeResponse
+	if err := json.Unmarshal(data, &resp); err == nil && resp.Errcode != 0 {
+		return newProviderError(provider, op, statusCode, strconv.Itoa(resp.Errcode), resp.Errmsg)
+	}
+	if statusCode >= http.StatusBadRequest {
+		return newProviderError(provider, op, statusCode, "", string(data))
+	}
+	return nil
+}
+
+// errcodeCheck 创建检查errcode风格响应的responseCheck
+// 参数:
+//   - provider: 提供者类型
+//   - op: 操作类型
+//
+// 返回:
+//   - responseCheck: 响应检查函数
+func errcodeCheck(provider string, op string) responseCheck {
+	return func(resp *http.Response, data []byte) error {
+		return checkErrcodeResponse(provider, op, resp.StatusCode, data)
+	}
+}
@@ -1,199 +1,340 @@
-// GitLab OAuth2登录提供者实现
-// 支持GitLab网页登录和用户信息获取
-package idp
-
-import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"strconv"
-	"time"
-
-	"golang.org/x/oauth2"
-)
-
-// GitlabIdProvider GitLab登录提供者
-// 实现GitLab OAuth2登录功能
-type GitlabIdProvider struct {
-	Client *http.Client    // HTTP客户端
-	Config *oauth2.Config // OAuth2配置
-}
-
-// NewGitlabIdProvider 创建GitLab登录提供者实例
-// 参数:
-//   - clientId: GitLab应用的Client ID
-//   - clientSecret: GitLab应用的Client Secret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *GitlabIdProvider: GitLab登录提供者实例
-func NewGitlabIdProvider(clientId string, clientSecret string, redirectUrl string) *GitlabIdProvider {
-	idp := &GitlabIdProvider{}
-
-	config := idp.getConfig(clientId, clientSecret, redirectUrl)
-	idp.Config = config
-
-	return idp
-}
-
-// SetHttpClient 设置HTTP客户端
-// 参数:
-//   - client: HTTP客户端实例
-func (idp *GitlabIdProvider) SetHttpClient(client *http.Client) {
-	idp.Client = client
-}
-
-// getConfig 获取GitLab OAuth2配置
-// 参数:
-//   - clientId: GitLab应用的Client ID
-//   - clientSecret: GitLab应用的Client Secret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *oauth2.Config: OAuth2配置实例
-func (idp *GitlabIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
-	endpoint := oauth2.Endpoint{
-		TokenURL: "https://gitlab.com/oauth/token",
-	}
-
-	config := &oauth2.Config{
-		Scopes:       []string{"read_user+profile"},
-		Endpoint:     endpoint,
-		ClientID:     clientId,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectUrl,
-	}
-
-	return config
-}
-
-// GitlabProviderToken GitLab访问令牌结构体
-type GitlabProviderToken struct {
-	AccessToken  string `json:"access_token"`  // 访问令牌
-	TokenType    string `json:"token_type"`    // 令牌类型
-	ExpiresIn    int    `json:"expires_in"`    // 访问令牌的有效时间，单位是秒
-	RefreshToken string `json:"refresh_token"` // 刷新令牌
-	CreatedAt    int    `json:"created_at"`    // 创建时间
-}
-
-// GetToken 通过授权码获取GitLab访问令牌
-// 参数:
-//   - code: GitLab返回的授权码
-// 返回:
-//   - *oauth2.Token: OAuth2访问令牌
-//   - error: 错误信息
-// 详细文档: https://docs.gitlab.com/ee/api/oauth2.html
-func (idp *GitlabIdProvider) GetToken(code string) (*oauth2.Token, error) {
-	params := url.Values{}
-	params.Add("grant_type", "authorization_code")
-	params.Add("client_id", idp.Config.ClientID)
-	params.Add("client_secret", idp.Config.ClientSecret)
-	params.Add("code", code)
-	params.Add("redirect_uri", idp.Config.RedirectURL)
-
-	accessTokenUrl := fmt.Sprintf("%s?%s", idp.Config.Endpoint.TokenURL, params.Encode())
-	resp, err := idp.Client.Post(accessTokenUrl, "application/json;charset=UTF-8", nil)
-	if err != nil {
-		return nil, err
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	gtoken := &GitlabProviderToken{}
-	if err = json.Unmarshal(data, gtoken); err != nil {
-		return nil, err
-	}
-
-	// gtoken.ExpiresIn always returns 0, so we set Expiry=7200 to avoid verification errors.
-	token := &oauth2.Token{
-		AccessToken:  gtoken.AccessToken,
-		TokenType:    gtoken.TokenType,
-		RefreshToken: gtoken.RefreshToken,
-		Expiry:       time.Unix(time.Now().Unix()+int64(7200), 0),
-	}
-
-	return token, nil
-}
-
-// GitlabUserInfo GitLab用户信息响应结构体
-// 包含从GitLab API获取的完整用户信息
-type GitlabUserInfo struct {
-	Id              int         `json:"id"`                // 用户ID
-	Name            string      `json:"name"`              // 真实姓名
-	Username        string      `json:"username"`          // 用户名
-	State           string      `json:"state"`             // 用户状态
-	AvatarUrl       string      `json:"avatar_url"`        // 头像URL
-	WebUrl          string      `json:"web_url"`           // 用户主页URL
-	CreatedAt       time.Time   `json:"created_at"`        // 创建时间
-	Bio             string      `json:"bio"`               // 个人简介
-	BioHtml         string      `json:"bio_html"`          // 个人简介HTML
-	Location        string      `json:"location"`          // 位置
-	PublicEmail     string      `json:"public_email"`      // 公开邮箱
-	Skype           string      `json:"skype"`             // Skype账号
-	Linkedin        string      `json:"linkedin"`          // LinkedIn账号
-	Twitter         string      `json:"twitter"`           // Twitter账号
-	WebsiteUrl      string      `json:"website_url"`       // 个人网站URL
-	Organization    string      `json:"organization"`      // 组织
-	JobTitle        string      `json:"job_title"`         // 职位
-	Pronouns        interface{} `json:"pronouns"`          // 代词
-	Bot             bool        `json:"bot"`               // 是否为机器人
-	WorkInformation interface{} `json:"work_information"`  // 工作信息
-	Followers       int         `json:"followers"`         // 关注者数
-	Following       int         `json:"following"`         // 关注数
-	LastSignInAt    time.Time   `json:"last_sign_in_at"`   // 最后登录时间
-	ConfirmedAt     time.Time   `json:"confirmed_at"`      // 确认时间
-	LastActivityOn  string      `json:"last_activity_on"`  // 最后活动日期
-	Email           string      `json:"email"`             // 邮箱地址
-	ThemeId         int         `json:"theme_id"`          // 主题ID
-	ColorSchemeId   int         `json:"color_scheme_id"`   // 颜色方案ID
-	ProjectsLimit   int         `json:"projects_limit"`    // 项目限制
-	CurrentSignInAt time.Time   `json:"current_sign_in_at"` // 当前登录时间
-	Identities      []struct {  // 身份信息
-		Provider       string      `json:"provider"`        // 提供者
-		ExternUid      string      `json:"extern_uid"`      // 外部UID
-		SamlProviderId interface{} `json:"saml_provider_id"` // SAML提供者ID
-	} `json:"identities"`
-	CanCreateGroup                 bool        `json:"can_create_group"`                  // 是否可创建组
-	CanCreateProject               bool        `json:"can_create_project"`                // 是否可创建项目
-	TwoFactorEnabled               bool        `json:"two_factor_enabled"`                // 是否启用双因子认证
-	External                       bool        `json:"external"`                          // 是否为外部用户
-	PrivateProfile                 bool        `json:"private_profile"`                   // 是否为私有档案
-	CommitEmail                    string      `json:"commit_email"`                      // 提交邮箱
-	SharedRunnersMinutesLimit      interface{} `json:"shared_runners_minutes_limit"`       // 共享运行器分钟限制
-	ExtraSharedRunnersMinutesLimit interface{} `json:"extra_shared_runners_minutes_limit"` // 额外共享运行器分钟限制
-}
-
-// GetUserInfo 获取GitLab用户信息
-// 参数:
-//   - token: OAuth2访问令牌
-// 返回:
-//   - *UserInfo: 标准化用户信息
-//   - error: 错误信息
-func (idp *GitlabIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
-	resp, err := idp.Client.Get("https://gitlab.com/api/v4/user?access_token=" + token.AccessToken)
-	if err != nil {
-		return nil, err
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	guser := GitlabUserInfo{}
-	if err = json.Unmarshal(data, &guser); err != nil {
-		return nil, err
-	}
-
-	userInfo := UserInfo{
-		Id:          strconv.Itoa(guser.Id),
-		Username:    guser.Username,
-		DisplayName: guser.Name,
-		AvatarUrl:   guser.AvatarUrl,
-		Email:       guser.Email,
-	}
-	return &userInfo, nil
-}
+// GitLab OAuth2登录提供者实现
+// 支持GitLab网页登录和用户信息获取
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// GitlabIdProvider GitLab登录提供者
+// 实现GitLab OAuth2登录功能
+type GitlabIdProvider struct {
+	providerBase
+
+	Client *http.Client    // HTTP客户端
+	Config *oauth2.Config // OAuth2配置
+}
+
+func init() {
+	RegisterProvider(IDP_GITLAB, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		idp := NewGitlabIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl)
+		idp.applyProviderInfo(idpInfo, idp.Config, true)
+		return idp, nil
+	})
+	// 非机密应用使用PKCE换取令牌，不需要ClientSecret
+}
+
+// NewGitlabIdProvider 创建GitLab登录提供者实例
+// 参数:
+//   - clientId: GitLab应用的Client ID
+//   - clientSecret: GitLab应用的Client Secret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *GitlabIdProvider: GitLab登录提供者实例
+func NewGitlabIdProvider(clientId string, clientSecret string, redirectUrl string) *GitlabIdProvider {
+	idp := &GitlabIdProvider{Client: DefaultHttpClient(), providerBase: providerBase{providerType: IDP_GITLAB, clientId: clientId}}
+
+	config := idp.getConfig(clientId, clientSecret, redirectUrl)
+	idp.Config = config
+
+	return idp
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *GitlabIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// getConfig 获取GitLab OAuth2配置
+// 参数:
+//   - clientId: GitLab应用的Client ID
+//   - clientSecret: GitLab应用的Client Secret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *oauth2.Config: OAuth2配置实例
+func (idp *GitlabIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
+	endpoint := oauth2.Endpoint{
+		AuthURL:  "https://gitlab.com/oauth/authorize",
+		TokenURL: "https://gitlab.com/oauth/token",
+	}
+
+	config := &oauth2.Config{
+		Scopes:       []string{"read_user", "profile"},
+		Endpoint:     endpoint,
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectUrl,
+	}
+
+	return config
+}
+
+// GetAuthURL 生成GitLab授权跳转URL
+// 支持通过WithPKCE加入code_challenge
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+// 返回:
+//   - string: 授权URL
+func (idp *GitlabIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	return standardAuthURL(idp.Config, state, opts, true)
+}
+
+// Capabilities 获取GitLab登录的能力描述
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *GitlabIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		Email:        true,
+		RefreshToken: true,
+		PKCE:         true,
+	})
+}
+
+// GitlabProviderToken GitLab访问令牌结构体
+type GitlabProviderToken struct {
+	AccessToken  string `json:"access_token"`  // 访问令牌
+	TokenType    string `json:"token_type"`    // 令牌类型
+	ExpiresIn    int    `json:"expires_in"`    // 访问令牌的有效时间，单位是秒
+	RefreshToken string `json:"refresh_token"` // 刷新令牌
+	CreatedAt    int    `json:"created_at"`    // 创建时间
+}
+
+// GetToken 通过授权码获取GitLab访问令牌
+// 参数:
+//   - code: GitLab返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+// 详细文档: https://docs.gitlab.com/ee/api/oauth2.html
+func (idp *GitlabIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取GitLab访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制，可通过WithCodeVerifier设置PKCE code_verifier
+//   - code: GitLab返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *GitlabIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *GitlabIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	params := url.Values{}
+	params.Add("grant_type", "authorization_code")
+	params.Add("client_id", idp.Config.ClientID)
+	// 非机密应用使用PKCE时没有应用密钥
+	if idp.Config.ClientSecret != "" {
+		params.Add("client_secret", idp.Config.ClientSecret)
+	}
+	params.Add("code", code)
+	params.Add("redirect_uri", tokenRedirectUrl(ctx, idp.Config))
+	if codeVerifier := codeVerifierFromContext(ctx); codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+
+	return idp.requestToken(ctx, params)
+}
+
+// RefreshToken 使用刷新令牌获取新的GitLab访问令牌
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: GetToken返回的OAuth2令牌
+// 返回:
+//   - *oauth2.Token: 新的OAuth2令牌
+//   - error: 错误信息
+func (idp *GitlabIdProvider) RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	start := time.Now()
+	newToken, err := idp.refreshToken(ctx, token)
+	idp.finishOperation(ctx, OpRefreshToken, start, err)
+	return newToken, err
+}
+
+// refreshToken 刷新令牌，见RefreshToken
+func (idp *GitlabIdProvider) refreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	if err := checkRefreshToken(token); err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", "refresh_token")
+	params.Add("client_id", idp.Config.ClientID)
+	if idp.Config.ClientSecret != "" {
+		params.Add("client_secret", idp.Config.ClientSecret)
+	}
+	params.Add("refresh_token", token.RefreshToken)
+	params.Add("redirect_uri", tokenRedirectUrl(ctx, idp.Config))
+
+	newToken, err := idp.requestToken(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return inheritTokenFields(newToken, token), nil
+}
+
+// requestToken 请求GitLab令牌接口并解析访问令牌，获取和刷新令牌共用
+// 参数:
+//   - ctx: 请求上下文
+//   - params: 查询参数
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *GitlabIdProvider) requestToken(ctx context.Context, params url.Values) (*oauth2.Token, error) {
+	accessTokenUrl := fmt.Sprintf("%s?%s", idp.Config.Endpoint.TokenURL, params.Encode())
+	req, err := http.NewRequestWithContext(ctx, "POST", accessTokenUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
+
+	op := OpToken
+	if params.Get("grant_type") == "refresh_token" {
+		op = OpRefreshToken
+	}
+	_, data, err := idp.doRequest(idp.Client, req, op, oauth2Check(IDP_GITLAB, op))
+	if err != nil {
+		return nil, err
+	}
+
+	gtoken := &GitlabProviderToken{}
+	if err = json.Unmarshal(data, gtoken); err != nil {
+		return nil, err
+	}
+
+	// gtoken.ExpiresIn always returns 0, so we set Expiry=7200 to avoid verification errors.
+	token := &oauth2.Token{
+		AccessToken:  gtoken.AccessToken,
+		TokenType:    gtoken.TokenType,
+		RefreshToken: gtoken.RefreshToken,
+		Expiry:       time.Unix(time.Now().Unix()+int64(7200), 0),
+	}
+
+	return idp.checkToken(op, token)
+}
+
+// GitlabUserInfo GitLab用户信息响应结构体
+// 包含从GitLab API获取的完整用户信息
+type GitlabUserInfo struct {
+	Id              int         `json:"id"`                // 用户ID
+	Name            string      `json:"name"`              // 真实姓名
+	Username        string      `json:"username"`          // 用户名
+	State           string      `json:"state"`             // 用户状态
+	AvatarUrl       string      `json:"avatar_url"`        // 头像URL
+	WebUrl          string      `json:"web_url"`           // 用户主页URL
+	CreatedAt       time.Time   `json:"created_at"`        // 创建时间
+	Bio             string      `json:"bio"`               // 个人简介
+	BioHtml         string      `json:"bio_html"`          // 个人简介HTML
+	Location        string      `json:"location"`          // 位置
+	PublicEmail     string      `json:"public_email"`      // 公开邮箱
+	Skype           string      `json:"skype"`             // Skype账号
+	Linkedin        string      `json:"linkedin"`          // LinkedIn账号
+	Twitter         string      `json:"twitter"`           // Twitter账号
+	WebsiteUrl      string      `json:"website_url"`       // 个人网站URL
+	Organization    string      `json:"organization"`      // 组织
+	JobTitle        string      `json:"job_title"`         // 职位
+	Pronouns        interface{} `json:"pronouns"`          // 代词
+	Bot             bool        `json:"bot"`               // 是否为机器人
+	WorkInformation interface{} `json:"work_information"`  // 工作信息
+	Followers       int         `json:"followers"`         // 关注者数
+	Following       int         `json:"following"`         // 关注数
+	LastSignInAt    time.Time   `json:"last_sign_in_at"`   // 最后登录时间
+	ConfirmedAt     time.Time   `json:"confirmed_at"`      // 确认时间
+	LastActivityOn  string      `json:"last_activity_on"`  // 最后活动日期
+	Email           string      `json:"email"`             // 邮箱地址
+	ThemeId         int         `json:"theme_id"`          // 主题ID
+	ColorSchemeId   int         `json:"color_scheme_id"`   // 颜色方案ID
+	ProjectsLimit   int         `json:"projects_limit"`    // 项目限制
+	CurrentSignInAt time.Time   `json:"current_sign_in_at"` // 当前登录时间
+	Identities      []struct {  // 身份信息
+		Provider       string      `json:"provider"`        // 提供者
+		ExternUid      string      `json:"extern_uid"`      // 外部UID
+		SamlProviderId interface{} `json:"saml_provider_id"` // SAML提供者ID
+	} `json:"identities"`
+	CanCreateGroup                 bool        `json:"can_create_group"`                  // 是否可创建组
+	CanCreateProject               bool        `json:"can_create_project"`                // 是否可创建项目
+	TwoFactorEnabled               bool        `json:"two_factor_enabled"`                // 是否启用双因子认证
+	External                       bool        `json:"external"`                          // 是否为外部用户
+	PrivateProfile                 bool        `json:"private_profile"`                   // 是否为私有档案
+	CommitEmail                    string      `json:"commit_email"`                      // 提交邮箱
+	SharedRunnersMinutesLimit      interface{} `json:"shared_runners_minutes_limit"`       // 共享运行器分钟限制
+	ExtraSharedRunnersMinutesLimit interface{} `json:"extra_shared_runners_minutes_limit"` // 额外共享运行器分钟限制
+}
+
+// GetUserInfo 获取GitLab用户信息
+// 参数:
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *GitlabIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 获取GitLab用户信息，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *GitlabIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *GitlabIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	req, err := http.NewRequestWithContext(withIdempotent(ctx), "GET", idp.resolveUserInfoUrl("https://gitlab.com/api/v4/user")+"?access_token="+token.AccessToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := idp.doRequest(idp.Client, req, OpUserInfo, oauth2Check(IDP_GITLAB, OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	guser := GitlabUserInfo{}
+	if err = json.Unmarshal(data, &guser); err != nil {
+		return nil, err
+	}
+	if guser.Id == 0 {
+		return nil, newProviderErrorf(IDP_GITLAB, OpUserInfo, nil, "用户信息中缺少用户ID")
+	}
+
+	userInfo := UserInfo{
+		Id:          strconv.Itoa(guser.Id),
+		Username:    guser.Username,
+		DisplayName: guser.Name,
+		AvatarUrl:   guser.AvatarUrl,
+		Identity:    idp.identity("", IdentityKey{Kind: "id", Scope: IdentityScopeGlobal, Namespace: idp.instanceHost("gitlab.com"), Value: strconv.Itoa(guser.Id)}),
+		Email:       guser.Email,
+	}
+
+	if err = idp.completeUserInfo(&userInfo, data); err != nil {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
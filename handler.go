@@ -0,0 +1,255 @@
+// 登录HTTP处理器
+// 基于net/http提供发起登录和处理回调的处理器，完成state及其浏览器绑定Cookie的校验、授权码换取令牌和获取用户信息
+package idp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrAuthorizationDenied 用户拒绝授权或平台在回调中返回了错误
+var ErrAuthorizationDenied = errors.New("用户拒绝授权或授权失败")
+
+// LoginSuccessFunc 登录成功回调，负责建立会话并跳转
+// 通过LoginStateFromContext(r.Context())可获取发起登录时的跳转地址等信息
+type LoginSuccessFunc func(w http.ResponseWriter, r *http.Request, userInfo *UserInfo, token *oauth2.Token)
+
+// LoginErrorFunc 登录失败回调，负责向用户展示错误
+type LoginErrorFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// LoginFlow 登录流程配置，用于创建发起登录和处理回调的HTTP处理器
+type LoginFlow struct {
+	States    *StateManager    // state管理器，必须设置
+	OnSuccess LoginSuccessFunc // 登录成功回调，必须设置
+	OnError   LoginErrorFunc   // 登录失败回调，为nil时返回不含错误详情的400或502响应
+
+	// RedirectParam 发起登录时携带登录后跳转地址的查询参数名，为空时使用redirect
+	// 只接受以"/"开头的本站相对地址，其他地址会被忽略
+	RedirectParam string
+
+	// CookieName 保存state浏览器绑定值的Cookie名称前缀，为空时使用idp_state，实际名称为{CookieName}_{提供者名称}
+	// Cookie为HttpOnly、Secure、SameSite=Lax，有效期与state一致，回调校验通过后清除
+	CookieName string
+}
+
+// loginStateKey 上下文中保存登录state信息的键
+type loginStateKey struct{}
+
+// LoginStateFromContext 获取回调请求中已校验的state信息
+// 参数:
+//   - ctx: LoginSuccessFunc收到的请求上下文
+//
+// 返回:
+//   - *StateData: state信息，包含发起登录时的跳转地址，不存在时为nil
+func LoginStateFromContext(ctx context.Context) *StateData {
+	data, _ := ctx.Value(loginStateKey{}).(*StateData)
+	return data
+}
+
+// LoginHandler 创建发起登录的处理器，生成state后重定向到第三方平台的授权页面
+// 提供者支持PKCE时自动加入code_challenge，支持nonce时（如OIDC）自动加入nonce
+// 参数:
+//   - name: 提供者名称，与CallbackHandler使用的名称一致，多个提供者间不能重复
+//   - provider: 登录提供者
+//   - opts: 授权URL构建选项（如授权范围）
+//
+// 返回:
+//   - http.Handler: HTTP处理器
+func (f *LoginFlow) LoginHandler(name string, provider IdProvider, opts ...AuthOption) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		binding, err := NewStateBinding()
+		if err != nil {
+			f.fail(w, r, err)
+			return
+		}
+		state, data, err := f.States.Issue(r.Context(), name, f.redirectTarget(r), binding)
+		if err != nil {
+			f.fail(w, r, err)
+			return
+		}
+
+		caps := GetCapabilities(provider)
+		authOpts := append([]AuthOption(nil), opts...)
+		if caps.Nonce {
+			authOpts = append(authOpts, WithNonce(data.Nonce))
+		}
+		if caps.PKCE {
+			authOpts = append(authOpts, WithPKCE(data.CodeVerifier))
+		}
+
+		authUrl, err := GetAuthURLContext(r.Context(), provider, state, authOpts...)
+		if err != nil {
+			f.fail(w, r, fmt.Errorf("提供者%s无法生成授权地址: %w", name, err))
+			return
+		}
+		f.setStateCookie(w, name, binding, int(f.States.ttl/time.Second))
+		http.Redirect(w, r, authUrl, http.StatusFound)
+	})
+}
+
+// CallbackHandler 创建处理授权回调的处理器
+// 依次校验state及浏览器绑定Cookie、使用授权码换取令牌、获取用户信息，成功后调用OnSuccess，任一步骤失败时调用OnError
+// 缺少Cookie或与state不符时不消耗state，校验通过后清除Cookie
+// 参数:
+//   - name: 提供者名称，与LoginHandler使用的名称一致
+//   - provider: 登录提供者
+//
+// 返回:
+//   - http.Handler: HTTP处理器
+func (f *LoginFlow) CallbackHandler(name string, provider IdProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		query := r.URL.Query()
+
+		cookie, err := r.Cookie(f.cookieName(name))
+		if err != nil || cookie.Value == "" {
+			f.fail(w, r, fmt.Errorf("%w: 缺少state Cookie，登录需在同一浏览器中发起", ErrInvalidState))
+			return
+		}
+		data, err := f.States.Validate(ctx, query.Get("state"), name, cookie.Value)
+		if err != nil {
+			f.fail(w, r, err)
+			return
+		}
+		f.setStateCookie(w, name, "", -1)
+		r = r.WithContext(context.WithValue(ctx, loginStateKey{}, data))
+
+		if errCode := query.Get("error"); errCode != "" {
+			f.fail(w, r, fmt.Errorf("%w: %s %s", ErrAuthorizationDenied, errCode, query.Get("error_description")))
+			return
+		}
+		code := callbackCode(query)
+		if code == "" {
+			f.fail(w, r, fmt.Errorf("%w: 回调中缺少授权码", ErrAuthorizationDenied))
+			return
+		}
+
+		caps := GetCapabilities(provider)
+		if caps.Nonce {
+			ctx = WithOidcNonce(ctx, data.Nonce)
+		}
+		if caps.PKCE {
+			ctx = WithCodeVerifier(ctx, data.CodeVerifier)
+		}
+		token, err := GetTokenContext(ctx, provider, code)
+		if err != nil {
+			f.fail(w, r, err)
+			return
+		}
+		userInfo, err := GetUserInfoContext(ctx, provider, token)
+		if err != nil {
+			f.fail(w, r, err)
+			return
+		}
+
+		f.OnSuccess(w, r, userInfo, token)
+	})
+}
+
+// Mount 在ServeMux上为多个提供者注册登录和回调处理器
+// 路径为prefix/{name}/login和prefix/{name}/callback，提供者配置的回调地址需与之一致
+// 参数:
+//   - mux: HTTP路由
+//   - prefix: 路径前缀，如/auth
+//   - providers: 提供者名称到登录提供者的映射
+func (f *LoginFlow) Mount(mux *http.ServeMux, prefix string, providers map[string]IdProvider) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	for name, provider := range providers {
+		mux.Handle(prefix+"/"+name+"/login", f.LoginHandler(name, provider))
+		mux.Handle(prefix+"/"+name+"/callback", f.CallbackHandler(name, provider))
+	}
+}
+
+// cookieName 获取保存state浏览器绑定值的Cookie名称
+// 每个提供者使用独立的Cookie，同一浏览器中同时发起多个提供者的登录时互不覆盖
+// 参数:
+//   - name: 提供者名称
+//
+// 返回:
+//   - string: Cookie名称，格式为{CookieName}_{name}
+func (f *LoginFlow) cookieName(name string) string {
+	prefix := f.CookieName
+	if prefix == "" {
+		prefix = "idp_state"
+	}
+	return prefix + "_" + name
+}
+
+// setStateCookie 设置或清除保存state浏览器绑定值的Cookie
+// 参数:
+//   - w: HTTP响应
+//   - name: 提供者名称
+//   - binding: 浏览器绑定值，清除时为空
+//   - maxAge: 有效期（秒），小于0时清除Cookie
+func (f *LoginFlow) setStateCookie(w http.ResponseWriter, name string, binding string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     f.cookieName(name),
+		Value:    binding,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// redirectTarget 获取发起登录时指定的登录后跳转地址
+// 参数:
+//   - r: 发起登录的请求
+//
+// 返回:
+//   - string: 本站相对地址，未指定或不是本站地址时为空字符串
+func (f *LoginFlow) redirectTarget(r *http.Request) string {
+	param := f.RedirectParam
+	if param == "" {
+		param = "redirect"
+	}
+	target := r.URL.Query().Get(param)
+	// 拒绝//example.com和/\example.com等协议相对地址，防止开放重定向
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return ""
+	}
+	return target
+}
+
+// fail 调用登录失败回调
+// 参数:
+//   - w: HTTP响应
+//   - r: HTTP请求
+//   - err: 错误信息
+func (f *LoginFlow) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if f.OnError != nil {
+		f.OnError(w, r, err)
+		return
+	}
+
+	status := http.StatusBadGateway
+	if errors.Is(err, ErrInvalidState) || errors.Is(err, ErrStateExpired) || errors.Is(err, ErrStateReplayed) ||
+		errors.Is(err, ErrAuthorizationDenied) || errors.Is(err, ErrCodeExpiredOrUsed) {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, "登录失败", status)
+}
+
+// callbackCode 获取回调中的授权码
+// 支付宝和企业微信第三方应用使用auth_code，钉钉使用authCode
+// 参数:
+//   - query: 回调查询参数
+//
+// 返回:
+//   - string: 授权码
+func callbackCode(query url.Values) string {
+	for _, key := range []string{"code", "auth_code", "authCode"} {
+		if code := query.Get(key); code != "" {
+			return code
+		}
+	}
+	return ""
+}
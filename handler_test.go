@@ -0,0 +1,75 @@
+package idp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/smart-unicom/idp"
+	"github.com/smart-unicom/idp/idptest"
+)
+
+// TestLoginFlowConcurrentProviders 同一浏览器先后发起两个提供者的登录，两个回调都能完成，OIDC授权地址带有nonce
+func TestLoginFlowConcurrentProviders(t *testing.T) {
+	states, err := idp.NewSignedStateManager(make([]byte, 32), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loggedIn []string
+	flow := &idp.LoginFlow{
+		States: states,
+		OnSuccess: func(w http.ResponseWriter, r *http.Request, userInfo *idp.UserInfo, token *oauth2.Token) {
+			loggedIn = append(loggedIn, idp.LoginStateFromContext(r.Context()).Provider)
+		},
+		OnError: func(w http.ResponseWriter, r *http.Request, err error) {
+			t.Errorf("登录失败: %v", err)
+		},
+	}
+
+	servers := make(map[string]*idptest.Server)
+	providers := make(map[string]idp.IdProvider)
+	for _, typ := range []string{idp.IDP_OIDC, idp.IDP_GITHUB} {
+		servers[typ], providers[typ] = newTestProvider(t, typ)
+	}
+	if !idp.GetCapabilities(providers[idp.IDP_OIDC]).Nonce {
+		t.Error("OIDC提供者的Capabilities().Nonce应为true")
+	}
+
+	// 浏览器中保存的Cookie和各提供者的回调地址
+	jar := make(map[string]*http.Cookie)
+	callbacks := make(map[string]string)
+	for _, typ := range []string{idp.IDP_OIDC, idp.IDP_GITHUB} {
+		rec := httptest.NewRecorder()
+		flow.LoginHandler(typ, providers[typ]).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/auth/"+typ+"/login", nil))
+		authUrl := rec.Header().Get("Location")
+		if typ == idp.IDP_OIDC {
+			if u, _ := url.Parse(authUrl); u == nil || u.Query().Get("nonce") == "" {
+				t.Errorf("OIDC授权地址缺少nonce: %s", authUrl)
+			}
+		}
+		for _, cookie := range rec.Result().Cookies() {
+			jar[cookie.Name] = cookie
+		}
+		callbacks[typ], err = servers[typ].Authorize(authUrl, testUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(jar) != 2 {
+		t.Fatalf("两个提供者应使用不同的Cookie: %v", jar)
+	}
+
+	for _, typ := range []string{idp.IDP_OIDC, idp.IDP_GITHUB} {
+		req := httptest.NewRequest(http.MethodGet, callbacks[typ], nil)
+		for _, cookie := range jar {
+			req.AddCookie(cookie)
+		}
+		flow.CallbackHandler(typ, providers[typ]).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if len(loggedIn) != 2 {
+		t.Errorf("完成登录的提供者: %v, want [%s %s]", loggedIn, idp.IDP_OIDC, idp.IDP_GITHUB)
+	}
+}
@@ -0,0 +1,63 @@
+// 默认HTTP客户端
+// 所有登录提供者和包级函数共用同一个调优过的HTTP客户端，复用连接并设置超时
+package idp
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NewDefaultHttpClient 创建适合调用第三方平台接口的HTTP客户端
+// 设置了连接、TLS握手、响应头和整体超时，启用连接池、长连接和HTTP/2，并支持环境变量中的代理配置
+// 返回:
+//   - *http.Client: HTTP客户端
+func NewDefaultHttpClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   15 * time.Second,
+	}
+}
+
+// 默认HTTP客户端相关变量
+var (
+	defaultHttpClient     = NewDefaultHttpClient() // 默认HTTP客户端
+	defaultHttpClientLock sync.RWMutex             // 默认HTTP客户端读写锁
+)
+
+// SetDefaultHttpClient 设置默认HTTP客户端
+// 之后创建的登录提供者以及微信公众号等包级函数使用该客户端，已创建的提供者可通过SetHttpClient单独设置
+// 参数:
+//   - client: HTTP客户端，为nil时恢复为NewDefaultHttpClient创建的客户端
+func SetDefaultHttpClient(client *http.Client) {
+	if client == nil {
+		client = NewDefaultHttpClient()
+	}
+	defaultHttpClientLock.Lock()
+	defer defaultHttpClientLock.Unlock()
+	defaultHttpClient = client
+}
+
+// DefaultHttpClient 获取默认HTTP客户端
+// 返回:
+//   - *http.Client: 默认HTTP客户端
+func DefaultHttpClient() *http.Client {
+	defaultHttpClientLock.RLock()
+	defer defaultHttpClientLock.RUnlock()
+	return defaultHttpClient
+}
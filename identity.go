@@ -0,0 +1,165 @@
+// 用户身份标识
+// 各平台的用户标识作用域不同：微信openid只在单个应用内唯一，unionid在同一开放平台账号下的所有应用间唯一，
+// 企业微信和钉钉的userid在企业内唯一。Identity列出平台返回的所有标识及其作用域，账号系统据此关联同一用户在不同应用中的身份
+//
+// 各平台的标识（均不随昵称、头像等资料变化）：
+//   - 微信、微信小程序: openid（应用内），unionid（开放平台账号内，应用绑定到开放平台后返回）
+//   - QQ、百度、哔哩哔哩: openid（应用内）
+//   - 抖音: open_id（应用内），union_id（同一开发者主体内）
+//   - 钉钉: openId（应用内），unionId（同一开发者主体内），userid（企业内）
+//   - 企业微信第三方应用: open_userid（同一服务商内），userid（企业内）
+//   - 企业微信内部应用: userid（企业内）
+//   - 支付宝: user_id（全平台）
+//   - 微博、GitHub、Gitee、GitLab: 用户ID（全平台，GitLab以实例地址区分）
+//   - 通用OAuth2、OIDC: 字段映射得到的用户ID或sub（签发者内）
+package idp
+
+import (
+	"net/url"
+	"sort"
+)
+
+// IdentityScope 身份标识的唯一范围
+type IdentityScope string
+
+// 身份标识的唯一范围，从小到大排列
+const (
+	IdentityScopeApp       IdentityScope = "app"       // 在同一应用内唯一，如微信openid，Namespace为应用ID
+	IdentityScopeTenant    IdentityScope = "tenant"    // 在同一企业内唯一，如企业微信userid，Namespace为企业ID
+	IdentityScopeDeveloper IdentityScope = "developer" // 在同一开发者主体（开放平台账号、服务商）的所有应用间唯一，如微信unionid
+	IdentityScopeGlobal    IdentityScope = "global"    // 在整个平台或签发者内唯一，如GitHub用户ID，Namespace为实例主机（如github.com）或签发者地址，单一实例的平台可为空
+)
+
+// scopeRank 唯一范围的大小，用于排序
+var scopeRank = map[IdentityScope]int{
+	IdentityScopeApp:       0,
+	IdentityScopeTenant:    1,
+	IdentityScopeDeveloper: 2,
+	IdentityScopeGlobal:    3,
+}
+
+// IdentityKey 用户的一个身份标识
+type IdentityKey struct {
+	Platform  string        // 平台，同一平台的不同提供者类型（如微信网站应用和小程序）共享该值
+	Kind      string        // 标识类型，使用平台接口中的字段名，如openid、unionid、userid
+	Scope     IdentityScope // 唯一范围
+	Namespace string        // 唯一范围的命名空间，如应用ID、企业ID
+	Value     string        // 标识值
+}
+
+// String 获取可直接持久化的键，格式为 平台:类型[:命名空间]:值
+// 同一用户在同一范围内的不同应用中得到相同的键
+// 返回:
+//   - string: 键
+func (k IdentityKey) String() string {
+	s := k.Platform + ":" + k.Kind + ":"
+	if k.Namespace != "" {
+		s += k.Namespace + ":"
+	}
+	return s + k.Value
+}
+
+// Identity 用户在第三方平台的身份
+type Identity struct {
+	Provider string        // 提供者类型（如WeChat、GitHub等）
+	Platform string        // 平台，微信和微信小程序为WeChat，企业微信第三方应用和内部应用为WeCom，其余与提供者类型相同
+	AppId    string        // 应用ID（ClientId）
+	TenantId string        // 企业ID，非企业应用或平台未返回时为空
+	UnionId  string        // 开发者主体内的联合ID，平台未返回时为空
+	Subject  IdentityKey   // 用户在当前应用中的主标识
+	Keys     []IdentityKey // 所有标识（包括Subject），按唯一范围从大到小排列
+}
+
+// LinkKey 获取用于跨应用关联账号的标识，即唯一范围最大的标识
+// 例如微信返回unionid时为unionid，否则为openid
+// 返回:
+//   - IdentityKey: 身份标识
+func (i *Identity) LinkKey() IdentityKey {
+	if len(i.Keys) == 0 {
+		return i.Subject
+	}
+	return i.Keys[0]
+}
+
+// Key 获取指定类型的标识
+// 参数:
+//   - kind: 标识类型，如openid、unionid
+//
+// 返回:
+//   - IdentityKey: 身份标识
+//   - bool: 是否存在
+func (i *Identity) Key(kind string) (IdentityKey, bool) {
+	for _, k := range i.Keys {
+		if k.Kind == kind {
+			return k, true
+		}
+	}
+	return IdentityKey{}, false
+}
+
+// identityPlatforms 共享开发者范围标识的提供者类型对应的平台
+var identityPlatforms = map[string]string{
+	IDP_WECHAT_MINI_PROGRAM: IDP_WECHAT,
+	IDP_WECOM_INTERNAL:      IDP_WECOM,
+}
+
+// identity 创建用户身份
+// 应用范围的标识未设置Namespace时使用应用ID，企业范围的标识未设置Namespace时使用tenantId，值为空的标识会被忽略
+// 参数:
+//   - tenantId: 企业ID，可为空
+//   - subject: 用户在当前应用中的主标识
+//   - others: 其他标识
+//
+// 返回:
+//   - *Identity: 用户身份
+func (b *providerBase) identity(tenantId string, subject IdentityKey, others ...IdentityKey) *Identity {
+	platform := b.providerType
+	if p, ok := identityPlatforms[b.providerType]; ok {
+		platform = p
+	}
+
+	id := &Identity{
+		Provider: b.providerType,
+		Platform: platform,
+		AppId:    b.clientId,
+		TenantId: tenantId,
+	}
+	for i, k := range append([]IdentityKey{subject}, others...) {
+		if k.Value == "" {
+			continue
+		}
+		k.Platform = platform
+		if k.Namespace == "" {
+			switch k.Scope {
+			case IdentityScopeApp:
+				k.Namespace = b.clientId
+			case IdentityScopeTenant:
+				k.Namespace = tenantId
+			}
+		}
+		if i == 0 {
+			id.Subject = k
+		}
+		if k.Scope == IdentityScopeDeveloper && id.UnionId == "" {
+			id.UnionId = k.Value
+		}
+		id.Keys = append(id.Keys, k)
+	}
+	sort.SliceStable(id.Keys, func(i, j int) bool {
+		return scopeRank[id.Keys[i].Scope] > scopeRank[id.Keys[j].Scope]
+	})
+	return id
+}
+
+// instanceHost 获取自建实例的主机名，作为全平台范围标识的命名空间
+// 参数:
+//   - defaultHost: 未配置HostUrl时使用的主机名
+//
+// 返回:
+//   - string: 主机名
+func (b *providerBase) instanceHost(defaultHost string) string {
+	if u, err := url.Parse(b.hostUrl); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return defaultHost
+}
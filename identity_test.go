@@ -0,0 +1,29 @@
+package idp_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/smart-unicom/idp"
+)
+
+// TestGithubIdentityNamespace 不同GitHub实例中相同的用户ID生成不同的身份标识键
+func TestGithubIdentityNamespace(t *testing.T) {
+	ctx := context.Background()
+	keys := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		server, provider := newTestProvider(t, idp.IDP_GITHUB)
+		userInfo, err := login(ctx, provider, server.IssueCode(testUser))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := userInfo.Identity.LinkKey()
+		if key.Namespace != server.Listener.Addr().String() {
+			t.Errorf("Namespace = %q, want %q", key.Namespace, server.Listener.Addr().String())
+		}
+		keys[key.String()] = true
+	}
+	if len(keys) != 2 {
+		t.Errorf("两个实例的身份标识键相同: %v", keys)
+	}
+}
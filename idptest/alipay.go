@@ -0,0 +1,179 @@
+// 支付宝模拟服务
+// 模拟支付宝开放平台网关，按method分发请求并校验RSA2签名，出错时返回error_response或业务响应中的sub_code
+package idptest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_ALIPAY, &platform{
+		clientIdParam: "app_id",
+		codeParam:     "auth_code",
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("POST /gateway.do", s.handleAlipayGateway)
+		},
+		clientSecret: func() string {
+			der, err := x509.MarshalPKCS8PrivateKey(signingKey())
+			if err != nil {
+				panic(err)
+			}
+			return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		},
+	})
+}
+
+// handleAlipayGateway 支付宝网关
+func (s *Server) handleAlipayGateway(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAlipayResponse(w, "error_response", alipayError("40002", "Invalid Arguments", "isv.invalid-parameter", "参数格式错误"))
+		return
+	}
+	form := r.PostForm
+	if form.Get("app_id") != s.ClientId {
+		writeAlipayResponse(w, "error_response", alipayError("40002", "Invalid Arguments", "isv.invalid-app-id", "无效的AppID参数"))
+		return
+	}
+	if !verifyAlipaySign(form) {
+		writeAlipayResponse(w, "error_response", alipayError("40002", "Invalid Arguments", "isv.invalid-signature", "验签出错"))
+		return
+	}
+
+	switch method := form.Get("method"); method {
+	case "alipay.system.oauth.token":
+		s.handleAlipayToken(w, form)
+	case "alipay.user.info.share":
+		s.handleAlipayUserInfo(w, form)
+	default:
+		writeAlipayResponse(w, "error_response", alipayError("40004", "Business Failed", "isv.invalid-method", "不存在的方法名: "+method))
+	}
+}
+
+// handleAlipayToken 换取授权访问令牌
+// 参数:
+//   - w: HTTP响应
+//   - form: 请求参数
+func (s *Server) handleAlipayToken(w http.ResponseWriter, form url.Values) {
+	var g *grant
+	var accessToken, refreshToken string
+	switch form.Get("grant_type") {
+	case "authorization_code":
+		var err error
+		if g, err = s.redeemCode(form.Get("code")); err != nil {
+			writeAlipayResponse(w, "error_response", alipayError("40002", "Invalid Arguments", "isv.code-invalid", "授权码code无效"))
+			return
+		}
+		accessToken, refreshToken = s.issueToken(g)
+	case "refresh_token":
+		if g, accessToken, refreshToken = s.refreshToken(form.Get("refresh_token")); g == nil {
+			writeAlipayResponse(w, "error_response", alipayError("40002", "Invalid Arguments", "isv.refresh-token-invalid", "刷新令牌refresh_token无效"))
+			return
+		}
+	default:
+		writeAlipayResponse(w, "error_response", alipayError("40002", "Invalid Arguments", "isv.grant-type-invalid", "grant_type参数不正确"))
+		return
+	}
+	writeAlipayResponse(w, "alipay_system_oauth_token_response", map[string]interface{}{
+		"access_token":   accessToken,
+		"alipay_user_id": g.user.Id,
+		"expires_in":     1296000,
+		"re_expires_in":  2592000,
+		"refresh_token":  refreshToken,
+		"user_id":        g.user.Id,
+	})
+}
+
+// handleAlipayUserInfo 支付宝会员授权信息查询
+// 参数:
+//   - w: HTTP响应
+//   - form: 请求参数
+func (s *Server) handleAlipayUserInfo(w http.ResponseWriter, form url.Values) {
+	g := s.lookupToken(form.Get("auth_token"))
+	if g == nil {
+		writeAlipayResponse(w, "alipay_user_info_share_response", alipayError("20001", "Insufficient Token Permissions", "aop.invalid-auth-token", "无效的访问令牌"))
+		return
+	}
+	writeAlipayResponse(w, "alipay_user_info_share_response", map[string]interface{}{
+		"code":      "10000",
+		"msg":       "Success",
+		"user_id":   g.user.Id,
+		"avatar":    g.user.AvatarUrl,
+		"nick_name": g.user.Name,
+	})
+}
+
+// alipayError 创建支付宝错误响应内容
+// 参数:
+//   - code: 网关返回码
+//   - msg: 网关返回码描述
+//   - subCode: 业务返回码
+//   - subMsg: 业务返回码描述
+//
+// 返回:
+//   - map[string]interface{}: 错误响应内容
+func alipayError(code string, msg string, subCode string, subMsg string) map[string]interface{} {
+	return map[string]interface{}{"code": code, "msg": msg, "sub_code": subCode, "sub_msg": subMsg}
+}
+
+// writeAlipayResponse 写入支付宝网关响应，并使用模拟服务的私钥对响应内容签名
+// 参数:
+//   - w: HTTP响应
+//   - key: 响应内容的键，如alipay_system_oauth_token_response、error_response
+//   - content: 响应内容
+func writeAlipayResponse(w http.ResponseWriter, key string, content map[string]interface{}) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		panic(err)
+	}
+	hashed := sha256.Sum256(data)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signingKey(), crypto.SHA256, hashed[:])
+	if err != nil {
+		panic(err)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		key:    json.RawMessage(data),
+		"sign": base64.StdEncoding.EncodeToString(signature),
+	})
+}
+
+// verifyAlipaySign 使用应用公钥校验请求的RSA2签名
+// 待签名字符串为除sign外的非空参数按参数名排序后以key=value&key=value拼接
+// 参数:
+//   - form: 请求参数
+//
+// 返回:
+//   - bool: 签名是否有效
+func verifyAlipaySign(form url.Values) bool {
+	signature, err := base64.StdEncoding.DecodeString(form.Get("sign"))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		if k != "sign" && form.Get(k) != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+form.Get(k))
+	}
+
+	hashed := sha256.Sum256([]byte(strings.Join(pairs, "&")))
+	return rsa.VerifyPKCS1v15(&signingKey().PublicKey, crypto.SHA256, hashed[:], signature) == nil
+}
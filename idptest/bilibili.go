@@ -0,0 +1,93 @@
+// 哔哩哔哩模拟服务
+// 模拟哔哩哔哩开放平台的账号授权接口，code为0表示成功，结果包装在data中
+package idptest
+
+import (
+	"net/http"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_BILIBILI, &platform{
+		redirectParam: "gourl",
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("POST /x/account-oauth2/v1/token", s.handleBilibiliToken)
+			mux.HandleFunc("POST /x/account-oauth2/v1/refresh_token", s.handleBilibiliToken)
+			mux.HandleFunc("GET /arcopen/fn/user/account/info", s.handleBilibiliUserInfo)
+		},
+	})
+}
+
+// writeBilibiliResponse 写入哔哩哔哩的响应
+// 参数:
+//   - w: HTTP响应
+//   - code: 响应码，0表示成功
+//   - message: 响应消息
+//   - data: 响应数据，失败时为nil
+func writeBilibiliResponse(w http.ResponseWriter, code int, message string, data interface{}) {
+	resp := map[string]interface{}{"code": code, "message": message, "ttl": 1}
+	if data != nil {
+		resp["data"] = data
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleBilibiliToken 获取或刷新access_token
+func (s *Server) handleBilibiliToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ClientId     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		GrantType    string `json:"grant_type"`
+		Code         string `json:"code"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !readJSON(r, &req) {
+		writeBilibiliResponse(w, -400, "请求错误", nil)
+		return
+	}
+	if req.ClientId != s.ClientId || req.ClientSecret != s.ClientSecret {
+		writeBilibiliResponse(w, -403, "访问权限不足", nil)
+		return
+	}
+
+	var g *grant
+	var accessToken, refreshToken string
+	switch req.GrantType {
+	case "authorization_code":
+		var err error
+		if g, err = s.redeemCode(req.Code); err != nil {
+			writeBilibiliResponse(w, -400, "code无效或已过期", nil)
+			return
+		}
+		accessToken, refreshToken = s.issueToken(g)
+	case "refresh_token":
+		if g, accessToken, refreshToken = s.refreshToken(req.RefreshToken); g == nil {
+			writeBilibiliResponse(w, -400, "refresh_token无效或已过期", nil)
+			return
+		}
+	default:
+		writeBilibiliResponse(w, -400, "请求错误", nil)
+		return
+	}
+	writeBilibiliResponse(w, 0, "0", map[string]interface{}{
+		"access_token":  accessToken,
+		"expires_in":    2592000,
+		"refresh_token": refreshToken,
+	})
+}
+
+// handleBilibiliUserInfo 获取已授权用户基础公开信息
+func (s *Server) handleBilibiliUserInfo(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	g := s.lookupToken(query.Get("access_token"))
+	if g == nil || query.Get("client_id") != s.ClientId {
+		writeBilibiliResponse(w, -101, "账号未登录", nil)
+		return
+	}
+	writeBilibiliResponse(w, 0, "0", map[string]interface{}{
+		"name":   g.user.Name,
+		"face":   g.user.AvatarUrl,
+		"openid": g.user.Id,
+	})
+}
@@ -0,0 +1,319 @@
+// 提供者一致性检查
+// 使用返回异常响应的测试服务检查IdProvider实现：畸形响应、非200状态码、令牌缺少附加字段、上下文取消和并发调用时
+// 都应返回错误而不是panic或返回空的结果，内置提供者和自定义提供者均可使用
+package idptest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smart-unicom/idp"
+	"golang.org/x/oauth2"
+)
+
+// conformanceTimeout 一致性检查中单次调用的超时时间
+const conformanceTimeout = 10 * time.Second
+
+// ConformanceFactory 创建待检查的提供者
+// 参数:
+//   - t: 测试对象
+//   - hostUrl: 测试服务地址，提供者调用的所有接口都应指向该地址，内置提供者设置ProviderInfo.HostUrl即可
+//
+// 返回:
+//   - idp.IdProvider: 待检查的提供者
+type ConformanceFactory func(t testing.TB, hostUrl string) idp.IdProvider
+
+// BuiltinFactory 创建内置提供者的ConformanceFactory，应用配置与NewServer的模拟应用相同
+// 参数:
+//   - providerType: 提供者类型，如idp.IDP_WECHAT
+//
+// 返回:
+//   - ConformanceFactory: 提供者工厂，平台不支持或提供者创建失败时调用t.Fatalf
+func BuiltinFactory(providerType string) ConformanceFactory {
+	return func(t testing.TB, hostUrl string) idp.IdProvider {
+		t.Helper()
+		p, ok := platforms[providerType]
+		if !ok {
+			t.Fatalf("idptest: 不支持模拟的平台: %s", providerType)
+		}
+		idpInfo := p.newProviderInfo(providerType, "idptest_"+randomString(8), p.newClientSecret(), hostUrl)
+		provider, err := idp.GetIdProvider(idpInfo, "https://example.com/callback")
+		if err != nil {
+			t.Fatalf("idptest: 创建%s提供者失败: %v", providerType, err)
+		}
+		return provider
+	}
+}
+
+// conformanceResponse 测试服务对所有请求返回的响应
+type conformanceResponse struct {
+	name        string // 场景名称
+	status      int    // HTTP状态码
+	contentType string // 响应类型
+	body        string // 响应内容
+}
+
+// malformedResponses 状态码为200但内容无法解析或缺少必要字段的响应
+var malformedResponses = []conformanceResponse{
+	{"Empty", http.StatusOK, "application/json", ""},
+	{"NotJSON", http.StatusOK, "text/html", "<html><body>502 Bad Gateway</body></html>"},
+	{"TruncatedJSON", http.StatusOK, "application/json", `{"access_token":"idptest`},
+	{"Null", http.StatusOK, "application/json", "null"},
+	{"Array", http.StatusOK, "application/json", `[{"access_token":"idptest"}]`},
+	{"EmptyObject", http.StatusOK, "application/json", "{}"},
+	{"WrongTypes", http.StatusOK, "application/json", `{"access_token":1,"expires_in":"x","openid":{},"data":[],"result":"x","errcode":"0","code":"0"}`},
+	{"EmptyData", http.StatusOK, "application/json", `{"errcode":0,"code":0,"data":{},"result":{}}`},
+}
+
+// errorStatuses 非200的HTTP状态码
+var errorStatuses = []int{
+	http.StatusBadRequest,
+	http.StatusUnauthorized,
+	http.StatusForbidden,
+	http.StatusNotFound,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+}
+
+// conformanceServer 一致性检查使用的测试服务，对所有请求返回当前设置的响应
+type conformanceServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	response conformanceResponse
+}
+
+// newConformanceServer 启动一致性检查使用的测试服务，测试结束时自动关闭
+// 参数:
+//   - t: 测试对象
+//
+// 返回:
+//   - *conformanceServer: 测试服务，默认返回EmptyObject响应
+func newConformanceServer(t testing.TB) *conformanceServer {
+	s := &conformanceServer{response: malformedResponses[5]}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		resp := s.response
+		s.lock.Unlock()
+		w.Header().Set("Content-Type", resp.contentType)
+		w.WriteHeader(resp.status)
+		_, _ = w.Write([]byte(resp.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// respond 设置测试服务返回的响应
+// 参数:
+//   - resp: 响应
+func (s *conformanceServer) respond(resp conformanceResponse) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.response = resp
+}
+
+// RunConformance 检查提供者的一致性，每项检查作为t的子测试运行
+// 检查内容：
+//   - 实现AuthURLProvider时GetAuthURL返回包含state的绝对地址（不支持授权页面的提供者可返回空字符串）
+//   - 畸形响应和非200状态码时GetTokenContext、GetUserInfoContext、RefreshToken返回错误，不返回空令牌或缺少ID的用户信息
+//   - 令牌缺少附加字段或附加字段类型错误时返回错误
+//   - 上下文已取消时返回错误
+//   - 并发调用时各次调用互不影响，配合go test -race可检查数据竞争
+//
+// 任何调用发生panic均视为检查失败。提供者支持设置重试策略时，检查期间关闭重试
+// 参数:
+//   - t: 测试对象
+//   - factory: 提供者工厂，每项检查创建新的提供者
+func RunConformance(t *testing.T, factory ConformanceFactory) {
+	t.Helper()
+	server := newConformanceServer(t)
+	newProvider := func(t *testing.T) idp.IdProvider {
+		t.Helper()
+		provider := factory(t, server.URL)
+		if provider == nil {
+			t.Fatalf("idptest: 提供者工厂返回nil")
+		}
+		provider.SetHttpClient(server.Client())
+		idp.SetProviderRetryPolicy(provider, &idp.RetryPolicy{MaxAttempts: 1})
+		return provider
+	}
+
+	t.Run("AuthURL", func(t *testing.T) {
+		checkAuthURL(t, newProvider(t), "idptestState")
+	})
+
+	t.Run("MalformedResponse", func(t *testing.T) {
+		for _, resp := range malformedResponses {
+			t.Run(resp.name, func(t *testing.T) {
+				server.respond(resp)
+				checkFailures(t, newProvider(t))
+			})
+		}
+	})
+
+	t.Run("ErrorStatus", func(t *testing.T) {
+		for _, status := range errorStatuses {
+			for _, resp := range []conformanceResponse{
+				{fmt.Sprintf("%d", status), status, "text/plain", http.StatusText(status)},
+				{fmt.Sprintf("%dSuccessBody", status), status, "application/json", `{"errcode":0,"code":0,"access_token":"idptest","openid":"idptest","id":1}`},
+			} {
+				t.Run(resp.name, func(t *testing.T) {
+					server.respond(resp)
+					checkFailures(t, newProvider(t))
+				})
+			}
+		}
+	})
+
+	t.Run("MissingTokenExtras", func(t *testing.T) {
+		server.respond(malformedResponses[5])
+		provider := newProvider(t)
+		wrongTypes := map[string]interface{}{}
+		for _, key := range []string{"code", "openid", "Openid", "open_id", "unionid", "uid", "id_token", "user_id"} {
+			wrongTypes[key] = 1
+		}
+		tokens := map[string]*oauth2.Token{
+			"Empty":      {},
+			"NoExtras":   {AccessToken: "idptest"},
+			"WrongTypes": (&oauth2.Token{AccessToken: "idptest"}).WithExtra(wrongTypes),
+		}
+		for name, token := range tokens {
+			t.Run(name, func(t *testing.T) {
+				checkUserInfoFails(t, provider, context.Background(), token)
+			})
+		}
+		t.Run("NoRefreshToken", func(t *testing.T) {
+			protect(t, "RefreshToken", func() {
+				if _, err := idp.RefreshToken(context.Background(), provider, &oauth2.Token{AccessToken: "idptest"}); err == nil {
+					t.Errorf("RefreshToken: 令牌缺少刷新令牌时未返回错误")
+				}
+			})
+		})
+	})
+
+	t.Run("CanceledContext", func(t *testing.T) {
+		server.respond(malformedResponses[5])
+		provider := newProvider(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		protect(t, "GetTokenContext", func() {
+			if _, err := idp.GetTokenContext(ctx, provider, "idptest"); err == nil {
+				t.Errorf("GetTokenContext: 上下文已取消时未返回错误")
+			}
+		})
+		checkUserInfoFails(t, provider, ctx, &oauth2.Token{AccessToken: "idptest"})
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		server.respond(malformedResponses[5])
+		provider := newProvider(t)
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				checkAuthURL(t, provider, fmt.Sprintf("idptestState%d", i))
+				protect(t, "Capabilities", func() { idp.GetCapabilities(provider) })
+				checkFailures(t, provider)
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+// protect 调用f，发生panic时记录为检查失败
+// 参数:
+//   - t: 测试对象
+//   - name: 调用名称
+//   - f: 被调用的函数
+func protect(t testing.TB, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("%s: panic: %v\n%s", name, r, debug.Stack())
+		}
+	}()
+	f()
+}
+
+// checkAuthURL 检查授权地址
+// 参数:
+//   - t: 测试对象
+//   - provider: 提供者
+//   - state: 状态参数，只包含字母和数字
+func checkAuthURL(t testing.TB, provider idp.IdProvider, state string) {
+	t.Helper()
+	p, ok := provider.(idp.AuthURLProvider)
+	if !ok {
+		return
+	}
+	protect(t, "GetAuthURL", func() {
+		authUrl := p.GetAuthURL(state)
+		if authUrl == "" {
+			return
+		}
+		u, err := url.Parse(authUrl)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			t.Errorf("GetAuthURL: 授权地址不是绝对地址: %s", authUrl)
+			return
+		}
+		if !strings.Contains(u.RawQuery, state) {
+			t.Errorf("GetAuthURL: 授权地址中缺少state=%s: %s", state, authUrl)
+		}
+	})
+}
+
+// checkFailures 检查测试服务返回异常响应时，获取令牌、获取用户信息和刷新令牌均返回错误
+// 参数:
+//   - t: 测试对象
+//   - provider: 提供者
+func checkFailures(t testing.TB, provider idp.IdProvider) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), conformanceTimeout)
+	defer cancel()
+
+	protect(t, "GetTokenContext", func() {
+		token, err := idp.GetTokenContext(ctx, provider, "idptest")
+		if err == nil {
+			t.Errorf("GetTokenContext: 未返回错误，令牌: %+v", token)
+		}
+	})
+	// 不携带openid等用户标识，避免不调用接口、直接由令牌生成用户信息的提供者（如微信小程序）返回成功
+	checkUserInfoFails(t, provider, ctx, (&oauth2.Token{AccessToken: "idptest", RefreshToken: "idptest"}).WithExtra(map[string]interface{}{
+		"code": "idptest", "uid": "1",
+	}))
+	if idp.GetCapabilities(provider).RefreshToken {
+		protect(t, "RefreshToken", func() {
+			token, err := idp.RefreshToken(ctx, provider, &oauth2.Token{AccessToken: "idptest", RefreshToken: "idptest"})
+			if err == nil {
+				t.Errorf("RefreshToken: 未返回错误，令牌: %+v", token)
+			}
+		})
+	}
+}
+
+// checkUserInfoFails 检查获取用户信息返回错误
+// 参数:
+//   - t: 测试对象
+//   - provider: 提供者
+//   - ctx: 请求上下文
+//   - token: 访问令牌
+func checkUserInfoFails(t testing.TB, provider idp.IdProvider, ctx context.Context, token *oauth2.Token) {
+	t.Helper()
+	protect(t, "GetUserInfoContext", func() {
+		userInfo, err := idp.GetUserInfoContext(ctx, provider, token)
+		if err == nil {
+			t.Errorf("GetUserInfoContext: 未返回错误，用户信息: %+v", userInfo)
+		}
+	})
+}
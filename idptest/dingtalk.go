@@ -0,0 +1,159 @@
+// 钉钉模拟服务
+// 模拟钉钉新版OAuth2登录接口和查询企业成员的旧版接口，新版接口出错时返回4xx和字符串错误码，旧版接口返回errcode
+package idptest
+
+import (
+	"net/http"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_DING_TALK, &platform{
+		codeParam: "authCode",
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("POST /v1.0/oauth2/userAccessToken", s.handleDingTalkUserToken)
+			mux.HandleFunc("GET /v1.0/contact/users/me", s.handleDingTalkMe)
+			mux.HandleFunc("POST /v1.0/oauth2/accessToken", s.handleDingTalkAppToken)
+			mux.HandleFunc("POST /topapi/user/getbyunionid", s.handleDingTalkUserId)
+			mux.HandleFunc("POST /topapi/v2/user/get", s.handleDingTalkUser)
+		},
+	})
+}
+
+// writeDingTalkError 写入钉钉新版接口的错误响应
+// 参数:
+//   - w: HTTP响应
+//   - status: HTTP状态码
+//   - code: 错误码，如invalidAuthCode
+//   - message: 错误信息
+func writeDingTalkError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"code":      code,
+		"message":   message,
+		"requestid": randomString(8),
+	})
+}
+
+// handleDingTalkUserToken 获取用户token
+func (s *Server) handleDingTalkUserToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ClientId     string `json:"clientId"`
+		ClientSecret string `json:"clientSecret"`
+		Code         string `json:"code"`
+		GrantType    string `json:"grantType"`
+	}
+	if !readJSON(r, &req) {
+		writeDingTalkError(w, http.StatusBadRequest, "MissingParameter", "请求参数格式错误")
+		return
+	}
+	if req.ClientId != s.ClientId {
+		writeDingTalkError(w, http.StatusBadRequest, "invalidClientId", "无效的clientId")
+		return
+	}
+	if req.ClientSecret != s.ClientSecret {
+		writeDingTalkError(w, http.StatusBadRequest, "invalidClientSecret", "无效的clientSecret")
+		return
+	}
+	g, err := s.redeemCode(req.Code)
+	if err != nil {
+		writeDingTalkError(w, http.StatusBadRequest, "invalidAuthCode", "不合法的临时授权码")
+		return
+	}
+	accessToken, refreshToken := s.issueToken(g)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"accessToken":  accessToken,
+		"refreshToken": refreshToken,
+		"expireIn":     7200,
+	})
+}
+
+// handleDingTalkMe 获取用户通讯录个人信息
+func (s *Server) handleDingTalkMe(w http.ResponseWriter, r *http.Request) {
+	g := s.lookupToken(r.Header.Get("x-acs-dingtalk-access-token"))
+	if g == nil {
+		writeDingTalkError(w, http.StatusUnauthorized, "InvalidAuthentication", "不合法的access_token")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"nick":      g.user.Name,
+		"avatarUrl": g.user.AvatarUrl,
+		"mobile":    g.user.Phone,
+		"openId":    g.user.Id,
+		"unionId":   g.user.UnionId,
+		"email":     g.user.Email,
+		"stateCode": "86",
+	})
+}
+
+// handleDingTalkAppToken 获取企业内部应用的accessToken
+func (s *Server) handleDingTalkAppToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AppKey    string `json:"appKey"`
+		AppSecret string `json:"appSecret"`
+	}
+	if !readJSON(r, &req) || req.AppKey != s.ClientId || req.AppSecret != s.ClientSecret {
+		writeDingTalkError(w, http.StatusBadRequest, "invalidClientSecret", "无效的appKey或appSecret")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"accessToken": s.issueAppToken(),
+		"expireIn":    7200,
+	})
+}
+
+// handleDingTalkUserId 根据unionid获取用户userid，用户不属于企业时返回60121
+func (s *Server) handleDingTalkUserId(w http.ResponseWriter, r *http.Request) {
+	if !s.validAppToken(r.URL.Query().Get("access_token")) {
+		writeErrcode(w, 40014, "不合法的access_token")
+		return
+	}
+	var req struct {
+		UnionId string `json:"unionid"`
+	}
+	_ = readJSON(r, &req)
+	user := s.findUser(func(user *User) bool {
+		return req.UnionId != "" && user.UnionId == req.UnionId && user.CorpUserId != ""
+	})
+	if user == nil {
+		writeErrcode(w, 60121, "找不到该用户")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errcode":    0,
+		"errmsg":     "ok",
+		"result":     map[string]interface{}{"contact_type": 0, "userid": user.CorpUserId},
+		"request_id": randomString(8),
+	})
+}
+
+// handleDingTalkUser 查询用户详情
+func (s *Server) handleDingTalkUser(w http.ResponseWriter, r *http.Request) {
+	if !s.validAppToken(r.URL.Query().Get("access_token")) {
+		writeErrcode(w, 40014, "不合法的access_token")
+		return
+	}
+	var req struct {
+		UserId string `json:"userid"`
+	}
+	_ = readJSON(r, &req)
+	user := s.findUser(func(user *User) bool { return req.UserId != "" && user.CorpUserId == req.UserId })
+	if user == nil {
+		writeErrcode(w, 60121, "找不到该用户")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errcode": 0,
+		"errmsg":  "ok",
+		"result": map[string]interface{}{
+			"userid":     user.CorpUserId,
+			"unionid":    user.UnionId,
+			"name":       user.Name,
+			"avatar":     user.AvatarUrl,
+			"mobile":     user.Phone,
+			"email":      user.Email,
+			"job_number": "",
+		},
+		"request_id": randomString(8),
+	})
+}
@@ -0,0 +1,131 @@
+// 抖音模拟服务
+// 模拟抖音开放平台的OAuth2接口，结果和错误均包装在data中，data.error_code非0表示失败
+package idptest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_DOUYIN, &platform{
+		clientIdParam: "client_key",
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("POST /oauth/access_token", s.handleDouyinToken)
+			mux.HandleFunc("POST /oauth/refresh_token/", s.handleDouyinRefresh)
+			mux.HandleFunc("GET /oauth/userinfo/", s.handleDouyinUserInfo)
+		},
+	})
+}
+
+// writeDouyinError 写入抖音的错误响应
+// 参数:
+//   - w: HTTP响应
+//   - code: 错误码
+//   - description: 错误描述
+func writeDouyinError(w http.ResponseWriter, code int, description string) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"captcha":     "",
+			"desc_url":    "",
+			"description": description,
+			"error_code":  code,
+		},
+		"extra": map[string]interface{}{
+			"error_code":      code,
+			"description":     description,
+			"sub_error_code":  0,
+			"sub_description": "",
+			"logid":           randomString(12),
+			"now":             time.Now().UnixMilli(),
+		},
+		"message": "error",
+	})
+}
+
+// writeDouyinToken 写入抖音令牌响应
+// 参数:
+//   - w: HTTP响应
+//   - g: 用户授权
+//   - accessToken: 访问令牌
+//   - refreshToken: 刷新令牌
+func writeDouyinToken(w http.ResponseWriter, g *grant, accessToken string, refreshToken string) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"access_token":       accessToken,
+			"description":        "",
+			"error_code":         0,
+			"expires_in":         1296000,
+			"open_id":            g.user.Id,
+			"refresh_expires_in": 2592000,
+			"refresh_token":      refreshToken,
+			"scope":              "user_info",
+		},
+		"message": "success",
+	})
+}
+
+// handleDouyinToken 获取access_token
+func (s *Server) handleDouyinToken(w http.ResponseWriter, r *http.Request) {
+	if r.PostFormValue("client_key") != s.ClientId || r.PostFormValue("client_secret") != s.ClientSecret {
+		writeDouyinError(w, 10013, "client_key或client_secret错误")
+		return
+	}
+	g, err := s.redeemCode(r.PostFormValue("code"))
+	if err != nil {
+		writeDouyinError(w, 10007, "授权码过期")
+		return
+	}
+	accessToken, refreshToken := s.issueToken(g)
+	writeDouyinToken(w, g, accessToken, refreshToken)
+}
+
+// handleDouyinRefresh 刷新access_token
+func (s *Server) handleDouyinRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.PostFormValue("client_key") != s.ClientId {
+		writeDouyinError(w, 10013, "client_key错误")
+		return
+	}
+	g, accessToken, refreshToken := s.refreshToken(r.PostFormValue("refresh_token"))
+	if g == nil {
+		writeDouyinError(w, 10010, "refresh_token过期")
+		return
+	}
+	writeDouyinToken(w, g, accessToken, refreshToken)
+}
+
+// handleDouyinUserInfo 获取用户公开信息
+func (s *Server) handleDouyinUserInfo(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AccessToken string `json:"access_token"`
+		OpenId      string `json:"open_id"`
+	}
+	_ = readJSON(r, &req)
+	accessToken := r.Header.Get("access-token")
+	if accessToken == "" {
+		accessToken = req.AccessToken
+	}
+	g := s.lookupToken(accessToken)
+	if g == nil {
+		writeDouyinError(w, 2190008, "access_token过期,请刷新或重新授权")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"avatar":         g.user.AvatarUrl,
+			"city":           "",
+			"country":        "",
+			"description":    "",
+			"e_account_role": "",
+			"error_code":     0,
+			"gender":         0,
+			"nickname":       g.user.Name,
+			"open_id":        g.user.Id,
+			"province":       "",
+			"union_id":       g.user.UnionId,
+		},
+		"message": "success",
+	})
+}
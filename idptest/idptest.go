@@ -0,0 +1,545 @@
+// Package idptest 第三方平台模拟服务
+// 使用httptest启动模拟各平台令牌、用户信息等接口的本地服务，响应格式和错误与真实平台一致（如微信40163、钉钉60121、支付宝error_response），
+// 通过ProviderInfo.HostUrl将提供者指向模拟服务，无需真实应用凭证即可在CI中离线运行完整的登录流程
+//
+// 基本用法：
+//
+//	server := idptest.NewServer(t, idp.IDP_WECHAT)
+//	provider := server.Provider("https://example.com/callback")
+//	authUrl, _ := idp.GetAuthURL(provider, "state")
+//	callbackUrl, err := server.Authorize(authUrl, &idptest.User{Id: "openid", UnionId: "unionid"})
+//	// 将callbackUrl交给回调处理器，或取出授权码直接调用provider.GetToken
+package idptest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/smart-unicom/idp"
+	"golang.org/x/oauth2"
+)
+
+// 授权码校验错误，各平台模拟接口将其转换为平台自己的错误码
+var (
+	errCodeInvalid = errors.New("授权码不存在")
+	errCodeUsed    = errors.New("授权码已被使用")
+)
+
+// User 模拟平台中的用户
+type User struct {
+	Id         string // 平台用户标识（openid、open_id、user_id等），GitHub、Gitee、GitLab、微博使用数字ID，非数字时转换为固定的数字
+	UnionId    string // 联合ID（微信unionid、钉钉unionId、抖音union_id）
+	CorpId     string // 企业ID，企业微信第三方应用返回
+	CorpUserId string // 企业内用户ID，钉钉和企业微信使用，为空表示用户不属于该企业
+	Name       string // 昵称或姓名
+	Email      string // 邮箱地址
+	Phone      string // 手机号码
+	AvatarUrl  string // 头像URL
+}
+
+// Supported 判断是否支持模拟指定平台
+// 参数:
+//   - providerType: 提供者类型
+//
+// 返回:
+//   - bool: 支持时返回true，可用于NewServer和BuiltinFactory
+func Supported(providerType string) bool {
+	_, ok := platforms[providerType]
+	return ok
+}
+
+// platform 平台模拟实现
+type platform struct {
+	clientIdParam string                              // 授权地址中应用ID的参数名，默认client_id
+	redirectParam string                              // 授权地址中回调地址的参数名，默认redirect_uri
+	codeParam     string                              // 回调地址中授权码的参数名，默认code
+	routes        func(s *Server, mux *http.ServeMux) // 注册平台接口
+	clientSecret  func() string                       // 生成模拟应用密钥，为nil时使用随机字符串
+	providerInfo  func(idpInfo *idp.ProviderInfo)     // 补充平台特有的提供者配置，可为nil
+}
+
+// platforms 提供者类型到平台模拟实现的映射
+var platforms = make(map[string]*platform)
+
+// registerPlatform 注册平台模拟实现，在各平台文件的init函数中调用
+// 参数:
+//   - providerType: 提供者类型
+//   - p: 平台模拟实现
+func registerPlatform(providerType string, p *platform) {
+	if p.clientIdParam == "" {
+		p.clientIdParam = "client_id"
+	}
+	if p.redirectParam == "" {
+		p.redirectParam = "redirect_uri"
+	}
+	if p.codeParam == "" {
+		p.codeParam = "code"
+	}
+	platforms[providerType] = p
+}
+
+// newProviderInfo 创建平台的提供者配置
+// 参数:
+//   - providerType: 提供者类型
+//   - clientId: 应用ID
+//   - clientSecret: 应用密钥
+//   - hostUrl: 平台接口地址
+//
+// 返回:
+//   - *idp.ProviderInfo: 提供者配置
+func (p *platform) newProviderInfo(providerType string, clientId string, clientSecret string, hostUrl string) *idp.ProviderInfo {
+	idpInfo := &idp.ProviderInfo{
+		Type:         providerType,
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		HostUrl:      hostUrl,
+	}
+	if p.providerInfo != nil {
+		p.providerInfo(idpInfo)
+	}
+	return idpInfo
+}
+
+// newClientSecret 生成模拟应用密钥
+// 返回:
+//   - string: 应用密钥
+func (p *platform) newClientSecret() string {
+	if p.clientSecret != nil {
+		return p.clientSecret()
+	}
+	return randomString(16)
+}
+
+// grant 一次用户授权，授权码换取令牌后绑定访问令牌和刷新令牌
+type grant struct {
+	user          *User  // 授权用户
+	redirectUrl   string // 授权时的回调地址
+	codeChallenge string // PKCE code_challenge，为空表示未使用PKCE
+	nonce         string // OIDC nonce
+	used          bool   // 授权码是否已被使用
+}
+
+// failure 注入的失败响应
+type failure struct {
+	status int    // HTTP状态码
+	body   string // 响应内容
+}
+
+// Server 模拟第三方平台的本地服务
+// 可在多个goroutine中并发使用，测试结束时自动关闭
+type Server struct {
+	*httptest.Server
+
+	Type         string // 提供者类型
+	ClientId     string // 模拟应用ID
+	ClientSecret string // 模拟应用密钥，支付宝为应用私钥（PEM格式）
+
+	t        testing.TB
+	platform *platform
+
+	lock          sync.Mutex
+	codes         map[string]*grant    // 授权码
+	accessTokens  map[string]*grant    // 用户访问令牌
+	refreshTokens map[string]*grant    // 刷新令牌
+	appTokens     map[string]bool      // 应用访问令牌（企业微信、钉钉）
+	users         []*User              // 已授权的用户
+	failures      map[string][]failure // 按接口路径注入的失败响应
+	requests      map[string]int       // 按接口路径统计的请求次数
+}
+
+// NewServer 启动模拟指定平台的本地服务，测试结束时自动关闭
+// 参数:
+//   - t: 测试对象，平台不支持时调用t.Fatalf
+//   - providerType: 提供者类型，如idp.IDP_WECHAT
+//
+// 返回:
+//   - *Server: 模拟服务
+func NewServer(t testing.TB, providerType string) *Server {
+	t.Helper()
+	p, ok := platforms[providerType]
+	if !ok {
+		t.Fatalf("idptest: 不支持模拟的平台: %s", providerType)
+	}
+
+	s := &Server{
+		Type:          providerType,
+		ClientId:      "idptest_" + randomString(8),
+		ClientSecret:  p.newClientSecret(),
+		t:             t,
+		platform:      p,
+		codes:         make(map[string]*grant),
+		accessTokens:  make(map[string]*grant),
+		refreshTokens: make(map[string]*grant),
+		appTokens:     make(map[string]bool),
+		failures:      make(map[string][]failure),
+		requests:      make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	p.routes(s, mux)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := s.nextFailure(r.URL.Path); ok {
+			if json.Valid([]byte(f.body)) {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			w.WriteHeader(f.status)
+			_, _ = w.Write([]byte(f.body))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// ProviderInfo 获取指向模拟服务的提供者配置
+// 返回:
+//   - *idp.ProviderInfo: 提供者配置，HostUrl为模拟服务地址
+func (s *Server) ProviderInfo() *idp.ProviderInfo {
+	return s.platform.newProviderInfo(s.Type, s.ClientId, s.ClientSecret, s.URL)
+}
+
+// Provider 创建指向模拟服务的提供者，创建失败时调用t.Fatalf
+// 参数:
+//   - redirectUrl: OAuth2重定向URL
+//
+// 返回:
+//   - idp.IdProvider: 登录提供者，已设置使用模拟服务的HTTP客户端
+func (s *Server) Provider(redirectUrl string) idp.IdProvider {
+	s.t.Helper()
+	provider, err := idp.GetIdProvider(s.ProviderInfo(), redirectUrl)
+	if err != nil {
+		s.t.Fatalf("idptest: 创建%s提供者失败: %v", s.Type, err)
+	}
+	provider.SetHttpClient(s.Client())
+	return provider
+}
+
+// Authorize 模拟用户在授权页面同意授权
+// 参数:
+//   - authUrl: 提供者GetAuthURL生成的授权地址
+//   - user: 授权的用户
+//
+// 返回:
+//   - string: 平台重定向回应用的回调地址，包含授权码和state
+//   - error: 授权地址缺少回调地址或应用ID不匹配时返回错误
+func (s *Server) Authorize(authUrl string, user *User) (string, error) {
+	if user == nil {
+		return "", errors.New("idptest: 用户不能为空")
+	}
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		return "", fmt.Errorf("idptest: 授权地址无效: %w", err)
+	}
+	query := u.Query()
+	if clientId := query.Get(s.platform.clientIdParam); clientId != s.ClientId {
+		return "", fmt.Errorf("idptest: 授权地址中的%s不匹配: %s", s.platform.clientIdParam, clientId)
+	}
+	callback, err := url.Parse(query.Get(s.platform.redirectParam))
+	if err != nil || callback.Scheme == "" || callback.Host == "" {
+		return "", fmt.Errorf("idptest: 授权地址中的%s无效: %s", s.platform.redirectParam, query.Get(s.platform.redirectParam))
+	}
+
+	code := s.issueCode(&grant{
+		user:          user,
+		redirectUrl:   callback.String(),
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+	})
+	params := callback.Query()
+	params.Set(s.platform.codeParam, code)
+	if state := query.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	callback.RawQuery = params.Encode()
+	return callback.String(), nil
+}
+
+// IssueCode 直接生成用户的授权码，用于没有授权页面的平台（如微信小程序的js_code）或跳过授权地址的测试
+// 参数:
+//   - user: 授权的用户
+//
+// 返回:
+//   - string: 授权码，只能使用一次
+func (s *Server) IssueCode(user *User) string {
+	return s.issueCode(&grant{user: user})
+}
+
+// FailNext 使指定接口的下一次请求返回给定的响应，多次调用时按顺序生效
+// 响应内容为JSON时Content-Type为application/json；提供者会按重试策略重试幂等请求的临时错误，需要让重试也失败时应多次调用
+// 参数:
+//   - path: 接口路径，如/sns/oauth2/access_token
+//   - status: HTTP状态码
+//   - body: 响应内容
+func (s *Server) FailNext(path string, status int, body string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures[path] = append(s.failures[path], failure{status: status, body: body})
+}
+
+// Requests 获取指定接口收到的请求次数，包括返回注入失败的请求
+// 参数:
+//   - path: 接口路径
+//
+// 返回:
+//   - int: 请求次数
+func (s *Server) Requests(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[path]
+}
+
+// nextFailure 记录请求并取出接口的下一个注入失败
+// 参数:
+//   - path: 接口路径
+//
+// 返回:
+//   - failure: 注入的失败响应
+//   - bool: 是否存在注入的失败
+func (s *Server) nextFailure(path string) (failure, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests[path]++
+	queue := s.failures[path]
+	if len(queue) == 0 {
+		return failure{}, false
+	}
+	s.failures[path] = queue[1:]
+	return queue[0], true
+}
+
+// issueCode 保存授权并生成授权码
+// 参数:
+//   - g: 用户授权
+//
+// 返回:
+//   - string: 授权码
+func (s *Server) issueCode(g *grant) string {
+	code := randomString(16)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.codes[code] = g
+	s.users = append(s.users, g.user)
+	return code
+}
+
+// redeemCode 使用授权码，每个授权码只能使用一次
+// 参数:
+//   - code: 授权码
+//
+// 返回:
+//   - *grant: 用户授权
+//   - error: 授权码不存在时返回errCodeInvalid，已被使用时返回errCodeUsed
+func (s *Server) redeemCode(code string) (*grant, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	g, ok := s.codes[code]
+	if !ok {
+		return nil, errCodeInvalid
+	}
+	if g.used {
+		return nil, errCodeUsed
+	}
+	g.used = true
+	return g, nil
+}
+
+// issueToken 为用户授权生成访问令牌和刷新令牌
+// 参数:
+//   - g: 用户授权
+//
+// 返回:
+//   - string: 访问令牌
+//   - string: 刷新令牌
+func (s *Server) issueToken(g *grant) (string, string) {
+	accessToken := randomString(24)
+	refreshToken := randomString(24)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.accessTokens[accessToken] = g
+	s.refreshTokens[refreshToken] = g
+	return accessToken, refreshToken
+}
+
+// refreshToken 使用刷新令牌生成新的访问令牌，原刷新令牌失效
+// 参数:
+//   - refreshToken: 刷新令牌
+//
+// 返回:
+//   - *grant: 用户授权，刷新令牌无效时为nil
+//   - string: 新的访问令牌
+//   - string: 新的刷新令牌
+func (s *Server) refreshToken(refreshToken string) (*grant, string, string) {
+	s.lock.Lock()
+	g, ok := s.refreshTokens[refreshToken]
+	delete(s.refreshTokens, refreshToken)
+	s.lock.Unlock()
+	if !ok {
+		return nil, "", ""
+	}
+	accessToken, newRefreshToken := s.issueToken(g)
+	return g, accessToken, newRefreshToken
+}
+
+// lookupToken 查找访问令牌对应的用户授权
+// 参数:
+//   - accessToken: 访问令牌
+//
+// 返回:
+//   - *grant: 用户授权，令牌无效时为nil
+func (s *Server) lookupToken(accessToken string) *grant {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accessTokens[accessToken]
+}
+
+// issueAppToken 生成应用访问令牌
+// 返回:
+//   - string: 应用访问令牌
+func (s *Server) issueAppToken() string {
+	token := randomString(24)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.appTokens[token] = true
+	return token
+}
+
+// validAppToken 判断应用访问令牌是否有效
+// 参数:
+//   - token: 应用访问令牌
+//
+// 返回:
+//   - bool: 是否有效
+func (s *Server) validAppToken(token string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.appTokens[token]
+}
+
+// findUser 在已授权的用户中查找
+// 参数:
+//   - match: 匹配条件
+//
+// 返回:
+//   - *User: 用户，不存在时为nil
+func (s *Server) findUser(match func(user *User) bool) *User {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, user := range s.users {
+		if match(user) {
+			return user
+		}
+	}
+	return nil
+}
+
+// verifyPKCE 校验PKCE code_verifier
+// 参数:
+//   - g: 用户授权
+//   - codeVerifier: 换取令牌时提交的code_verifier
+//
+// 返回:
+//   - bool: 授权未使用PKCE或code_verifier匹配时为true
+func (g *grant) verifyPKCE(codeVerifier string) bool {
+	if g.codeChallenge == "" {
+		return true
+	}
+	return codeVerifier != "" && oauth2.S256ChallengeFromVerifier(codeVerifier) == g.codeChallenge
+}
+
+// numericId 获取数字形式的用户ID，用于GitHub、Gitee等使用数字ID的平台
+// 返回:
+//   - int64: User.Id为数字时为其值，否则为其哈希值
+func (u *User) numericId() int64 {
+	if id, err := strconv.ParseInt(u.Id, 10, 64); err == nil {
+		return id
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(u.Id))
+	return int64(h.Sum32())
+}
+
+// writeJSON 写入JSON响应
+// 参数:
+//   - w: HTTP响应
+//   - status: HTTP状态码
+//   - v: 响应内容
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeErrcode 写入微信、企业微信、钉钉旧版接口风格的错误响应，这些平台出错时HTTP状态码仍为200
+// 参数:
+//   - w: HTTP响应
+//   - errcode: 错误码
+//   - errmsg: 错误信息
+func writeErrcode(w http.ResponseWriter, errcode int, errmsg string) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"errcode": errcode, "errmsg": errmsg})
+}
+
+// readJSON 读取JSON请求体
+// 参数:
+//   - r: HTTP请求
+//   - v: 解析目标
+//
+// 返回:
+//   - bool: 是否解析成功
+func readJSON(r *http.Request, v interface{}) bool {
+	return json.NewDecoder(r.Body).Decode(v) == nil
+}
+
+// randomString 生成随机十六进制字符串
+// 参数:
+//   - n: 随机字节数
+//
+// 返回:
+//   - string: 长度为2n的十六进制字符串
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// 模拟服务共用的RSA密钥，用于支付宝应用私钥和OIDC ID令牌签名
+var (
+	rsaKey     *rsa.PrivateKey
+	rsaKeyOnce sync.Once
+)
+
+// signingKey 获取模拟服务共用的RSA密钥，首次调用时生成
+// 返回:
+//   - *rsa.PrivateKey: RSA私钥
+func signingKey() *rsa.PrivateKey {
+	rsaKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		rsaKey = key
+	})
+	return rsaKey
+}
+
+// keyId 获取共用RSA密钥的ID
+// 返回:
+//   - string: 公钥摘要的前16个十六进制字符
+func keyId() string {
+	sum := sha256.Sum256(signingKey().PublicKey.N.Bytes())
+	return hex.EncodeToString(sum[:8])
+}
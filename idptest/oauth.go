@@ -0,0 +1,301 @@
+// 标准OAuth2平台模拟服务
+// 模拟令牌接口遵循RFC 6749的平台：百度、Gitee、GitHub、GitLab和通用OAuth2，出错时返回{"error":"invalid_grant","error_description":"..."}
+package idptest
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_BAIDU, &platform{
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.Handle("POST /oauth/2.0/token", s.oauth2TokenHandler(oauth2TokenOptions{}))
+			mux.HandleFunc("GET /rest/2.0/passport/users/getInfo", s.handleBaiduUserInfo)
+		},
+	})
+	registerPlatform(idp.IDP_GITEE, &platform{
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.Handle("POST /oauth/token", s.oauth2TokenHandler(oauth2TokenOptions{refreshWithoutClient: true}))
+			mux.HandleFunc("GET /api/v5/user", s.handleGiteeUser)
+		},
+	})
+	registerPlatform(idp.IDP_GITHUB, &platform{
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("POST /login/oauth/access_token", s.handleGithubToken)
+			mux.HandleFunc("GET /api/v3/user", s.handleGithubUser)
+		},
+	})
+	registerPlatform(idp.IDP_GITLAB, &platform{
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.Handle("POST /oauth/token", s.oauth2TokenHandler(oauth2TokenOptions{publicClient: true}))
+			mux.HandleFunc("GET /api/v4/user", s.handleGitlabUser)
+		},
+	})
+	registerPlatform(idp.IDP_CUSTOM, &platform{
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.Handle("POST /oauth/token", s.oauth2TokenHandler(oauth2TokenOptions{publicClient: true}))
+			mux.HandleFunc("/oauth/userinfo", s.handleCustomUserInfo)
+		},
+		providerInfo: func(idpInfo *idp.ProviderInfo) {
+			idpInfo.AuthURL = "/oauth/authorize"
+			idpInfo.TokenURL = "/oauth/token"
+			idpInfo.UserInfoURL = "/oauth/userinfo"
+		},
+	})
+}
+
+// oauth2TokenOptions 标准OAuth2令牌接口的平台差异
+type oauth2TokenOptions struct {
+	publicClient         bool                                             // 是否允许使用PKCE的公开客户端不提交client_secret
+	refreshWithoutClient bool                                             // 刷新令牌时是否不要求客户端凭证（Gitee）
+	extra                func(s *Server, g *grant) map[string]interface{} // 令牌响应中的附加字段（如OIDC的id_token），可为nil
+}
+
+// writeOAuth2Error 写入RFC 6749格式的错误响应
+// 参数:
+//   - w: HTTP响应
+//   - status: HTTP状态码
+//   - code: 错误码，如invalid_grant
+//   - description: 错误描述
+func writeOAuth2Error(w http.ResponseWriter, status int, code string, description string) {
+	writeJSON(w, status, map[string]interface{}{"error": code, "error_description": description})
+}
+
+// oauth2TokenHandler 创建标准OAuth2令牌接口
+// 参数同时从查询字符串和表单中读取，客户端凭证可通过HTTP Basic认证或请求参数传递
+// 参数:
+//   - opts: 平台差异
+//
+// 返回:
+//   - http.Handler: 令牌接口
+func (s *Server) oauth2TokenHandler(opts oauth2TokenOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeOAuth2Error(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		clientId, clientSecret, basic := r.BasicAuth()
+		if basic {
+			// RFC 6749 2.3.1: Basic认证中的凭证先经过application/x-www-form-urlencoded编码
+			clientId, _ = url.QueryUnescape(clientId)
+			clientSecret, _ = url.QueryUnescape(clientSecret)
+		} else {
+			clientId, clientSecret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+		}
+
+		var g *grant
+		var accessToken, refreshToken string
+		switch grantType := r.Form.Get("grant_type"); grantType {
+		case "authorization_code":
+			if clientId != s.ClientId {
+				writeOAuth2Error(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed due to unknown client.")
+				return
+			}
+			var err error
+			if g, err = s.redeemCode(r.Form.Get("code")); err != nil {
+				writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "The provided authorization grant is invalid, expired, revoked, or was issued to another client.")
+				return
+			}
+			public := opts.publicClient && clientSecret == "" && g.codeChallenge != ""
+			if clientSecret != s.ClientSecret && !public {
+				writeOAuth2Error(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed due to invalid client secret.")
+				return
+			}
+			if g.redirectUrl != "" && r.Form.Get("redirect_uri") != g.redirectUrl {
+				writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "The redirect URI included is not valid.")
+				return
+			}
+			if !g.verifyPKCE(r.Form.Get("code_verifier")) {
+				writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "The code_verifier does not match the code_challenge.")
+				return
+			}
+			accessToken, refreshToken = s.issueToken(g)
+		case "refresh_token":
+			if !opts.refreshWithoutClient && clientId != s.ClientId {
+				writeOAuth2Error(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed due to unknown client.")
+				return
+			}
+			if g, accessToken, refreshToken = s.refreshToken(r.Form.Get("refresh_token")); g == nil {
+				writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "The provided refresh token is invalid, expired or revoked.")
+				return
+			}
+		default:
+			writeOAuth2Error(w, http.StatusBadRequest, "unsupported_grant_type", "The authorization grant type is not supported: "+grantType)
+			return
+		}
+
+		resp := map[string]interface{}{
+			"access_token":  accessToken,
+			"token_type":    "bearer",
+			"expires_in":    7200,
+			"refresh_token": refreshToken,
+			"scope":         r.Form.Get("scope"),
+			"created_at":    time.Now().Unix(),
+		}
+		if opts.extra != nil {
+			for k, v := range opts.extra(s, g) {
+				resp[k] = v
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+// bearerToken 获取请求的访问令牌，依次读取Authorization请求头和access_token参数
+// 参数:
+//   - r: HTTP请求
+//
+// 返回:
+//   - string: 访问令牌
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	for _, prefix := range []string{"Bearer ", "bearer ", "token "} {
+		if strings.HasPrefix(auth, prefix) {
+			return strings.TrimPrefix(auth, prefix)
+		}
+	}
+	if err := r.ParseForm(); err != nil {
+		return ""
+	}
+	return r.Form.Get("access_token")
+}
+
+// handleBaiduUserInfo 获取百度用户信息
+func (s *Server) handleBaiduUserInfo(w http.ResponseWriter, r *http.Request) {
+	g := s.lookupToken(r.URL.Query().Get("access_token"))
+	if g == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"error_code": 110, "error_msg": "Access token invalid or no longer valid"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"openid":   g.user.Id,
+		"username": g.user.Name,
+		"portrait": g.user.AvatarUrl,
+	})
+}
+
+// handleGiteeUser 获取授权用户的资料
+func (s *Server) handleGiteeUser(w http.ResponseWriter, r *http.Request) {
+	g := s.lookupToken(r.URL.Query().Get("access_token"))
+	if g == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"message": "401 Unauthorized: Access token does not exist"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":         g.user.numericId(),
+		"login":      strconv.FormatInt(g.user.numericId(), 10),
+		"name":       g.user.Name,
+		"email":      g.user.Email,
+		"avatar_url": g.user.AvatarUrl,
+	})
+}
+
+// handleGithubToken 通过授权码获取GitHub访问令牌，出错时HTTP状态码仍为200
+func (s *Server) handleGithubToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code         string `json:"code"`
+		ClientId     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		CodeVerifier string `json:"code_verifier"`
+	}
+	if !readJSON(r, &req) {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_request", "Problems parsing JSON")
+		return
+	}
+	if req.ClientId != s.ClientId || req.ClientSecret != s.ClientSecret {
+		writeOAuth2Error(w, http.StatusOK, "incorrect_client_credentials", "The client_id and/or client_secret passed are incorrect.")
+		return
+	}
+	g, err := s.redeemCode(req.Code)
+	if err != nil || !g.verifyPKCE(req.CodeVerifier) {
+		writeOAuth2Error(w, http.StatusOK, "bad_verification_code", "The code passed is incorrect or expired.")
+		return
+	}
+	accessToken, _ := s.issueToken(g)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "bearer",
+		"scope":        "user:email",
+	})
+}
+
+// handleGithubUser 获取已认证用户的资料
+func (s *Server) handleGithubUser(w http.ResponseWriter, r *http.Request) {
+	g := s.lookupToken(bearerToken(r))
+	if g == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"message":           "Bad credentials",
+			"documentation_url": "https://docs.github.com/rest",
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"login":      strconv.FormatInt(g.user.numericId(), 10),
+		"id":         g.user.numericId(),
+		"type":       "User",
+		"name":       g.user.Name,
+		"email":      g.user.Email,
+		"avatar_url": g.user.AvatarUrl,
+		"created_at": "2020-01-01T00:00:00Z",
+		"updated_at": "2020-01-01T00:00:00Z",
+	})
+}
+
+// handleGitlabUser 获取当前用户
+func (s *Server) handleGitlabUser(w http.ResponseWriter, r *http.Request) {
+	g := s.lookupToken(bearerToken(r))
+	if g == nil {
+		writeOAuth2Error(w, http.StatusUnauthorized, "invalid_token", "Token was revoked. You have to re-authorize from the user.")
+		return
+	}
+	id := g.user.numericId()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":         id,
+		"username":   strconv.FormatInt(id, 10),
+		"name":       g.user.Name,
+		"state":      "active",
+		"avatar_url": g.user.AvatarUrl,
+		"web_url":    "https://gitlab.example.com/" + strconv.FormatInt(id, 10),
+		"email":      g.user.Email,
+	})
+}
+
+// handleCustomUserInfo 通用OAuth2用户信息接口，返回OIDC标准声明
+func (s *Server) handleCustomUserInfo(w http.ResponseWriter, r *http.Request) {
+	g := s.lookupToken(bearerToken(r))
+	if g == nil {
+		writeOAuth2Error(w, http.StatusUnauthorized, "invalid_token", "The access token is invalid or has expired.")
+		return
+	}
+	writeJSON(w, http.StatusOK, userClaims(g.user))
+}
+
+// userClaims 生成用户的OIDC标准声明，通用OAuth2用户信息接口和OIDC共用
+// 参数:
+//   - user: 用户
+//
+// 返回:
+//   - map[string]interface{}: 用户声明
+func userClaims(user *User) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":                user.Id,
+		"preferred_username": user.Id,
+		"name":               user.Name,
+	}
+	if user.Email != "" {
+		claims["email"] = user.Email
+	}
+	if user.Phone != "" {
+		claims["phone_number"] = user.Phone
+	}
+	if user.AvatarUrl != "" {
+		claims["picture"] = user.AvatarUrl
+	}
+	return claims
+}
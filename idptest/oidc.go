@@ -0,0 +1,97 @@
+// OpenID Connect模拟服务
+// 提供发现文档、JWKS和标准OAuth2令牌接口，令牌响应中包含使用模拟服务RSA密钥签名的RS256 ID令牌
+package idptest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_OIDC, &platform{
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("GET /.well-known/openid-configuration", s.handleOidcDiscovery)
+			mux.HandleFunc("GET /oauth2/jwks", s.handleOidcJwks)
+			mux.Handle("POST /oauth2/token", s.oauth2TokenHandler(oauth2TokenOptions{
+				publicClient: true,
+				extra: func(s *Server, g *grant) map[string]interface{} {
+					return map[string]interface{}{"id_token": s.signIdToken(g)}
+				},
+			}))
+			mux.HandleFunc("/oauth2/userinfo", s.handleCustomUserInfo)
+		},
+	})
+}
+
+// handleOidcDiscovery OpenID Connect发现文档
+func (s *Server) handleOidcDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + "/oauth2/authorize",
+		"token_endpoint":                        s.URL + "/oauth2/token",
+		"userinfo_endpoint":                     s.URL + "/oauth2/userinfo",
+		"jwks_uri":                              s.URL + "/oauth2/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// handleOidcJwks ID令牌签名公钥集合
+func (s *Server) handleOidcJwks(w http.ResponseWriter, r *http.Request) {
+	key := signingKey().PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]interface{}{{
+			"kty": "RSA",
+			"kid": keyId(),
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+// signIdToken 为用户授权签发RS256 ID令牌
+// 参数:
+//   - g: 用户授权
+//
+// 返回:
+//   - string: ID令牌
+func (s *Server) signIdToken(g *grant) string {
+	now := time.Now()
+	claims := userClaims(g.user)
+	claims["iss"] = s.URL
+	claims["aud"] = s.ClientId
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Hour).Unix()
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyId()})
+	if err != nil {
+		panic(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		panic(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signingKey(), crypto.SHA256, hashed[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
@@ -0,0 +1,110 @@
+// QQ模拟服务
+// 模拟QQ互联的OAuth2接口，令牌接口返回URL编码的文本，获取openid接口返回JSONP，出错时返回callback( {"error":...} );
+package idptest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_QQ, &platform{
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("GET /oauth2.0/token", s.handleQqToken)
+			mux.HandleFunc("GET /oauth2.0/me", s.handleQqMe)
+			mux.HandleFunc("GET /user/get_user_info", s.handleQqUserInfo)
+		},
+	})
+}
+
+// writeQqCallback 写入QQ互联的JSONP响应
+// 参数:
+//   - w: HTTP响应
+//   - v: 回调参数
+func writeQqCallback(w http.ResponseWriter, v string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, "callback( %s );\n", v)
+}
+
+// writeQqError 写入QQ互联的错误响应
+// 参数:
+//   - w: HTTP响应
+//   - code: 错误码
+//   - description: 错误描述
+func writeQqError(w http.ResponseWriter, code int, description string) {
+	writeQqCallback(w, fmt.Sprintf(`{"error":%d,"error_description":"%s"}`, code, description))
+}
+
+// handleQqToken 通过Authorization Code获取Access Token
+func (s *Server) handleQqToken(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != s.ClientId {
+		writeQqError(w, 100008, "client id is illegal")
+		return
+	}
+	if query.Get("client_secret") != s.ClientSecret {
+		writeQqError(w, 100009, "client secret is illegal")
+		return
+	}
+	g, err := s.redeemCode(query.Get("code"))
+	switch err {
+	case errCodeInvalid:
+		writeQqError(w, 100019, "code to access token error")
+		return
+	case errCodeUsed:
+		writeQqError(w, 100020, "code is reused error")
+		return
+	}
+	if g.redirectUrl != "" && query.Get("redirect_uri") != g.redirectUrl {
+		writeQqError(w, 100010, "redirect uri is illegal")
+		return
+	}
+
+	accessToken, refreshToken := s.issueToken(g)
+	body := url.Values{}
+	body.Set("access_token", accessToken)
+	body.Set("expires_in", "7776000")
+	body.Set("refresh_token", refreshToken)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(body.Encode()))
+}
+
+// handleQqMe 获取用户OpenID
+func (s *Server) handleQqMe(w http.ResponseWriter, r *http.Request) {
+	g := s.lookupToken(r.URL.Query().Get("access_token"))
+	if g == nil {
+		writeQqError(w, 100016, "access token check failed")
+		return
+	}
+	writeQqCallback(w, fmt.Sprintf(`{"client_id":"%s","openid":"%s"}`, s.ClientId, g.user.Id))
+}
+
+// handleQqUserInfo 获取用户信息
+func (s *Server) handleQqUserInfo(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	g := s.lookupToken(query.Get("access_token"))
+	if g == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ret": 100016, "msg": "access token check failed"})
+		return
+	}
+	if query.Get("oauth_consumer_key") != s.ClientId || query.Get("openid") != g.user.Id {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ret": -1, "msg": "client request's parameters are invalid, invalid openid"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ret":            0,
+		"msg":            "",
+		"is_lost":        0,
+		"nickname":       g.user.Name,
+		"gender":         "男",
+		"gender_type":    1,
+		"figureurl":      g.user.AvatarUrl,
+		"figureurl_1":    g.user.AvatarUrl,
+		"figureurl_2":    g.user.AvatarUrl,
+		"figureurl_qq_1": g.user.AvatarUrl,
+		"figureurl_qq_2": g.user.AvatarUrl,
+	})
+}
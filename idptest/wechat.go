@@ -0,0 +1,168 @@
+// 微信模拟服务
+// 模拟微信网站应用登录和小程序登录的接口，错误时HTTP状态码为200，响应中的errcode与真实平台一致
+package idptest
+
+import (
+	"net/http"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_WECHAT, &platform{
+		clientIdParam: "appid",
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("GET /sns/oauth2/access_token", s.handleWechatToken)
+			mux.HandleFunc("GET /sns/oauth2/refresh_token", s.handleWechatRefresh)
+			mux.HandleFunc("GET /sns/userinfo", s.handleWechatUserInfo)
+		},
+	})
+	registerPlatform(idp.IDP_WECHAT_MINI_PROGRAM, &platform{
+		clientIdParam: "appid",
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("GET /sns/jscode2session", s.handleWechatSession)
+		},
+	})
+}
+
+// wechatRid 生成微信错误信息末尾的请求ID
+// 返回:
+//   - string: 如rid: 6206378a-793424c0-2e4091cc
+func wechatRid() string {
+	rid := randomString(12)
+	return "rid: " + rid[:8] + "-" + rid[8:16] + "-" + rid[16:]
+}
+
+// checkWechatApp 校验微信应用的appid和secret
+// 参数:
+//   - w: HTTP响应，校验失败时写入错误
+//   - r: HTTP请求
+//
+// 返回:
+//   - bool: 是否校验通过
+func (s *Server) checkWechatApp(w http.ResponseWriter, r *http.Request) bool {
+	query := r.URL.Query()
+	if query.Get("appid") != s.ClientId {
+		writeErrcode(w, 40013, "invalid appid, "+wechatRid())
+		return false
+	}
+	if query.Get("secret") != s.ClientSecret {
+		writeErrcode(w, 40125, "invalid appsecret, "+wechatRid())
+		return false
+	}
+	return true
+}
+
+// redeemWechatCode 使用微信授权码
+// 参数:
+//   - w: HTTP响应，授权码无效时写入40029，已被使用时写入40163
+//   - code: 授权码
+//
+// 返回:
+//   - *grant: 用户授权，授权码无效时为nil
+func (s *Server) redeemWechatCode(w http.ResponseWriter, code string) *grant {
+	g, err := s.redeemCode(code)
+	switch err {
+	case errCodeInvalid:
+		writeErrcode(w, 40029, "invalid code, "+wechatRid())
+	case errCodeUsed:
+		writeErrcode(w, 40163, "code been used, "+wechatRid())
+	}
+	return g
+}
+
+// handleWechatToken 通过code获取access_token
+func (s *Server) handleWechatToken(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWechatApp(w, r) {
+		return
+	}
+	g := s.redeemWechatCode(w, r.URL.Query().Get("code"))
+	if g == nil {
+		return
+	}
+	accessToken, refreshToken := s.issueToken(g)
+	s.writeWechatToken(w, g, accessToken, refreshToken)
+}
+
+// handleWechatRefresh 刷新access_token
+func (s *Server) handleWechatRefresh(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("appid") != s.ClientId {
+		writeErrcode(w, 40013, "invalid appid, "+wechatRid())
+		return
+	}
+	g, accessToken, refreshToken := s.refreshToken(query.Get("refresh_token"))
+	if g == nil {
+		writeErrcode(w, 40030, "invalid refresh_token, "+wechatRid())
+		return
+	}
+	s.writeWechatToken(w, g, accessToken, refreshToken)
+}
+
+// writeWechatToken 写入微信令牌响应
+// 参数:
+//   - w: HTTP响应
+//   - g: 用户授权
+//   - accessToken: 访问令牌
+//   - refreshToken: 刷新令牌
+func (s *Server) writeWechatToken(w http.ResponseWriter, g *grant, accessToken string, refreshToken string) {
+	resp := map[string]interface{}{
+		"access_token":  accessToken,
+		"expires_in":    7200,
+		"refresh_token": refreshToken,
+		"openid":        g.user.Id,
+		"scope":         "snsapi_login",
+	}
+	if g.user.UnionId != "" {
+		resp["unionid"] = g.user.UnionId
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleWechatUserInfo 获取用户个人信息
+func (s *Server) handleWechatUserInfo(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	g := s.lookupToken(query.Get("access_token"))
+	if g == nil {
+		writeErrcode(w, 40014, "invalid access_token, "+wechatRid())
+		return
+	}
+	if query.Get("openid") != g.user.Id {
+		writeErrcode(w, 40003, "invalid openid, "+wechatRid())
+		return
+	}
+	resp := map[string]interface{}{
+		"openid":     g.user.Id,
+		"nickname":   g.user.Name,
+		"sex":        0,
+		"language":   "",
+		"city":       "",
+		"province":   "",
+		"country":    "",
+		"headimgurl": g.user.AvatarUrl,
+		"privilege":  []string{},
+	}
+	if g.user.UnionId != "" {
+		resp["unionid"] = g.user.UnionId
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleWechatSession 小程序登录，通过js_code换取openid和session_key
+func (s *Server) handleWechatSession(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWechatApp(w, r) {
+		return
+	}
+	g := s.redeemWechatCode(w, r.URL.Query().Get("js_code"))
+	if g == nil {
+		return
+	}
+	resp := map[string]interface{}{
+		"openid":      g.user.Id,
+		"session_key": randomString(12),
+	}
+	if g.user.UnionId != "" {
+		resp["unionid"] = g.user.UnionId
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,152 @@
+// 企业微信模拟服务
+// 模拟企业微信第三方应用和内部应用的扫码登录接口，访问令牌为应用级凭证，授权码在获取用户信息时校验
+package idptest
+
+import (
+	"net/http"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_WECOM, &platform{
+		clientIdParam: "appid",
+		codeParam:     "auth_code",
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("POST /cgi-bin/service/get_provider_token", s.handleWecomProviderToken)
+			mux.HandleFunc("POST /cgi-bin/service/get_login_info", s.handleWecomLoginInfo)
+		},
+	})
+	registerPlatform(idp.IDP_WECOM_INTERNAL, &platform{
+		clientIdParam: "appid",
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("GET /cgi-bin/gettoken", s.handleWecomToken)
+			mux.HandleFunc("GET /cgi-bin/user/getuserinfo", s.handleWecomUserId)
+			mux.HandleFunc("GET /cgi-bin/user/get", s.handleWecomUser)
+		},
+		providerInfo: func(idpInfo *idp.ProviderInfo) {
+			idpInfo.AppId = "1000002"
+		},
+	})
+}
+
+// handleWecomProviderToken 获取服务商凭证
+func (s *Server) handleWecomProviderToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CorpId         string `json:"corpid"`
+		ProviderSecret string `json:"provider_secret"`
+	}
+	if !readJSON(r, &req) {
+		writeErrcode(w, 47001, "data format error")
+		return
+	}
+	if req.CorpId != s.ClientId {
+		writeErrcode(w, 40013, "invalid corpid")
+		return
+	}
+	if req.ProviderSecret != s.ClientSecret {
+		writeErrcode(w, 40091, "provider_secret is invalid")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"provider_access_token": s.issueAppToken(),
+		"expires_in":            7200,
+	})
+}
+
+// handleWecomLoginInfo 获取登录用户信息
+func (s *Server) handleWecomLoginInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.validAppToken(r.URL.Query().Get("access_token")) {
+		writeErrcode(w, 40014, "invalid access_token")
+		return
+	}
+	var req struct {
+		AuthCode string `json:"auth_code"`
+	}
+	if !readJSON(r, &req) {
+		writeErrcode(w, 47001, "data format error")
+		return
+	}
+	g, err := s.redeemCode(req.AuthCode)
+	if err != nil {
+		writeErrcode(w, 40029, "invalid code")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"usertype": 5,
+		"user_info": map[string]interface{}{
+			"userid":      g.user.CorpUserId,
+			"open_userid": g.user.Id,
+			"name":        g.user.Name,
+			"avatar":      g.user.AvatarUrl,
+		},
+		"corp_info": map[string]interface{}{
+			"corpid": g.user.CorpId,
+		},
+		"agent":     []interface{}{},
+		"auth_info": map[string]interface{}{"department": []interface{}{}},
+	})
+}
+
+// handleWecomToken 获取内部应用access_token
+func (s *Server) handleWecomToken(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("corpid") != s.ClientId {
+		writeErrcode(w, 40013, "invalid corpid")
+		return
+	}
+	if query.Get("corpsecret") != s.ClientSecret {
+		writeErrcode(w, 40001, "invalid credential")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errcode":      0,
+		"errmsg":       "ok",
+		"access_token": s.issueAppToken(),
+		"expires_in":   7200,
+	})
+}
+
+// handleWecomUserId 通过授权码获取访问用户身份，非企业成员返回OpenId
+func (s *Server) handleWecomUserId(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if !s.validAppToken(query.Get("access_token")) {
+		writeErrcode(w, 40014, "invalid access_token")
+		return
+	}
+	g, err := s.redeemCode(query.Get("code"))
+	if err != nil {
+		writeErrcode(w, 40029, "invalid code")
+		return
+	}
+	if g.user.CorpUserId == "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"errcode": 0, "errmsg": "ok", "OpenId": g.user.Id})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"errcode": 0, "errmsg": "ok", "UserId": g.user.CorpUserId})
+}
+
+// handleWecomUser 读取成员
+func (s *Server) handleWecomUser(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if !s.validAppToken(query.Get("access_token")) {
+		writeErrcode(w, 40014, "invalid access_token")
+		return
+	}
+	userId := query.Get("userid")
+	user := s.findUser(func(user *User) bool { return userId != "" && user.CorpUserId == userId })
+	if user == nil {
+		writeErrcode(w, 60111, "userid not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errcode":     0,
+		"errmsg":      "ok",
+		"userid":      user.CorpUserId,
+		"open_userid": user.Id,
+		"name":        user.Name,
+		"email":       user.Email,
+		"mobile":      user.Phone,
+		"avatar":      user.AvatarUrl,
+	})
+}
@@ -0,0 +1,94 @@
+// 微博模拟服务
+// 模拟微博开放平台的OAuth2接口，出错时返回4xx和{"error":"...","error_code":21325,"request":"..."}
+package idptest
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/smart-unicom/idp"
+)
+
+func init() {
+	registerPlatform(idp.IDP_WEIBO, &platform{
+		routes: func(s *Server, mux *http.ServeMux) {
+			mux.HandleFunc("POST /oauth2/access_token", s.handleWeiboToken)
+			mux.HandleFunc("GET /2/users/show.json", s.handleWeiboUser)
+			mux.HandleFunc("GET /2/account/profile/email.json", s.handleWeiboEmail)
+		},
+	})
+}
+
+// writeWeiboError 写入微博的错误响应
+// 参数:
+//   - w: HTTP响应
+//   - r: HTTP请求
+//   - status: HTTP状态码
+//   - code: 错误码
+//   - message: 错误信息
+func writeWeiboError(w http.ResponseWriter, r *http.Request, status int, code int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error":      message,
+		"error_code": code,
+		"request":    r.URL.Path,
+	})
+}
+
+// handleWeiboToken 获取授权过的Access Token
+func (s *Server) handleWeiboToken(w http.ResponseWriter, r *http.Request) {
+	if r.PostFormValue("client_id") != s.ClientId || r.PostFormValue("client_secret") != s.ClientSecret {
+		writeWeiboError(w, r, http.StatusBadRequest, 21324, "invalid_client")
+		return
+	}
+	g, err := s.redeemCode(r.PostFormValue("code"))
+	if err != nil {
+		writeWeiboError(w, r, http.StatusBadRequest, 21325, "invalid_grant")
+		return
+	}
+	if g.redirectUrl != "" && r.PostFormValue("redirect_uri") != g.redirectUrl {
+		writeWeiboError(w, r, http.StatusBadRequest, 21322, "redirect_uri_mismatch")
+		return
+	}
+	accessToken, _ := s.issueToken(g)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"remind_in":    "157679999",
+		"expires_in":   157679999,
+		"uid":          strconv.FormatInt(g.user.numericId(), 10),
+		"isRealName":   "true",
+	})
+}
+
+// handleWeiboUser 根据用户ID获取用户信息
+func (s *Server) handleWeiboUser(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	g := s.lookupToken(query.Get("access_token"))
+	if g == nil {
+		writeWeiboError(w, r, http.StatusUnauthorized, 21332, "invalid_access_token")
+		return
+	}
+	id := g.user.numericId()
+	if query.Get("uid") != strconv.FormatInt(id, 10) {
+		writeWeiboError(w, r, http.StatusBadRequest, 20003, "User does not exists!")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":                id,
+		"idstr":             strconv.FormatInt(id, 10),
+		"screen_name":       g.user.Name,
+		"name":              g.user.Name,
+		"profile_image_url": g.user.AvatarUrl,
+		"avatar_large":      g.user.AvatarUrl,
+		"gender":            "n",
+	})
+}
+
+// handleWeiboEmail 获取用户的联系邮箱
+func (s *Server) handleWeiboEmail(w http.ResponseWriter, r *http.Request) {
+	g := s.lookupToken(r.URL.Query().Get("access_token"))
+	if g == nil {
+		writeWeiboError(w, r, http.StatusUnauthorized, 21332, "invalid_access_token")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"email": g.user.Email})
+}
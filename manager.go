@@ -0,0 +1,301 @@
+// 多租户提供者管理
+// 从JSON配置加载各租户的登录提供者，按租户和名称缓存已创建的实例，配置文件变化时整体替换，无需重启即可更新应用凭证
+package idp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrProviderNotFound 租户下不存在指定名称的提供者
+var ErrProviderNotFound = errors.New("登录提供者不存在")
+
+// ProviderConfig 提供者配置文件
+// Providers为默认租户（租户ID为空）的提供者，Tenants按租户ID配置各租户的提供者，两者的键均为提供者名称
+type ProviderConfig struct {
+	Providers          map[string]*ProviderInfo            `json:"providers"`          // 默认租户的提供者
+	Tenants            map[string]map[string]*ProviderInfo `json:"tenants"`            // 各租户的提供者
+	DefaultRedirectUrl string                              `json:"defaultRedirectUrl"` // 提供者未配置RedirectUrl时使用的回调地址
+	HttpTimeout        int                                 `json:"httpTimeout"`        // HTTP请求超时时间（秒），为0时使用默认HTTP客户端
+}
+
+// ParseProviderConfig 解析JSON格式的提供者配置
+// ProviderInfo的字段名不区分大小写，如clientId、clientSecret、redirectUrl
+// 参数:
+//   - data: JSON配置内容
+//
+// 返回:
+//   - *ProviderConfig: 提供者配置
+//   - error: 错误信息
+func ParseProviderConfig(data []byte) (*ProviderConfig, error) {
+	config := &ProviderConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("解析提供者配置失败: %w", err)
+	}
+	return config, nil
+}
+
+// providerKey 提供者的租户和名称
+type providerKey struct {
+	tenant string // 租户ID
+	name   string // 提供者名称
+}
+
+// managedProvider 已创建的提供者及其配置
+type managedProvider struct {
+	info        ProviderInfo // 创建时的配置，密钥引用已解析
+	redirectUrl string       // 创建时的回调地址
+	httpTimeout int          // 创建时的HTTP请求超时时间
+	provider    IdProvider   // 提供者实例
+}
+
+// providerSnapshot 某一版本配置创建的所有提供者，创建后不再修改
+type providerSnapshot struct {
+	config    *ProviderConfig                  // 提供者配置
+	providers map[providerKey]*managedProvider // 提供者实例
+}
+
+// ProviderManager 多租户登录提供者管理器
+// 可在多个goroutine中并发使用，重新加载配置时整体替换，正在处理的请求继续使用原实例
+type ProviderManager struct {
+	snapshot atomic.Pointer[providerSnapshot] // 当前使用的提供者
+	loadLock sync.Mutex                       // 保证同一时间只有一次加载
+	fileHash [sha256.Size]byte                // 最近一次通过LoadFile加载的配置文件内容摘要
+}
+
+// NewProviderManager 创建提供者管理器，需要调用Load或LoadFile加载配置
+// 返回:
+//   - *ProviderManager: 提供者管理器
+func NewProviderManager() *ProviderManager {
+	m := &ProviderManager{}
+	m.snapshot.Store(&providerSnapshot{
+		config:    &ProviderConfig{},
+		providers: make(map[providerKey]*managedProvider),
+	})
+	return m
+}
+
+// Load 加载提供者配置，全部提供者创建成功后替换当前配置
+// 参数:
+//   - config: 提供者配置
+//
+// 返回:
+//   - error: 任一提供者配置无效时返回使用errors.Join合并的错误，此时继续使用原配置
+func (m *ProviderManager) Load(config *ProviderConfig) error {
+	return m.LoadContext(context.Background(), config)
+}
+
+// LoadContext 加载提供者配置，支持上下文控制密钥解析
+// 每次加载都会重新解析密钥引用，解析后的配置和回调地址均未变化的提供者沿用原实例，保留其已加载的发现文档、公钥等状态
+// 参数:
+//   - ctx: 上下文，传递给SecretResolver
+//   - config: 提供者配置
+//
+// 返回:
+//   - error: 任一提供者配置无效或密钥引用解析失败时返回使用errors.Join合并的错误，此时继续使用原配置
+func (m *ProviderManager) LoadContext(ctx context.Context, config *ProviderConfig) error {
+	m.loadLock.Lock()
+	defer m.loadLock.Unlock()
+
+	old := m.snapshot.Load()
+	next := &providerSnapshot{
+		config:    config,
+		providers: make(map[providerKey]*managedProvider),
+	}
+
+	var errs []error
+	add := func(tenant string, providers map[string]*ProviderInfo) {
+		for name, info := range providers {
+			key := providerKey{tenant: tenant, name: name}
+			managed, err := m.build(ctx, old.providers[key], info, config)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+			next.providers[key] = managed
+		}
+	}
+	add("", config.Providers)
+	for tenant, providers := range config.Tenants {
+		if tenant == "" {
+			errs = append(errs, errors.New("租户ID不能为空，默认租户的提供者请配置在providers中"))
+			continue
+		}
+		add(tenant, providers)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	m.snapshot.Store(next)
+	return nil
+}
+
+// build 创建提供者，配置未变化时沿用原实例
+// 参数:
+//   - ctx: 上下文
+//   - old: 原配置中的同名提供者，可为nil
+//   - info: 提供者配置信息
+//   - config: 提供者配置
+//
+// 返回:
+//   - *managedProvider: 提供者
+//   - error: 错误信息
+func (m *ProviderManager) build(ctx context.Context, old *managedProvider, info *ProviderInfo, config *ProviderConfig) (*managedProvider, error) {
+	if info == nil {
+		return nil, errors.New("配置为空")
+	}
+	info, err := ResolveProviderSecrets(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	redirectUrl := info.RedirectUrl
+	if redirectUrl == "" {
+		redirectUrl = config.DefaultRedirectUrl
+	}
+	if old != nil && old.redirectUrl == redirectUrl && old.httpTimeout == config.HttpTimeout && reflect.DeepEqual(old.info, *info) {
+		return old, nil
+	}
+
+	provider, err := newIdProvider(info, redirectUrl)
+	if err != nil {
+		return nil, err
+	}
+	if config.HttpTimeout > 0 {
+		client := NewDefaultHttpClient()
+		client.Timeout = time.Duration(config.HttpTimeout) * time.Second
+		provider.SetHttpClient(client)
+	}
+	return &managedProvider{info: *info, redirectUrl: redirectUrl, httpTimeout: config.HttpTimeout, provider: provider}, nil
+}
+
+// LoadFile 从JSON配置文件加载提供者配置
+// 参数:
+//   - path: 配置文件路径
+//
+// 返回:
+//   - error: 错误信息，失败时继续使用原配置
+func (m *ProviderManager) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config, err := ParseProviderConfig(data)
+	if err != nil {
+		return err
+	}
+	if err = m.Load(config); err != nil {
+		return err
+	}
+	m.loadLock.Lock()
+	m.fileHash = sha256.Sum256(data)
+	m.loadLock.Unlock()
+	return nil
+}
+
+// Watch 定期检查配置文件，内容变化时重新加载
+// 阻塞直到ctx结束，通常在单独的goroutine中运行；调用前需先通过LoadFile完成首次加载
+// 参数:
+//   - ctx: 上下文，结束时停止检查
+//   - path: 配置文件路径
+//   - interval: 检查间隔，小于等于0时为5秒
+//   - onReload: 每次重新加载后的回调，err为nil表示加载成功，可为nil
+func (m *ProviderManager) Watch(ctx context.Context, path string, interval time.Duration, onReload func(err error)) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	m.loadLock.Lock()
+	lastHash := m.fileHash
+	m.loadLock.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		data, err := os.ReadFile(path)
+		if err == nil && sha256.Sum256(data) == lastHash {
+			continue
+		}
+		if err == nil {
+			// 无论加载是否成功都记录摘要，配置错误时不重复报告，等待下次修改
+			lastHash = sha256.Sum256(data)
+			var config *ProviderConfig
+			if config, err = ParseProviderConfig(data); err == nil {
+				err = m.LoadContext(ctx, config)
+			}
+		}
+		if onReload != nil {
+			onReload(err)
+		}
+	}
+}
+
+// Get 获取租户的登录提供者
+// 参数:
+//   - tenant: 租户ID，默认租户为空字符串
+//   - name: 提供者名称
+//
+// 返回:
+//   - IdProvider: 登录提供者
+//   - error: 不存在时返回ErrProviderNotFound
+func (m *ProviderManager) Get(tenant string, name string) (IdProvider, error) {
+	managed, ok := m.snapshot.Load().providers[providerKey{tenant: tenant, name: name}]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProviderNotFound, providerKey{tenant: tenant, name: name})
+	}
+	return managed.provider, nil
+}
+
+// Names 获取租户下所有提供者的名称
+// 参数:
+//   - tenant: 租户ID，默认租户为空字符串
+//
+// 返回:
+//   - []string: 按字母顺序排列的提供者名称
+func (m *ProviderManager) Names(tenant string) []string {
+	var names []string
+	for key := range m.snapshot.Load().providers {
+		if key.tenant == tenant {
+			names = append(names, key.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Tenants 获取配置了提供者的所有租户ID，不包括默认租户
+// 返回:
+//   - []string: 按字母顺序排列的租户ID
+func (m *ProviderManager) Tenants() []string {
+	var tenants []string
+	for tenant := range m.snapshot.Load().config.Tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// String 获取用于错误信息的租户和名称
+func (k providerKey) String() string {
+	if k.tenant == "" {
+		return k.name
+	}
+	return k.tenant + "/" + k.name
+}
@@ -0,0 +1,118 @@
+// 登录指标
+// 按提供者和登录操作统计操作次数、成功次数和按错误分类的失败次数，按接口统计调用耗时
+package idp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// 失败操作的错误分类，对应Metrics.RecordOperation的category参数
+const (
+	CategoryCodeExpiredOrUsed  string = "code_expired_or_used" // 授权码无效、已过期或已被使用
+	CategoryInvalidCredentials string = "invalid_credentials"  // 应用凭证无效
+	CategoryInvalidToken       string = "invalid_token"        // 访问令牌或刷新令牌无效
+	CategoryNotCorpMember      string = "not_corp_member"      // 用户不属于该企业
+	CategoryRateLimited        string = "rate_limited"         // 接口调用频率超限
+	CategoryUpstream           string = "upstream"             // 平台返回的其他错误
+	CategoryTimeout            string = "timeout"              // 请求超时
+	CategoryCanceled           string = "canceled"             // 请求被取消
+	CategoryNetwork            string = "network"              // 网络错误
+	CategoryOther              string = "other"                // 响应解析失败等其他错误
+)
+
+// Metrics 登录指标收集器
+// 实现需要支持并发调用，可对接Prometheus、OpenTelemetry等监控系统
+type Metrics interface {
+	// RecordOperation 记录一次登录操作的结果
+	// 每次获取令牌、刷新令牌或获取用户信息只记录一次，不受重试和多次接口调用影响
+	// 参数:
+	//   - provider: 提供者类型（如WeChat、GitHub等）
+	//   - op: 操作类型：token、refreshToken、userinfo
+	//   - category: 错误分类，操作成功时为空
+	RecordOperation(provider string, op string, category string)
+
+	// RecordLatency 记录一次第三方平台接口调用的耗时，重试时每次请求分别记录
+	// 参数:
+	//   - provider: 提供者类型
+	//   - endpoint: 接口名称，如token、refreshToken、userinfo
+	//   - latency: 接口耗时
+	RecordLatency(provider string, endpoint string, latency time.Duration)
+}
+
+// ErrorCategory 获取错误对应的分类，用于按分类统计失败次数
+// 参数:
+//   - err: 登录提供者返回的错误
+//
+// 返回:
+//   - string: 错误分类，err为nil时返回空字符串
+func ErrorCategory(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrCodeExpiredOrUsed):
+		return CategoryCodeExpiredOrUsed
+	case errors.Is(err, ErrInvalidCredentials):
+		return CategoryInvalidCredentials
+	case errors.Is(err, ErrInvalidToken):
+		return CategoryInvalidToken
+	case errors.Is(err, ErrNotCorpMember):
+		return CategoryNotCorpMember
+	case errors.Is(err, ErrRateLimited):
+		return CategoryRateLimited
+	case errors.Is(err, context.DeadlineExceeded):
+		return CategoryTimeout
+	case errors.Is(err, context.Canceled):
+		return CategoryCanceled
+	}
+
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return CategoryUpstream
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return CategoryTimeout
+		}
+		return CategoryNetwork
+	}
+	return CategoryOther
+}
+
+// MetricsObserver 将登录操作和接口调用事件转换为登录指标的观察者
+// 操作次数和失败次数来自OnOperation，接口调用事件只用于统计接口耗时
+type MetricsObserver struct {
+	Metrics Metrics // 指标收集器
+}
+
+// NewMetricsObserver 创建记录登录指标的观察者
+// 与其他观察者同时使用时可通过NewMultiObserver组合
+// 参数:
+//   - metrics: 指标收集器
+//
+// 返回:
+//   - *MetricsObserver: 观察者实例
+func NewMetricsObserver(metrics Metrics) *MetricsObserver {
+	return &MetricsObserver{Metrics: metrics}
+}
+
+// OnRequest 请求开始时不记录指标，接口耗时在请求结束时统计
+func (o *MetricsObserver) OnRequest(ctx context.Context, event *RequestEvent) {}
+
+// OnResponse 记录接口耗时
+func (o *MetricsObserver) OnResponse(ctx context.Context, event *ResponseEvent) {
+	o.Metrics.RecordLatency(event.Provider, event.Endpoint, event.Latency)
+}
+
+// OnError 记录接口耗时，失败次数由OnOperation按登录操作统计
+func (o *MetricsObserver) OnError(ctx context.Context, event *ResponseEvent) {
+	o.Metrics.RecordLatency(event.Provider, event.Endpoint, event.Latency)
+}
+
+// OnOperation 记录登录操作的结果
+func (o *MetricsObserver) OnOperation(ctx context.Context, event *OperationEvent) {
+	o.Metrics.RecordOperation(event.Provider, event.Op, ErrorCategory(event.Err))
+}
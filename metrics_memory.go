@@ -0,0 +1,245 @@
+// 内存登录指标
+// 在进程内存中统计登录指标，可通过expvar在/debug/vars中导出
+package idp
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets 默认的接口耗时直方图桶上界
+var DefaultLatencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// EndpointMetrics 单个提供者单个登录操作或接口的指标快照
+// 登录操作token、refreshToken、userinfo与同名接口共用一条记录，
+// 只在登录过程中调用的接口（如钉钉的userid）只有耗时统计
+type EndpointMetrics struct {
+	Provider  string           `json:"provider"`  // 提供者类型
+	Endpoint  string           `json:"endpoint"`  // 登录操作或接口名称
+	Attempts  int64            `json:"attempts"`  // 登录操作次数，重试和多次接口调用不重复计数
+	Successes int64            `json:"successes"` // 登录操作成功次数
+	Failures  map[string]int64 `json:"failures"`  // 按错误分类统计的登录操作失败次数
+	Latency   LatencyHistogram `json:"latency"`   // 接口耗时直方图，每次请求分别统计
+}
+
+// ErrorRate 获取登录操作失败率
+// 返回:
+//   - float64: 失败次数与操作次数之比，没有操作时为0
+func (m *EndpointMetrics) ErrorRate() float64 {
+	if m.Attempts == 0 {
+		return 0
+	}
+	return float64(m.Attempts-m.Successes) / float64(m.Attempts)
+}
+
+// LatencyHistogram 接口耗时直方图
+type LatencyHistogram struct {
+	Buckets []LatencyBucket `json:"buckets"` // 各桶的累计次数，按上界升序排列
+	Count   int64           `json:"count"`   // 总次数
+	Sum     time.Duration   `json:"sum"`     // 总耗时
+}
+
+// LatencyBucket 耗时直方图的桶
+type LatencyBucket struct {
+	UpperBound time.Duration `json:"upperBound"` // 桶上界
+	Count      int64         `json:"count"`      // 耗时不超过上界的次数
+}
+
+// MemoryMetrics 在内存中统计登录指标的Metrics实现
+type MemoryMetrics struct {
+	lock    sync.Mutex
+	buckets []time.Duration                  // 耗时直方图桶上界
+	entries map[metricsKey]*endpointCounters // 按提供者和登录操作或接口统计的计数
+}
+
+// metricsKey 指标统计维度
+type metricsKey struct {
+	provider string // 提供者类型
+	endpoint string // 登录操作或接口名称
+}
+
+// endpointCounters 单个提供者单个登录操作或接口的计数
+type endpointCounters struct {
+	attempts     int64            // 登录操作次数
+	successes    int64            // 登录操作成功次数
+	failures     map[string]int64 // 按错误分类统计的登录操作失败次数
+	bucketCounts []int64          // 各桶的非累计次数
+	latencyCount int64            // 接口调用次数
+	latencySum   time.Duration    // 总耗时
+}
+
+// NewMemoryMetrics 创建内存登录指标
+// 参数:
+//   - buckets: 耗时直方图桶上界，为空时使用DefaultLatencyBuckets
+//
+// 返回:
+//   - *MemoryMetrics: 内存登录指标
+func NewMemoryMetrics(buckets ...time.Duration) *MemoryMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	sorted := append([]time.Duration(nil), buckets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &MemoryMetrics{
+		buckets: sorted,
+		entries: make(map[metricsKey]*endpointCounters),
+	}
+}
+
+// RecordOperation 记录一次登录操作的结果
+// 参数:
+//   - provider: 提供者类型
+//   - op: 操作类型
+//   - category: 错误分类，操作成功时为空
+func (m *MemoryMetrics) RecordOperation(provider string, op string, category string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	c := m.counters(provider, op)
+	c.attempts++
+	if category == "" {
+		c.successes++
+	} else {
+		c.failures[category]++
+	}
+}
+
+// RecordLatency 记录一次第三方平台接口调用的耗时
+// 参数:
+//   - provider: 提供者类型
+//   - endpoint: 接口名称
+//   - latency: 接口耗时
+func (m *MemoryMetrics) RecordLatency(provider string, endpoint string, latency time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	c := m.counters(provider, endpoint)
+	c.latencyCount++
+	c.latencySum += latency
+	if i := sort.Search(len(m.buckets), func(i int) bool { return latency <= m.buckets[i] }); i < len(m.buckets) {
+		c.bucketCounts[i]++
+	}
+}
+
+// counters 获取或创建计数，调用方需持有锁
+// 参数:
+//   - provider: 提供者类型
+//   - endpoint: 登录操作或接口名称
+//
+// 返回:
+//   - *endpointCounters: 计数
+func (m *MemoryMetrics) counters(provider string, endpoint string) *endpointCounters {
+	key := metricsKey{provider: provider, endpoint: endpoint}
+	c, ok := m.entries[key]
+	if !ok {
+		c = &endpointCounters{
+			failures:     make(map[string]int64),
+			bucketCounts: make([]int64, len(m.buckets)),
+		}
+		m.entries[key] = c
+	}
+	return c
+}
+
+// Snapshot 获取当前指标快照
+// 返回:
+//   - []EndpointMetrics: 按提供者和接口名称排序的指标
+func (m *MemoryMetrics) Snapshot() []EndpointMetrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snapshot := make([]EndpointMetrics, 0, len(m.entries))
+	for key, c := range m.entries {
+		failures := make(map[string]int64, len(c.failures))
+		for category, count := range c.failures {
+			failures[category] = count
+		}
+
+		histogram := LatencyHistogram{
+			Buckets: make([]LatencyBucket, len(m.buckets)),
+			Count:   c.latencyCount,
+			Sum:     c.latencySum,
+		}
+		var cumulative int64
+		for i, upperBound := range m.buckets {
+			cumulative += c.bucketCounts[i]
+			histogram.Buckets[i] = LatencyBucket{UpperBound: upperBound, Count: cumulative}
+		}
+
+		snapshot = append(snapshot, EndpointMetrics{
+			Provider:  key.provider,
+			Endpoint:  key.endpoint,
+			Attempts:  c.attempts,
+			Successes: c.successes,
+			Failures:  failures,
+			Latency:   histogram,
+		})
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].Provider != snapshot[j].Provider {
+			return snapshot[i].Provider < snapshot[j].Provider
+		}
+		return snapshot[i].Endpoint < snapshot[j].Endpoint
+	})
+	return snapshot
+}
+
+// Get 获取单个提供者单个登录操作或接口的指标
+// 参数:
+//   - provider: 提供者类型
+//   - endpoint: 登录操作或接口名称
+//
+// 返回:
+//   - EndpointMetrics: 指标快照
+//   - bool: 尚无调用记录时返回false
+func (m *MemoryMetrics) Get(provider string, endpoint string) (EndpointMetrics, bool) {
+	for _, metrics := range m.Snapshot() {
+		if metrics.Provider == provider && metrics.Endpoint == endpoint {
+			return metrics, true
+		}
+	}
+	return EndpointMetrics{}, false
+}
+
+// Reset 清空所有指标
+func (m *MemoryMetrics) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries = make(map[metricsKey]*endpointCounters)
+}
+
+// expvarPublishLock 保证PublishExpvar检查变量名和发布变量之间不被其他调用打断
+// expvar.Publish在变量名重复时会panic
+var expvarPublishLock sync.Mutex
+
+// PublishExpvar 将指标快照以expvar变量导出，可通过/debug/vars查看
+// 可并发调用，同一变量名只有一次调用成功
+// 参数:
+//   - name: expvar变量名
+//
+// 返回:
+//   - error: 变量名已被使用时返回错误
+func (m *MemoryMetrics) PublishExpvar(name string) error {
+	expvarPublishLock.Lock()
+	defer expvarPublishLock.Unlock()
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar变量 %s 已存在", name)
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.Snapshot()
+	}))
+	return nil
+}
@@ -0,0 +1,32 @@
+package idp_test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smart-unicom/idp"
+)
+
+// TestPublishExpvarConcurrent 并发以同一变量名导出指标时只有一次成功，其余返回错误而不是panic
+func TestPublishExpvarConcurrent(t *testing.T) {
+	// expvar变量无法删除，使用唯一的变量名以便重复运行测试
+	name := fmt.Sprintf("idp_test_%d", time.Now().UnixNano())
+	var succeeded int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := idp.NewMemoryMetrics().PublishExpvar(name); err == nil {
+				atomic.AddInt32(&succeeded, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if succeeded != 1 {
+		t.Errorf("成功导出 %d 次, want 1", succeeded)
+	}
+}
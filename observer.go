@@ -0,0 +1,229 @@
+// 第三方平台接口调用观察
+// 每次调用第三方平台接口时通知Observer，用于记录日志、统计耗时和错误率
+package idp
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Observer 第三方平台接口调用观察者
+// 每次调用先触发OnRequest，结束后触发OnResponse或OnError之一，实现需要支持并发调用
+type Observer interface {
+	// OnRequest 发起请求前调用
+	OnRequest(ctx context.Context, event *RequestEvent)
+
+	// OnResponse 请求成功后调用
+	OnResponse(ctx context.Context, event *ResponseEvent)
+
+	// OnError 请求失败后调用，包括网络错误、HTTP状态码错误和平台返回的错误码
+	OnError(ctx context.Context, event *ResponseEvent)
+}
+
+// RequestEvent 第三方平台接口请求事件
+type RequestEvent struct {
+	Provider string // 提供者类型（如WeChat、GitHub等）
+	SubType  string // 提供者子类型
+	Endpoint string // 接口名称，如token、refreshToken、userinfo
+	Method   string // HTTP方法
+	Url      string // 请求地址，不含查询参数，避免记录访问令牌、密钥等敏感信息
+}
+
+// ResponseEvent 第三方平台接口响应事件
+type ResponseEvent struct {
+	RequestEvent
+	StatusCode int           // HTTP状态码，网络错误时为0
+	Latency    time.Duration // 请求耗时
+	Code       string        // 平台错误码，成功时为空
+	Err        error         // 错误信息，OnResponse中为nil
+}
+
+// OperationObserver 登录操作观察者，观察者可选实现的接口
+// 每次获取令牌、刷新令牌或获取用户信息结束后触发一次OnOperation，
+// 重试和多次接口调用不会重复触发，接口调用之后的响应解析、用户字段映射等失败同样会通知
+type OperationObserver interface {
+	// OnOperation 登录操作结束后调用
+	OnOperation(ctx context.Context, event *OperationEvent)
+}
+
+// OperationEvent 登录操作结束事件
+type OperationEvent struct {
+	Provider string        // 提供者类型（如WeChat、GitHub等）
+	SubType  string        // 提供者子类型
+	Op       string        // 操作类型：token、refreshToken、userinfo
+	Latency  time.Duration // 操作耗时，包括重试等待和所有接口调用
+	Err      error         // 错误信息，操作成功时为nil
+}
+
+// multiObserver 依次通知多个观察者
+type multiObserver []Observer
+
+// NewMultiObserver 组合多个观察者，事件按顺序通知每个观察者
+// 参数:
+//   - observers: 观察者列表，nil会被忽略
+//
+// 返回:
+//   - Observer: 组合后的观察者
+func NewMultiObserver(observers ...Observer) Observer {
+	multi := make(multiObserver, 0, len(observers))
+	for _, observer := range observers {
+		if observer != nil {
+			multi = append(multi, observer)
+		}
+	}
+	return multi
+}
+
+// OnRequest 通知所有观察者请求开始
+func (m multiObserver) OnRequest(ctx context.Context, event *RequestEvent) {
+	for _, observer := range m {
+		observer.OnRequest(ctx, event)
+	}
+}
+
+// OnResponse 通知所有观察者请求成功
+func (m multiObserver) OnResponse(ctx context.Context, event *ResponseEvent) {
+	for _, observer := range m {
+		observer.OnResponse(ctx, event)
+	}
+}
+
+// OnError 通知所有观察者请求失败
+func (m multiObserver) OnError(ctx context.Context, event *ResponseEvent) {
+	for _, observer := range m {
+		observer.OnError(ctx, event)
+	}
+}
+
+// OnOperation 通知实现了OperationObserver的观察者登录操作结束
+func (m multiObserver) OnOperation(ctx context.Context, event *OperationEvent) {
+	for _, observer := range m {
+		if operationObserver, ok := observer.(OperationObserver); ok {
+			operationObserver.OnOperation(ctx, event)
+		}
+	}
+}
+
+// 默认观察者相关变量
+var (
+	defaultObserver     Observer     // 未单独设置观察者的提供者使用的观察者
+	defaultObserverLock sync.RWMutex // 默认观察者读写锁
+)
+
+// SetDefaultObserver 设置所有提供者默认使用的观察者
+// 参数:
+//   - observer: 观察者，为nil时取消观察
+func SetDefaultObserver(observer Observer) {
+	defaultObserverLock.Lock()
+	defer defaultObserverLock.Unlock()
+	defaultObserver = observer
+}
+
+// getDefaultObserver 获取默认观察者
+// 返回:
+//   - Observer: 默认观察者，未设置时为nil
+func getDefaultObserver() Observer {
+	defaultObserverLock.RLock()
+	defer defaultObserverLock.RUnlock()
+	return defaultObserver
+}
+
+// SetProviderObserver 为单个提供者设置观察者，优先于SetDefaultObserver设置的默认观察者
+// 参数:
+//   - provider: 登录提供者
+//   - observer: 观察者，为nil时使用默认观察者
+//
+// 返回:
+//   - bool: 提供者不支持设置观察者时返回false
+func SetProviderObserver(provider IdProvider, observer Observer) bool {
+	setter, ok := provider.(interface{ SetObserver(observer Observer) })
+	if !ok {
+		return false
+	}
+	setter.SetObserver(observer)
+	return true
+}
+
+// callObservation 一次接口调用的观察记录
+type callObservation struct {
+	ctx      context.Context // 请求上下文
+	observer Observer        // 观察者
+	event    RequestEvent    // 请求事件
+	start    time.Time       // 开始时间
+}
+
+// startCall 开始观察一次接口调用并触发OnRequest
+// 参数:
+//   - ctx: 请求上下文
+//   - observer: 观察者，为nil时不做任何事
+//   - event: 请求事件，Url中的查询参数会被去除
+//
+// 返回:
+//   - *callObservation: 观察记录，调用结束后调用finish
+func startCall(ctx context.Context, observer Observer, event RequestEvent) *callObservation {
+	if u, err := url.Parse(event.Url); err == nil {
+		u.RawQuery = ""
+		u.Fragment = ""
+		u.User = nil
+		event.Url = u.String()
+	}
+	if observer == nil {
+		return &callObservation{ctx: ctx, event: event}
+	}
+	observer.OnRequest(ctx, &event)
+	return &callObservation{ctx: ctx, observer: observer, event: event, start: time.Now()}
+}
+
+// waitRateLimit 等待客户端限流器放行
+// 参数:
+//   - limiter: 客户端限流器，可为nil
+//
+// 返回:
+//   - error: 客户端限流时返回Err为ErrRateLimited的*ProviderError
+func (c *callObservation) waitRateLimit(limiter *RateLimiter) error {
+	err := limiter.Wait(c.ctx)
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		providerErr.Provider = c.event.Provider
+		providerErr.Op = c.event.Endpoint
+	}
+	return err
+}
+
+// finish 结束观察并触发OnResponse或OnError
+// 网络错误中的*url.Error包含完整的请求地址，其中的查询参数可能含有应用密钥、授权码和访问令牌，
+// 通知观察者和返回给调用方之前替换为去除查询参数的地址
+// 参数:
+//   - statusCode: HTTP状态码，未知时为0
+//   - err: 调用结果，为*ProviderError时从中读取平台错误码和HTTP状态码
+func (c *callObservation) finish(statusCode int, err error) {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = c.event.Url
+	}
+	if c.observer == nil {
+		return
+	}
+	event := &ResponseEvent{
+		RequestEvent: c.event,
+		StatusCode:   statusCode,
+		Latency:      time.Since(c.start),
+		Err:          err,
+	}
+	if err == nil {
+		c.observer.OnResponse(c.ctx, event)
+		return
+	}
+
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		event.Code = providerErr.Code
+		if event.StatusCode == 0 {
+			event.StatusCode = providerErr.StatusCode
+		}
+	}
+	c.observer.OnError(c.ctx, event)
+}
@@ -0,0 +1,66 @@
+// 基于log/slog的观察者
+package idp
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogObserver 将第三方平台接口调用记录到slog日志
+// 请求记录为Debug级别，成功响应为Info级别，失败为Warn级别
+type SlogObserver struct {
+	Logger *slog.Logger // 日志记录器，为nil时使用slog.Default()
+}
+
+// NewSlogObserver 创建基于slog的观察者
+// 参数:
+//   - logger: 日志记录器，为nil时使用slog.Default()
+//
+// 返回:
+//   - *SlogObserver: 观察者实例
+func NewSlogObserver(logger *slog.Logger) *SlogObserver {
+	return &SlogObserver{Logger: logger}
+}
+
+// OnRequest 记录请求
+func (o *SlogObserver) OnRequest(ctx context.Context, event *RequestEvent) {
+	o.logger().LogAttrs(ctx, slog.LevelDebug, "idp request",
+		slog.String("provider", event.Provider),
+		slog.String("subType", event.SubType),
+		slog.String("endpoint", event.Endpoint),
+		slog.String("method", event.Method),
+		slog.String("url", event.Url),
+	)
+}
+
+// OnResponse 记录成功响应
+func (o *SlogObserver) OnResponse(ctx context.Context, event *ResponseEvent) {
+	o.logger().LogAttrs(ctx, slog.LevelInfo, "idp response",
+		slog.String("provider", event.Provider),
+		slog.String("subType", event.SubType),
+		slog.String("endpoint", event.Endpoint),
+		slog.Int("status", event.StatusCode),
+		slog.Duration("latency", event.Latency),
+	)
+}
+
+// OnError 记录失败响应
+func (o *SlogObserver) OnError(ctx context.Context, event *ResponseEvent) {
+	o.logger().LogAttrs(ctx, slog.LevelWarn, "idp error",
+		slog.String("provider", event.Provider),
+		slog.String("subType", event.SubType),
+		slog.String("endpoint", event.Endpoint),
+		slog.Int("status", event.StatusCode),
+		slog.Duration("latency", event.Latency),
+		slog.String("code", event.Code),
+		slog.Any("error", event.Err),
+	)
+}
+
+// logger 获取日志记录器
+func (o *SlogObserver) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,54 @@
+package idp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/smart-unicom/idp"
+)
+
+// failingTransport 所有请求都返回网络错误的Transport
+type failingTransport struct{}
+
+// RoundTrip 返回网络错误
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+// TestSlogObserverRedactsUrlError 网络错误日志中不包含请求地址的查询参数
+func TestSlogObserverRedactsUrlError(t *testing.T) {
+	provider, err := idp.GetIdProvider(&idp.ProviderInfo{
+		Type:         idp.IDP_WECHAT,
+		ClientId:     "wx_idptest",
+		ClientSecret: "idptest_app_secret",
+	}, "https://example.com/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.SetHttpClient(&http.Client{Transport: failingTransport{}})
+	idp.SetProviderRetryPolicy(provider, &idp.RetryPolicy{MaxAttempts: 1})
+
+	var buf bytes.Buffer
+	idp.SetProviderObserver(provider, idp.NewSlogObserver(slog.New(slog.NewTextHandler(&buf, nil))))
+
+	_, err = idp.GetTokenContext(context.Background(), provider, "idptest_code")
+	if err == nil {
+		t.Fatal("网络错误时GetTokenContext应返回错误")
+	}
+	if !strings.Contains(buf.String(), "idp error") {
+		t.Fatalf("缺少错误日志: %s", buf.String())
+	}
+	for _, secret := range []string{"secret=", "idptest_app_secret", "idptest_code"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("日志包含%s: %s", secret, buf.String())
+		}
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("错误信息包含%s: %v", secret, err)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+// OpenID Connect登录提供者实现
+// 通过发现文档获取接口地址，校验ID令牌并将标准声明映射为用户信息
+// 适用于Keycloak、Authing、Azure AD、Google等标准OIDC身份提供方
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// oidcDiscoveryPath OIDC发现文档路径
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// oidcDefaultUserMapping OIDC提供者的默认用户字段映射，基于OIDC标准声明
+var oidcDefaultUserMapping = map[string]string{
+	"id":          "sub",
+	"username":    "preferred_username|email|sub",
+	"displayName": "name|nickname|preferred_username",
+	"email":       "email",
+	"phone":       "phone_number",
+	"avatarUrl":   "picture",
+}
+
+// oidcNonceKey 上下文中保存期望nonce的键
+type oidcNonceKey struct{}
+
+// WithOidcNonce 在上下文中设置期望的nonce，GetTokenContext会据此校验ID令牌中的nonce声明
+// 参数:
+//   - ctx: 请求上下文
+//   - nonce: 生成授权URL时使用的nonce
+//
+// 返回:
+//   - context.Context: 携带nonce的上下文
+func WithOidcNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, oidcNonceKey{}, nonce)
+}
+
+// OidcDiscoveryDocument OIDC发现文档
+type OidcDiscoveryDocument struct {
+	Issuer                string   `json:"issuer"`                                // 签发者
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`                // 授权接口地址
+	TokenEndpoint         string   `json:"token_endpoint"`                        // 令牌接口地址
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`                     // 用户信息接口地址
+	JwksUri               string   `json:"jwks_uri"`                              // JWKS地址
+	EndSessionEndpoint    string   `json:"end_session_endpoint"`                  // 退出登录地址
+	SigningAlgs           []string `json:"id_token_signing_alg_values_supported"` // 支持的ID令牌签名算法
+}
+
+// OidcIdProvider OpenID Connect登录提供者
+// 首次使用时加载发现文档，ID令牌签名公钥按需从JWKS拉取并缓存
+type OidcIdProvider struct {
+	providerBase
+
+	Client *http.Client   // HTTP客户端
+	Config *oauth2.Config // OAuth2配置
+	Issuer string         // 签发者地址
+
+	discoveryLock sync.Mutex             // 发现文档加载锁
+	discovery     *OidcDiscoveryDocument // 已加载的发现文档
+	authUrl       string                 // 显式配置的授权地址
+	tokenUrl      string                 // 显式配置的令牌地址
+	keySet        oidcKeySet             // JWKS公钥缓存
+}
+
+func init() {
+	RegisterProvider(IDP_OIDC, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		return NewOidcIdProvider(idpInfo, redirectUrl)
+	})
+	RegisterProviderValidator(IDP_OIDC, validateOidcInfo)
+}
+
+// validateOidcInfo 校验OpenID Connect提供者配置，HostUrl为签发者地址
+// 参数:
+//   - idpInfo: 提供者配置信息
+//
+// 返回:
+//   - error: 错误信息
+func validateOidcInfo(idpInfo *ProviderInfo) error {
+	if idpInfo.HostUrl == "" {
+		return errors.New("HostUrl: OIDC提供者必须配置签发者地址")
+	}
+	return nil
+}
+
+// NewOidcIdProvider 创建OpenID Connect登录提供者实例
+// HostUrl为签发者地址，发现文档在首次使用时加载；AuthURL、TokenURL、UserInfoURL非空时覆盖发现文档中的地址
+// 参数:
+//   - idpInfo: 提供者配置信息
+//   - redirectUrl: OAuth2重定向URL
+//
+// 返回:
+//   - *OidcIdProvider: OpenID Connect登录提供者实例
+//   - error: 配置无效时返回错误
+func NewOidcIdProvider(idpInfo *ProviderInfo, redirectUrl string) (*OidcIdProvider, error) {
+	if idpInfo.HostUrl == "" {
+		return nil, fmt.Errorf("OIDC提供者必须通过HostUrl配置签发者地址")
+	}
+
+	userMapping := mergeUserMapping(oidcDefaultUserMapping, idpInfo.UserMapping)
+	if err := ValidateUserMapping(userMapping); err != nil {
+		return nil, err
+	}
+
+	// 授权范围必须包含openid，否则身份提供方不会返回ID令牌
+	scopes := []string{"openid", "profile", "email"}
+	if len(idpInfo.Scopes) > 0 {
+		scopes = idpInfo.Scopes
+		hasOpenId := false
+		for _, scope := range scopes {
+			if scope == "openid" {
+				hasOpenId = true
+			}
+		}
+		if !hasOpenId {
+			scopes = append([]string{"openid"}, scopes...)
+		}
+	}
+
+	idp := &OidcIdProvider{
+		Client: DefaultHttpClient(),
+		Config: &oauth2.Config{
+			ClientID:     idpInfo.ClientId,
+			ClientSecret: idpInfo.ClientSecret,
+			RedirectURL:  redirectUrl,
+			Scopes:       scopes,
+		},
+		Issuer:   strings.TrimSuffix(idpInfo.HostUrl, "/"),
+		authUrl:  idpInfo.AuthURL,
+		tokenUrl: idpInfo.TokenURL,
+	}
+	idp.providerType = IDP_OIDC
+	idp.subType = idpInfo.SubType
+	idp.clientId = idpInfo.ClientId
+	idp.userInfoUrl = idpInfo.UserInfoURL
+	idp.userMapping = userMapping
+
+	return idp, nil
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *OidcIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// Discover 加载并缓存发现文档，可在启动时调用以提前发现配置错误
+// 参数:
+//   - ctx: 请求上下文
+//
+// 返回:
+//   - *OidcDiscoveryDocument: 发现文档
+//   - error: 错误信息
+func (idp *OidcIdProvider) Discover(ctx context.Context) (*OidcDiscoveryDocument, error) {
+	idp.discoveryLock.Lock()
+	defer idp.discoveryLock.Unlock()
+
+	if idp.discovery != nil {
+		return idp.discovery, nil
+	}
+
+	data, err := idp.fetchDocument(ctx, "discovery", idp.Issuer+oidcDiscoveryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery := &OidcDiscoveryDocument{}
+	if err = json.Unmarshal(data, discovery); err != nil {
+		return nil, newProviderErrorf(IDP_OIDC, OpDiscovery, nil, "发现文档解析失败: %v", err)
+	}
+	// 发现文档中的签发者必须与配置一致，防止被替换为其他身份提供方
+	if strings.TrimSuffix(discovery.Issuer, "/") != idp.Issuer {
+		return nil, newProviderErrorf(IDP_OIDC, OpDiscovery, nil, "发现文档签发者不匹配: 期望 %s，实际 %s", idp.Issuer, discovery.Issuer)
+	}
+	if discovery.JwksUri == "" {
+		return nil, newProviderErrorf(IDP_OIDC, OpDiscovery, nil, "发现文档缺少jwks_uri")
+	}
+
+	idp.Config.Endpoint.AuthURL = discovery.AuthorizationEndpoint
+	if idp.authUrl != "" {
+		idp.Config.Endpoint.AuthURL = idp.authUrl
+	}
+	idp.Config.Endpoint.TokenURL = discovery.TokenEndpoint
+	if idp.tokenUrl != "" {
+		idp.Config.Endpoint.TokenURL = idp.tokenUrl
+	}
+	if idp.userInfoUrl == "" {
+		idp.userInfoUrl = discovery.UserinfoEndpoint
+	}
+	idp.discovery = discovery
+
+	return discovery, nil
+}
+
+// fetchDocument 获取发现文档、JWKS等公开文档
+// 参数:
+//   - ctx: 请求上下文
+//   - endpoint: 接口名称，如discovery、jwks
+//   - docUrl: 文档地址
+//
+// 返回:
+//   - []byte: 文档内容
+//   - error: 错误信息
+func (idp *OidcIdProvider) fetchDocument(ctx context.Context, endpoint string, docUrl string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(withIdempotent(ctx), "GET", docUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := idp.doRequest(idp.Client, req, endpoint, func(resp *http.Response, data []byte) error {
+		if resp.StatusCode != http.StatusOK {
+			return newProviderError(IDP_OIDC, OpDiscovery, resp.StatusCode, "", string(data))
+		}
+		return nil
+	})
+	return data, err
+}
+
+// fetchJwks 获取JWKS
+// 参数:
+//   - ctx: 请求上下文
+//   - jwksUri: JWKS地址
+//
+// 返回:
+//   - []byte: JWKS内容
+//   - error: 错误信息
+func (idp *OidcIdProvider) fetchJwks(ctx context.Context, jwksUri string) ([]byte, error) {
+	return idp.fetchDocument(ctx, "jwks", jwksUri)
+}
+
+// GetAuthURL 生成OIDC授权跳转URL
+// 需要时会加载发现文档，加载失败时返回空字符串，需要具体错误时使用GetAuthURLContext
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+//
+// 返回:
+//   - string: 授权URL
+func (idp *OidcIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	authUrl, _ := idp.GetAuthURLContext(context.Background(), state, opts...)
+	return authUrl
+}
+
+// GetAuthURLContext 生成OIDC授权跳转URL，需要时加载发现文档
+// 使用WithNonce设置nonce，并在回调时通过WithOidcNonce传入GetTokenContext进行校验，支持通过WithPKCE加入code_challenge
+// 参数:
+//   - ctx: 请求上下文，用于加载发现文档
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+//
+// 返回:
+//   - string: 授权URL
+//   - error: 发现文档加载失败时返回错误
+func (idp *OidcIdProvider) GetAuthURLContext(ctx context.Context, state string, opts ...AuthOption) (string, error) {
+	if _, err := idp.Discover(ctx); err != nil {
+		return "", err
+	}
+	return standardAuthURL(idp.Config, state, opts, true), nil
+}
+
+// Capabilities 获取OIDC登录的能力描述
+// 邮箱和手机号来自email、phone_number声明，取决于用户字段映射和授权范围
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *OidcIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		RefreshToken: true,
+		PKCE:         true,
+		Nonce:        true,
+	})
+}
+
+// GetToken 通过授权码获取访问令牌并校验ID令牌
+// 参数:
+//   - code: 授权码
+//
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌，ID令牌位于Extra("id_token")
+//   - error: 错误信息
+func (idp *OidcIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取访问令牌并校验ID令牌，请求受上下文控制
+// 校验ID令牌的签名、签发者、受众和有效期，上下文中通过WithOidcNonce设置了nonce时一并校验
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制，可通过WithCodeVerifier设置PKCE code_verifier
+//   - code: 授权码
+//
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌，ID令牌位于Extra("id_token")
+//   - error: 错误信息
+func (idp *OidcIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *OidcIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	if _, err := idp.Discover(ctx); err != nil {
+		return nil, err
+	}
+
+	token, err := idp.observeToken(ctx, OpToken, idp.Config.Endpoint.TokenURL, func() (*oauth2.Token, error) {
+		return idp.Config.Exchange(context.WithValue(ctx, oauth2.HTTPClient, idp.Client), code, exchangeOptions(ctx)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rawIdToken, _ := token.Extra("id_token").(string)
+	if rawIdToken == "" {
+		return nil, newProviderErrorf(IDP_OIDC, OpToken, nil, "令牌响应中缺少id_token")
+	}
+	nonce, _ := ctx.Value(oidcNonceKey{}).(string)
+	if _, err = idp.verifyIdToken(ctx, OpToken, rawIdToken, nonce, false); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// RefreshToken 使用刷新令牌获取新的访问令牌
+// 响应中包含新的ID令牌时会校验其签名、签发者、受众和有效期，不包含时沿用原ID令牌
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: GetToken返回的OAuth2令牌
+//
+// 返回:
+//   - *oauth2.Token: 新的OAuth2令牌
+//   - error: 错误信息
+func (idp *OidcIdProvider) RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	start := time.Now()
+	newToken, err := idp.refreshToken(ctx, token)
+	idp.finishOperation(ctx, OpRefreshToken, start, err)
+	return newToken, err
+}
+
+// refreshToken 刷新令牌，见RefreshToken
+func (idp *OidcIdProvider) refreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	if _, err := idp.Discover(ctx); err != nil {
+		return nil, err
+	}
+
+	newToken, err := idp.refreshStandardToken(ctx, idp.Client, idp.Config, token)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIdToken, _ := newToken.Extra("id_token").(string)
+	if rawIdToken == "" {
+		// 刷新响应通常不包含ID令牌，沿用原ID令牌供GetUserInfo使用
+		return inheritTokenFields(newToken, token, "id_token"), nil
+	}
+	if _, err = idp.verifyIdToken(ctx, OpRefreshToken, rawIdToken, "", false); err != nil {
+		return nil, err
+	}
+	return newToken, nil
+}
+
+// VerifyIdToken 校验ID令牌的签名、签发者、受众、有效期和nonce
+// 参数:
+//   - ctx: 请求上下文
+//   - rawIdToken: ID令牌
+//   - nonce: 期望的nonce，为空时不校验
+//
+// 返回:
+//   - []byte: ID令牌载荷JSON
+//   - error: 校验失败时返回ErrInvalidToken分类的*ProviderError
+func (idp *OidcIdProvider) VerifyIdToken(ctx context.Context, rawIdToken string, nonce string) ([]byte, error) {
+	if _, err := idp.Discover(ctx); err != nil {
+		return nil, err
+	}
+	return idp.verifyIdToken(ctx, OpToken, rawIdToken, nonce, false)
+}
+
+// verifyIdToken 校验ID令牌
+// 参数:
+//   - ctx: 请求上下文
+//   - op: 操作类型，用于校验失败时的ProviderError
+//   - rawIdToken: ID令牌
+//   - nonce: 期望的nonce，为空时不校验
+//   - skipExpiry: 是否跳过过期时间校验
+//
+// 返回:
+//   - []byte: ID令牌载荷JSON
+//   - error: ID令牌无效时返回ErrInvalidToken分类的*ProviderError，拉取JWKS失败时返回对应错误
+func (idp *OidcIdProvider) verifyIdToken(ctx context.Context, op string, rawIdToken string, nonce string, skipExpiry bool) ([]byte, error) {
+	invalid := func(err error) error {
+		return newProviderErrorf(IDP_OIDC, op, ErrInvalidToken, "%v", err)
+	}
+
+	header, payload, signature, err := parseOidcJwt(rawIdToken)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	switch header.Alg {
+	case "RS256", "ES256", "EdDSA":
+	default:
+		return nil, invalid(fmt.Errorf("不支持的ID令牌签名算法: %s", header.Alg))
+	}
+
+	key, err := idp.keySet.getKey(ctx, idp.fetchJwks, idp.discovery.JwksUri, header.Kid, header.Alg)
+	if errors.Is(err, errOidcKeyNotFound) {
+		return nil, invalid(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signingInput := rawIdToken[:strings.LastIndex(rawIdToken, ".")]
+	if err = verifyOidcSignature(header.Alg, key, signingInput, signature); err != nil {
+		return nil, invalid(err)
+	}
+
+	_, err = verifyOidcClaims(payload, &oidcVerifyOptions{
+		issuer:     idp.discovery.Issuer,
+		clientId:   idp.Config.ClientID,
+		nonce:      nonce,
+		skipExpiry: skipExpiry,
+	})
+	if err != nil {
+		return nil, invalid(err)
+	}
+	return payload, nil
+}
+
+// GetUserInfo 通过访问令牌获取用户信息
+// 参数:
+//   - token: GetToken返回的OAuth2访问令牌
+//
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *OidcIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 通过访问令牌获取用户信息，请求受上下文控制
+// 用户信息由ID令牌声明和用户信息接口返回的声明合并而成，后者优先
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: GetToken返回的OAuth2访问令牌
+//
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *OidcIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *OidcIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	if _, err := idp.Discover(ctx); err != nil {
+		return nil, err
+	}
+
+	// ID令牌已在GetToken时完成完整校验，此处只校验签名等信息，不再校验有效期
+	var idTokenClaims []byte
+	var subject string
+	if rawIdToken, _ := token.Extra("id_token").(string); rawIdToken != "" {
+		payload, err := idp.verifyIdToken(ctx, OpUserInfo, rawIdToken, "", true)
+		if err != nil {
+			return nil, err
+		}
+		idTokenClaims = payload
+
+		var claims struct {
+			Subject string `json:"sub"`
+		}
+		if err = json.Unmarshal(payload, &claims); err != nil {
+			return nil, newProviderErrorf(IDP_OIDC, OpUserInfo, ErrInvalidToken, "ID令牌载荷解析失败: %v", err)
+		}
+		subject = claims.Subject
+	}
+
+	var userInfoClaims []byte
+	if idp.userInfoUrl != "" {
+		req, err := http.NewRequestWithContext(withIdempotent(ctx), "GET", idp.userInfoUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		req.Header.Set("Accept", "application/json")
+		_, data, err := idp.doRequest(idp.Client, req, OpUserInfo, func(resp *http.Response, data []byte) error {
+			if resp.StatusCode != http.StatusOK {
+				return newProviderError(IDP_OIDC, OpUserInfo, resp.StatusCode, "", string(data))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var claims struct {
+			Subject string `json:"sub"`
+		}
+		if err = json.Unmarshal(data, &claims); err != nil {
+			return nil, newProviderErrorf(IDP_OIDC, OpUserInfo, nil, "用户信息解析失败: %v", err)
+		}
+		// 用户信息接口返回的sub必须与ID令牌一致，防止令牌替换攻击
+		if subject != "" && claims.Subject != subject {
+			return nil, newProviderErrorf(IDP_OIDC, OpUserInfo, ErrInvalidToken, "用户信息sub与ID令牌不一致")
+		}
+		userInfoClaims = data
+	}
+
+	if idTokenClaims == nil && userInfoClaims == nil {
+		return nil, newProviderErrorf(IDP_OIDC, OpUserInfo, nil, "令牌中缺少id_token且未配置用户信息接口")
+	}
+
+	userInfo := UserInfo{}
+	if err := idp.completeUserInfo(&userInfo, idTokenClaims, userInfoClaims); err != nil {
+		return nil, err
+	}
+	userInfo.Identity = idp.identity("", IdentityKey{Kind: "sub", Scope: IdentityScopeGlobal, Namespace: idp.Issuer, Value: userInfo.Id})
+
+	return &userInfo, nil
+}
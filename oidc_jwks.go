@@ -0,0 +1,422 @@
+// OpenID Connect ID令牌校验
+// 提供JWKS公钥缓存与轮换，以及RS256、ES256、EdDSA签名的ID令牌校验
+package idp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWKS缓存相关常量
+const (
+	oidcJwksMaxAge          = 24 * time.Hour  // 公钥缓存的最长有效期
+	oidcJwksMinRefreshDelay = time.Minute     // 遇到未知kid时两次刷新公钥的最小间隔，防止被伪造的kid放大请求
+	oidcClockSkew           = 1 * time.Minute // 校验exp、nbf时允许的时钟偏差
+)
+
+// errOidcKeyNotFound JWKS中不存在与ID令牌头部匹配的公钥
+var errOidcKeyNotFound = errors.New("JWKS中不存在匹配的公钥")
+
+// oidcJwk JWKS中的单个公钥
+type oidcJwk struct {
+	Kid string `json:"kid"` // 公钥ID
+	Kty string `json:"kty"` // 密钥类型：RSA、EC、OKP
+	Alg string `json:"alg"` // 签名算法
+	Use string `json:"use"` // 用途，sig表示签名
+	N   string `json:"n"`   // RSA模数
+	E   string `json:"e"`   // RSA公钥指数
+	Crv string `json:"crv"` // 曲线：P-256、Ed25519
+	X   string `json:"x"`   // EC/OKP公钥X坐标
+	Y   string `json:"y"`   // EC公钥Y坐标
+}
+
+// oidcPublicKey 解析后的公钥
+type oidcPublicKey struct {
+	kid string           // 公钥ID
+	alg string           // 签名算法，为空表示未限定
+	key crypto.PublicKey // 公钥
+}
+
+// oidcFetchFunc 拉取JWKS等公开文档的函数，返回响应内容
+type oidcFetchFunc func(ctx context.Context, docUrl string) ([]byte, error)
+
+// oidcKeySet JWKS公钥缓存
+// 缓存过期或遇到未知kid时重新拉取，以支持身份提供方的密钥轮换
+type oidcKeySet struct {
+	lock      sync.Mutex
+	keys      []oidcPublicKey // 已缓存的公钥
+	fetchedAt time.Time       // 最近一次拉取时间
+}
+
+// getKey 获取与ID令牌头部匹配的公钥
+// 参数:
+//   - ctx: 请求上下文
+//   - fetch: 拉取JWKS的函数
+//   - jwksUri: JWKS地址
+//   - kid: ID令牌头部中的公钥ID
+//   - alg: ID令牌头部中的签名算法
+//
+// 返回:
+//   - crypto.PublicKey: 公钥
+//   - error: 错误信息
+func (s *oidcKeySet) getKey(ctx context.Context, fetch oidcFetchFunc, jwksUri string, kid string, alg string) (crypto.PublicKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.keys == nil || time.Since(s.fetchedAt) > oidcJwksMaxAge {
+		if err := s.refresh(ctx, fetch, jwksUri); err != nil {
+			return nil, err
+		}
+	}
+	if key := s.find(kid, alg); key != nil {
+		return key, nil
+	}
+
+	// 未找到对应公钥，可能是身份提供方已轮换密钥
+	if time.Since(s.fetchedAt) >= oidcJwksMinRefreshDelay {
+		if err := s.refresh(ctx, fetch, jwksUri); err != nil {
+			return nil, err
+		}
+		if key := s.find(kid, alg); key != nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: kid=%s, alg=%s", errOidcKeyNotFound, kid, alg)
+}
+
+// find 在缓存中查找公钥，kid为空时返回第一个算法匹配的公钥
+// 参数:
+//   - kid: 公钥ID
+//   - alg: 签名算法
+//
+// 返回:
+//   - crypto.PublicKey: 公钥，未找到时为nil
+func (s *oidcKeySet) find(kid string, alg string) crypto.PublicKey {
+	for _, k := range s.keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		if !oidcKeyMatchesAlg(k.key, alg) {
+			continue
+		}
+		return k.key
+	}
+	return nil
+}
+
+// refresh 重新拉取JWKS并替换缓存
+// 参数:
+//   - ctx: 请求上下文
+//   - fetch: 拉取JWKS的函数
+//   - jwksUri: JWKS地址
+//
+// 返回:
+//   - error: 错误信息
+func (s *oidcKeySet) refresh(ctx context.Context, fetch oidcFetchFunc, jwksUri string) error {
+	data, err := fetch(ctx, jwksUri)
+	if err != nil {
+		return err
+	}
+
+	var jwks struct {
+		Keys []oidcJwk `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		return newProviderErrorf(IDP_OIDC, OpDiscovery, nil, "JWKS解析失败: %v", err)
+	}
+
+	keys := make([]oidcPublicKey, 0, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// 跳过无法解析或不支持的公钥，避免单个异常公钥导致整体不可用
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys = append(keys, oidcPublicKey{kid: jwk.Kid, alg: jwk.Alg, key: key})
+	}
+
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	return nil
+}
+
+// publicKey 将JWK转换为公钥
+// 返回:
+//   - crypto.PublicKey: 公钥
+//   - error: 密钥类型不支持或参数无效时返回错误
+func (jwk *oidcJwk) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("无效的RSA公钥")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("不支持的EC曲线: %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("无效的EC公钥")
+		}
+		return key, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("不支持的OKP曲线: %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("无效的Ed25519公钥")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("不支持的密钥类型: %s", jwk.Kty)
+	}
+}
+
+// oidcKeyMatchesAlg 判断公钥类型是否与签名算法匹配
+// 参数:
+//   - key: 公钥
+//   - alg: 签名算法
+//
+// 返回:
+//   - bool: 是否匹配
+func oidcKeyMatchesAlg(key crypto.PublicKey, alg string) bool {
+	switch alg {
+	case "RS256":
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case "ES256":
+		_, ok := key.(*ecdsa.PublicKey)
+		return ok
+	case "EdDSA":
+		_, ok := key.(ed25519.PublicKey)
+		return ok
+	default:
+		return false
+	}
+}
+
+// oidcJwtHeader ID令牌头部
+type oidcJwtHeader struct {
+	Alg string `json:"alg"` // 签名算法
+	Kid string `json:"kid"` // 公钥ID
+}
+
+// oidcAudience ID令牌的aud声明，可以是字符串或字符串数组
+type oidcAudience []string
+
+// UnmarshalJSON 兼容字符串和字符串数组两种格式
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*a = multi
+	return nil
+}
+
+// contains 判断受众中是否包含指定客户端
+func (a oidcAudience) contains(clientId string) bool {
+	for _, aud := range a {
+		if aud == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcIdTokenClaims ID令牌中需要校验的标准声明
+type oidcIdTokenClaims struct {
+	Issuer          string       `json:"iss"`   // 签发者
+	Subject         string       `json:"sub"`   // 用户标识
+	Audience        oidcAudience `json:"aud"`   // 受众
+	Expiry          json.Number  `json:"exp"`   // 过期时间
+	NotBefore       json.Number  `json:"nbf"`   // 生效时间
+	Nonce           string       `json:"nonce"` // 防重放随机数
+	AuthorizedParty string       `json:"azp"`   // 授权方
+}
+
+// oidcVerifyOptions ID令牌校验参数
+type oidcVerifyOptions struct {
+	issuer     string // 期望的签发者
+	clientId   string // 期望的受众
+	nonce      string // 期望的nonce，为空时不校验
+	skipExpiry bool   // 是否跳过过期时间校验
+}
+
+// parseOidcJwt 拆分并解码JWT
+// 参数:
+//   - rawToken: JWT字符串
+//
+// 返回:
+//   - *oidcJwtHeader: 头部
+//   - []byte: 载荷JSON
+//   - []byte: 签名
+//   - error: 格式无效时返回错误
+func parseOidcJwt(rawToken string) (*oidcJwtHeader, []byte, []byte, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, nil, nil, fmt.Errorf("ID令牌格式无效")
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("ID令牌头部解码失败: %w", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("ID令牌载荷解码失败: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("ID令牌签名解码失败: %w", err)
+	}
+
+	header := &oidcJwtHeader{}
+	if err = json.Unmarshal(headerBytes, header); err != nil {
+		return nil, nil, nil, fmt.Errorf("ID令牌头部解析失败: %w", err)
+	}
+	return header, payload, signature, nil
+}
+
+// verifyOidcSignature 校验JWT签名
+// 参数:
+//   - alg: 签名算法
+//   - key: 公钥
+//   - signingInput: 签名原文，即"头部.载荷"
+//   - signature: 签名
+//
+// 返回:
+//   - error: 签名无效时返回错误
+func verifyOidcSignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	switch alg {
+	case "RS256":
+		hash := sha256.Sum256([]byte(signingInput))
+		if err := rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], signature); err != nil {
+			return fmt.Errorf("ID令牌签名无效")
+		}
+	case "ES256":
+		if len(signature) != 64 {
+			return fmt.Errorf("ID令牌签名无效")
+		}
+		hash := sha256.Sum256([]byte(signingInput))
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key.(*ecdsa.PublicKey), hash[:], r, s) {
+			return fmt.Errorf("ID令牌签名无效")
+		}
+	case "EdDSA":
+		if !ed25519.Verify(key.(ed25519.PublicKey), []byte(signingInput), signature) {
+			return fmt.Errorf("ID令牌签名无效")
+		}
+	default:
+		return fmt.Errorf("不支持的ID令牌签名算法: %s", alg)
+	}
+	return nil
+}
+
+// verifyOidcClaims 校验ID令牌的签发者、受众、有效期和nonce
+// 参数:
+//   - payload: 载荷JSON
+//   - opts: 校验参数
+//
+// 返回:
+//   - *oidcIdTokenClaims: 标准声明
+//   - error: 校验失败时返回错误
+func verifyOidcClaims(payload []byte, opts *oidcVerifyOptions) (*oidcIdTokenClaims, error) {
+	claims := &oidcIdTokenClaims{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(claims); err != nil {
+		return nil, fmt.Errorf("ID令牌载荷解析失败: %w", err)
+	}
+
+	if claims.Issuer != opts.issuer {
+		return nil, fmt.Errorf("ID令牌签发者不匹配: 期望 %s，实际 %s", opts.issuer, claims.Issuer)
+	}
+	if !claims.Audience.contains(opts.clientId) {
+		return nil, fmt.Errorf("ID令牌受众不包含当前客户端: %s", opts.clientId)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != "" && claims.AuthorizedParty != opts.clientId {
+		return nil, fmt.Errorf("ID令牌授权方不匹配: %s", claims.AuthorizedParty)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("ID令牌缺少sub声明")
+	}
+
+	now := time.Now()
+	if !opts.skipExpiry {
+		exp, err := claims.Expiry.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("ID令牌缺少有效的exp声明")
+		}
+		if now.Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+			return nil, fmt.Errorf("ID令牌已过期")
+		}
+	}
+	if claims.NotBefore != "" {
+		nbf, err := claims.NotBefore.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("ID令牌的nbf声明无效")
+		}
+		if now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+			return nil, fmt.Errorf("ID令牌尚未生效")
+		}
+	}
+	if opts.nonce != "" && claims.Nonce != opts.nonce {
+		return nil, fmt.Errorf("ID令牌nonce不匹配")
+	}
+
+	return claims, nil
+}
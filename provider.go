@@ -1,128 +1,219 @@
-// Package idp 第三方身份认证提供者组件库
-// 支持微信、企业微信、支付宝、GitHub等主流平台的OAuth2登录集成
-package idp
-
-import (
-	"fmt"
-	"net/http"
-
-	"golang.org/x/oauth2"
-)
-
-// UserInfo 用户信息结构体
-// 包含从第三方平台获取的用户基本信息
-type UserInfo struct {
-	Id          string            // 用户唯一标识
-	Username    string            // 用户名
-	DisplayName string            // 显示名称
-	UnionId     string            // 联合ID（如微信UnionId）
-	Email       string            // 邮箱地址
-	Phone       string            // 手机号码
-	CountryCode string            // 国家代码
-	AvatarUrl   string            // 头像URL
-	Extra       map[string]string // 扩展信息
-}
-
-// ProviderInfo 第三方登录提供者配置信息
-// 包含OAuth2认证所需的各种配置参数
-type ProviderInfo struct {
-	Type          string            // 提供者类型（如WeChat、GitHub等）
-	SubType       string            // 子类型（如微信公众号、小程序等）
-	ClientId      string            // 客户端ID
-	ClientSecret  string            // 客户端密钥
-	ClientId2     string            // 备用客户端ID
-	ClientSecret2 string            // 备用客户端密钥
-	AppId         string            // 应用ID
-	HostUrl       string            // 主机URL
-	RedirectUrl   string            // 重定向URL
-
-	TokenURL    string            // 获取Token的URL
-	AuthURL     string            // 授权URL
-	UserInfoURL string            // 获取用户信息的URL
-	UserMapping map[string]string // 用户字段映射
-}
-
-// 支持的第三方登录平台常量定义
-const (
-	// 国内平台
-	IDP_WECHAT           string = "WeChat"          // 微信
-	IDP_QQ               string = "QQ"              // QQ
-	IDP_BAIDU            string = "Baidu"           // 百度
-	IDP_ALIPAY           string = "Alipay"          // 支付宝
-	IDP_BILIBILI         string = "Bilibili"        // 哔哩哔哩
-	IDP_DOUYIN           string = "Douyin"          // 抖音
-	IDP_DING_TALK        string = "DingTalk"        // 钉钉
-	IDP_WEIBO            string = "Weibo"           // 微博
-	IDP_WECOM            string = "WeCom"           // 企业微信第三方应用
-	IDP_WECOM_INTERNAL   string = "WeComInternal"   // 企业微信内部应用
-
-	// 国外平台
-	IDP_GITHUB string = "GitHub" // GitHub
-	IDP_GITEE  string = "Gitee"  // 码云
-	IDP_GITLAB string = "GitLab" // GitLab
-)
-
-// IdProvider 第三方身份认证提供者接口
-// 定义了所有第三方登录提供者必须实现的方法
-type IdProvider interface {
-	// SetHttpClient 设置HTTP客户端
-	// 参数:
-	//   - client: HTTP客户端实例
-	SetHttpClient(client *http.Client)
-	
-	// GetToken 通过授权码获取访问令牌
-	// 参数:
-	//   - code: 授权码
-	// 返回:
-	//   - *oauth2.Token: OAuth2访问令牌
-	//   - error: 错误信息
-	GetToken(code string) (*oauth2.Token, error)
-	
-	// GetUserInfo 通过访问令牌获取用户信息
-	// 参数:
-	//   - token: OAuth2访问令牌
-	// 返回:
-	//   - *UserInfo: 用户信息
-	//   - error: 错误信息
-	GetUserInfo(token *oauth2.Token) (*UserInfo, error)
-}
-
-// GetIdProvider 根据提供者信息创建对应的身份认证提供者实例
-// 参数:
-//   - idpInfo: 提供者配置信息
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - IdProvider: 身份认证提供者实例
-//   - error: 错误信息
-func GetIdProvider(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
-	switch idpInfo.Type {
-	case "GitHub":
-		return NewGithubIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "QQ":
-		return NewQqIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "WeChat":
-		return NewWeChatIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "DingTalk":
-		return NewDingTalkIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "Weibo":
-		return NewWeiBoIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "Gitee":
-		return NewGiteeIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "GitLab":
-		return NewGitlabIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "Baidu":
-		return NewBaiduIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "Alipay":
-		return NewAlipayIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "Douyin":
-		return NewDouyinIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "Bilibili":
-		return NewBilibiliIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "WeCom":
-		return NewWeComIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	case "WeComInternal":
-		return NewWeComInternalIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl), nil
-	default:
-		return nil, fmt.Errorf("不支持的登录提供者类型: %s", idpInfo.Type)
-	}
-}
+// Package idp 第三方身份认证提供者组件库
+// 支持微信、企业微信、支付宝、GitHub等主流平台的OAuth2登录集成
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// UserInfo 用户信息结构体
+// 包含从第三方平台获取的用户基本信息
+type UserInfo struct {
+	Id          string            // 用户唯一标识
+	Username    string            // 用户名
+	DisplayName string            // 显示名称
+	UnionId     string            // 联合ID（如微信UnionId）
+	Email       string            // 邮箱地址
+	Phone       string            // 手机号码
+	CountryCode string            // 国家代码
+	AvatarUrl   string            // 头像URL
+	Extra       map[string]string // 扩展信息
+	Provider    string            // 提供者类型（如WeChat、GitHub等）
+	SubType     string            // 提供者子类型，来自ProviderInfo.SubType
+	Identity    *Identity         // 平台返回的所有身份标识及其唯一范围，用于跨应用关联账号，见Identity
+	RawProfiles []json.RawMessage // 第三方平台返回的原始用户数据，需要调用多个接口时按调用顺序排列，见RawValue
+}
+
+// ProviderInfo 第三方登录提供者配置信息
+// 包含OAuth2认证所需的各种配置参数
+type ProviderInfo struct {
+	Type          string // 提供者类型（如WeChat、GitHub等）
+	SubType       string // 子类型（如微信公众号、小程序等）
+	ClientId      string // 客户端ID
+	ClientSecret  string // 客户端密钥
+	ClientId2     string // 备用客户端ID
+	ClientSecret2 string // 备用客户端密钥
+	AppId         string // 应用ID
+	HostUrl       string // 主机URL，替换第三方平台接口的协议和主机（私有化部署、代理或模拟服务）
+	RedirectUrl   string // 重定向URL
+
+	TokenURL    string            // 获取Token的URL，非空时覆盖平台默认地址
+	AuthURL     string            // 授权URL，非空时覆盖平台默认地址
+	UserInfoURL string            // 获取用户信息的URL，非空时覆盖平台默认地址
+	UserMapping map[string]string // 用户字段映射，键为UserInfo字段名，值为映射表达式，见ApplyUserMapping
+
+	Scopes         []string // 授权范围，非空时覆盖平台默认值
+	TokenAuthStyle string   // 令牌接口的客户端认证方式（header、params，为空时自动探测），用于Custom
+	UserInfoMethod string   // 获取用户信息的HTTP方法（GET、POST，默认GET），用于Custom
+}
+
+// 支持的第三方登录平台常量定义
+const (
+	// 国内平台
+	IDP_WECHAT              string = "WeChat"            // 微信
+	IDP_WECHAT_MINI_PROGRAM string = "WeChatMiniProgram" // 微信小程序
+	IDP_QQ                  string = "QQ"                // QQ
+	IDP_BAIDU               string = "Baidu"             // 百度
+	IDP_ALIPAY              string = "Alipay"            // 支付宝
+	IDP_BILIBILI            string = "Bilibili"          // 哔哩哔哩
+	IDP_DOUYIN              string = "Douyin"            // 抖音
+	IDP_DING_TALK           string = "DingTalk"          // 钉钉
+	IDP_WEIBO               string = "Weibo"             // 微博
+	IDP_WECOM               string = "WeCom"             // 企业微信第三方应用
+	IDP_WECOM_INTERNAL      string = "WeComInternal"     // 企业微信内部应用
+
+	// 国外平台
+	IDP_GITHUB string = "GitHub" // GitHub
+	IDP_GITEE  string = "Gitee"  // 码云
+	IDP_GITLAB string = "GitLab" // GitLab
+
+	// 通用协议
+	IDP_CUSTOM string = "Custom" // 通用OAuth2
+	IDP_OIDC   string = "OIDC"   // OpenID Connect
+)
+
+// IdProvider 第三方身份认证提供者接口
+// 定义了所有第三方登录提供者必须实现的方法
+// 上下文控制、生成授权URL和能力描述为可选接口（ContextIdProvider、AuthURLProvider、CapabilitiesProvider），
+// 内置提供者均已实现，调用方通过GetTokenContext、GetAuthURL、GetCapabilities等函数使用
+type IdProvider interface {
+	// SetHttpClient 设置HTTP客户端
+	// 参数:
+	//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+	SetHttpClient(client *http.Client)
+
+	// GetToken 通过授权码获取访问令牌
+	// 参数:
+	//   - code: 授权码
+	// 返回:
+	//   - *oauth2.Token: OAuth2访问令牌
+	//   - error: 错误信息
+	GetToken(code string) (*oauth2.Token, error)
+
+	// GetUserInfo 通过访问令牌获取用户信息
+	// 参数:
+	//   - token: OAuth2访问令牌
+	// 返回:
+	//   - *UserInfo: 用户信息
+	//   - error: 错误信息
+	GetUserInfo(token *oauth2.Token) (*UserInfo, error)
+}
+
+// ContextIdProvider 可选的上下文控制接口
+// 实现该接口的提供者在上下文取消或超时后中止对第三方平台的调用
+type ContextIdProvider interface {
+	// GetTokenContext 通过授权码获取访问令牌，请求受上下文控制
+	// 参数:
+	//   - ctx: 请求上下文，取消或超时后将中止对第三方平台的调用
+	//   - code: 授权码
+	// 返回:
+	//   - *oauth2.Token: OAuth2访问令牌
+	//   - error: 错误信息
+	GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error)
+
+	// GetUserInfoContext 通过访问令牌获取用户信息，请求受上下文控制
+	// 多次调用第三方接口的流程（如钉钉、QQ、微博）均使用同一上下文
+	// 参数:
+	//   - ctx: 请求上下文，取消或超时后将中止对第三方平台的调用
+	//   - token: OAuth2访问令牌
+	// 返回:
+	//   - *UserInfo: 用户信息
+	//   - error: 错误信息
+	GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error)
+}
+
+// GetTokenContext 通过授权码获取访问令牌，请求受上下文控制
+// 提供者未实现ContextIdProvider时，在上下文未结束的情况下调用GetToken
+// 参数:
+//   - ctx: 请求上下文
+//   - provider: 登录提供者
+//   - code: 授权码
+//
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func GetTokenContext(ctx context.Context, provider IdProvider, code string) (*oauth2.Token, error) {
+	if p, ok := provider.(ContextIdProvider); ok {
+		return p.GetTokenContext(ctx, code)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return provider.GetToken(code)
+}
+
+// GetUserInfoContext 通过访问令牌获取用户信息，请求受上下文控制
+// 提供者未实现ContextIdProvider时，在上下文未结束的情况下调用GetUserInfo
+// 参数:
+//   - ctx: 请求上下文
+//   - provider: 登录提供者
+//   - token: OAuth2访问令牌
+//
+// 返回:
+//   - *UserInfo: 用户信息
+//   - error: 错误信息
+func GetUserInfoContext(ctx context.Context, provider IdProvider, token *oauth2.Token) (*UserInfo, error) {
+	if p, ok := provider.(ContextIdProvider); ok {
+		return p.GetUserInfoContext(ctx, token)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return provider.GetUserInfo(token)
+}
+
+// GetIdProvider 根据提供者信息创建对应的身份认证提供者实例
+// 提供者类型需已通过RegisterProvider注册，内置类型在包初始化时自动注册
+// 创建前解析密钥引用（见ResolveSecret），再调用ProviderInfo.Validate校验配置，并校验redirectUrl的格式
+// 参数:
+//   - idpInfo: 提供者配置信息
+//   - redirectUrl: OAuth2重定向URL
+//
+// 返回:
+//   - IdProvider: 身份认证提供者实例
+//   - error: 错误信息
+func GetIdProvider(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+	return GetIdProviderContext(context.Background(), idpInfo, redirectUrl)
+}
+
+// GetIdProviderContext 根据提供者信息创建对应的身份认证提供者实例，支持上下文控制密钥解析
+// 参数:
+//   - ctx: 上下文，传递给SecretResolver
+//   - idpInfo: 提供者配置信息
+//   - redirectUrl: OAuth2重定向URL
+//
+// 返回:
+//   - IdProvider: 身份认证提供者实例
+//   - error: 错误信息
+func GetIdProviderContext(ctx context.Context, idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+	resolved, err := ResolveProviderSecrets(ctx, idpInfo)
+	if err != nil {
+		return nil, err
+	}
+	return newIdProvider(resolved, redirectUrl)
+}
+
+// newIdProvider 使用已解析密钥引用的提供者信息创建提供者实例
+// 参数:
+//   - idpInfo: 已解析密钥引用的提供者配置信息
+//   - redirectUrl: OAuth2重定向URL
+//
+// 返回:
+//   - IdProvider: 身份认证提供者实例
+//   - error: 错误信息
+func newIdProvider(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+	factory, ok := getProviderFactory(idpInfo.Type)
+	if !ok {
+		return nil, fmt.Errorf("不支持的登录提供者类型: %s", idpInfo.Type)
+	}
+	if err := errors.Join(idpInfo.Validate(), validateUrl("redirectUrl", redirectUrl, false)); err != nil {
+		return nil, err
+	}
+	return factory(idpInfo, redirectUrl)
+}
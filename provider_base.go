@@ -0,0 +1,292 @@
+// 登录提供者公共配置
+// 各登录提供者嵌入providerBase以共享接口地址覆盖、用户字段映射等可选配置
+package idp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// providerBase 各登录提供者共用的可选配置
+type providerBase struct {
+	providerType string            // 提供者类型，写入UserInfo.Provider和观察事件
+	subType      string            // 提供者子类型，写入UserInfo.SubType
+	clientId     string            // 应用ID，用于查找客户端限流器
+	hostUrl      string            // 覆盖第三方平台接口的协议和主机，用于私有化部署、出口代理或本地模拟服务
+	userInfoUrl  string            // 覆盖获取用户信息接口的完整地址
+	userMapping  map[string]string // 用户字段映射，见ApplyUserMapping
+	observer     Observer          // 接口调用观察者，为nil时使用默认观察者
+	retryPolicy  *RetryPolicy      // 重试策略，为nil时使用默认重试策略
+}
+
+// responseCheck 检查平台响应，响应表示失败时返回*ProviderError
+type responseCheck func(resp *http.Response, data []byte) error
+
+// applyProviderInfo 应用ProviderInfo中的接口地址覆盖、授权范围和用户字段映射配置
+// HostUrl会替换令牌接口及其他服务端接口的主机，显式配置的AuthURL、TokenURL优先级更高
+// 参数:
+//   - idpInfo: 提供者配置信息
+//   - config: 提供者的OAuth2配置
+//   - hostedAuth: 授权页面是否与接口部署在同一主机（如私有化部署的GitLab），为true时HostUrl同时作用于AuthURL
+func (b *providerBase) applyProviderInfo(idpInfo *ProviderInfo, config *oauth2.Config, hostedAuth bool) {
+	b.subType = idpInfo.SubType
+	b.hostUrl = strings.TrimSuffix(idpInfo.HostUrl, "/")
+	b.userInfoUrl = idpInfo.UserInfoURL
+	b.userMapping = idpInfo.UserMapping
+
+	if hostedAuth && config.Endpoint.AuthURL != "" {
+		config.Endpoint.AuthURL = b.resolveUrl(config.Endpoint.AuthURL)
+	}
+	if config.Endpoint.TokenURL != "" {
+		config.Endpoint.TokenURL = b.resolveUrl(config.Endpoint.TokenURL)
+	}
+	if idpInfo.AuthURL != "" {
+		config.Endpoint.AuthURL = idpInfo.AuthURL
+	}
+	if idpInfo.TokenURL != "" {
+		config.Endpoint.TokenURL = idpInfo.TokenURL
+	}
+	if len(idpInfo.Scopes) > 0 {
+		config.Scopes = idpInfo.Scopes
+	}
+}
+
+// resolveUrl 使用HostUrl替换平台默认接口地址的协议和主机，保留路径和查询参数
+// 参数:
+//   - defaultUrl: 平台默认接口地址
+//
+// 返回:
+//   - string: 实际请求的接口地址
+func (b *providerBase) resolveUrl(defaultUrl string) string {
+	if b.hostUrl == "" {
+		return defaultUrl
+	}
+
+	u, err := url.Parse(defaultUrl)
+	if err != nil {
+		return defaultUrl
+	}
+	resolved := b.hostUrl + u.EscapedPath()
+	if u.RawQuery != "" {
+		resolved += "?" + u.RawQuery
+	}
+	return resolved
+}
+
+// resolveUserInfoUrl 获取用户信息接口地址，优先使用UserInfoURL覆盖配置
+// 参数:
+//   - defaultUrl: 平台默认的用户信息接口地址
+//
+// 返回:
+//   - string: 实际请求的用户信息接口地址
+func (b *providerBase) resolveUserInfoUrl(defaultUrl string) string {
+	if b.userInfoUrl != "" {
+		return b.userInfoUrl
+	}
+	return b.resolveUrl(defaultUrl)
+}
+
+// SetObserver 设置接口调用观察者，优先于SetDefaultObserver设置的默认观察者
+// 参数:
+//   - observer: 观察者，为nil时使用默认观察者
+func (b *providerBase) SetObserver(observer Observer) {
+	b.observer = observer
+}
+
+// SetRetryPolicy 设置重试策略，优先于SetDefaultRetryPolicy设置的默认策略
+// 参数:
+//   - policy: 重试策略，为nil时使用默认策略
+func (b *providerBase) SetRetryPolicy(policy *RetryPolicy) {
+	b.retryPolicy = policy
+}
+
+// currentObserver 获取提供者当前使用的观察者
+// 返回:
+//   - Observer: 单独设置的观察者，未设置时为默认观察者，均未设置时为nil
+func (b *providerBase) currentObserver() Observer {
+	if b.observer != nil {
+		return b.observer
+	}
+	return getDefaultObserver()
+}
+
+// finishOperation 登录操作结束后通知实现了OperationObserver的观察者
+// 参数:
+//   - ctx: 请求上下文
+//   - op: 操作类型，如token、refreshToken、userinfo
+//   - start: 操作开始时间
+//   - err: 操作结果
+func (b *providerBase) finishOperation(ctx context.Context, op string, start time.Time, err error) {
+	observer, ok := b.currentObserver().(OperationObserver)
+	if !ok {
+		return
+	}
+	observer.OnOperation(ctx, &OperationEvent{
+		Provider: b.providerType,
+		SubType:  b.subType,
+		Op:       op,
+		Latency:  time.Since(start),
+		Err:      err,
+	})
+}
+
+// startCall 开始观察一次接口调用
+// 参数:
+//   - ctx: 请求上下文
+//   - endpoint: 接口名称
+//   - method: HTTP方法
+//   - rawUrl: 请求地址
+//
+// 返回:
+//   - *callObservation: 观察记录，调用结束后调用finish
+func (b *providerBase) startCall(ctx context.Context, endpoint string, method string, rawUrl string) *callObservation {
+	return startCall(ctx, b.currentObserver(), RequestEvent{
+		Provider: b.providerType,
+		SubType:  b.subType,
+		Endpoint: endpoint,
+		Method:   method,
+		Url:      rawUrl,
+	})
+}
+
+// doRequest 发送请求并读取响应内容，调用过程通知观察者
+// 请求上下文经withIdempotent标记时按重试策略重试临时错误
+// 参数:
+//   - client: HTTP客户端
+//   - req: HTTP请求，请求上下文同时作为观察事件的上下文
+//   - endpoint: 接口名称，如token、userinfo
+//   - check: 平台响应检查，可为nil
+//
+// 返回:
+//   - *http.Response: HTTP响应，响应体已读取并关闭
+//   - []byte: 响应内容
+//   - error: 网络错误或check返回的错误
+func (b *providerBase) doRequest(client *http.Client, req *http.Request, endpoint string, check responseCheck) (*http.Response, []byte, error) {
+	start := func() *callObservation {
+		return b.startCall(req.Context(), endpoint, req.Method, req.URL.String())
+	}
+	limiter := getRateLimiter(b.providerType, b.clientId)
+	if !isIdempotent(req) {
+		return doObservedRequest(client, req, limiter, start(), check)
+	}
+
+	policy := b.retryPolicy
+	if policy == nil {
+		policy = getDefaultRetryPolicy()
+	}
+	return doRetryableRequest(client, req, policy, limiter, start, check)
+}
+
+// doObservedRequest 发送请求并读取响应内容，结束后通知观察记录
+// 平台返回频率超限错误时从Retry-After响应头读取建议的等待时间
+// 参数:
+//   - client: HTTP客户端
+//   - req: HTTP请求
+//   - limiter: 客户端限流器，可为nil
+//   - call: 已开始的观察记录
+//   - check: 平台响应检查，可为nil
+//
+// 返回:
+//   - *http.Response: HTTP响应，响应体已读取并关闭
+//   - []byte: 响应内容
+//   - error: 网络错误、客户端限流或check返回的错误
+func doObservedRequest(client *http.Client, req *http.Request, limiter *RateLimiter, call *callObservation, check responseCheck) (*http.Response, []byte, error) {
+	if err := call.waitRateLimit(limiter); err != nil {
+		call.finish(0, err)
+		return nil, nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		call.finish(0, err)
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err == nil && check != nil {
+		err = check(resp, data)
+	}
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) && providerErr.Err == ErrRateLimited && providerErr.RetryAfter == 0 {
+		providerErr.RetryAfter = parseRetryAfter(resp.Header)
+	}
+	call.finish(resp.StatusCode, err)
+	if err != nil {
+		return resp, nil, err
+	}
+	return resp, data, nil
+}
+
+// observeToken 观察通过golang.org/x/oauth2调用的令牌接口，并将错误转换为ProviderError
+// 参数:
+//   - ctx: 请求上下文
+//   - op: 操作类型，同时作为接口名称
+//   - tokenUrl: 令牌接口地址
+//   - fetch: 调用令牌接口的函数
+//
+// 返回:
+//   - *oauth2.Token: OAuth2令牌
+//   - error: 错误信息
+func (b *providerBase) observeToken(ctx context.Context, op string, tokenUrl string, fetch func() (*oauth2.Token, error)) (*oauth2.Token, error) {
+	call := b.startCall(ctx, op, http.MethodPost, tokenUrl)
+	if err := call.waitRateLimit(getRateLimiter(b.providerType, b.clientId)); err != nil {
+		call.finish(0, err)
+		return nil, err
+	}
+	token, err := fetch()
+	if err != nil {
+		err = wrapOAuth2Error(b.providerType, op, err)
+		call.finish(0, err)
+		return nil, err
+	}
+	call.finish(http.StatusOK, nil)
+	return token, nil
+}
+
+// checkToken 检查从平台响应中解析出的令牌，平台返回成功但响应中缺少访问令牌时返回错误
+// 参数:
+//   - op: 操作类型
+//   - token: 解析出的令牌
+//
+// 返回:
+//   - *oauth2.Token: 令牌
+//   - error: 缺少访问令牌时返回*ProviderError
+func (b *providerBase) checkToken(op string, token *oauth2.Token) (*oauth2.Token, error) {
+	if token.AccessToken == "" {
+		return nil, newProviderErrorf(b.providerType, op, nil, "令牌响应中缺少访问令牌")
+	}
+	return token, nil
+}
+
+// completeUserInfo 记录提供者类型和原始用户数据，并应用配置的用户字段映射
+// 参数:
+//   - userInfo: 提供者解析出的用户信息
+//   - raws: 第三方平台返回的原始JSON对象，按接口调用顺序排列
+//
+// 返回:
+//   - error: 错误信息，映射后用户ID仍为空时返回*ProviderError
+func (b *providerBase) completeUserInfo(userInfo *UserInfo, raws ...[]byte) error {
+	userInfo.Provider = b.providerType
+	userInfo.SubType = b.subType
+	for _, raw := range raws {
+		if len(raw) > 0 {
+			userInfo.RawProfiles = append(userInfo.RawProfiles, raw)
+		}
+	}
+	if err := ApplyUserMapping(userInfo, b.userMapping, raws...); err != nil {
+		return err
+	}
+	// 平台返回成功但响应中缺少用户标识时，不能返回无法关联账号的用户信息
+	if userInfo.Id == "" {
+		return newProviderErrorf(b.providerType, OpUserInfo, nil, "用户信息中缺少用户ID，请检查平台响应或UserMapping中的id映射")
+	}
+	return nil
+}
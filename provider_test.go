@@ -0,0 +1,230 @@
+package idp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/smart-unicom/idp"
+	"github.com/smart-unicom/idp/idptest"
+)
+
+// errorCase 平台错误响应与错误分类的对应关系
+type errorCase struct {
+	name   string // 用例名称
+	op     string // 注入错误的操作：idp.OpToken或idp.OpUserInfo，企业微信在获取用户信息时才使用授权码
+	path   string // 返回错误的接口路径
+	status int    // HTTP状态码
+	body   string // 平台错误响应
+	want   error  // 期望的错误分类
+}
+
+// platformCase 单个平台的测试用例
+type platformCase struct {
+	typ    string      // 提供者类型
+	errors []errorCase // 错误响应用例
+
+	// genericCodeError 平台对无效授权码返回通用错误码（如哔哩哔哩的-400），重复使用授权码时只校验为*ProviderError
+	genericCodeError bool
+}
+
+// platformCases 各平台的错误响应用例，响应格式与idptest模拟服务及真实平台一致
+var platformCases = []platformCase{
+	{typ: idp.IDP_WECHAT, errors: []errorCase{
+		{"CodeUsed", idp.OpToken, "/sns/oauth2/access_token", http.StatusOK, `{"errcode":40163,"errmsg":"code been used"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidCode", idp.OpToken, "/sns/oauth2/access_token", http.StatusOK, `{"errcode":40029,"errmsg":"invalid code"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidSecret", idp.OpToken, "/sns/oauth2/access_token", http.StatusOK, `{"errcode":40125,"errmsg":"invalid appsecret"}`, idp.ErrInvalidCredentials},
+		{"RateLimited", idp.OpToken, "/sns/oauth2/access_token", http.StatusOK, `{"errcode":45011,"errmsg":"api minute-quota reach limit"}`, idp.ErrRateLimited},
+		{"InvalidToken", idp.OpUserInfo, "/sns/userinfo", http.StatusOK, `{"errcode":40014,"errmsg":"invalid access_token"}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_WECHAT_MINI_PROGRAM, errors: []errorCase{
+		{"CodeUsed", idp.OpToken, "/sns/jscode2session", http.StatusOK, `{"errcode":40163,"errmsg":"code been used"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidSecret", idp.OpToken, "/sns/jscode2session", http.StatusOK, `{"errcode":40125,"errmsg":"invalid appsecret"}`, idp.ErrInvalidCredentials},
+		{"RateLimited", idp.OpToken, "/sns/jscode2session", http.StatusOK, `{"errcode":45011,"errmsg":"api minute-quota reach limit"}`, idp.ErrRateLimited},
+	}},
+	{typ: idp.IDP_WECOM, errors: []errorCase{
+		{"InvalidSecret", idp.OpToken, "/cgi-bin/service/get_provider_token", http.StatusOK, `{"errcode":40091,"errmsg":"provider_secret is invalid"}`, idp.ErrInvalidCredentials},
+		{"InvalidCode", idp.OpUserInfo, "/cgi-bin/service/get_login_info", http.StatusOK, `{"errcode":40029,"errmsg":"invalid code"}`, idp.ErrCodeExpiredOrUsed},
+		{"RateLimited", idp.OpUserInfo, "/cgi-bin/service/get_login_info", http.StatusOK, `{"errcode":45009,"errmsg":"api freq out of limit"}`, idp.ErrRateLimited},
+	}},
+	{typ: idp.IDP_WECOM_INTERNAL, errors: []errorCase{
+		{"InvalidSecret", idp.OpToken, "/cgi-bin/gettoken", http.StatusOK, `{"errcode":40001,"errmsg":"invalid credential"}`, idp.ErrInvalidCredentials},
+		{"InvalidCode", idp.OpUserInfo, "/cgi-bin/user/getuserinfo", http.StatusOK, `{"errcode":40029,"errmsg":"invalid code"}`, idp.ErrCodeExpiredOrUsed},
+		{"NotCorpMember", idp.OpUserInfo, "/cgi-bin/user/get", http.StatusOK, `{"errcode":60111,"errmsg":"userid not found"}`, idp.ErrNotCorpMember},
+		{"InvalidToken", idp.OpUserInfo, "/cgi-bin/user/get", http.StatusOK, `{"errcode":42001,"errmsg":"access_token expired"}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_DING_TALK, errors: []errorCase{
+		{"InvalidCode", idp.OpToken, "/v1.0/oauth2/userAccessToken", http.StatusBadRequest, `{"code":"invalidAuthCode","message":"不合法的临时授权码"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidSecret", idp.OpToken, "/v1.0/oauth2/userAccessToken", http.StatusBadRequest, `{"code":"invalidClientSecret","message":"无效的clientSecret"}`, idp.ErrInvalidCredentials},
+		{"RateLimited", idp.OpToken, "/v1.0/oauth2/userAccessToken", http.StatusForbidden, `{"code":"Forbidden.AccessDenied.QpsLimitForApi","message":"请求频率超限"}`, idp.ErrRateLimited},
+		{"InvalidToken", idp.OpUserInfo, "/v1.0/contact/users/me", http.StatusUnauthorized, `{"code":"InvalidAuthentication","message":"不合法的access_token"}`, idp.ErrInvalidToken},
+		{"NotCorpMember", idp.OpUserInfo, "/topapi/user/getbyunionid", http.StatusOK, `{"errcode":60121,"errmsg":"找不到该用户"}`, idp.ErrNotCorpMember},
+	}},
+	{typ: idp.IDP_ALIPAY, errors: []errorCase{
+		{"InvalidCode", idp.OpToken, "/gateway.do", http.StatusOK, `{"error_response":{"code":"40002","msg":"Invalid Arguments","sub_code":"isv.code-invalid","sub_msg":"授权码code无效"}}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidAppId", idp.OpToken, "/gateway.do", http.StatusOK, `{"error_response":{"code":"40002","msg":"Invalid Arguments","sub_code":"isv.invalid-app-id","sub_msg":"无效的AppID参数"}}`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/gateway.do", http.StatusOK, `{"error_response":{"code":"20001","msg":"Insufficient Token Permissions","sub_code":"aop.invalid-auth-token","sub_msg":"无效的访问令牌"}}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_QQ, errors: []errorCase{
+		{"CodeUsed", idp.OpToken, "/oauth2.0/token", http.StatusOK, `callback( {"error":100020,"error_description":"code is reused error"} );`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidSecret", idp.OpToken, "/oauth2.0/token", http.StatusOK, `callback( {"error":100009,"error_description":"client secret is illegal"} );`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/user/get_user_info", http.StatusOK, `{"ret":100016,"msg":"access token check failed"}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_WEIBO, errors: []errorCase{
+		{"InvalidCode", idp.OpToken, "/oauth2/access_token", http.StatusBadRequest, `{"error":"invalid_grant","error_code":21325,"request":"/oauth2/access_token"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidClient", idp.OpToken, "/oauth2/access_token", http.StatusBadRequest, `{"error":"invalid_client","error_code":21324,"request":"/oauth2/access_token"}`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/2/users/show.json", http.StatusBadRequest, `{"error":"invalid_access_token","error_code":21332,"request":"/2/users/show.json"}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_DOUYIN, errors: []errorCase{
+		{"CodeExpired", idp.OpToken, "/oauth/access_token", http.StatusOK, `{"data":{"description":"授权码过期","error_code":10007},"message":"error"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidSecret", idp.OpToken, "/oauth/access_token", http.StatusOK, `{"data":{"description":"client_key或client_secret错误","error_code":10013},"message":"error"}`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/oauth/userinfo/", http.StatusOK, `{"data":{"description":"access_token过期","error_code":2190008},"message":"error"}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_BILIBILI, genericCodeError: true, errors: []errorCase{
+		{"RateLimited", idp.OpToken, "/x/account-oauth2/v1/token", http.StatusTooManyRequests, `{"code":-509,"message":"请求过于频繁","ttl":1}`, idp.ErrRateLimited},
+		{"InvalidToken", idp.OpUserInfo, "/arcopen/fn/user/account/info", http.StatusUnauthorized, `{"code":-101,"message":"账号未登录","ttl":1}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_BAIDU, errors: []errorCase{
+		{"InvalidCode", idp.OpToken, "/oauth/2.0/token", http.StatusBadRequest, `{"error":"invalid_grant","error_description":"Invalid authorization code"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidClient", idp.OpToken, "/oauth/2.0/token", http.StatusUnauthorized, `{"error":"invalid_client","error_description":"unknown client id"}`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/rest/2.0/passport/users/getInfo", http.StatusOK, `{"error_code":110,"error_msg":"Access token invalid or no longer valid"}`, idp.ErrInvalidToken},
+		{"RateLimited", idp.OpUserInfo, "/rest/2.0/passport/users/getInfo", http.StatusOK, `{"error_code":18,"error_msg":"Open api qps request limit reached"}`, idp.ErrRateLimited},
+	}},
+	{typ: idp.IDP_GITEE, errors: []errorCase{
+		{"InvalidCode", idp.OpToken, "/oauth/token", http.StatusBadRequest, `{"error":"invalid_grant","error_description":"授权方式无效"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidClient", idp.OpToken, "/oauth/token", http.StatusUnauthorized, `{"error":"invalid_client","error_description":"客户端认证失败"}`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/api/v5/user", http.StatusUnauthorized, `{"message":"401 Unauthorized: Access token does not exist"}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_GITHUB, errors: []errorCase{
+		{"InvalidCode", idp.OpToken, "/login/oauth/access_token", http.StatusOK, `{"error":"bad_verification_code","error_description":"The code passed is incorrect or expired."}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidClient", idp.OpToken, "/login/oauth/access_token", http.StatusOK, `{"error":"incorrect_client_credentials","error_description":"The client_id and/or client_secret passed are incorrect."}`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/api/v3/user", http.StatusUnauthorized, `{"message":"Bad credentials"}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_GITLAB, errors: []errorCase{
+		{"InvalidCode", idp.OpToken, "/oauth/token", http.StatusBadRequest, `{"error":"invalid_grant","error_description":"The provided authorization grant is invalid"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidClient", idp.OpToken, "/oauth/token", http.StatusUnauthorized, `{"error":"invalid_client","error_description":"Client authentication failed"}`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/api/v4/user", http.StatusUnauthorized, `{"message":"401 Unauthorized"}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_CUSTOM, errors: []errorCase{
+		{"InvalidCode", idp.OpToken, "/oauth/token", http.StatusBadRequest, `{"error":"invalid_grant","error_description":"invalid code"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidClient", idp.OpToken, "/oauth/token", http.StatusUnauthorized, `{"error":"invalid_client","error_description":"Client authentication failed"}`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/oauth/userinfo", http.StatusUnauthorized, `{"error":"invalid_token","error_description":"expired"}`, idp.ErrInvalidToken},
+	}},
+	{typ: idp.IDP_OIDC, errors: []errorCase{
+		{"InvalidCode", idp.OpToken, "/oauth2/token", http.StatusBadRequest, `{"error":"invalid_grant","error_description":"invalid code"}`, idp.ErrCodeExpiredOrUsed},
+		{"InvalidClient", idp.OpToken, "/oauth2/token", http.StatusUnauthorized, `{"error":"invalid_client","error_description":"Client authentication failed"}`, idp.ErrInvalidCredentials},
+		{"InvalidToken", idp.OpUserInfo, "/oauth2/userinfo", http.StatusUnauthorized, `{"error":"invalid_token","error_description":"expired"}`, idp.ErrInvalidToken},
+	}},
+}
+
+// testUser 测试使用的用户，包含企业成员身份以覆盖钉钉和企业微信的完整流程
+var testUser = &idptest.User{
+	Id:         "idptest_user",
+	UnionId:    "idptest_union",
+	CorpId:     "idptest_corp",
+	CorpUserId: "idptest_corp_user",
+	Name:       "测试用户",
+	Email:      "user@example.com",
+}
+
+// newTestProvider 启动平台模拟服务并创建不重试的提供者
+// 参数:
+//   - t: 测试对象
+//   - typ: 提供者类型
+//
+// 返回:
+//   - *idptest.Server: 模拟服务
+//   - idp.IdProvider: 指向模拟服务的提供者
+func newTestProvider(t *testing.T, typ string) (*idptest.Server, idp.IdProvider) {
+	server := idptest.NewServer(t, typ)
+	provider := server.Provider("https://example.com/callback")
+	idp.SetProviderRetryPolicy(provider, &idp.RetryPolicy{MaxAttempts: 1})
+	return server, provider
+}
+
+// login 使用授权码换取令牌并获取用户信息
+// 参数:
+//   - ctx: 请求上下文
+//   - provider: 登录提供者
+//   - code: 授权码
+//
+// 返回:
+//   - *idp.UserInfo: 用户信息
+//   - error: 任一步骤的错误
+func login(ctx context.Context, provider idp.IdProvider, code string) (*idp.UserInfo, error) {
+	token, err := idp.GetTokenContext(ctx, provider, code)
+	if err != nil {
+		return nil, err
+	}
+	return idp.GetUserInfoContext(ctx, provider, token)
+}
+
+// TestProviderLogin 各平台使用授权码换取令牌并获取用户信息，授权码只能使用一次
+func TestProviderLogin(t *testing.T) {
+	for _, pc := range platformCases {
+		t.Run(pc.typ, func(t *testing.T) {
+			server, provider := newTestProvider(t, pc.typ)
+			ctx := context.Background()
+			code := server.IssueCode(testUser)
+
+			userInfo, err := login(ctx, provider, code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userInfo.Id == "" {
+				t.Errorf("UserInfo.Id为空")
+			}
+			if userInfo.Provider != pc.typ {
+				t.Errorf("UserInfo.Provider = %q, want %q", userInfo.Provider, pc.typ)
+			}
+
+			_, err = login(ctx, provider, code)
+			var providerErr *idp.ProviderError
+			switch {
+			case !errors.As(err, &providerErr):
+				t.Errorf("重复使用授权码: err = %v, want *idp.ProviderError", err)
+			case !pc.genericCodeError && !errors.Is(err, idp.ErrCodeExpiredOrUsed):
+				t.Errorf("重复使用授权码: err = %v, want ErrCodeExpiredOrUsed", err)
+			}
+		})
+	}
+}
+
+// TestProviderErrors 各平台的错误响应转换为对应错误分类的*ProviderError
+func TestProviderErrors(t *testing.T) {
+	for _, pc := range platformCases {
+		for _, ec := range pc.errors {
+			t.Run(pc.typ+"/"+ec.name, func(t *testing.T) {
+				server, provider := newTestProvider(t, pc.typ)
+				ctx := context.Background()
+
+				var err error
+				if ec.op == idp.OpToken {
+					// 百度、通用OAuth2和OIDC通过oauth2库换取令牌，自动探测认证方式时失败后会换一种方式再请求一次
+					server.FailNext(ec.path, ec.status, ec.body)
+					server.FailNext(ec.path, ec.status, ec.body)
+					_, err = idp.GetTokenContext(ctx, provider, server.IssueCode(testUser))
+				} else {
+					token, tokenErr := idp.GetTokenContext(ctx, provider, server.IssueCode(testUser))
+					if tokenErr != nil {
+						t.Fatalf("GetTokenContext: %v", tokenErr)
+					}
+					server.FailNext(ec.path, ec.status, ec.body)
+					_, err = idp.GetUserInfoContext(ctx, provider, token)
+				}
+
+				if !errors.Is(err, ec.want) {
+					t.Fatalf("err = %v, want %v", err, ec.want)
+				}
+				var providerErr *idp.ProviderError
+				if !errors.As(err, &providerErr) {
+					t.Fatalf("err = %T, want *idp.ProviderError", err)
+				}
+				if providerErr.Provider != pc.typ {
+					t.Errorf("ProviderError.Provider = %q, want %q", providerErr.Provider, pc.typ)
+				}
+			})
+		}
+	}
+}
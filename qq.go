@@ -1,185 +1,294 @@
-// QQ OAuth2登录提供者实现
-// 支持QQ网页登录和用户信息获取
-package idp
-
-import (
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"regexp"
-
-	"golang.org/x/oauth2"
-)
-
-// QqIdProvider QQ登录提供者
-// 实现QQ OAuth2登录功能
-type QqIdProvider struct {
-	Client *http.Client    // HTTP客户端
-	Config *oauth2.Config // OAuth2配置
-}
-
-// NewQqIdProvider 创建QQ登录提供者实例
-// 参数:
-//   - clientId: QQ应用的AppId
-//   - clientSecret: QQ应用的AppKey
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *QqIdProvider: QQ登录提供者实例
-func NewQqIdProvider(clientId string, clientSecret string, redirectUrl string) *QqIdProvider {
-	idp := &QqIdProvider{}
-
-	config := idp.getConfig()
-	config.ClientID = clientId
-	config.ClientSecret = clientSecret
-	config.RedirectURL = redirectUrl
-	idp.Config = config
-
-	return idp
-}
-
-// SetHttpClient 设置HTTP客户端
-// 参数:
-//   - client: HTTP客户端实例
-func (idp *QqIdProvider) SetHttpClient(client *http.Client) {
-	idp.Client = client
-}
-
-// getConfig 获取QQ OAuth2配置
-// 返回:
-//   - *oauth2.Config: OAuth2配置实例
-func (idp *QqIdProvider) getConfig() *oauth2.Config {
-	endpoint := oauth2.Endpoint{
-		TokenURL: "https://graph.qq.com/oauth2.0/token",
-	}
-
-	config := &oauth2.Config{
-		Scopes:   []string{"get_user_info"},
-		Endpoint: endpoint,
-	}
-
-	return config
-}
-
-// GetToken 通过授权码获取QQ访问令牌
-// 参数:
-//   - code: QQ返回的授权码
-// 返回:
-//   - *oauth2.Token: OAuth2访问令牌
-//   - error: 错误信息
-func (idp *QqIdProvider) GetToken(code string) (*oauth2.Token, error) {
-	params := url.Values{}
-	params.Add("grant_type", "authorization_code")
-	params.Add("client_id", idp.Config.ClientID)
-	params.Add("client_secret", idp.Config.ClientSecret)
-	params.Add("code", code)
-	params.Add("redirect_uri", idp.Config.RedirectURL)
-
-	accessTokenUrl := fmt.Sprintf("https://graph.qq.com/oauth2.0/token?%s", params.Encode())
-	resp, err := idp.Client.Get(accessTokenUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-	tokenContent, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	re := regexp.MustCompile("token=(.*?)&")
-	matched := re.FindAllStringSubmatch(string(tokenContent), -1)
-	accessToken := matched[0][1]
-	token := &oauth2.Token{
-		AccessToken: accessToken,
-		TokenType:   "Bearer",
-	}
-	return token, nil
-}
-
-// QqUserInfo QQ用户信息结构体
-type QqUserInfo struct {
-	Ret             int    `json:"ret"`               // 返回码
-	Msg             string `json:"msg"`               // 返回信息
-	IsLost          int    `json:"is_lost"`           // 是否丢失
-	Nickname        string `json:"nickname"`          // 用户昵称
-	Gender          string `json:"gender"`            // 性别
-	GenderType      int    `json:"gender_type"`       // 性别类型
-	Province        string `json:"province"`          // 省份
-	City            string `json:"city"`              // 城市
-	Year            string `json:"year"`              // 出生年份
-	Constellation   string `json:"constellation"`     // 星座
-	Figureurl       string `json:"figureurl"`         // 头像URL
-	Figureurl1      string `json:"figureurl_1"`       // 头像URL1
-	Figureurl2      string `json:"figureurl_2"`       // 头像URL2
-	FigureurlQq1    string `json:"figureurl_qq_1"`    // QQ头像URL1
-	FigureurlQq2    string `json:"figureurl_qq_2"`    // QQ头像URL2
-	FigureurlQq     string `json:"figureurl_qq"`      // QQ头像URL
-	FigureurlType   string `json:"figureurl_type"`    // 头像类型
-	IsYellowVip     string `json:"is_yellow_vip"`     // 是否黄钻用户
-	Vip             string `json:"vip"`               // 是否VIP用户
-	YellowVipLevel  string `json:"yellow_vip_level"`  // 黄钻等级
-	Level           string `json:"level"`             // 用户等级
-	IsYellowYearVip string `json:"is_yellow_year_vip"` // 是否年费黄钻用户
-}
-
-// GetUserInfo 通过访问令牌获取QQ用户信息
-// 参数:
-//   - token: OAuth2访问令牌
-// 返回:
-//   - *UserInfo: 标准化用户信息
-//   - error: 错误信息
-func (idp *QqIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
-	openIdUrl := fmt.Sprintf("https://graph.qq.com/oauth2.0/me?access_token=%s", token.AccessToken)
-	resp, err := idp.Client.Get(openIdUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-	openIdBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	re := regexp.MustCompile("\"openid\":\"(.*?)\"}")
-	matched := re.FindAllStringSubmatch(string(openIdBody), -1)
-	openId := matched[0][1]
-	if openId == "" {
-		return nil, errors.New("openId is empty")
-	}
-
-	userInfoUrl := fmt.Sprintf(
-		"https://graph.qq.com/user/get_user_info?access_token=%s&oauth_consumer_key=%s&openid=%s",
-		token.AccessToken, idp.Config.ClientID, openId)
-	resp, err = idp.Client.Get(userInfoUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-	userInfoBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var qqUserInfo QqUserInfo
-	err = json.Unmarshal(userInfoBody, &qqUserInfo)
-	if err != nil {
-		return nil, err
-	}
-
-	if qqUserInfo.Ret != 0 {
-		return nil, fmt.Errorf("ret expected 0, got %d", qqUserInfo.Ret)
-	}
-
-	userInfo := UserInfo{
-		Id:          openId,
-		Username:    qqUserInfo.Nickname,
-		DisplayName: qqUserInfo.Nickname,
-		AvatarUrl:   qqUserInfo.FigureurlQq1,
-	}
-	return &userInfo, nil
-}
+// QQ OAuth2登录提供者实现
+// 支持QQ网页登录和用户信息获取
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// QqIdProvider QQ登录提供者
+// 实现QQ OAuth2登录功能
+type QqIdProvider struct {
+	providerBase
+
+	Client *http.Client    // HTTP客户端
+	Config *oauth2.Config // OAuth2配置
+}
+
+func init() {
+	RegisterProvider(IDP_QQ, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		idp := NewQqIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl)
+		idp.applyProviderInfo(idpInfo, idp.Config, false)
+		return idp, nil
+	})
+	RegisterProviderValidator(IDP_QQ, requireClientSecret)
+}
+
+// NewQqIdProvider 创建QQ登录提供者实例
+// 参数:
+//   - clientId: QQ应用的AppId
+//   - clientSecret: QQ应用的AppKey
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *QqIdProvider: QQ登录提供者实例
+func NewQqIdProvider(clientId string, clientSecret string, redirectUrl string) *QqIdProvider {
+	idp := &QqIdProvider{Client: DefaultHttpClient(), providerBase: providerBase{providerType: IDP_QQ, clientId: clientId}}
+
+	config := idp.getConfig()
+	config.ClientID = clientId
+	config.ClientSecret = clientSecret
+	config.RedirectURL = redirectUrl
+	idp.Config = config
+
+	return idp
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *QqIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// getConfig 获取QQ OAuth2配置
+// 返回:
+//   - *oauth2.Config: OAuth2配置实例
+func (idp *QqIdProvider) getConfig() *oauth2.Config {
+	endpoint := oauth2.Endpoint{
+		AuthURL:  "https://graph.qq.com/oauth2.0/authorize",
+		TokenURL: "https://graph.qq.com/oauth2.0/token",
+	}
+
+	config := &oauth2.Config{
+		Scopes:   []string{"get_user_info"},
+		Endpoint: endpoint,
+	}
+
+	return config
+}
+
+// GetAuthURL 生成QQ授权跳转URL
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+// 返回:
+//   - string: 授权URL
+func (idp *QqIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	return standardAuthURL(idp.Config, state, opts, false)
+}
+
+// Capabilities 获取QQ登录的能力描述
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *QqIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		QRCodeLogin: true,
+	})
+}
+
+// GetToken 通过授权码获取QQ访问令牌
+// 参数:
+//   - code: QQ返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *QqIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取QQ访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - code: QQ返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *QqIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *QqIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	params := url.Values{}
+	params.Add("grant_type", "authorization_code")
+	params.Add("client_id", idp.Config.ClientID)
+	params.Add("client_secret", idp.Config.ClientSecret)
+	params.Add("code", code)
+	params.Add("redirect_uri", tokenRedirectUrl(ctx, idp.Config))
+
+	accessTokenUrl := fmt.Sprintf("%s?%s", idp.Config.Endpoint.TokenURL, params.Encode())
+	tokenContent, err := idp.getUrlResp(ctx, OpToken, accessTokenUrl, qqCheck(OpToken))
+	if err != nil {
+		return nil, err
+	}
+
+	re := regexp.MustCompile("token=(.*?)&")
+	matched := re.FindAllStringSubmatch(string(tokenContent), -1)
+	if len(matched) == 0 {
+		return nil, newProviderErrorf(IDP_QQ, OpToken, nil, "unexpected token response: %s", string(tokenContent))
+	}
+	accessToken := matched[0][1]
+	token := &oauth2.Token{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+	}
+	return idp.checkToken(OpToken, token)
+}
+
+// QqUserInfo QQ用户信息结构体
+type QqUserInfo struct {
+	Ret             int    `json:"ret"`               // 返回码
+	Msg             string `json:"msg"`               // 返回信息
+	IsLost          int    `json:"is_lost"`           // 是否丢失
+	Nickname        string `json:"nickname"`          // 用户昵称
+	Gender          string `json:"gender"`            // 性别
+	GenderType      int    `json:"gender_type"`       // 性别类型
+	Province        string `json:"province"`          // 省份
+	City            string `json:"city"`              // 城市
+	Year            string `json:"year"`              // 出生年份
+	Constellation   string `json:"constellation"`     // 星座
+	Figureurl       string `json:"figureurl"`         // 头像URL
+	Figureurl1      string `json:"figureurl_1"`       // 头像URL1
+	Figureurl2      string `json:"figureurl_2"`       // 头像URL2
+	FigureurlQq1    string `json:"figureurl_qq_1"`    // QQ头像URL1
+	FigureurlQq2    string `json:"figureurl_qq_2"`    // QQ头像URL2
+	FigureurlQq     string `json:"figureurl_qq"`      // QQ头像URL
+	FigureurlType   string `json:"figureurl_type"`    // 头像类型
+	IsYellowVip     string `json:"is_yellow_vip"`     // 是否黄钻用户
+	Vip             string `json:"vip"`               // 是否VIP用户
+	YellowVipLevel  string `json:"yellow_vip_level"`  // 黄钻等级
+	Level           string `json:"level"`             // 用户等级
+	IsYellowYearVip string `json:"is_yellow_year_vip"` // 是否年费黄钻用户
+}
+
+// GetUserInfo 通过访问令牌获取QQ用户信息
+// 参数:
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *QqIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 通过访问令牌获取QQ用户信息，请求受上下文控制
+// 获取OpenID和获取用户资料两次调用共用同一上下文
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *QqIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *QqIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	openIdUrl := fmt.Sprintf("%s?access_token=%s", idp.resolveUrl("https://graph.qq.com/oauth2.0/me"), token.AccessToken)
+	openIdBody, err := idp.getUrlResp(withIdempotent(ctx), "openid", openIdUrl, qqCheck(OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	re := regexp.MustCompile("\"openid\":\"(.*?)\"}")
+	matched := re.FindAllStringSubmatch(string(openIdBody), -1)
+	if len(matched) == 0 || matched[0][1] == "" {
+		return nil, newProviderErrorf(IDP_QQ, OpUserInfo, nil, "openId is empty")
+	}
+	openId := matched[0][1]
+
+	userInfoUrl := fmt.Sprintf(
+		"%s?access_token=%s&oauth_consumer_key=%s&openid=%s",
+		idp.resolveUserInfoUrl("https://graph.qq.com/user/get_user_info"), token.AccessToken, idp.Config.ClientID, openId)
+	userInfoBody, err := idp.getUrlResp(withIdempotent(ctx), OpUserInfo, userInfoUrl, qqCheck(OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	var qqUserInfo QqUserInfo
+	err = json.Unmarshal(userInfoBody, &qqUserInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo := UserInfo{
+		Id:          openId,
+		Username:    qqUserInfo.Nickname,
+		DisplayName: qqUserInfo.Nickname,
+		AvatarUrl:   qqUserInfo.FigureurlQq1,
+		Identity:    idp.identity("", IdentityKey{Kind: "openid", Scope: IdentityScopeApp, Value: openId}),
+	}
+
+	// 用户信息接口不返回openid，补充后参与字段映射
+	openIdJson, err := json.Marshal(map[string]string{"openid": openId})
+	if err != nil {
+		return nil, err
+	}
+	if err = idp.completeUserInfo(&userInfo, userInfoBody, openIdJson); err != nil {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
+
+// getUrlResp 发送HTTP GET请求并获取响应内容
+// 参数:
+//   - ctx: 请求上下文
+//   - endpoint: 接口名称，用于观察事件
+//   - url: 请求URL
+//   - check: 平台响应检查
+// 返回:
+//   - []byte: 响应内容
+//   - error: 错误信息
+func (idp *QqIdProvider) getUrlResp(ctx context.Context, endpoint string, url string, check responseCheck) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := idp.doRequest(idp.Client, req, endpoint, check)
+	return data, err
+}
+
+// qqCallbackErrorPattern QQ接口错误响应格式：callback( {"error":100019,"error_description":"..."} );
+var qqCallbackErrorPattern = regexp.MustCompile(`"error"\s*:\s*(\d+)\s*,\s*"error_description"\s*:\s*"(.*?)"`)
+
+// qqCheck 创建检查QQ接口响应的responseCheck
+// 令牌接口和OpenID接口以callback包装的形式返回错误，用户信息接口通过ret返回错误码
+// 参数:
+//   - op: 操作类型
+// 返回:
+//   - responseCheck: 响应检查函数
+func qqCheck(op string) responseCheck {
+	return func(resp *http.Response, body []byte) error {
+		if matched := qqCallbackErrorPattern.FindStringSubmatch(string(body)); matched != nil {
+			return newProviderError(IDP_QQ, op, resp.StatusCode, matched[1], matched[2])
+		}
+		var result struct {
+			Ret int    `json:"ret"`
+			Msg string `json:"msg"`
+		}
+		if err := json.Unmarshal(body, &result); err == nil && result.Ret != 0 {
+			return newProviderError(IDP_QQ, op, resp.StatusCode, strconv.Itoa(result.Ret), result.Msg)
+		}
+		return nil
+	}
+}
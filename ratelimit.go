@@ -0,0 +1,162 @@
+// 客户端限流
+// 按提供者类型或应用ID使用令牌桶限制对第三方平台的调用频率，避免集中登录时触发平台的频率限制
+package idp
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter 令牌桶限流器，可在多个提供者实例间共享
+type RateLimiter struct {
+	lock    sync.Mutex
+	rate    float64       // 每秒补充的令牌数
+	burst   float64       // 令牌桶容量
+	maxWait time.Duration // 最长排队等待时间
+	tokens  float64       // 当前令牌数
+	last    time.Time     // 上次补充令牌的时间
+}
+
+// NewRateLimiter 创建令牌桶限流器
+// 参数:
+//   - rate: 每秒允许的调用次数
+//   - burst: 允许的突发调用次数，小于1时按1处理
+//   - maxWait: 最长排队等待时间，需要等待更久时直接返回ErrRateLimited，为0时不等待
+//
+// 返回:
+//   - *RateLimiter: 限流器
+func NewRateLimiter(rate float64, burst int, maxWait time.Duration) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		maxWait: maxWait,
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// reserve 预占一个令牌
+// 参数:
+//   - now: 当前时间
+//   - maxWait: 最长等待时间
+//
+// 返回:
+//   - time.Duration: 需要等待的时间
+//   - bool: 等待时间超过maxWait时返回false，此时不占用令牌
+func (l *RateLimiter) reserve(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if l.rate <= 0 {
+		return 0, false
+	}
+
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	l.tokens--
+	return wait, true
+}
+
+// Allow 尝试立即获取一个令牌
+// 返回:
+//   - bool: 获取成功返回true
+func (l *RateLimiter) Allow() bool {
+	_, ok := l.reserve(time.Now(), 0)
+	return ok
+}
+
+// Wait 获取一个令牌，令牌不足时在maxWait内排队等待
+// 参数:
+//   - ctx: 请求上下文
+//
+// 返回:
+//   - error: 需要等待超过maxWait时返回Err为ErrRateLimited的*ProviderError，上下文结束时返回上下文错误
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	wait, ok := l.reserve(time.Now(), l.maxWait)
+	if !ok {
+		return &ProviderError{
+			Message:    "客户端限流",
+			Retryable:  true,
+			RetryAfter: wait,
+			Err:        ErrRateLimited,
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rateLimiterKey 限流器的配置维度
+type rateLimiterKey struct {
+	providerType string // 提供者类型
+	clientId     string // 应用ID，为空表示该类型的所有应用
+}
+
+// 限流器配置相关变量
+var (
+	rateLimiters     = make(map[rateLimiterKey]*RateLimiter) // 已配置的限流器
+	rateLimitersLock sync.RWMutex                            // 限流器配置读写锁
+)
+
+// SetRateLimiter 为提供者类型或单个应用设置客户端限流器
+// 同一应用的多个提供者实例共享限流器，单个应用的配置优先于提供者类型的配置
+// 参数:
+//   - providerType: 提供者类型（如WeChat、DingTalk等）
+//   - clientId: 应用ID（ClientId），为空时作用于该类型下未单独配置的所有应用
+//   - limiter: 限流器，为nil时删除配置
+func SetRateLimiter(providerType string, clientId string, limiter *RateLimiter) {
+	rateLimitersLock.Lock()
+	defer rateLimitersLock.Unlock()
+
+	key := rateLimiterKey{providerType: providerType, clientId: clientId}
+	if limiter == nil {
+		delete(rateLimiters, key)
+		return
+	}
+	rateLimiters[key] = limiter
+}
+
+// getRateLimiter 获取应用使用的限流器
+// 参数:
+//   - providerType: 提供者类型
+//   - clientId: 应用ID
+//
+// 返回:
+//   - *RateLimiter: 限流器，未配置时为nil
+func getRateLimiter(providerType string, clientId string) *RateLimiter {
+	rateLimitersLock.RLock()
+	defer rateLimitersLock.RUnlock()
+
+	if limiter, ok := rateLimiters[rateLimiterKey{providerType: providerType, clientId: clientId}]; ok {
+		return limiter
+	}
+	return rateLimiters[rateLimiterKey{providerType: providerType}]
+}
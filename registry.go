@@ -0,0 +1,115 @@
+// 登录提供者注册表
+// 内置提供者在包初始化时注册，调用方也可以注册自定义提供者
+package idp
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ProviderFactory 登录提供者工厂函数
+// 参数:
+//   - idpInfo: 提供者配置信息
+//   - redirectUrl: OAuth2重定向URL
+//
+// 返回:
+//   - IdProvider: 身份认证提供者实例
+//   - error: 错误信息
+type ProviderFactory func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error)
+
+// ProviderValidator 提供者配置校验函数，校验该类型特有的必填项和格式
+// 参数:
+//   - idpInfo: 提供者配置信息
+//
+// 返回:
+//   - error: 配置有误时返回错误，多个问题使用errors.Join合并
+type ProviderValidator func(idpInfo *ProviderInfo) error
+
+// 提供者注册表相关变量
+var (
+	providerFactories     = make(map[string]ProviderFactory)   // 提供者类型到工厂函数的映射
+	providerValidators    = make(map[string]ProviderValidator) // 提供者类型到配置校验函数的映射
+	providerFactoriesLock sync.RWMutex                         // 注册表读写锁
+)
+
+// RegisterProvider 注册登录提供者类型
+// 同一类型重复注册或工厂函数为空时会panic，通常在init函数中调用
+// 参数:
+//   - typeName: 提供者类型，与ProviderInfo.Type对应
+//   - factory: 提供者工厂函数
+func RegisterProvider(typeName string, factory ProviderFactory) {
+	providerFactoriesLock.Lock()
+	defer providerFactoriesLock.Unlock()
+
+	if typeName == "" {
+		panic("idp: RegisterProvider typeName is empty")
+	}
+	if factory == nil {
+		panic("idp: RegisterProvider factory is nil for " + typeName)
+	}
+	if _, dup := providerFactories[typeName]; dup {
+		panic(fmt.Sprintf("idp: RegisterProvider called twice for %s", typeName))
+	}
+	providerFactories[typeName] = factory
+}
+
+// RegisterProviderValidator 注册提供者类型的配置校验函数
+// ProviderInfo.Validate在通用校验之后调用，同一类型重复注册时会panic，通常在init函数中调用
+// 参数:
+//   - typeName: 提供者类型，与ProviderInfo.Type对应
+//   - validator: 配置校验函数
+func RegisterProviderValidator(typeName string, validator ProviderValidator) {
+	providerFactoriesLock.Lock()
+	defer providerFactoriesLock.Unlock()
+
+	if validator == nil {
+		panic("idp: RegisterProviderValidator validator is nil for " + typeName)
+	}
+	if _, dup := providerValidators[typeName]; dup {
+		panic(fmt.Sprintf("idp: RegisterProviderValidator called twice for %s", typeName))
+	}
+	providerValidators[typeName] = validator
+}
+
+// RegisteredProviders 获取已注册的提供者类型
+// 返回:
+//   - []string: 按字母顺序排列的提供者类型列表
+func RegisteredProviders() []string {
+	providerFactoriesLock.RLock()
+	defer providerFactoriesLock.RUnlock()
+
+	types := make([]string, 0, len(providerFactories))
+	for typeName := range providerFactories {
+		types = append(types, typeName)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// getProviderFactory 获取提供者类型对应的工厂函数
+// 参数:
+//   - typeName: 提供者类型
+//
+// 返回:
+//   - ProviderFactory: 提供者工厂函数
+//   - bool: 是否已注册
+func getProviderFactory(typeName string) (ProviderFactory, bool) {
+	providerFactoriesLock.RLock()
+	defer providerFactoriesLock.RUnlock()
+
+	factory, ok := providerFactories[typeName]
+	return factory, ok
+}
+
+// getProviderValidator 获取提供者类型对应的配置校验函数
+// 参数:
+//   - typeName: 提供者类型
+//
+// 返回:
+//   - ProviderValidator: 配置校验函数，未注册时为nil
+func getProviderValidator(typeName string) ProviderValidator {
+	providerFactoriesLock.RLock()
+	defer providerFactoriesLock.RUnlock()
+	return providerValidators[typeName]
+}
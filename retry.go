@@ -0,0 +1,228 @@
+// 接口调用重试
+// 仅对可以安全重复调用的接口（获取用户信息、获取应用访问令牌等）按重试策略重试，
+// 授权码换取令牌和刷新令牌等一次性调用不会重试，避免授权码或刷新令牌被消耗
+package idp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryPolicy 重试策略
+type RetryPolicy struct {
+	MaxAttempts    int                  // 最大尝试次数（包括首次调用），小于等于1时不重试
+	InitialBackoff time.Duration        // 首次重试前的等待时间
+	MaxBackoff     time.Duration        // 最长等待时间，为0时不限制
+	Multiplier     float64              // 每次重试等待时间的增长倍数，小于1时按1处理
+	Jitter         float64              // 随机抖动比例（0~1），等待时间在[d*(1-Jitter), d*(1+Jitter)]内随机
+	Retryable      func(err error) bool // 判断错误是否可以重试，为nil时使用IsRetryable
+}
+
+// DefaultRetryPolicy 默认重试策略：最多调用3次，等待时间从200毫秒开始按2倍增长
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// 默认重试策略相关变量
+var (
+	defaultRetryPolicy     = &DefaultRetryPolicy // 未单独设置重试策略的提供者使用的策略
+	defaultRetryPolicyLock sync.RWMutex          // 默认重试策略读写锁
+)
+
+// SetDefaultRetryPolicy 设置所有提供者默认使用的重试策略
+// 参数:
+//   - policy: 重试策略，为nil时不重试
+func SetDefaultRetryPolicy(policy *RetryPolicy) {
+	defaultRetryPolicyLock.Lock()
+	defer defaultRetryPolicyLock.Unlock()
+	defaultRetryPolicy = policy
+}
+
+// getDefaultRetryPolicy 获取默认重试策略
+// 返回:
+//   - *RetryPolicy: 默认重试策略，为nil时不重试
+func getDefaultRetryPolicy() *RetryPolicy {
+	defaultRetryPolicyLock.RLock()
+	defer defaultRetryPolicyLock.RUnlock()
+	return defaultRetryPolicy
+}
+
+// SetProviderRetryPolicy 为单个提供者设置重试策略，优先于SetDefaultRetryPolicy设置的默认策略
+// 参数:
+//   - provider: 登录提供者
+//   - policy: 重试策略，为nil时使用默认策略
+//
+// 返回:
+//   - bool: 提供者不支持设置重试策略时返回false
+func SetProviderRetryPolicy(provider IdProvider, policy *RetryPolicy) bool {
+	setter, ok := provider.(interface{ SetRetryPolicy(policy *RetryPolicy) })
+	if !ok {
+		return false
+	}
+	setter.SetRetryPolicy(policy)
+	return true
+}
+
+// IsRetryable 判断错误是否为可以重试的临时错误
+// 平台繁忙、频率超限、HTTP 5xx以及网络错误可以重试，请求上下文被取消或超时时不重试
+// 参数:
+//   - err: 接口调用错误
+//
+// 返回:
+//   - bool: 是否可以重试
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.Retryable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// backoff 计算第attempt次重试前的等待时间
+// 参数:
+//   - attempt: 重试序号，从1开始
+//
+// 返回:
+//   - time.Duration: 等待时间
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// retryable 判断错误是否可以重试
+// 参数:
+//   - err: 接口调用错误
+//
+// 返回:
+//   - bool: 是否可以重试
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// do 按重试策略执行调用
+// 错误中建议的等待时间（RetryAfter）长于退避时间时按建议时间等待，超过MaxBackoff时不再重试
+// 参数:
+//   - ctx: 请求上下文，等待期间上下文结束时返回最后一次调用的错误
+//   - fn: 调用函数，attempt为尝试序号，从0开始
+//
+// 返回:
+//   - error: 最后一次调用的错误
+func (p *RetryPolicy) do(ctx context.Context, fn func(attempt int) error) error {
+	maxAttempts := 1
+	if p != nil && p.MaxAttempts > 1 {
+		maxAttempts = p.MaxAttempts
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt == maxAttempts-1 || !p.retryable(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt + 1)
+		if retryAfter := RetryAfter(err); retryAfter > delay {
+			if p.MaxBackoff > 0 && retryAfter > p.MaxBackoff {
+				return err
+			}
+			delay = retryAfter
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// idempotentKey 标记请求可以安全重试的上下文键
+type idempotentKey struct{}
+
+// withIdempotent 标记通过该上下文发起的请求可以安全重试
+// 授权码换取令牌、刷新令牌等一次性调用不能使用
+// 参数:
+//   - ctx: 请求上下文
+//
+// 返回:
+//   - context.Context: 标记后的上下文
+func withIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// isIdempotent 判断请求是否可以安全重试
+// 参数:
+//   - req: HTTP请求
+//
+// 返回:
+//   - bool: 请求上下文已标记且请求体可以重新读取时返回true
+func isIdempotent(req *http.Request) bool {
+	idempotent, _ := req.Context().Value(idempotentKey{}).(bool)
+	return idempotent && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+}
+
+// doRetryableRequest 按重试策略发送请求，每次尝试分别通知观察者
+// 参数:
+//   - client: HTTP客户端
+//   - req: HTTP请求，请求体需要支持GetBody
+//   - policy: 重试策略，为nil时不重试
+//   - limiter: 客户端限流器，可为nil
+//   - start: 开始观察一次尝试的函数
+//   - check: 平台响应检查，可为nil
+//
+// 返回:
+//   - *http.Response: 最后一次尝试的HTTP响应
+//   - []byte: 响应内容
+//   - error: 最后一次尝试的错误
+func doRetryableRequest(client *http.Client, req *http.Request, policy *RetryPolicy, limiter *RateLimiter, start func() *callObservation, check responseCheck) (*http.Response, []byte, error) {
+	var resp *http.Response
+	var data []byte
+	err := policy.do(req.Context(), func(attempt int) error {
+		r := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		var err error
+		resp, data, err = doObservedRequest(client, r, limiter, start(), check)
+		return err
+	})
+	return resp, data, err
+}
@@ -0,0 +1,183 @@
+// 密钥引用解析
+// ProviderInfo的ClientSecret和ClientSecret2可以填写"方案:引用"形式的密钥引用，创建提供者时解析为实际值，
+// 使支付宝应用私钥、企业微信服务商密钥等敏感信息与其余配置分开保存
+//
+// 内置方案：
+//   - env:WECHAT_SECRET 读取环境变量
+//   - file:/run/secrets/alipay.pem 读取文件内容，去除末尾换行
+//   - literal:env:abc 去除前缀后原样使用，用于本身以已注册方案开头的密钥
+//
+// 未注册的方案按原值使用，因此普通密钥无需转义
+package idp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SecretResolver 密钥解析器，将某一方案的密钥引用解析为实际值
+type SecretResolver interface {
+	// Resolve 解析密钥引用
+	// 参数:
+	//   - ctx: 上下文
+	//   - ref: 去除"方案:"前缀后的引用，如环境变量名、文件路径
+	//
+	// 返回:
+	//   - string: 密钥值
+	//   - error: 错误信息，不应包含密钥值
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// SecretResolverFunc 函数形式的SecretResolver
+type SecretResolverFunc func(ctx context.Context, ref string) (string, error)
+
+// Resolve 解析密钥引用
+func (f SecretResolverFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+// 密钥解析器注册表相关变量
+var (
+	secretResolvers     = make(map[string]SecretResolver) // 方案到密钥解析器的映射
+	secretResolversLock sync.RWMutex                      // 注册表读写锁
+)
+
+func init() {
+	RegisterSecretResolver("env", SecretResolverFunc(resolveEnvSecret))
+	RegisterSecretResolver("file", SecretResolverFunc(resolveFileSecret))
+	RegisterSecretResolver("literal", SecretResolverFunc(resolveLiteralSecret))
+}
+
+// RegisterSecretResolver 注册密钥引用方案，如接入Vault、KMS等密钥管理服务
+// 同一方案重复注册、方案为空或解析器为空时会panic，通常在init函数中调用
+// 参数:
+//   - scheme: 方案名称，不含冒号，如vault
+//   - resolver: 密钥解析器
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	secretResolversLock.Lock()
+	defer secretResolversLock.Unlock()
+
+	if scheme == "" || strings.Contains(scheme, ":") {
+		panic("idp: RegisterSecretResolver invalid scheme " + scheme)
+	}
+	if resolver == nil {
+		panic("idp: RegisterSecretResolver resolver is nil for " + scheme)
+	}
+	if _, dup := secretResolvers[scheme]; dup {
+		panic(fmt.Sprintf("idp: RegisterSecretResolver called twice for %s", scheme))
+	}
+	secretResolvers[scheme] = resolver
+}
+
+// ResolveSecret 解析密钥引用
+// 参数:
+//   - ctx: 上下文
+//   - value: 密钥引用或密钥值
+//
+// 返回:
+//   - string: 方案已注册时为解析得到的密钥值，否则为原值
+//   - error: 错误信息
+func ResolveSecret(ctx context.Context, value string) (string, error) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return value, nil
+	}
+
+	secretResolversLock.RLock()
+	resolver, ok := secretResolvers[scheme]
+	secretResolversLock.RUnlock()
+	if !ok {
+		return value, nil
+	}
+
+	secret, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("解析密钥引用%s:%s失败: %w", scheme, ref, err)
+	}
+	return secret, nil
+}
+
+// isSecretReference 判断值是否为已注册方案的密钥引用
+// 参数:
+//   - value: 密钥引用或密钥值
+//
+// 返回:
+//   - bool: 以已注册的方案开头时返回true
+func isSecretReference(value string) bool {
+	scheme, _, ok := strings.Cut(value, ":")
+	if !ok {
+		return false
+	}
+
+	secretResolversLock.RLock()
+	defer secretResolversLock.RUnlock()
+	_, ok = secretResolvers[scheme]
+	return ok
+}
+
+// ResolveProviderSecrets 解析提供者配置中的密钥引用
+// 参数:
+//   - ctx: 上下文
+//   - idpInfo: 提供者配置信息，不会被修改
+//
+// 返回:
+//   - *ProviderInfo: ClientSecret和ClientSecret2已解析的配置副本
+//   - error: 错误信息
+func ResolveProviderSecrets(ctx context.Context, idpInfo *ProviderInfo) (*ProviderInfo, error) {
+	resolved := *idpInfo
+	var err error
+	if resolved.ClientSecret, err = ResolveSecret(ctx, idpInfo.ClientSecret); err != nil {
+		return nil, fmt.Errorf("ClientSecret: %w", err)
+	}
+	if resolved.ClientSecret2, err = ResolveSecret(ctx, idpInfo.ClientSecret2); err != nil {
+		return nil, fmt.Errorf("ClientSecret2: %w", err)
+	}
+	return &resolved, nil
+}
+
+// resolveEnvSecret 从环境变量读取密钥
+// 参数:
+//   - ctx: 上下文
+//   - name: 环境变量名
+//
+// 返回:
+//   - string: 密钥值
+//   - error: 环境变量未设置时返回错误
+func resolveEnvSecret(ctx context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("环境变量%s未设置", name)
+	}
+	return value, nil
+}
+
+// resolveLiteralSecret 原样返回密钥，用于转义以已注册方案开头的密钥值
+// 参数:
+//   - ctx: 上下文
+//   - value: 去除"literal:"前缀后的密钥值
+//
+// 返回:
+//   - string: 密钥值
+//   - error: 总是为nil
+func resolveLiteralSecret(ctx context.Context, value string) (string, error) {
+	return value, nil
+}
+
+// resolveFileSecret 从文件读取密钥
+// 参数:
+//   - ctx: 上下文
+//   - path: 文件路径
+//
+// 返回:
+//   - string: 去除末尾换行后的文件内容
+//   - error: 错误信息
+func resolveFileSecret(ctx context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,453 @@
+// 授权状态管理
+// 生成并校验OAuth2的state参数，防止CSRF、登录CSRF和回调重放，同时携带发起登录的提供者、登录后跳转地址、OIDC nonce和PKCE code_verifier
+package idp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultStateTTL 默认的state有效期
+const DefaultStateTTL = 10 * time.Minute
+
+// state校验错误
+var (
+	ErrInvalidState  = errors.New("state参数无效")
+	ErrStateExpired  = errors.New("state参数已过期")
+	ErrStateReplayed = errors.New("state参数已被使用")
+	ErrStateNotFound = errors.New("state不存在或已过期") // StateStore.Consume找不到记录时返回
+)
+
+// StateData state参数携带的登录上下文
+type StateData struct {
+	Id             string    // state唯一标识，用于防重放
+	Provider       string    // 发起登录的提供者类型或名称
+	RedirectTarget string    // 登录完成后跳转的地址，使用前需由调用方校验是否为本站地址
+	Nonce          string    // OIDC nonce，生成授权地址时通过WithNonce传入，回调时通过WithOidcNonce校验ID令牌
+	CodeVerifier   string    // PKCE code_verifier，签名模式下不出现在state中
+	ExpiresAt      time.Time // 过期时间
+}
+
+// stateRecord state的序列化结构，签名模式下作为state内容，字段名尽量短以缩短授权地址
+type stateRecord struct {
+	Id             string `json:"i"`           // state唯一标识
+	Provider       string `json:"p,omitempty"` // 提供者类型或名称
+	RedirectTarget string `json:"r,omitempty"` // 登录完成后跳转的地址
+	Nonce          string `json:"n,omitempty"` // OIDC nonce
+	Binding        string `json:"b"`           // 浏览器绑定值的摘要
+	Expires        int64  `json:"e"`           // 过期时间（Unix秒）
+	CodeVerifier   string `json:"v,omitempty"` // PKCE code_verifier，仅保存在服务端存储中
+}
+
+// StateStore state存储接口
+// 集群部署时可基于Redis等共享存储实现，所有方法需要支持并发调用
+type StateStore interface {
+	// Save 保存state
+	// 参数:
+	//   - ctx: 请求上下文
+	//   - key: 键
+	//   - value: 值
+	//   - ttl: 有效期，过期后需自动删除
+	// 返回:
+	//   - error: 错误信息
+	Save(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Get 读取state但不删除，用于消费前校验浏览器绑定
+	// 参数:
+	//   - ctx: 请求上下文
+	//   - key: 键
+	// 返回:
+	//   - []byte: 值
+	//   - error: 不存在或已过期时返回ErrStateNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Consume 读取并删除state，同一个键只能成功读取一次（如Redis的GETDEL）
+	// 参数:
+	//   - ctx: 请求上下文
+	//   - key: 键
+	// 返回:
+	//   - []byte: 值
+	//   - error: 不存在或已过期时返回ErrStateNotFound
+	Consume(ctx context.Context, key string) ([]byte, error)
+
+	// MarkUsed 标记键已使用，键不存在时写入并返回true，已存在时返回false（如Redis的SET NX）
+	// 参数:
+	//   - ctx: 请求上下文
+	//   - key: 键
+	//   - ttl: 标记的有效期
+	// 返回:
+	//   - bool: 首次标记时返回true
+	//   - error: 错误信息
+	MarkUsed(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+// StateManager OAuth2 state管理器
+// 签名模式下state为HMAC签名的登录上下文，服务端只需记录已使用的state；存储模式下state为随机值，登录上下文保存在StateStore中
+type StateManager struct {
+	secret []byte        // 签名密钥，为空时使用存储模式
+	store  StateStore    // state存储
+	ttl    time.Duration // state有效期
+}
+
+// NewStateBinding 生成浏览器绑定值
+// 绑定值保存在发起登录的浏览器中（如HttpOnly Cookie），发起登录和处理回调时分别传给Issue和Validate，
+// 使state只能在发起登录的浏览器中使用，防止攻击者将自己的授权回调注入受害者的浏览器；也可以使用已有的会话ID
+// 返回:
+//   - string: 随机绑定值
+//   - error: 读取随机数失败时返回错误
+func NewStateBinding() (string, error) {
+	return randomString(32)
+}
+
+// NewSignedStateManager 创建使用HMAC-SHA256签名的state管理器
+// PKCE code_verifier由密钥和state标识派生，不会出现在授权地址中；集群内所有节点需使用相同的密钥和共享的存储
+// 参数:
+//   - secret: 签名密钥，至少32字节
+//   - store: 记录已使用state的存储，为nil时使用内存存储
+//   - ttl: state有效期，小于等于0时使用DefaultStateTTL
+//
+// 返回:
+//   - *StateManager: state管理器
+//   - error: 密钥过短时返回错误
+func NewSignedStateManager(secret []byte, store StateStore, ttl time.Duration) (*StateManager, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("state签名密钥至少需要32字节")
+	}
+	return newStateManager(secret, store, ttl), nil
+}
+
+// NewStoredStateManager 创建将登录上下文保存在服务端存储中的state管理器
+// 参数:
+//   - store: state存储，为nil时使用内存存储
+//   - ttl: state有效期，小于等于0时使用DefaultStateTTL
+//
+// 返回:
+//   - *StateManager: state管理器
+func NewStoredStateManager(store StateStore, ttl time.Duration) *StateManager {
+	return newStateManager(nil, store, ttl)
+}
+
+// newStateManager 创建state管理器
+// 参数:
+//   - secret: 签名密钥，为空时使用存储模式
+//   - store: state存储，为nil时使用内存存储
+//   - ttl: state有效期，小于等于0时使用DefaultStateTTL
+//
+// 返回:
+//   - *StateManager: state管理器
+func newStateManager(secret []byte, store StateStore, ttl time.Duration) *StateManager {
+	if store == nil {
+		store = NewMemoryStateStore()
+	}
+	if ttl <= 0 {
+		ttl = DefaultStateTTL
+	}
+	return &StateManager{
+		secret: append([]byte(nil), secret...),
+		store:  store,
+		ttl:    ttl,
+	}
+}
+
+// Issue 生成state参数
+// 同时生成OIDC nonce和PKCE code_verifier，调用方按提供者能力决定是否使用
+// 参数:
+//   - ctx: 请求上下文
+//   - provider: 发起登录的提供者类型或名称，回调时用于校验
+//   - redirectTarget: 登录完成后跳转的地址，可为空
+//   - binding: 浏览器绑定值，见NewStateBinding，state中只保存其摘要
+//
+// 返回:
+//   - string: state参数，用于GetAuthURL
+//   - *StateData: 登录上下文
+//   - error: 错误信息
+func (m *StateManager) Issue(ctx context.Context, provider string, redirectTarget string, binding string) (string, *StateData, error) {
+	if binding == "" {
+		return "", nil, errors.New("state浏览器绑定值不能为空")
+	}
+	id, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randomString(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	data := &StateData{
+		Id:             id,
+		Provider:       provider,
+		RedirectTarget: redirectTarget,
+		Nonce:          nonce,
+		ExpiresAt:      time.Now().Add(m.ttl).Truncate(time.Second),
+	}
+	record := stateRecord{
+		Id:             id,
+		Provider:       provider,
+		RedirectTarget: redirectTarget,
+		Nonce:          nonce,
+		Binding:        m.bindingDigest(binding),
+		Expires:        data.ExpiresAt.Unix(),
+	}
+
+	if len(m.secret) > 0 {
+		data.CodeVerifier = m.deriveCodeVerifier(id)
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return "", nil, err
+		}
+		encoded := base64.RawURLEncoding.EncodeToString(payload)
+		return encoded + "." + m.sign(encoded), data, nil
+	}
+
+	if data.CodeVerifier, err = randomString(32); err != nil {
+		return "", nil, err
+	}
+	record.CodeVerifier = data.CodeVerifier
+	value, err := json.Marshal(record)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = m.store.Save(ctx, stateStoreKey(id), value, m.ttl); err != nil {
+		return "", nil, fmt.Errorf("保存state失败: %w", err)
+	}
+	return id, data, nil
+}
+
+// Validate 校验回调中的state参数，每个state只能成功校验一次
+// 参数:
+//   - ctx: 请求上下文
+//   - state: 回调中的state参数
+//   - provider: 处理回调的提供者类型或名称，为空时不校验
+//   - binding: 处理回调的浏览器的绑定值，需与Issue时一致
+//
+// 返回:
+//   - *StateData: 生成state时的登录上下文
+//   - error: state无效、已过期、已被使用、与提供者或浏览器不符时返回ErrInvalidState、ErrStateExpired或ErrStateReplayed
+func (m *StateManager) Validate(ctx context.Context, state string, provider string, binding string) (*StateData, error) {
+	if state == "" {
+		return nil, fmt.Errorf("%w: 缺少state参数", ErrInvalidState)
+	}
+	if binding == "" {
+		return nil, fmt.Errorf("%w: 缺少浏览器绑定值", ErrInvalidState)
+	}
+
+	var data *StateData
+	var err error
+	if len(m.secret) > 0 {
+		data, err = m.validateSigned(ctx, state, binding)
+	} else {
+		data, err = m.validateStored(ctx, state, binding)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if provider != "" && data.Provider != provider {
+		return nil, fmt.Errorf("%w: state属于提供者%s", ErrInvalidState, data.Provider)
+	}
+	return data, nil
+}
+
+// validateSigned 校验签名模式的state
+// 参数:
+//   - ctx: 请求上下文
+//   - state: state参数
+//   - binding: 浏览器绑定值
+//
+// 返回:
+//   - *StateData: 登录上下文
+//   - error: 错误信息
+func (m *StateManager) validateSigned(ctx context.Context, state string, binding string) (*StateData, error) {
+	encoded, signature, ok := strings.Cut(state, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(m.sign(encoded))) {
+		return nil, fmt.Errorf("%w: 签名错误", ErrInvalidState)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	data, digest, err := decodeStateRecord(payload)
+	if err != nil {
+		return nil, err
+	}
+	// 浏览器不符时不标记为已使用，避免他人的回调请求使state失效
+	if err = m.checkBinding(digest, binding); err != nil {
+		return nil, err
+	}
+
+	remaining := time.Until(data.ExpiresAt)
+	if remaining <= 0 {
+		return nil, ErrStateExpired
+	}
+	first, err := m.store.MarkUsed(ctx, stateUsedKey(data.Id), remaining)
+	if err != nil {
+		return nil, fmt.Errorf("记录state使用状态失败: %w", err)
+	}
+	if !first {
+		return nil, ErrStateReplayed
+	}
+
+	data.CodeVerifier = m.deriveCodeVerifier(data.Id)
+	return data, nil
+}
+
+// validateStored 校验存储模式的state
+// 参数:
+//   - ctx: 请求上下文
+//   - state: state参数
+//   - binding: 浏览器绑定值
+//
+// 返回:
+//   - *StateData: 登录上下文
+//   - error: 错误信息
+func (m *StateManager) validateStored(ctx context.Context, state string, binding string) (*StateData, error) {
+	key := stateStoreKey(state)
+	value, err := m.store.Get(ctx, key)
+	if errors.Is(err, ErrStateNotFound) {
+		// 记录被消费后无法区分重放和伪造的state
+		return nil, fmt.Errorf("%w: state不存在、已过期或已被使用", ErrInvalidState)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取state失败: %w", err)
+	}
+
+	data, digest, err := decodeStateRecord(value)
+	if err != nil {
+		return nil, err
+	}
+	if data.Id != state {
+		return nil, fmt.Errorf("%w: state标识不一致", ErrInvalidState)
+	}
+	// 浏览器不符时不消费state，避免他人的回调请求使state失效
+	if err = m.checkBinding(digest, binding); err != nil {
+		return nil, err
+	}
+
+	// 并发回调中只有一个能成功消费
+	_, err = m.store.Consume(ctx, key)
+	if errors.Is(err, ErrStateNotFound) {
+		return nil, ErrStateReplayed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取state失败: %w", err)
+	}
+	if !time.Now().Before(data.ExpiresAt) {
+		return nil, ErrStateExpired
+	}
+	return data, nil
+}
+
+// sign 计算state内容的签名
+// 参数:
+//   - encoded: 编码后的state内容
+//
+// 返回:
+//   - string: base64url编码的签名
+func (m *StateManager) sign(encoded string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte("state\x00" + encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// bindingDigest 计算浏览器绑定值的摘要，签名模式下使用签名密钥计算HMAC，避免state中出现可离线验证的摘要
+// 参数:
+//   - binding: 浏览器绑定值
+//
+// 返回:
+//   - string: base64url编码的摘要
+func (m *StateManager) bindingDigest(binding string) string {
+	if len(m.secret) > 0 {
+		mac := hmac.New(sha256.New, m.secret)
+		mac.Write([]byte("binding\x00" + binding))
+		return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+	}
+	sum := sha256.Sum256([]byte(binding))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// checkBinding 校验浏览器绑定值与state中的摘要是否一致
+// 参数:
+//   - digest: state中保存的摘要
+//   - binding: 处理回调的浏览器的绑定值
+//
+// 返回:
+//   - error: 不一致时返回ErrInvalidState
+func (m *StateManager) checkBinding(digest string, binding string) error {
+	if digest == "" || !hmac.Equal([]byte(digest), []byte(m.bindingDigest(binding))) {
+		return fmt.Errorf("%w: state不属于当前浏览器", ErrInvalidState)
+	}
+	return nil
+}
+
+// deriveCodeVerifier 由签名密钥和state标识派生PKCE code_verifier
+// 参数:
+//   - id: state标识
+//
+// 返回:
+//   - string: 43个字符的code_verifier
+func (m *StateManager) deriveCodeVerifier(id string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte("code_verifier\x00" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// decodeStateRecord 解析state记录
+// 参数:
+//   - value: 序列化的state记录
+//
+// 返回:
+//   - *StateData: 登录上下文
+//   - string: 浏览器绑定值的摘要
+//   - error: 格式错误时返回ErrInvalidState
+func decodeStateRecord(value []byte) (*StateData, string, error) {
+	var record stateRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	if record.Id == "" || record.Expires == 0 {
+		return nil, "", fmt.Errorf("%w: 缺少标识或过期时间", ErrInvalidState)
+	}
+
+	return &StateData{
+		Id:             record.Id,
+		Provider:       record.Provider,
+		RedirectTarget: record.RedirectTarget,
+		Nonce:          record.Nonce,
+		CodeVerifier:   record.CodeVerifier,
+		ExpiresAt:      time.Unix(record.Expires, 0),
+	}, record.Binding, nil
+}
+
+// stateStoreKey 存储模式下state在StateStore中的键
+func stateStoreKey(id string) string {
+	return "idp:state:" + id
+}
+
+// stateUsedKey 签名模式下已使用state在StateStore中的键
+func stateUsedKey(id string) string {
+	return "idp:state-used:" + id
+}
+
+// randomString 生成base64url编码的随机字符串
+// 参数:
+//   - n: 随机字节数
+//
+// 返回:
+//   - string: 随机字符串
+//   - error: 读取随机数失败时返回错误
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
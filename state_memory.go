@@ -0,0 +1,103 @@
+// 内存state存储
+// 适用于单实例部署，集群部署时需要实现基于共享存储的StateStore
+package idp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// stateSweepInterval 清理过期记录的最短间隔
+const stateSweepInterval = time.Minute
+
+// memoryStateEntry 内存存储中的记录
+type memoryStateEntry struct {
+	value     []byte    // 值
+	expiresAt time.Time // 过期时间
+}
+
+// MemoryStateStore 基于内存的StateStore实现，过期记录在写入时定期清理
+type MemoryStateStore struct {
+	lock      sync.Mutex
+	entries   map[string]memoryStateEntry // 记录
+	nextSweep time.Time                   // 下次清理过期记录的时间
+}
+
+// NewMemoryStateStore 创建内存state存储
+// 返回:
+//   - *MemoryStateStore: 内存state存储
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		entries:   make(map[string]memoryStateEntry),
+		nextSweep: time.Now().Add(stateSweepInterval),
+	}
+}
+
+// Save 保存state
+func (s *MemoryStateStore) Save(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	s.entries[key] = memoryStateEntry{value: append([]byte(nil), value...), expiresAt: now.Add(ttl)}
+	return nil
+}
+
+// Get 读取state但不删除
+func (s *MemoryStateStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		return nil, ErrStateNotFound
+	}
+	return append([]byte(nil), entry.value...), nil
+}
+
+// Consume 读取并删除state
+func (s *MemoryStateStore) Consume(ctx context.Context, key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, ErrStateNotFound
+	}
+	delete(s.entries, key)
+	if !time.Now().Before(entry.expiresAt) {
+		return nil, ErrStateNotFound
+	}
+	return entry.value, nil
+}
+
+// MarkUsed 标记键已使用
+func (s *MemoryStateStore) MarkUsed(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expiresAt) {
+		return false, nil
+	}
+	s.entries[key] = memoryStateEntry{expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+// sweep 到达清理时间时删除过期记录，调用方需持有锁
+// 参数:
+//   - now: 当前时间
+func (s *MemoryStateStore) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+	s.nextSweep = now.Add(stateSweepInterval)
+}
@@ -0,0 +1,44 @@
+package idp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/smart-unicom/idp"
+)
+
+// TestStateBindingMismatchKeepsState 浏览器绑定值不符时state校验失败且不被消耗，发起登录的浏览器仍可完成登录
+func TestStateBindingMismatchKeepsState(t *testing.T) {
+	signed, err := idp.NewSignedStateManager(make([]byte, 32), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managers := map[string]*idp.StateManager{
+		"Signed": signed,
+		"Stored": idp.NewStoredStateManager(nil, 0),
+	}
+	for name, states := range managers {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			state, _, err := states.Issue(ctx, idp.IDP_GITHUB, "/dashboard", "browser")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = states.Validate(ctx, state, idp.IDP_GITHUB, "attacker"); !errors.Is(err, idp.ErrInvalidState) {
+				t.Fatalf("绑定值不符: err = %v, want ErrInvalidState", err)
+			}
+			data, err := states.Validate(ctx, state, idp.IDP_GITHUB, "browser")
+			if err != nil {
+				t.Fatalf("绑定值一致: %v", err)
+			}
+			if data.RedirectTarget != "/dashboard" {
+				t.Errorf("RedirectTarget = %q, want /dashboard", data.RedirectTarget)
+			}
+			if _, err = states.Validate(ctx, state, idp.IDP_GITHUB, "browser"); err == nil {
+				t.Error("重复校验同一state应失败")
+			}
+		})
+	}
+}
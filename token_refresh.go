@@ -0,0 +1,102 @@
+// 访问令牌刷新
+// 支持刷新令牌的登录提供者实现TokenRefresher接口
+package idp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrRefreshNotSupported 登录提供者不支持刷新访问令牌
+var ErrRefreshNotSupported = errors.New("登录提供者不支持刷新访问令牌")
+
+// TokenRefresher 可选的令牌刷新接口
+// 刷新后的令牌Expiry按平台返回的有效期计算，并保留Openid、open_id等GetUserInfo依赖的扩展字段
+type TokenRefresher interface {
+	// RefreshToken 使用刷新令牌获取新的访问令牌
+	// 参数:
+	//   - ctx: 请求上下文，用于取消和超时控制
+	//   - token: 之前获取的OAuth2令牌，必须包含RefreshToken
+	// 返回:
+	//   - *oauth2.Token: 新的OAuth2令牌，平台未返回新的刷新令牌时沿用原刷新令牌
+	//   - error: 错误信息
+	RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error)
+}
+
+// RefreshToken 刷新访问令牌
+// 参数:
+//   - ctx: 请求上下文
+//   - provider: 登录提供者
+//   - token: 之前获取的OAuth2令牌
+//
+// 返回:
+//   - *oauth2.Token: 新的OAuth2令牌
+//   - error: 提供者未实现TokenRefresher时返回ErrRefreshNotSupported
+func RefreshToken(ctx context.Context, provider IdProvider, token *oauth2.Token) (*oauth2.Token, error) {
+	refresher, ok := provider.(TokenRefresher)
+	if !ok {
+		return nil, ErrRefreshNotSupported
+	}
+	return refresher.RefreshToken(ctx, token)
+}
+
+// checkRefreshToken 检查令牌是否可以刷新
+// 参数:
+//   - token: OAuth2令牌
+//
+// 返回:
+//   - error: 令牌为空或缺少刷新令牌时返回错误
+func checkRefreshToken(token *oauth2.Token) error {
+	if token == nil || token.RefreshToken == "" {
+		return errors.New("令牌中缺少refresh_token，无法刷新")
+	}
+	return nil
+}
+
+// refreshStandardToken 按OAuth2规范使用刷新令牌获取新的访问令牌
+// 参数:
+//   - ctx: 请求上下文
+//   - client: HTTP客户端
+//   - config: OAuth2配置
+//   - token: 之前获取的OAuth2令牌
+//
+// 返回:
+//   - *oauth2.Token: 新的OAuth2令牌
+//   - error: 错误信息
+func (b *providerBase) refreshStandardToken(ctx context.Context, client *http.Client, config *oauth2.Config, token *oauth2.Token) (*oauth2.Token, error) {
+	if err := checkRefreshToken(token); err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+	return b.observeToken(ctx, OpRefreshToken, config.Endpoint.TokenURL, func() (*oauth2.Token, error) {
+		return config.TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken}).Token()
+	})
+}
+
+// inheritTokenFields 将原令牌中的刷新令牌和扩展字段补充到新令牌
+// 平台刷新接口可能不返回新的刷新令牌或openid，新令牌中已有的值保持不变
+// 参数:
+//   - newToken: 刷新得到的令牌
+//   - oldToken: 原令牌
+//   - keys: 需要保留的扩展字段名，返回的令牌只包含这些扩展字段
+//
+// 返回:
+//   - *oauth2.Token: 补充后的令牌
+func inheritTokenFields(newToken *oauth2.Token, oldToken *oauth2.Token, keys ...string) *oauth2.Token {
+	if newToken.RefreshToken == "" {
+		newToken.RefreshToken = oldToken.RefreshToken
+	}
+
+	extra := make(map[string]interface{})
+	for _, key := range keys {
+		if v := newToken.Extra(key); v != nil && v != "" {
+			extra[key] = v
+		} else if v := oldToken.Extra(key); v != nil {
+			extra[key] = v
+		}
+	}
+	return newToken.WithExtra(extra)
+}
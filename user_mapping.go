@@ -0,0 +1,319 @@
+// 用户字段映射
+// 根据ProviderInfo.UserMapping中的表达式，从第三方平台返回的原始用户数据中提取UserInfo字段
+//
+// 映射的键为UserInfo字段名（id、username、displayName、unionId、email、phone、countryCode、avatarUrl，
+// 不区分大小写），其他键（可带"extra."前缀）写入UserInfo.Extra。映射的值为表达式：
+//   - 路径：使用"."访问嵌套字段，数字访问数组下标，如"data.user.name"、"emails.0.value"
+//   - 备选：使用"|"分隔多个表达式，取第一个非空结果，如"login|name"
+//   - 模板：使用"{路径}"引用字段，如"wx_{unionid}"、"{corp_info.corpid}:{user_info.userid}"，
+//     任一引用为空时整个模板结果为空，便于与备选配合使用，如"wx_{unionid}|wx_{openid}"
+//
+// 表达式结果为空时保留提供者默认解析出的值
+package idp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ApplyUserMapping 将字段映射应用到用户信息
+// 参数:
+//   - userInfo: 提供者解析出的用户信息，映射结果会覆盖其中的字段
+//   - mapping: 字段映射配置
+//   - raws: 第三方平台返回的原始JSON对象，多个对象按顺序合并，同名字段以后者为准
+//
+// 返回:
+//   - error: 映射表达式或原始数据无效时返回错误
+func ApplyUserMapping(userInfo *UserInfo, mapping map[string]string, raws ...[]byte) error {
+	if len(mapping) == 0 {
+		return nil
+	}
+
+	profile, err := mergeRawProfiles(raws...)
+	if err != nil {
+		return fmt.Errorf("用户字段映射解析原始数据失败: %w", err)
+	}
+
+	for field, expr := range mapping {
+		alternatives, err := parseMappingExpr(expr)
+		if err != nil {
+			return fmt.Errorf("用户字段映射 %s 无效: %w", field, err)
+		}
+		value := evalMappingExpr(alternatives, profile)
+		if value == "" {
+			continue
+		}
+		setUserInfoField(userInfo, field, value)
+	}
+	return nil
+}
+
+// RawProfile 将第三方平台返回的原始用户数据合并为一个对象，同名字段以后调用的接口为准
+// 返回:
+//   - map[string]interface{}: 合并后的原始数据，数字为json.Number
+//   - error: 原始数据不是JSON对象时返回错误
+func (u *UserInfo) RawProfile() (map[string]interface{}, error) {
+	raws := make([][]byte, len(u.RawProfiles))
+	for i, raw := range u.RawProfiles {
+		raws[i] = raw
+	}
+	return mergeRawProfiles(raws...)
+}
+
+// RawValue 从原始用户数据中读取平台特有的字段
+// 表达式语法与用户字段映射相同，如"company"、"corp_info.corpid"、"verified"、"wx_{unionid}|wx_{openid}"
+// 参数:
+//   - expr: 字段表达式
+//
+// 返回:
+//   - string: 字段值，字段不存在或表达式无效时为空
+func (u *UserInfo) RawValue(expr string) string {
+	alternatives, err := parseMappingExpr(expr)
+	if err != nil {
+		return ""
+	}
+	profile, err := u.RawProfile()
+	if err != nil {
+		return ""
+	}
+	return evalMappingExpr(alternatives, profile)
+}
+
+// mergeRawProfiles 解析并合并多个原始JSON对象，同名字段以后者为准
+// 参数:
+//   - raws: 原始JSON对象，空内容会被忽略
+//
+// 返回:
+//   - map[string]interface{}: 合并后的对象，数字为json.Number
+//   - error: 原始数据不是JSON对象时返回错误
+func mergeRawProfiles(raws ...[]byte) (map[string]interface{}, error) {
+	profile := make(map[string]interface{})
+	for _, raw := range raws {
+		if len(raw) == 0 {
+			continue
+		}
+		var obj map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&obj); err != nil {
+			return nil, err
+		}
+		for k, v := range obj {
+			profile[k] = v
+		}
+	}
+	return profile, nil
+}
+
+// ValidateUserMapping 检查字段映射表达式的语法
+// 参数:
+//   - mapping: 字段映射配置
+//
+// 返回:
+//   - error: 第一个无效表达式对应的错误
+func ValidateUserMapping(mapping map[string]string) error {
+	for field, expr := range mapping {
+		if _, err := parseMappingExpr(expr); err != nil {
+			return fmt.Errorf("用户字段映射 %s 无效: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// mergeUserMapping 合并提供者默认映射与配置的映射，字段名不区分大小写，配置中的同名键覆盖默认映射
+// 参数:
+//   - defaults: 提供者默认映射
+//   - overrides: 配置的映射
+//
+// 返回:
+//   - map[string]string: 合并后的映射
+func mergeUserMapping(defaults map[string]string, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(defaults)+len(overrides))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		for dk := range defaults {
+			if strings.EqualFold(dk, k) {
+				delete(merged, dk)
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// parseMappingExpr 按顶层的"|"拆分映射表达式，模板花括号内的"|"不参与拆分
+// 参数:
+//   - expr: 映射表达式
+//
+// 返回:
+//   - []string: 备选表达式列表
+//   - error: 花括号不匹配或存在空表达式（包括空的模板引用）时返回错误
+func parseMappingExpr(expr string) ([]string, error) {
+	var alternatives []string
+	depth := 0
+	start := 0
+	open := 0
+	for i, c := range expr {
+		switch c {
+		case '{':
+			if depth > 0 {
+				return nil, fmt.Errorf("不支持嵌套的花括号: %q", expr)
+			}
+			depth++
+			open = i
+		case '}':
+			if depth == 0 {
+				return nil, fmt.Errorf("花括号不匹配: %q", expr)
+			}
+			depth--
+			if _, err := parseMappingExpr(expr[open+1 : i]); err != nil {
+				return nil, err
+			}
+		case '|':
+			if depth == 0 {
+				alternatives = append(alternatives, strings.TrimSpace(expr[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("花括号不匹配: %q", expr)
+	}
+	alternatives = append(alternatives, strings.TrimSpace(expr[start:]))
+
+	for _, alt := range alternatives {
+		if alt == "" {
+			return nil, fmt.Errorf("存在空表达式: %q", expr)
+		}
+	}
+	return alternatives, nil
+}
+
+// evalMappingExpr 依次计算备选表达式，返回第一个非空结果
+// 参数:
+//   - alternatives: 备选表达式列表
+//   - profile: 原始用户数据
+//
+// 返回:
+//   - string: 表达式结果
+func evalMappingExpr(alternatives []string, profile map[string]interface{}) string {
+	for _, alt := range alternatives {
+		var value string
+		if strings.Contains(alt, "{") {
+			value = evalMappingTemplate(alt, profile)
+		} else {
+			value = lookupProfilePath(profile, alt)
+		}
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// evalMappingTemplate 计算模板表达式，任一引用为空时返回空字符串
+// 参数:
+//   - tmpl: 模板表达式
+//   - profile: 原始用户数据
+//
+// 返回:
+//   - string: 模板结果
+func evalMappingTemplate(tmpl string, profile map[string]interface{}) string {
+	var sb strings.Builder
+	for {
+		open := strings.IndexByte(tmpl, '{')
+		if open < 0 {
+			sb.WriteString(tmpl)
+			return sb.String()
+		}
+		end := strings.IndexByte(tmpl, '}')
+		sb.WriteString(tmpl[:open])
+
+		inner, _ := parseMappingExpr(tmpl[open+1 : end])
+		value := evalMappingExpr(inner, profile)
+		if value == "" {
+			return ""
+		}
+		sb.WriteString(value)
+		tmpl = tmpl[end+1:]
+	}
+}
+
+// lookupProfilePath 按路径读取原始用户数据中的字段并转换为字符串
+// 参数:
+//   - profile: 原始用户数据
+//   - path: 以"."分隔的字段路径
+//
+// 返回:
+//   - string: 字段值，字段不存在时为空字符串
+func lookupProfilePath(profile map[string]interface{}, path string) string {
+	var current interface{} = profile
+	for _, key := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			current = node[key]
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return ""
+			}
+			current = node[index]
+		default:
+			return ""
+		}
+	}
+
+	switch value := current.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		bs, err := json.Marshal(value)
+		// 空对象和空数组与缺少字段相同，避免映射出"{}"这样的无效值
+		if err != nil || string(bs) == "{}" || string(bs) == "[]" {
+			return ""
+		}
+		return string(bs)
+	}
+}
+
+// setUserInfoField 设置用户信息字段，非标准字段写入Extra
+// 参数:
+//   - userInfo: 用户信息
+//   - field: 字段名
+//   - value: 字段值
+func setUserInfoField(userInfo *UserInfo, field string, value string) {
+	switch strings.ToLower(field) {
+	case "id":
+		userInfo.Id = value
+	case "username":
+		userInfo.Username = value
+	case "displayname":
+		userInfo.DisplayName = value
+	case "unionid":
+		userInfo.UnionId = value
+	case "email":
+		userInfo.Email = value
+	case "phone":
+		userInfo.Phone = value
+	case "countrycode":
+		userInfo.CountryCode = value
+	case "avatarurl":
+		userInfo.AvatarUrl = value
+	default:
+		if userInfo.Extra == nil {
+			userInfo.Extra = make(map[string]string)
+		}
+		userInfo.Extra[strings.TrimPrefix(field, "extra.")] = value
+	}
+}
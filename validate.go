@@ -0,0 +1,84 @@
+// 提供者配置校验
+// 在保存或加载配置时发现缺少必填项、地址格式错误、密钥无法解析等问题，而不是等到用户登录时才失败
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Validate 校验提供者配置
+// 先进行所有类型通用的校验（类型已注册、ClientId、各地址格式、用户字段映射），再调用该类型注册的ProviderValidator
+// 返回:
+//   - error: 配置有误时返回使用errors.Join合并的错误，包含发现的所有问题
+func (idpInfo *ProviderInfo) Validate() error {
+	var errs []error
+	if idpInfo.Type == "" {
+		errs = append(errs, errors.New("Type: 未配置提供者类型"))
+	} else if _, ok := getProviderFactory(idpInfo.Type); !ok {
+		errs = append(errs, fmt.Errorf("Type: 不支持的登录提供者类型: %s", idpInfo.Type))
+	}
+	if strings.TrimSpace(idpInfo.ClientId) == "" {
+		errs = append(errs, errors.New("ClientId: 不能为空"))
+	}
+
+	errs = append(errs,
+		validateUrl("HostUrl", idpInfo.HostUrl, false),
+		validateUrl("RedirectUrl", idpInfo.RedirectUrl, false),
+		validateUrl("AuthURL", idpInfo.AuthURL, idpInfo.HostUrl != ""),
+		validateUrl("TokenURL", idpInfo.TokenURL, idpInfo.HostUrl != ""),
+		validateUrl("UserInfoURL", idpInfo.UserInfoURL, idpInfo.HostUrl != ""),
+	)
+	if err := ValidateUserMapping(idpInfo.UserMapping); err != nil {
+		errs = append(errs, fmt.Errorf("UserMapping: %w", err))
+	}
+
+	if validator := getProviderValidator(idpInfo.Type); validator != nil {
+		errs = append(errs, validator(idpInfo))
+	}
+	return errors.Join(errs...)
+}
+
+// validateUrl 校验地址格式
+// 参数:
+//   - field: 字段名，用于错误信息
+//   - rawUrl: 地址，为空时不校验
+//   - allowPath: 是否允许以"/"开头的相对路径（相对HostUrl）
+//
+// 返回:
+//   - error: 地址不是http或https的绝对地址时返回错误
+func validateUrl(field string, rawUrl string, allowPath bool) error {
+	if rawUrl == "" {
+		return nil
+	}
+	if allowPath && strings.HasPrefix(rawUrl, "/") {
+		return nil
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("%s: 地址格式错误: %w", field, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s: 必须是http或https地址: %s", field, rawUrl)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s: 缺少主机名: %s", field, rawUrl)
+	}
+	return nil
+}
+
+// requireClientSecret 校验已配置应用密钥，适用于需要ClientSecret换取令牌的提供者
+// 参数:
+//   - idpInfo: 提供者配置信息
+//
+// 返回:
+//   - error: ClientSecret为空时返回错误
+func requireClientSecret(idpInfo *ProviderInfo) error {
+	if strings.TrimSpace(idpInfo.ClientSecret) == "" {
+		return errors.New("ClientSecret: 不能为空")
+	}
+	return nil
+}
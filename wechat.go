@@ -1,394 +1,595 @@
-// 微信OAuth2登录提供者实现
-// 支持微信网页登录和公众号扫码登录
-package idp
-
-import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"sort"
-	"strings"
-	"sync"
-	"time"
-
-	"github.com/skip2/go-qrcode"
-	"golang.org/x/oauth2"
-)
-
-// 微信登录缓存相关变量
-var (
-	WechatCacheMap map[string]WechatCacheMapValue // 微信登录缓存映射
-	Lock           sync.RWMutex                   // 读写锁
-)
-
-// WeChatIdProvider 微信登录提供者
-// 实现微信OAuth2登录功能
-type WeChatIdProvider struct {
-	Client *http.Client   // HTTP客户端
-	Config *oauth2.Config // OAuth2配置
-}
-
-// WechatCacheMapValue 微信缓存值结构体
-// 用于临时存储扫码登录状态
-type WechatCacheMapValue struct {
-	IsScanned     bool   // 是否已扫码
-	WechatUnionId string // 微信UnionId
-}
-
-// NewWeChatIdProvider 创建微信登录提供者实例
-// 参数:
-//   - clientId: 微信应用的AppId
-//   - clientSecret: 微信应用的AppSecret
-//   - redirectUrl: OAuth2重定向URL
-//
-// 返回:
-//   - *WeChatIdProvider: 微信登录提供者实例
-func NewWeChatIdProvider(clientId string, clientSecret string, redirectUrl string) *WeChatIdProvider {
-	idp := &WeChatIdProvider{}
-
-	config := idp.getConfig(clientId, clientSecret, redirectUrl)
-	idp.Config = config
-
-	return idp
-}
-
-// SetHttpClient 设置HTTP客户端
-// 参数:
-//   - client: HTTP客户端实例
-func (idp *WeChatIdProvider) SetHttpClient(client *http.Client) {
-	idp.Client = client
-}
-
-// getConfig 获取微信OAuth2配置
-// 参数:
-//   - clientId: 微信应用的AppId
-//   - clientSecret: 微信应用的AppSecret
-//   - redirectUrl: OAuth2重定向URL
-//
-// 返回:
-//   - *oauth2.Config: OAuth2配置实例
-func (idp *WeChatIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
-	endpoint := oauth2.Endpoint{
-		TokenURL: "https://graph.qq.com/oauth2.0/token",
-	}
-
-	config := &oauth2.Config{
-		Scopes:       []string{"snsapi_login"},
-		Endpoint:     endpoint,
-		ClientID:     clientId,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectUrl,
-	}
-
-	return config
-}
-
-// WechatAccessToken 微信访问令牌响应结构体
-type WechatAccessToken struct {
-	AccessToken  string `json:"access_token"`  // 接口调用凭证
-	ExpiresIn    int64  `json:"expires_in"`    // access_token接口调用凭证超时时间，单位（秒）
-	RefreshToken string `json:"refresh_token"` // 用户刷新access_token
-	Openid       string `json:"openid"`        // 授权用户唯一标识
-	Scope        string `json:"scope"`         // 用户授权的作用域，使用逗号（,）分隔
-	Unionid      string `json:"unionid"`       // 只有在用户将公众号绑定到微信开放平台帐号后，才会出现该字段
-}
-
-// GetToken 通过授权码获取微信访问令牌
-// 参数:
-//   - code: 微信返回的授权码或特殊格式的票据
-//
-// 返回:
-//   - *oauth2.Token: OAuth2访问令牌
-//   - error: 错误信息
-//
-// 详细文档: https://developers.weixin.qq.com/doc/oplatform/Website_App/WeChat_Login/Wechat_Login.html
-func (idp *WeChatIdProvider) GetToken(code string) (*oauth2.Token, error) {
-	if strings.HasPrefix(code, "wechat_oa:") {
-		token := oauth2.Token{
-			AccessToken: code,
-			TokenType:   "WeChatAccessToken",
-			Expiry:      time.Time{},
-		}
-		return &token, nil
-	}
-
-	params := url.Values{}
-	params.Add("grant_type", "authorization_code")
-	params.Add("appid", idp.Config.ClientID)
-	params.Add("secret", idp.Config.ClientSecret)
-	params.Add("code", code)
-
-	accessTokenUrl := fmt.Sprintf("https://api.weixin.qq.com/sns/oauth2/access_token?%s", params.Encode())
-	tokenResponse, err := idp.Client.Get(accessTokenUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			return
-		}
-	}(tokenResponse.Body)
-
-	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(tokenResponse.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	// {"errcode":40163,"errmsg":"code been used, rid: 6206378a-793424c0-2e4091cc"}
-	if strings.Contains(buf.String(), "errcode") {
-		return nil, fmt.Errorf(buf.String())
-	}
-
-	var wechatAccessToken WechatAccessToken
-	if err = json.Unmarshal(buf.Bytes(), &wechatAccessToken); err != nil {
-		return nil, err
-	}
-
-	token := oauth2.Token{
-		AccessToken:  wechatAccessToken.AccessToken,
-		TokenType:    "WeChatAccessToken",
-		RefreshToken: wechatAccessToken.RefreshToken,
-		Expiry:       time.Time{},
-	}
-
-	raw := make(map[string]string)
-	raw["Openid"] = wechatAccessToken.Openid
-	token.WithExtra(raw)
-
-	return &token, nil
-}
-
-// WechatUserInfo 微信用户信息结构体
-type WechatUserInfo struct {
-	Openid     string   `json:"openid"`     // 用户的唯一标识
-	Nickname   string   `json:"nickname"`   // 用户昵称
-	Sex        int      `json:"sex"`        // 用户的性别，值为1时是男性，值为2时是女性，值为0时是未知
-	Language   string   `json:"language"`   // 用户的语言，简体中文为zh_CN
-	City       string   `json:"city"`       // 普通用户个人资料填写的城市
-	Province   string   `json:"province"`   // 用户个人资料填写的省份
-	Country    string   `json:"country"`    // 国家，如中国为CN
-	Headimgurl string   `json:"headimgurl"` // 用户头像，最后一个数值代表正方形头像大小（有0、46、64、96、132数值可选，0代表640*640正方形头像），用户没有头像时该项为空
-	Privilege  []string `json:"privilege"`  // 用户特权信息，json 数组，如微信沃卡用户为（chinaunicom）
-	Unionid    string   `json:"unionid"`    // 只有在用户将公众号绑定到微信开放平台帐号后，才会出现该字段
-}
-
-// GetUserInfo 通过访问令牌获取微信用户信息
-// 参数:
-//   - token: OAuth2访问令牌
-//
-// 返回:
-//   - *UserInfo: 标准化用户信息
-//   - error: 错误信息
-//
-// 详细文档: https://developers.weixin.qq.com/doc/oplatform/Website_App/WeChat_Login/Authorized_Interface_Calling_UnionId.html
-func (idp *WeChatIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
-	var wechatUserInfo WechatUserInfo
-	accessToken := token.AccessToken
-
-	if strings.HasPrefix(accessToken, "wechat_oa:") {
-		Lock.RLock()
-		mapValue, ok := WechatCacheMap[accessToken[10:]]
-		Lock.RUnlock()
-
-		if !ok || mapValue.WechatUnionId == "" {
-			return nil, fmt.Errorf("error ticket")
-		}
-
-		Lock.Lock()
-		delete(WechatCacheMap, accessToken[10:])
-		Lock.Unlock()
-
-		userInfo := UserInfo{
-			Id:          mapValue.WechatUnionId,
-			Username:    "wx_user_" + mapValue.WechatUnionId,
-			DisplayName: "wx_user_" + mapValue.WechatUnionId,
-			AvatarUrl:   "",
-		}
-		return &userInfo, nil
-	}
-
-	openid := token.Extra("Openid")
-
-	userInfoUrl := fmt.Sprintf("https://api.weixin.qq.com/sns/userinfo?access_token=%s&openid=%s", accessToken, openid)
-	resp, err := idp.Client.Get(userInfoUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			return
-		}
-	}(resp.Body)
-
-	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	if err = json.Unmarshal(buf.Bytes(), &wechatUserInfo); err != nil {
-		return nil, err
-	}
-
-	id := wechatUserInfo.Unionid
-	if id == "" {
-		id = wechatUserInfo.Openid
-	}
-
-	extra := make(map[string]string)
-	extra["wechat_unionid"] = wechatUserInfo.Openid
-	// For WeChat, different appId corresponds to different openId
-	extra[BuildWechatOpenIdKey(idp.Config.ClientID)] = wechatUserInfo.Openid
-	userInfo := UserInfo{
-		Id:          id,
-		Username:    wechatUserInfo.Nickname,
-		DisplayName: wechatUserInfo.Nickname,
-		AvatarUrl:   wechatUserInfo.Headimgurl,
-		Extra:       extra,
-	}
-	return &userInfo, nil
-}
-
-// BuildWechatOpenIdKey 构建微信OpenId键
-// 参数:
-//   - appId: 微信应用AppId
-//
-// 返回:
-//   - string: 格式化的键值
-func BuildWechatOpenIdKey(appId string) string {
-	return fmt.Sprintf("wechat_openid_%s", appId)
-}
-
-// GetWechatOfficialAccountAccessToken 获取微信公众号访问令牌
-// 参数:
-//   - clientId: 微信公众号AppId
-//   - clientSecret: 微信公众号AppSecret
-//
-// 返回:
-//   - string: 访问令牌
-//   - string: 错误消息
-//   - error: 错误信息
-func GetWechatOfficialAccountAccessToken(clientId string, clientSecret string) (string, string, error) {
-	accessTokenUrl := fmt.Sprintf("https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=%s&secret=%s", clientId, clientSecret)
-	request, err := http.NewRequest("GET", accessTokenUrl, nil)
-	if err != nil {
-		return "", "", err
-	}
-
-	client := new(http.Client)
-	resp, err := client.Do(request)
-	if err != nil {
-		return "", "", err
-	}
-	defer resp.Body.Close()
-
-	respBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", err
-	}
-
-	var data struct {
-		ExpireIn    int    `json:"expires_in"`
-		AccessToken string `json:"access_token"`
-		ErrCode     int    `json:"errcode"`
-		Errmsg      string `json:"errmsg"`
-	}
-	err = json.Unmarshal(respBytes, &data)
-	if err != nil {
-		return "", "", err
-	}
-
-	return data.AccessToken, data.Errmsg, nil
-}
-
-// GetWechatOfficialAccountQRCode 获取微信公众号二维码
-// 参数:
-//   - clientId: 微信公众号AppId
-//   - clientSecret: 微信公众号AppSecret
-//   - providerId: 提供者ID，用作场景字符串
-//
-// 返回:
-//   - string: Base64编码的二维码图片
-//   - string: 二维码票据
-//   - error: 错误信息
-func GetWechatOfficialAccountQRCode(clientId string, clientSecret string, providerId string) (string, string, error) {
-	accessToken, errMsg, err := GetWechatOfficialAccountAccessToken(clientId, clientSecret)
-	if err != nil {
-		return "", "", err
-	}
-
-	if errMsg != "" {
-		return "", "", fmt.Errorf("Fail to fetch WeChat QRcode: %s", errMsg)
-	}
-
-	client := new(http.Client)
-
-	weChatEndpoint := "https://api.weixin.qq.com/cgi-bin/qrcode/create"
-	qrCodeUrl := fmt.Sprintf("%s?access_token=%s", weChatEndpoint, accessToken)
-	params := fmt.Sprintf(`{"expire_seconds": 3600, "action_name": "QR_STR_SCENE", "action_info": {"scene": {"scene_str": "%s"}}}`, providerId)
-
-	bodyData := bytes.NewReader([]byte(params))
-	requeset, err := http.NewRequest("POST", qrCodeUrl, bodyData)
-	if err != nil {
-		return "", "", err
-	}
-
-	resp, err := client.Do(requeset)
-	if err != nil {
-		return "", "", err
-	}
-	defer resp.Body.Close()
-
-	respBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", err
-	}
-	var data struct {
-		Ticket        string `json:"ticket"`
-		ExpireSeconds int    `json:"expire_seconds"`
-		URL           string `json:"url"`
-	}
-	err = json.Unmarshal(respBytes, &data)
-	if err != nil {
-		return "", "", err
-	}
-
-	var png []byte
-	png, err = qrcode.Encode(data.URL, qrcode.Medium, 256)
-	base64Image := base64.StdEncoding.EncodeToString(png)
-	return base64Image, data.Ticket, nil
-}
-
-// VerifyWechatSignature 验证微信签名
-// 参数:
-//   - token: 微信公众号配置的Token
-//   - nonce: 随机数
-//   - timestamp: 时间戳
-//   - signature: 微信加密签名
-//
-// 返回:
-//   - bool: 验证结果
-func VerifyWechatSignature(token string, nonce string, timestamp string, signature string) bool {
-	// verify the signature
-	tmpArr := sort.StringSlice{token, timestamp, nonce}
-	sort.Sort(tmpArr)
-
-	tmpStr := ""
-	for _, str := range tmpArr {
-		tmpStr = tmpStr + str
-	}
-
-	b := sha1.Sum([]byte(tmpStr))
-	res := hex.EncodeToString(b[:])
-	return res == signature
-}
+// 微信OAuth2登录提供者实现
+// 支持微信网页登录和公众号扫码登录
+package idp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/oauth2"
+)
+
+// 微信登录缓存相关变量
+var (
+	WechatCacheMap map[string]WechatCacheMapValue // 微信登录缓存映射
+	Lock           sync.RWMutex                   // 读写锁
+)
+
+// WeChatIdProvider 微信登录提供者
+// 实现微信OAuth2登录功能
+type WeChatIdProvider struct {
+	providerBase
+
+	Client *http.Client   // HTTP客户端
+	Config *oauth2.Config // OAuth2配置
+}
+
+// WechatCacheMapValue 微信缓存值结构体
+// 用于临时存储扫码登录状态
+type WechatCacheMapValue struct {
+	IsScanned     bool   // 是否已扫码
+	WechatUnionId string // 微信UnionId
+}
+
+func init() {
+	RegisterProvider(IDP_WECHAT, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		idp := NewWeChatIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl)
+		idp.applyProviderInfo(idpInfo, idp.Config, false)
+		return idp, nil
+	})
+	RegisterProviderValidator(IDP_WECHAT, requireClientSecret)
+}
+
+// NewWeChatIdProvider 创建微信登录提供者实例
+// 参数:
+//   - clientId: 微信应用的AppId
+//   - clientSecret: 微信应用的AppSecret
+//   - redirectUrl: OAuth2重定向URL
+//
+// 返回:
+//   - *WeChatIdProvider: 微信登录提供者实例
+func NewWeChatIdProvider(clientId string, clientSecret string, redirectUrl string) *WeChatIdProvider {
+	idp := &WeChatIdProvider{Client: DefaultHttpClient(), providerBase: providerBase{providerType: IDP_WECHAT, clientId: clientId}}
+
+	config := idp.getConfig(clientId, clientSecret, redirectUrl)
+	idp.Config = config
+
+	return idp
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *WeChatIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// getConfig 获取微信OAuth2配置
+// 参数:
+//   - clientId: 微信应用的AppId
+//   - clientSecret: 微信应用的AppSecret
+//   - redirectUrl: OAuth2重定向URL
+//
+// 返回:
+//   - *oauth2.Config: OAuth2配置实例
+func (idp *WeChatIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
+	endpoint := oauth2.Endpoint{
+		AuthURL:  "https://open.weixin.qq.com/connect/qrconnect",
+		TokenURL: "https://api.weixin.qq.com/sns/oauth2/access_token",
+	}
+
+	config := &oauth2.Config{
+		Scopes:       []string{"snsapi_login"},
+		Endpoint:     endpoint,
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectUrl,
+	}
+
+	return config
+}
+
+// GetAuthURL 生成微信授权跳转URL
+// 默认生成网站应用扫码登录地址，授权范围包含snsapi_base或snsapi_userinfo时生成公众号网页授权地址
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+//
+// 返回:
+//   - string: 授权URL
+func (idp *WeChatIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	o := newAuthOptions(idp.Config, opts)
+
+	// 公众号网页授权（snsapi_base/snsapi_userinfo）与网站应用扫码登录使用不同的授权地址
+	authUrl := idp.Config.Endpoint.AuthURL
+	scope := o.scope(",")
+	if strings.Contains(scope, "snsapi_base") || strings.Contains(scope, "snsapi_userinfo") {
+		authUrl = wechatOAuth2AuthURL(authUrl)
+	}
+
+	params := url.Values{}
+	params.Set("appid", idp.Config.ClientID)
+	params.Set("redirect_uri", o.redirectUrl)
+	params.Set("response_type", "code")
+	params.Set("scope", scope)
+	params.Set("state", state)
+
+	// 微信要求授权URL必须以#wechat_redirect结尾
+	return buildAuthURL(authUrl, params, o) + "#wechat_redirect"
+}
+
+// wechatOAuth2AuthURL 由扫码登录授权地址得到公众号网页授权地址
+// 两者部署在同一主机，只替换路径，AuthURL覆盖的协议和主机保持不变；路径不是扫码登录地址时视为已显式配置，原样使用
+// 参数:
+//   - authUrl: 配置的授权地址
+//
+// 返回:
+//   - string: 公众号网页授权地址
+func wechatOAuth2AuthURL(authUrl string) string {
+	u, err := url.Parse(authUrl)
+	if err != nil || !strings.HasSuffix(u.Path, "/connect/qrconnect") {
+		return authUrl
+	}
+	u.Path = strings.TrimSuffix(u.Path, "qrconnect") + "oauth2/authorize"
+	return u.String()
+}
+
+// wechatRefreshTokenURL 由令牌接口地址得到刷新令牌接口地址
+// 两者部署在同一主机，只替换路径，HostUrl或TokenURL覆盖的协议和主机保持不变
+// 参数:
+//   - tokenUrl: 配置的令牌接口地址
+//
+// 返回:
+//   - string: 刷新令牌接口地址
+func wechatRefreshTokenURL(tokenUrl string) string {
+	u, err := url.Parse(tokenUrl)
+	if err != nil {
+		return "https://api.weixin.qq.com/sns/oauth2/refresh_token"
+	}
+	if strings.HasSuffix(u.Path, "/access_token") {
+		u.Path = strings.TrimSuffix(u.Path, "access_token") + "refresh_token"
+	} else {
+		u.Path = "/sns/oauth2/refresh_token"
+	}
+	u.RawQuery = ""
+	return u.String()
+}
+
+// Capabilities 获取微信登录的能力描述
+// 网站应用扫码登录，公众号网页授权使用snsapi_base时在微信内静默授权
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *WeChatIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		UnionId:      true,
+		RefreshToken: true,
+		QRCodeLogin:  true,
+		SilentLogin:  true,
+	})
+}
+
+// WechatAccessToken 微信访问令牌响应结构体
+type WechatAccessToken struct {
+	AccessToken  string `json:"access_token"`  // 接口调用凭证
+	ExpiresIn    int64  `json:"expires_in"`    // access_token接口调用凭证超时时间，单位（秒）
+	RefreshToken string `json:"refresh_token"` // 用户刷新access_token
+	Openid       string `json:"openid"`        // 授权用户唯一标识
+	Scope        string `json:"scope"`         // 用户授权的作用域，使用逗号（,）分隔
+	Unionid      string `json:"unionid"`       // 只有在用户将公众号绑定到微信开放平台帐号后，才会出现该字段
+}
+
+// GetToken 通过授权码获取微信访问令牌
+// 参数:
+//   - code: 微信返回的授权码或特殊格式的票据
+//
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+//
+// 详细文档: https://developers.weixin.qq.com/doc/oplatform/Website_App/WeChat_Login/Wechat_Login.html
+func (idp *WeChatIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取微信访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - code: 微信返回的授权码或特殊格式的票据
+//
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *WeChatIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *WeChatIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	if strings.HasPrefix(code, "wechat_oa:") {
+		token := oauth2.Token{
+			AccessToken: code,
+			TokenType:   "WeChatAccessToken",
+			Expiry:      time.Time{},
+		}
+		return &token, nil
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", "authorization_code")
+	params.Add("appid", idp.Config.ClientID)
+	params.Add("secret", idp.Config.ClientSecret)
+	params.Add("code", code)
+
+	return idp.requestAccessToken(ctx, OpToken, fmt.Sprintf("%s?%s", idp.Config.Endpoint.TokenURL, params.Encode()))
+}
+
+// RefreshToken 使用刷新令牌获取新的微信访问令牌，公众号扫码登录的票据不支持刷新
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: GetToken返回的OAuth2令牌
+//
+// 返回:
+//   - *oauth2.Token: 新的OAuth2令牌
+//   - error: 错误信息
+//
+// 详细文档: https://developers.weixin.qq.com/doc/oplatform/Website_App/WeChat_Login/Authorized_Interface_Calling_UnionID.html
+func (idp *WeChatIdProvider) RefreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	start := time.Now()
+	newToken, err := idp.refreshToken(ctx, token)
+	idp.finishOperation(ctx, OpRefreshToken, start, err)
+	return newToken, err
+}
+
+// refreshToken 刷新令牌，见RefreshToken
+func (idp *WeChatIdProvider) refreshToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	if err := checkRefreshToken(token); err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", "refresh_token")
+	params.Add("appid", idp.Config.ClientID)
+	params.Add("refresh_token", token.RefreshToken)
+
+	refreshUrl := fmt.Sprintf("%s?%s", wechatRefreshTokenURL(idp.Config.Endpoint.TokenURL), params.Encode())
+	newToken, err := idp.requestAccessToken(ctx, OpRefreshToken, refreshUrl)
+	if err != nil {
+		return nil, err
+	}
+	return inheritTokenFields(newToken, token, "Openid", "Unionid"), nil
+}
+
+// requestAccessToken 请求微信令牌接口并解析访问令牌，获取和刷新令牌共用
+// 参数:
+//   - ctx: 请求上下文
+//   - op: 操作类型，用于错误信息
+//   - tokenUrl: 带查询参数的令牌接口地址
+//
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌，Extra中包含Openid和Unionid
+//   - error: 错误信息
+func (idp *WeChatIdProvider) requestAccessToken(ctx context.Context, op string, tokenUrl string) (*oauth2.Token, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", tokenUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	// {"errcode":40163,"errmsg":"code been used, rid: 6206378a-793424c0-2e4091cc"}
+	_, data, err := idp.doRequest(idp.Client, req, op, errcodeCheck(IDP_WECHAT, op))
+	if err != nil {
+		return nil, err
+	}
+
+	var wechatAccessToken WechatAccessToken
+	if err = json.Unmarshal(data, &wechatAccessToken); err != nil {
+		return nil, err
+	}
+
+	token := oauth2.Token{
+		AccessToken:  wechatAccessToken.AccessToken,
+		TokenType:    "WeChatAccessToken",
+		RefreshToken: wechatAccessToken.RefreshToken,
+		Expiry:       time.Unix(time.Now().Unix()+wechatAccessToken.ExpiresIn, 0),
+	}
+
+	raw := make(map[string]interface{})
+	raw["Openid"] = wechatAccessToken.Openid
+	raw["Unionid"] = wechatAccessToken.Unionid
+
+	return idp.checkToken(op, token.WithExtra(raw))
+}
+
+// WechatUserInfo 微信用户信息结构体
+type WechatUserInfo struct {
+	Openid     string   `json:"openid"`     // 用户的唯一标识
+	Nickname   string   `json:"nickname"`   // 用户昵称
+	Sex        int      `json:"sex"`        // 用户的性别，值为1时是男性，值为2时是女性，值为0时是未知
+	Language   string   `json:"language"`   // 用户的语言，简体中文为zh_CN
+	City       string   `json:"city"`       // 普通用户个人资料填写的城市
+	Province   string   `json:"province"`   // 用户个人资料填写的省份
+	Country    string   `json:"country"`    // 国家，如中国为CN
+	Headimgurl string   `json:"headimgurl"` // 用户头像，最后一个数值代表正方形头像大小（有0、46、64、96、132数值可选，0代表640*640正方形头像），用户没有头像时该项为空
+	Privilege  []string `json:"privilege"`  // 用户特权信息，json 数组，如微信沃卡用户为（chinaunicom）
+	Unionid    string   `json:"unionid"`    // 只有在用户将公众号绑定到微信开放平台帐号后，才会出现该字段
+}
+
+// GetUserInfo 通过访问令牌获取微信用户信息
+// 参数:
+//   - token: OAuth2访问令牌
+//
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+//
+// 详细文档: https://developers.weixin.qq.com/doc/oplatform/Website_App/WeChat_Login/Authorized_Interface_Calling_UnionId.html
+func (idp *WeChatIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 通过访问令牌获取微信用户信息，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: OAuth2访问令牌
+//
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *WeChatIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *WeChatIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	var wechatUserInfo WechatUserInfo
+	accessToken := token.AccessToken
+
+	if strings.HasPrefix(accessToken, "wechat_oa:") {
+		Lock.RLock()
+		mapValue, ok := WechatCacheMap[accessToken[10:]]
+		Lock.RUnlock()
+
+		if !ok || mapValue.WechatUnionId == "" {
+			return nil, newProviderErrorf(IDP_WECHAT, OpUserInfo, ErrCodeExpiredOrUsed, "公众号扫码票据无效或已被使用")
+		}
+
+		Lock.Lock()
+		delete(WechatCacheMap, accessToken[10:])
+		Lock.Unlock()
+
+		userInfo := UserInfo{
+			Id:          mapValue.WechatUnionId,
+			Username:    "wx_user_" + mapValue.WechatUnionId,
+			DisplayName: "wx_user_" + mapValue.WechatUnionId,
+			UnionId:     mapValue.WechatUnionId,
+			AvatarUrl:   "",
+			Provider:    idp.providerType,
+			SubType:     idp.subType,
+			Identity:    idp.identity("", IdentityKey{Kind: "unionid", Scope: IdentityScopeDeveloper, Value: mapValue.WechatUnionId}),
+		}
+		return &userInfo, nil
+	}
+
+	openid, _ := token.Extra("Openid").(string)
+
+	userInfoUrl := fmt.Sprintf("%s?access_token=%s&openid=%s", idp.resolveUserInfoUrl("https://api.weixin.qq.com/sns/userinfo"), accessToken, openid)
+	req, err := http.NewRequestWithContext(withIdempotent(ctx), "GET", userInfoUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := idp.doRequest(idp.Client, req, OpUserInfo, errcodeCheck(IDP_WECHAT, OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &wechatUserInfo); err != nil {
+		return nil, err
+	}
+
+	id := wechatUserInfo.Unionid
+	if id == "" {
+		id = wechatUserInfo.Openid
+	}
+
+	extra := make(map[string]string)
+	if wechatUserInfo.Unionid != "" {
+		extra["wechat_unionid"] = wechatUserInfo.Unionid
+	}
+	// For WeChat, different appId corresponds to different openId
+	extra[BuildWechatOpenIdKey(idp.Config.ClientID)] = wechatUserInfo.Openid
+	userInfo := UserInfo{
+		Id:          id,
+		Username:    wechatUserInfo.Nickname,
+		DisplayName: wechatUserInfo.Nickname,
+		UnionId:     wechatUserInfo.Unionid,
+		AvatarUrl:   wechatUserInfo.Headimgurl,
+		Extra:       extra,
+		Identity: idp.identity("",
+			IdentityKey{Kind: "openid", Scope: IdentityScopeApp, Value: wechatUserInfo.Openid},
+			IdentityKey{Kind: "unionid", Scope: IdentityScopeDeveloper, Value: wechatUserInfo.Unionid},
+		),
+	}
+
+	if err = idp.completeUserInfo(&userInfo, data); err != nil {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
+
+// BuildWechatOpenIdKey 构建微信OpenId键
+// 参数:
+//   - appId: 微信应用AppId
+//
+// 返回:
+//   - string: 格式化的键值
+func BuildWechatOpenIdKey(appId string) string {
+	return fmt.Sprintf("wechat_openid_%s", appId)
+}
+
+// GetWechatOfficialAccountAccessToken 获取微信公众号访问令牌
+// 平台返回的错误码通过错误消息返回，需要按错误分类处理时使用GetWechatOfficialAccountAccessTokenContext
+// 参数:
+//   - clientId: 微信公众号AppId
+//   - clientSecret: 微信公众号AppSecret
+//
+// 返回:
+//   - string: 访问令牌
+//   - string: 错误消息
+//   - error: 错误信息
+func GetWechatOfficialAccountAccessToken(clientId string, clientSecret string) (string, string, error) {
+	accessToken, err := GetWechatOfficialAccountAccessTokenContext(context.Background(), clientId, clientSecret)
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) && providerErr.Code != "" {
+		return "", providerErr.Message, nil
+	}
+	return accessToken, "", err
+}
+
+// GetWechatOfficialAccountAccessTokenContext 获取微信公众号访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - clientId: 微信公众号AppId
+//   - clientSecret: 微信公众号AppSecret
+//
+// 返回:
+//   - string: 访问令牌
+//   - error: 平台返回错误码时为*ProviderError，可使用errors.Is(err, ErrRateLimited)等判断
+func GetWechatOfficialAccountAccessTokenContext(ctx context.Context, clientId string, clientSecret string) (string, error) {
+	accessTokenUrl := fmt.Sprintf("https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=%s&secret=%s", clientId, clientSecret)
+	request, err := http.NewRequestWithContext(ctx, "GET", accessTokenUrl, nil)
+	if err != nil {
+		return "", err
+	}
+
+	client := DefaultHttpClient()
+	start := func() *callObservation {
+		return startCall(ctx, getDefaultObserver(), RequestEvent{Provider: IDP_WECHAT, Endpoint: "officialAccountToken", Method: request.Method, Url: accessTokenUrl})
+	}
+	// 获取公众号访问令牌可以安全重试
+	_, respBytes, err := doRetryableRequest(client, request, getDefaultRetryPolicy(), getRateLimiter(IDP_WECHAT, clientId), start, errcodeCheck(IDP_WECHAT, OpToken))
+	if err != nil {
+		return "", err
+	}
+
+	var data struct {
+		ExpireIn    int    `json:"expires_in"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.Unmarshal(respBytes, &data)
+	if err != nil {
+		return "", err
+	}
+	if data.AccessToken == "" {
+		return "", newProviderErrorf(IDP_WECHAT, OpToken, nil, "令牌响应中缺少访问令牌")
+	}
+
+	return data.AccessToken, nil
+}
+
+// GetWechatOfficialAccountQRCode 获取微信公众号二维码
+// 参数:
+//   - clientId: 微信公众号AppId
+//   - clientSecret: 微信公众号AppSecret
+//   - providerId: 提供者ID，用作场景字符串
+//
+// 返回:
+//   - string: Base64编码的二维码图片
+//   - string: 二维码票据
+//   - error: 错误信息
+func GetWechatOfficialAccountQRCode(clientId string, clientSecret string, providerId string) (string, string, error) {
+	return GetWechatOfficialAccountQRCodeContext(context.Background(), clientId, clientSecret, providerId)
+}
+
+// GetWechatOfficialAccountQRCodeContext 获取微信公众号二维码，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，获取令牌和创建二维码两次调用共用同一上下文
+//   - clientId: 微信公众号AppId
+//   - clientSecret: 微信公众号AppSecret
+//   - providerId: 提供者ID，用作场景字符串
+//
+// 返回:
+//   - string: Base64编码的二维码图片
+//   - string: 二维码票据
+//   - error: 错误信息
+func GetWechatOfficialAccountQRCodeContext(ctx context.Context, clientId string, clientSecret string, providerId string) (string, string, error) {
+	accessToken, err := GetWechatOfficialAccountAccessTokenContext(ctx, clientId, clientSecret)
+	if err != nil {
+		return "", "", err
+	}
+
+	client := DefaultHttpClient()
+
+	weChatEndpoint := "https://api.weixin.qq.com/cgi-bin/qrcode/create"
+	qrCodeUrl := fmt.Sprintf("%s?access_token=%s", weChatEndpoint, accessToken)
+	params := fmt.Sprintf(`{"expire_seconds": 3600, "action_name": "QR_STR_SCENE", "action_info": {"scene": {"scene_str": "%s"}}}`, providerId)
+
+	bodyData := bytes.NewReader([]byte(params))
+	requeset, err := http.NewRequestWithContext(ctx, "POST", qrCodeUrl, bodyData)
+	if err != nil {
+		return "", "", err
+	}
+
+	call := startCall(ctx, getDefaultObserver(), RequestEvent{Provider: IDP_WECHAT, Endpoint: "officialAccountQRCode", Method: requeset.Method, Url: qrCodeUrl})
+	_, respBytes, err := doObservedRequest(client, requeset, getRateLimiter(IDP_WECHAT, clientId), call, nil)
+	if err != nil {
+		return "", "", err
+	}
+	var data struct {
+		Ticket        string `json:"ticket"`
+		ExpireSeconds int    `json:"expire_seconds"`
+		URL           string `json:"url"`
+	}
+	err = json.Unmarshal(respBytes, &data)
+	if err != nil {
+		return "", "", err
+	}
+
+	var png []byte
+	png, err = qrcode.Encode(data.URL, qrcode.Medium, 256)
+	base64Image := base64.StdEncoding.EncodeToString(png)
+	return base64Image, data.Ticket, nil
+}
+
+// VerifyWechatSignature 验证微信签名
+// 参数:
+//   - token: 微信公众号配置的Token
+//   - nonce: 随机数
+//   - timestamp: 时间戳
+//   - signature: 微信加密签名
+//
+// 返回:
+//   - bool: 验证结果
+func VerifyWechatSignature(token string, nonce string, timestamp string, signature string) bool {
+	// verify the signature
+	tmpArr := sort.StringSlice{token, timestamp, nonce}
+	sort.Sort(tmpArr)
+
+	tmpStr := ""
+	for _, str := range tmpArr {
+		tmpStr = tmpStr + str
+	}
+
+	b := sha1.Sum([]byte(tmpStr))
+	res := hex.EncodeToString(b[:])
+	return res == signature
+}
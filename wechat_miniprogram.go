@@ -1,101 +1,262 @@
-// 微信小程序登录提供者实现
-// 支持微信小程序授权登录和会话管理
-package idp
-
-import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-
-	"golang.org/x/oauth2"
-)
-
-// WeChatMiniProgramIdProvider 微信小程序登录提供者
-// 实现微信小程序授权登录功能
-type WeChatMiniProgramIdProvider struct {
-	Client *http.Client   // HTTP客户端
-	Config *oauth2.Config // OAuth2配置
-}
-
-// NewWeChatMiniProgramIdProvider 创建微信小程序登录提供者实例
-// 参数:
-//   - clientId: 微信小程序的AppId
-//   - clientSecret: 微信小程序的AppSecret
-//
-// 返回:
-//   - *WeChatMiniProgramIdProvider: 微信小程序登录提供者实例
-func NewWeChatMiniProgramIdProvider(clientId string, clientSecret string) *WeChatMiniProgramIdProvider {
-	idp := &WeChatMiniProgramIdProvider{}
-
-	config := idp.getConfig(clientId, clientSecret)
-	idp.Config = config
-	idp.Client = &http.Client{}
-	return idp
-}
-
-// SetHttpClient 设置HTTP客户端
-// 参数:
-//   - client: HTTP客户端实例
-func (idp *WeChatMiniProgramIdProvider) SetHttpClient(client *http.Client) {
-	idp.Client = client
-}
-
-// getConfig 获取微信小程序OAuth2配置
-// 参数:
-//   - clientId: 微信小程序的AppId
-//   - clientSecret: 微信小程序的AppSecret
-//
-// 返回:
-//   - *oauth2.Config: OAuth2配置实例
-func (idp *WeChatMiniProgramIdProvider) getConfig(clientId string, clientSecret string) *oauth2.Config {
-	config := &oauth2.Config{
-		ClientID:     clientId,
-		ClientSecret: clientSecret,
-	}
-
-	return config
-}
-
-// WeChatMiniProgramSessionResponse 微信小程序会话响应结构体
-// 包含从微信小程序API获取的会话信息
-type WeChatMiniProgramSessionResponse struct {
-	Openid     string `json:"openid"`      // 用户唯一标识
-	SessionKey string `json:"session_key"` // 会话密钥
-	Unionid    string `json:"unionid"`     // 用户在开放平台的唯一标识符，若当前小程序已绑定到微信开放平台帐号下会返回
-	Errcode    int    `json:"errcode"`     // 错误码
-	Errmsg     string `json:"errmsg"`      // 错误信息
-}
-
-// GetSessionByCode 通过授权码获取微信小程序会话信息
-// 参数:
-//   - code: 微信小程序返回的授权码
-//
-// 返回:
-//   - *WeChatMiniProgramSessionResponse: 会话响应信息
-//   - error: 错误信息
-//
-// 详细文档: https://developers.weixin.qq.com/miniprogram/dev/OpenApiDoc/user-login/code2Session.html
-func (idp *WeChatMiniProgramIdProvider) GetSessionByCode(code string) (*WeChatMiniProgramSessionResponse, error) {
-	sessionUri := fmt.Sprintf(
-		"https://api.weixin.qq.com/sns/jscode2session?appid=%s&secret=%s&js_code=%s&grant_type=authorization_code",
-		idp.Config.ClientID, idp.Config.ClientSecret, code)
-	sessionResponse, err := idp.Client.Get(sessionUri)
-	if err != nil {
-		return nil, err
-	}
-	defer sessionResponse.Body.Close()
-	data, err := io.ReadAll(sessionResponse.Body)
-	if err != nil {
-		return nil, err
-	}
-	var session WeChatMiniProgramSessionResponse
-	err = json.Unmarshal(data, &session)
-	if err != nil {
-		return nil, err
-	}
-	if session.Errcode != 0 {
-		return nil, fmt.Errorf("err: %s", session.Errmsg)
-	}
-	return &session, nil
-}
+// 微信小程序登录提供者实现
+// 支持微信小程序授权登录和会话管理
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// WeChatMiniProgramIdProvider 微信小程序登录提供者
+// 实现微信小程序授权登录功能
+type WeChatMiniProgramIdProvider struct {
+	providerBase
+
+	Client *http.Client   // HTTP客户端
+	Config *oauth2.Config // OAuth2配置
+}
+
+func init() {
+	RegisterProvider(IDP_WECHAT_MINI_PROGRAM, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		idp := NewWeChatMiniProgramIdProvider(idpInfo.ClientId, idpInfo.ClientSecret)
+		idp.applyProviderInfo(idpInfo, idp.Config, false)
+		return idp, nil
+	})
+	RegisterProviderValidator(IDP_WECHAT_MINI_PROGRAM, requireClientSecret)
+}
+
+// NewWeChatMiniProgramIdProvider 创建微信小程序登录提供者实例
+// 参数:
+//   - clientId: 微信小程序的AppId
+//   - clientSecret: 微信小程序的AppSecret
+//
+// 返回:
+//   - *WeChatMiniProgramIdProvider: 微信小程序登录提供者实例
+func NewWeChatMiniProgramIdProvider(clientId string, clientSecret string) *WeChatMiniProgramIdProvider {
+	idp := &WeChatMiniProgramIdProvider{Client: DefaultHttpClient(), providerBase: providerBase{providerType: IDP_WECHAT_MINI_PROGRAM, clientId: clientId}}
+
+	config := idp.getConfig(clientId, clientSecret)
+	idp.Config = config
+	return idp
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *WeChatMiniProgramIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// getConfig 获取微信小程序OAuth2配置
+// 参数:
+//   - clientId: 微信小程序的AppId
+//   - clientSecret: 微信小程序的AppSecret
+//
+// 返回:
+//   - *oauth2.Config: OAuth2配置实例
+func (idp *WeChatMiniProgramIdProvider) getConfig(clientId string, clientSecret string) *oauth2.Config {
+	endpoint := oauth2.Endpoint{
+		TokenURL: "https://api.weixin.qq.com/sns/jscode2session",
+	}
+
+	config := &oauth2.Config{
+		Endpoint:     endpoint,
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+	}
+
+	return config
+}
+
+// GetAuthURL 微信小程序通过wx.login在客户端内获取授权码，没有网页授权跳转地址
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+//
+// 返回:
+//   - string: 始终为空字符串
+func (idp *WeChatMiniProgramIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	return ""
+}
+
+// Capabilities 获取微信小程序登录的能力描述
+// 授权码由小程序内的wx.login静默获取
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *WeChatMiniProgramIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		UnionId:     true,
+		SilentLogin: true,
+	})
+}
+
+// WeChatMiniProgramSessionResponse 微信小程序会话响应结构体
+// 包含从微信小程序API获取的会话信息
+type WeChatMiniProgramSessionResponse struct {
+	Openid     string `json:"openid"`      // 用户唯一标识
+	SessionKey string `json:"session_key"` // 会话密钥
+	Unionid    string `json:"unionid"`     // 用户在开放平台的唯一标识符，若当前小程序已绑定到微信开放平台帐号下会返回
+	Errcode    int    `json:"errcode"`     // 错误码
+	Errmsg     string `json:"errmsg"`      // 错误信息
+}
+
+// GetSessionByCode 通过授权码获取微信小程序会话信息
+// 参数:
+//   - code: 微信小程序返回的授权码
+//
+// 返回:
+//   - *WeChatMiniProgramSessionResponse: 会话响应信息
+//   - error: 错误信息
+//
+// 详细文档: https://developers.weixin.qq.com/miniprogram/dev/OpenApiDoc/user-login/code2Session.html
+func (idp *WeChatMiniProgramIdProvider) GetSessionByCode(code string) (*WeChatMiniProgramSessionResponse, error) {
+	return idp.GetSessionByCodeContext(context.Background(), code)
+}
+
+// GetSessionByCodeContext 通过授权码获取微信小程序会话信息，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - code: 微信小程序返回的授权码
+//
+// 返回:
+//   - *WeChatMiniProgramSessionResponse: 会话响应信息
+//   - error: 错误信息
+func (idp *WeChatMiniProgramIdProvider) GetSessionByCodeContext(ctx context.Context, code string) (*WeChatMiniProgramSessionResponse, error) {
+	sessionUri := fmt.Sprintf(
+		"%s?appid=%s&secret=%s&js_code=%s&grant_type=authorization_code",
+		idp.Config.Endpoint.TokenURL, idp.Config.ClientID, idp.Config.ClientSecret, code)
+	req, err := http.NewRequestWithContext(ctx, "GET", sessionUri, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := idp.doRequest(idp.Client, req, OpToken, errcodeCheck(IDP_WECHAT_MINI_PROGRAM, OpToken))
+	if err != nil {
+		return nil, err
+	}
+	var session WeChatMiniProgramSessionResponse
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetToken 通过wx.login返回的授权码获取微信小程序会话
+// 参数:
+//   - code: 微信小程序返回的授权码
+//
+// 返回:
+//   - *oauth2.Token: 以session_key作为访问令牌，Extra中携带openid、unionid和session_key
+//   - error: 错误信息
+func (idp *WeChatMiniProgramIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过wx.login返回的授权码获取微信小程序会话，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - code: 微信小程序返回的授权码
+//
+// 返回:
+//   - *oauth2.Token: 以session_key作为访问令牌，Extra中携带openid、unionid和session_key
+//   - error: 错误信息
+func (idp *WeChatMiniProgramIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *WeChatMiniProgramIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	session, err := idp.GetSessionByCodeContext(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken: session.SessionKey,
+		TokenType:   "WeChatMiniProgramSession",
+	}
+
+	raw := make(map[string]interface{})
+	raw["openid"] = session.Openid
+	raw["unionid"] = session.Unionid
+	raw["session_key"] = session.SessionKey
+	return idp.checkToken(OpToken, token.WithExtra(raw))
+}
+
+// GetUserInfo 根据会话信息构建微信小程序用户信息
+// 小程序服务端接口不返回昵称和头像，用户信息仅包含OpenID和UnionID
+// 参数:
+//   - token: GetToken返回的会话令牌
+//
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *WeChatMiniProgramIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 根据会话信息构建微信小程序用户信息
+// 不需要调用微信接口，ctx仅用于满足IdProvider接口
+// 参数:
+//   - ctx: 请求上下文
+//   - token: GetToken返回的会话令牌
+//
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *WeChatMiniProgramIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *WeChatMiniProgramIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	openid, _ := token.Extra("openid").(string)
+	unionid, _ := token.Extra("unionid").(string)
+	if openid == "" {
+		return nil, newProviderErrorf(IDP_WECHAT_MINI_PROGRAM, OpUserInfo, nil, "openid is empty")
+	}
+
+	id := unionid
+	if id == "" {
+		id = openid
+	}
+
+	extra := make(map[string]string)
+	extra[BuildWechatOpenIdKey(idp.Config.ClientID)] = openid
+	userInfo := UserInfo{
+		Id:          id,
+		Username:    openid,
+		DisplayName: openid,
+		UnionId:     unionid,
+		Extra:       extra,
+		Identity: idp.identity("",
+			IdentityKey{Kind: "openid", Scope: IdentityScopeApp, Value: openid},
+			IdentityKey{Kind: "unionid", Scope: IdentityScopeDeveloper, Value: unionid},
+		),
+	}
+
+	// 会话中的openid和unionid作为原始数据参与字段映射，session_key不对外暴露
+	session, err := json.Marshal(map[string]string{"openid": openid, "unionid": unionid})
+	if err != nil {
+		return nil, err
+	}
+	if err = idp.completeUserInfo(&userInfo, session); err != nil {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
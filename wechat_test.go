@@ -0,0 +1,43 @@
+package idp_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/smart-unicom/idp"
+	"github.com/smart-unicom/idp/idptest"
+)
+
+// TestWechatRefreshTokenURL 未配置HostUrl、只通过TokenURL覆盖令牌接口时，刷新令牌请求发往同一主机
+func TestWechatRefreshTokenURL(t *testing.T) {
+	ctx := context.Background()
+	server := idptest.NewServer(t, idp.IDP_WECHAT)
+	idpInfo := server.ProviderInfo()
+	idpInfo.HostUrl = ""
+	idpInfo.TokenURL = server.URL + "/sns/oauth2/access_token"
+	idpInfo.UserInfoURL = server.URL + "/sns/userinfo"
+	provider, err := idp.GetIdProvider(idpInfo, "https://example.com/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.SetHttpClient(server.Client())
+	idp.SetProviderRetryPolicy(provider, &idp.RetryPolicy{MaxAttempts: 1})
+
+	token, err := idp.GetTokenContext(ctx, provider, server.IssueCode(testUser))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := idp.RefreshToken(ctx, provider, token)
+	if err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+	if n := server.Requests("/sns/oauth2/refresh_token"); n != 1 {
+		t.Errorf("模拟服务收到 %d 次刷新令牌请求, want 1", n)
+	}
+	if newToken.AccessToken == token.AccessToken {
+		t.Error("刷新后的访问令牌未更新")
+	}
+	if newToken.Extra("Openid") != token.Extra("Openid") {
+		t.Errorf("Openid = %v, want %v", newToken.Extra("Openid"), token.Extra("Openid"))
+	}
+}
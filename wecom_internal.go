@@ -1,192 +1,292 @@
-// 企业微信内部应用登录提供者实现
-// 支持企业微信内部应用授权登录和用户信息获取
-package idp
-
-import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"time"
-
-	"golang.org/x/oauth2"
-)
-
-// WeComInternalIdProvider 企业微信内部应用登录提供者
-// 实现企业微信内部应用OAuth2登录功能
-type WeComInternalIdProvider struct {
-	Client *http.Client   // HTTP客户端
-	Config *oauth2.Config // OAuth2配置
-}
-
-// NewWeComInternalIdProvider 创建企业微信内部应用登录提供者实例
-// 参数:
-//   - clientId: 企业微信应用的CorpId
-//   - clientSecret: 企业微信应用的CorpSecret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *WeComInternalIdProvider: 企业微信内部应用登录提供者实例
-func NewWeComInternalIdProvider(clientId string, clientSecret string, redirectUrl string) *WeComInternalIdProvider {
-	idp := &WeComInternalIdProvider{}
-
-	config := idp.getConfig(clientId, clientSecret, redirectUrl)
-	idp.Config = config
-
-	return idp
-}
-
-// SetHttpClient 设置HTTP客户端
-// 参数:
-//   - client: HTTP客户端实例
-func (idp *WeComInternalIdProvider) SetHttpClient(client *http.Client) {
-	idp.Client = client
-}
-
-// getConfig 获取企业微信内部应用OAuth2配置
-// 参数:
-//   - clientId: 企业微信应用的CorpId
-//   - clientSecret: 企业微信应用的CorpSecret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *oauth2.Config: OAuth2配置实例
-func (idp *WeComInternalIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
-	config := &oauth2.Config{
-		ClientID:     clientId,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectUrl,
-	}
-
-	return config
-}
-
-// WecomInterToken 企业微信内部应用访问令牌结构体
-type WecomInterToken struct {
-	Errcode     int    `json:"errcode"`      // 错误码
-	Errmsg      string `json:"errmsg"`       // 错误信息
-	AccessToken string `json:"access_token"` // 访问令牌
-	ExpiresIn   int    `json:"expires_in"`   // 访问令牌的有效时间，单位是秒
-}
-
-// GetToken 通过授权码获取企业微信内部应用访问令牌
-// 参数:
-//   - code: 企业微信返回的授权码
-// 返回:
-//   - *oauth2.Token: OAuth2访问令牌
-//   - error: 错误信息
-// 详细文档: https://developer.work.weixin.qq.com/document/path/91039
-func (idp *WeComInternalIdProvider) GetToken(code string) (*oauth2.Token, error) {
-	pTokenParams := &struct {
-		CorpId     string `json:"corpid"`
-		Corpsecret string `json:"corpsecret"`
-	}{idp.Config.ClientID, idp.Config.ClientSecret}
-	resp, err := idp.Client.Get(fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=%s&corpsecret=%s", pTokenParams.CorpId, pTokenParams.Corpsecret))
-	if err != nil {
-		return nil, err
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	pToken := &WecomInterToken{}
-	err = json.Unmarshal(data, pToken)
-	if err != nil {
-		return nil, err
-	}
-	if pToken.Errcode != 0 {
-		return nil, fmt.Errorf("pToken.Errcode = %d, pToken.Errmsg = %s", pToken.Errcode, pToken.Errmsg)
-	}
-
-	token := &oauth2.Token{
-		AccessToken: pToken.AccessToken,
-		Expiry:      time.Unix(time.Now().Unix()+int64(pToken.ExpiresIn), 0),
-	}
-
-	raw := make(map[string]interface{})
-	raw["code"] = code
-	token = token.WithExtra(raw)
-
-	return token, nil
-}
-
-// WecomInternalUserResp 企业微信内部用户响应结构体
-type WecomInternalUserResp struct {
-	Errcode int    `json:"errcode"` // 错误码
-	Errmsg  string `json:"errmsg"`  // 错误信息
-	UserId  string `json:"UserId"`  // 用户ID
-	OpenId  string `json:"OpenId"`  // 开放ID
-}
-
-// WecomInternalUserInfo 企业微信内部用户信息结构体
-type WecomInternalUserInfo struct {
-	Errcode int    `json:"errcode"`     // 错误码
-	Errmsg  string `json:"errmsg"`      // 错误信息
-	Name    string `json:"name"`        // 用户姓名
-	Email   string `json:"email"`       // 邮箱地址
-	Avatar  string `json:"avatar"`      // 头像URL
-	OpenId  string `json:"open_userid"` // 开放用户ID
-	UserId  string `json:"userid"`      // 用户ID
-}
-
-// GetUserInfo 获取企业微信内部用户信息
-// 参数:
-//   - token: OAuth2访问令牌
-// 返回:
-//   - *UserInfo: 标准化用户信息
-//   - error: 错误信息
-func (idp *WeComInternalIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
-	// Get userid first
-	accessToken := token.AccessToken
-	code := token.Extra("code").(string)
-	resp, err := idp.Client.Get(fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/user/getuserinfo?access_token=%s&code=%s", accessToken, code))
-	if err != nil {
-		return nil, err
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	userResp := &WecomInternalUserResp{}
-	err = json.Unmarshal(data, userResp)
-	if err != nil {
-		return nil, err
-	}
-	if userResp.Errcode != 0 {
-		return nil, fmt.Errorf("userIdResp.Errcode = %d, userIdResp.Errmsg = %s", userResp.Errcode, userResp.Errmsg)
-	}
-	if userResp.OpenId != "" {
-		return nil, fmt.Errorf("not an internal user")
-	}
-	// Use userid and accesstoken to get user information
-	resp, err = idp.Client.Get(fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/user/get?access_token=%s&userid=%s", accessToken, userResp.UserId))
-	if err != nil {
-		return nil, err
-	}
-
-	data, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	infoResp := &WecomInternalUserInfo{}
-	err = json.Unmarshal(data, infoResp)
-	if err != nil {
-		return nil, err
-	}
-	if infoResp.Errcode != 0 {
-		return nil, fmt.Errorf("userInfoResp.errcode = %d, userInfoResp.errmsg = %s", infoResp.Errcode, infoResp.Errmsg)
-	}
-	userInfo := UserInfo{
-		Id:          infoResp.UserId,
-		Username:    infoResp.Name,
-		DisplayName: infoResp.Name,
-		Email:       infoResp.Email,
-		AvatarUrl:   infoResp.Avatar,
-	}
-
-	if userInfo.Id == "" {
-		userInfo.Id = userInfo.Username
-	}
-
-	return &userInfo, nil
-}
+// 企业微信内部应用登录提供者实现
+// 支持企业微信内部应用授权登录和用户信息获取
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// WeComInternalIdProvider 企业微信内部应用登录提供者
+// 实现企业微信内部应用OAuth2登录功能
+type WeComInternalIdProvider struct {
+	providerBase
+
+	Client  *http.Client   // HTTP客户端
+	Config  *oauth2.Config // OAuth2配置
+	AgentId string         // 企业微信应用的AgentId，生成扫码登录授权URL时使用
+}
+
+func init() {
+	RegisterProvider(IDP_WECOM_INTERNAL, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		idp := NewWeComInternalIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl)
+		idp.AgentId = idpInfo.AppId
+		idp.applyProviderInfo(idpInfo, idp.Config, false)
+		return idp, nil
+	})
+	RegisterProviderValidator(IDP_WECOM_INTERNAL, requireClientSecret)
+}
+
+// NewWeComInternalIdProvider 创建企业微信内部应用登录提供者实例
+// 参数:
+//   - clientId: 企业微信应用的CorpId
+//   - clientSecret: 企业微信应用的CorpSecret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *WeComInternalIdProvider: 企业微信内部应用登录提供者实例
+func NewWeComInternalIdProvider(clientId string, clientSecret string, redirectUrl string) *WeComInternalIdProvider {
+	idp := &WeComInternalIdProvider{Client: DefaultHttpClient(), providerBase: providerBase{providerType: IDP_WECOM_INTERNAL, clientId: clientId}}
+
+	config := idp.getConfig(clientId, clientSecret, redirectUrl)
+	idp.Config = config
+
+	return idp
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *WeComInternalIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// getConfig 获取企业微信内部应用OAuth2配置
+// 参数:
+//   - clientId: 企业微信应用的CorpId
+//   - clientSecret: 企业微信应用的CorpSecret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *oauth2.Config: OAuth2配置实例
+func (idp *WeComInternalIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
+	endpoint := oauth2.Endpoint{
+		AuthURL:  "https://login.work.weixin.qq.com/wwlogin/sso/login",
+		TokenURL: "https://qyapi.weixin.qq.com/cgi-bin/gettoken",
+	}
+
+	config := &oauth2.Config{
+		Endpoint:     endpoint,
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectUrl,
+	}
+
+	return config
+}
+
+// GetAuthURL 生成企业微信内部应用扫码登录授权跳转URL
+// 扫码登录需要应用的AgentId，只在企业微信客户端内通过网页授权登录时可以不配置
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+// 返回:
+//   - string: 授权URL，未配置AgentId时为空
+func (idp *WeComInternalIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	if idp.AgentId == "" {
+		return ""
+	}
+	o := newAuthOptions(idp.Config, opts)
+
+	params := url.Values{}
+	params.Set("login_type", "CorpApp")
+	params.Set("appid", idp.Config.ClientID)
+	params.Set("agentid", idp.AgentId)
+	params.Set("redirect_uri", o.redirectUrl)
+	params.Set("state", state)
+
+	return buildAuthURL(idp.Config.Endpoint.AuthURL, params, o)
+}
+
+// Capabilities 获取企业微信内部应用登录的能力描述
+// 企业微信客户端内通过网页授权（snsapi_base）获取的授权码同样可以登录，未配置AgentId时不支持扫码登录
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *WeComInternalIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		Email:       true,
+		QRCodeLogin: idp.AgentId != "",
+		SilentLogin: true,
+	})
+}
+
+// WecomInterToken 企业微信内部应用访问令牌结构体
+type WecomInterToken struct {
+	Errcode     int    `json:"errcode"`      // 错误码
+	Errmsg      string `json:"errmsg"`       // 错误信息
+	AccessToken string `json:"access_token"` // 访问令牌
+	ExpiresIn   int    `json:"expires_in"`   // 访问令牌的有效时间，单位是秒
+}
+
+// GetToken 通过授权码获取企业微信内部应用访问令牌
+// 参数:
+//   - code: 企业微信返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+// 详细文档: https://developer.work.weixin.qq.com/document/path/91039
+func (idp *WeComInternalIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取企业微信内部应用访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - code: 企业微信返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *WeComInternalIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *WeComInternalIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	pTokenParams := &struct {
+		CorpId     string `json:"corpid"`
+		Corpsecret string `json:"corpsecret"`
+	}{idp.Config.ClientID, idp.Config.ClientSecret}
+	// gettoken使用应用凭证获取访问令牌，不消耗授权码，可以安全重试
+	data, err := idp.getUrlResp(withIdempotent(ctx), OpToken, fmt.Sprintf("%s?corpid=%s&corpsecret=%s", idp.Config.Endpoint.TokenURL, pTokenParams.CorpId, pTokenParams.Corpsecret), errcodeCheck(IDP_WECOM_INTERNAL, OpToken))
+	if err != nil {
+		return nil, err
+	}
+	pToken := &WecomInterToken{}
+	err = json.Unmarshal(data, pToken)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken: pToken.AccessToken,
+		Expiry:      time.Unix(time.Now().Unix()+int64(pToken.ExpiresIn), 0),
+	}
+
+	raw := make(map[string]interface{})
+	raw["code"] = code
+	token = token.WithExtra(raw)
+
+	return idp.checkToken(OpToken, token)
+}
+
+// WecomInternalUserResp 企业微信内部用户响应结构体
+type WecomInternalUserResp struct {
+	Errcode int    `json:"errcode"` // 错误码
+	Errmsg  string `json:"errmsg"`  // 错误信息
+	UserId  string `json:"UserId"`  // 用户ID
+	OpenId  string `json:"OpenId"`  // 开放ID
+}
+
+// WecomInternalUserInfo 企业微信内部用户信息结构体
+type WecomInternalUserInfo struct {
+	Errcode int    `json:"errcode"`     // 错误码
+	Errmsg  string `json:"errmsg"`      // 错误信息
+	Name    string `json:"name"`        // 用户姓名
+	Email   string `json:"email"`       // 邮箱地址
+	Avatar  string `json:"avatar"`      // 头像URL
+	OpenId  string `json:"open_userid"` // 开放用户ID
+	UserId  string `json:"userid"`      // 用户ID
+}
+
+// GetUserInfo 获取企业微信内部用户信息
+// 参数:
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *WeComInternalIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext 获取企业微信内部用户信息，请求受上下文控制
+// 获取用户ID和获取用户详情两次调用共用同一上下文
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - token: OAuth2访问令牌
+// 返回:
+//   - *UserInfo: 标准化用户信息
+//   - error: 错误信息
+func (idp *WeComInternalIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *WeComInternalIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	// Get userid first
+	accessToken := token.AccessToken
+	code, _ := token.Extra("code").(string)
+	if code == "" {
+		return nil, newProviderErrorf(IDP_WECOM_INTERNAL, OpUserInfo, nil, "令牌中缺少授权码，请使用GetToken返回的令牌")
+	}
+	data, err := idp.getUrlResp(ctx, "userid", fmt.Sprintf("%s?access_token=%s&code=%s", idp.resolveUrl("https://qyapi.weixin.qq.com/cgi-bin/user/getuserinfo"), accessToken, code), errcodeCheck(IDP_WECOM_INTERNAL, OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+	userResp := &WecomInternalUserResp{}
+	err = json.Unmarshal(data, userResp)
+	if err != nil {
+		return nil, err
+	}
+	if userResp.OpenId != "" {
+		return nil, newProviderErrorf(IDP_WECOM_INTERNAL, OpUserInfo, ErrNotCorpMember, "not an internal user")
+	}
+	// Use userid and accesstoken to get user information
+	data, err = idp.getUrlResp(withIdempotent(ctx), OpUserInfo, fmt.Sprintf("%s?access_token=%s&userid=%s", idp.resolveUserInfoUrl("https://qyapi.weixin.qq.com/cgi-bin/user/get"), accessToken, userResp.UserId), errcodeCheck(IDP_WECOM_INTERNAL, OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+	infoResp := &WecomInternalUserInfo{}
+	err = json.Unmarshal(data, infoResp)
+	if err != nil {
+		return nil, err
+	}
+	userInfo := UserInfo{
+		Id:          infoResp.UserId,
+		Username:    infoResp.Name,
+		DisplayName: infoResp.Name,
+		Email:       infoResp.Email,
+		AvatarUrl:   infoResp.Avatar,
+		Identity:    idp.identity(idp.Config.ClientID, IdentityKey{Kind: "userid", Scope: IdentityScopeTenant, Value: userResp.UserId}),
+	}
+
+	if userInfo.Id == "" {
+		userInfo.Id = userInfo.Username
+	}
+
+	if err = idp.completeUserInfo(&userInfo, data); err != nil {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
+
+// getUrlResp 发送HTTP GET请求并获取响应内容
+// 参数:
+//   - ctx: 请求上下文
+//   - endpoint: 接口名称，用于观察事件
+//   - url: 请求URL
+//   - check: 平台响应检查
+// 返回:
+//   - []byte: 响应内容
+//   - error: 错误信息
+func (idp *WeComInternalIdProvider) getUrlResp(ctx context.Context, endpoint string, url string, check responseCheck) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := idp.doRequest(idp.Client, req, endpoint, check)
+	return data, err
+}
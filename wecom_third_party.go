@@ -1,193 +1,267 @@
-// 企业微信第三方应用登录提供者实现
-// 支持企业微信第三方应用授权登录和用户信息获取
-package idp
-
-import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"strings"
-	"time"
-
-	"golang.org/x/oauth2"
-)
-
-// WeComIdProvider 企业微信第三方应用登录提供者
-// 实现企业微信第三方应用OAuth2登录功能
-type WeComIdProvider struct {
-	Client *http.Client   // HTTP客户端
-	Config *oauth2.Config // OAuth2配置
-}
-
-// NewWeComIdProvider 创建企业微信第三方应用登录提供者实例
-// 参数:
-//   - clientId: 企业微信第三方应用的CorpId
-//   - clientSecret: 企业微信第三方应用的ProviderSecret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *WeComIdProvider: 企业微信第三方应用登录提供者实例
-func NewWeComIdProvider(clientId string, clientSecret string, redirectUrl string) *WeComIdProvider {
-	idp := &WeComIdProvider{}
-
-	config := idp.getConfig(clientId, clientSecret, redirectUrl)
-	idp.Config = config
-
-	return idp
-}
-
-// SetHttpClient 设置HTTP客户端
-// 参数:
-//   - client: HTTP客户端实例
-func (idp *WeComIdProvider) SetHttpClient(client *http.Client) {
-	idp.Client = client
-}
-
-// getConfig 获取企业微信第三方应用OAuth2配置
-// 参数:
-//   - clientId: 企业微信第三方应用的CorpId
-//   - clientSecret: 企业微信第三方应用的ProviderSecret
-//   - redirectUrl: OAuth2重定向URL
-// 返回:
-//   - *oauth2.Config: OAuth2配置实例
-func (idp *WeComIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
-	endpoint := oauth2.Endpoint{
-		TokenURL: "https://graph.qq.com/oauth2.0/token",
-	}
-
-	config := &oauth2.Config{
-		Scopes:       []string{"snsapi_login"},
-		Endpoint:     endpoint,
-		ClientID:     clientId,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectUrl,
-	}
-
-	return config
-}
-
-// WeComProviderToken 企业微信第三方应用访问令牌结构体
-type WeComProviderToken struct {
-	Errcode             int    `json:"errcode"`              // 错误码
-	Errmsg              string `json:"errmsg"`               // 错误信息
-	ProviderAccessToken string `json:"provider_access_token"` // 第三方应用访问令牌
-	ExpiresIn           int    `json:"expires_in"`           // 访问令牌的有效时间，单位是秒
-}
-
-// GetToken 通过授权码获取企业微信第三方应用访问令牌
-// 参数:
-//   - code: 企业微信返回的授权码
-// 返回:
-//   - *oauth2.Token: OAuth2访问令牌
-//   - error: 错误信息
-// 详细文档: https://work.weixin.qq.com/api/doc/90001/90143/91125
-func (idp *WeComIdProvider) GetToken(code string) (*oauth2.Token, error) {
-	pTokenParams := &struct {
-		CorpId         string `json:"corpid"`
-		ProviderSecret string `json:"provider_secret"`
-	}{idp.Config.ClientID, idp.Config.ClientSecret}
-	data, err := idp.postWithBody(pTokenParams, "https://qyapi.weixin.qq.com/cgi-bin/service/get_provider_token")
-	if err != nil {
-		return nil, err
-	}
-	pToken := &WeComProviderToken{}
-	err = json.Unmarshal(data, pToken)
-	if err != nil {
-		return nil, err
-	}
-	if pToken.Errcode != 0 {
-		return nil, fmt.Errorf("pToken.Errcode = %d, pToken.Errmsg = %s", pToken.Errcode, pToken.Errmsg)
-	}
-
-	token := &oauth2.Token{
-		AccessToken: pToken.ProviderAccessToken,
-		Expiry:      time.Unix(time.Now().Unix()+int64(pToken.ExpiresIn), 0),
-	}
-
-	raw := make(map[string]interface{})
-	raw["code"] = code
-	token = token.WithExtra(raw)
-
-	return token, nil
-}
-
-type WeComUserInfo struct {
-	Errcode  int    `json:"errcode"`
-	Errmsg   string `json:"errmsg"`
-	Usertype int    `json:"usertype"`
-	UserInfo struct {
-		Userid     string `json:"userid"`
-		OpenUserid string `json:"open_userid"`
-		Name       string `json:"name"`
-		Avatar     string `json:"avatar"`
-	} `json:"user_info"`
-	CorpInfo struct {
-		Corpid string `json:"corpid"`
-	} `json:"corp_info"`
-	Agent []struct {
-		Agentid  int `json:"agentid"`
-		AuthType int `json:"auth_type"`
-	} `json:"agent"`
-	AuthInfo struct {
-		Department []struct {
-			Id       int  `json:"id"`
-			Writable bool `json:"writable"`
-		} `json:"department"`
-	} `json:"auth_info"`
-}
-
-// GetUserInfo use WeComProviderToken gotten before return WeComUserInfo
-// get more detail via: https://work.weixin.qq.com/api/doc/90001/90143/91125
-func (idp *WeComIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
-	accessToken := token.AccessToken
-	code := token.Extra("code").(string)
-
-	requestBody := &struct {
-		AuthCode string `json:"auth_code"`
-	}{code}
-	data, err := idp.postWithBody(requestBody, fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/service/get_login_info?access_token=%s", accessToken))
-	if err != nil {
-		return nil, err
-	}
-
-	wecomUserInfo := WeComUserInfo{}
-	err = json.Unmarshal(data, &wecomUserInfo)
-	if err != nil {
-		return nil, err
-	}
-	if wecomUserInfo.Errcode != 0 {
-		return nil, fmt.Errorf("wecomUserInfo.Errcode = %d, wecomUserInfo.Errmsg = %s", wecomUserInfo.Errcode, wecomUserInfo.Errmsg)
-	}
-
-	userInfo := UserInfo{
-		Id:          wecomUserInfo.UserInfo.OpenUserid,
-		Username:    wecomUserInfo.UserInfo.Name,
-		DisplayName: wecomUserInfo.UserInfo.Name,
-		AvatarUrl:   wecomUserInfo.UserInfo.Avatar,
-	}
-	return &userInfo, nil
-}
-
-func (idp *WeComIdProvider) postWithBody(body interface{}, url string) ([]byte, error) {
-	bs, err := json.Marshal(body)
-	if err != nil {
-		return nil, err
-	}
-	r := strings.NewReader(string(bs))
-	resp, err := idp.Client.Post(url, "application/json;charset=UTF-8", r)
-	if err != nil {
-		return nil, err
-	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			return
-		}
-	}(resp.Body)
-
-	return data, nil
-}
+// 企业微信第三方应用登录提供者实现
+// 支持企业微信第三方应用授权登录和用户信息获取
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// WeComIdProvider 企业微信第三方应用登录提供者
+// 实现企业微信第三方应用OAuth2登录功能
+type WeComIdProvider struct {
+	providerBase
+
+	Client *http.Client   // HTTP客户端
+	Config *oauth2.Config // OAuth2配置
+}
+
+func init() {
+	RegisterProvider(IDP_WECOM, func(idpInfo *ProviderInfo, redirectUrl string) (IdProvider, error) {
+		idp := NewWeComIdProvider(idpInfo.ClientId, idpInfo.ClientSecret, redirectUrl)
+		idp.applyProviderInfo(idpInfo, idp.Config, false)
+		return idp, nil
+	})
+	RegisterProviderValidator(IDP_WECOM, requireClientSecret)
+}
+
+// NewWeComIdProvider 创建企业微信第三方应用登录提供者实例
+// 参数:
+//   - clientId: 企业微信第三方应用的CorpId
+//   - clientSecret: 企业微信第三方应用的ProviderSecret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *WeComIdProvider: 企业微信第三方应用登录提供者实例
+func NewWeComIdProvider(clientId string, clientSecret string, redirectUrl string) *WeComIdProvider {
+	idp := &WeComIdProvider{Client: DefaultHttpClient(), providerBase: providerBase{providerType: IDP_WECOM, clientId: clientId}}
+
+	config := idp.getConfig(clientId, clientSecret, redirectUrl)
+	idp.Config = config
+
+	return idp
+}
+
+// SetHttpClient 设置HTTP客户端
+// 参数:
+//   - client: HTTP客户端实例，为nil时使用默认HTTP客户端
+func (idp *WeComIdProvider) SetHttpClient(client *http.Client) {
+	if client == nil {
+		client = DefaultHttpClient()
+	}
+	idp.Client = client
+}
+
+// getConfig 获取企业微信第三方应用OAuth2配置
+// 参数:
+//   - clientId: 企业微信第三方应用的CorpId
+//   - clientSecret: 企业微信第三方应用的ProviderSecret
+//   - redirectUrl: OAuth2重定向URL
+// 返回:
+//   - *oauth2.Config: OAuth2配置实例
+func (idp *WeComIdProvider) getConfig(clientId string, clientSecret string, redirectUrl string) *oauth2.Config {
+	endpoint := oauth2.Endpoint{
+		AuthURL:  "https://open.work.weixin.qq.com/wwopen/sso/3rd_qrConnect",
+		TokenURL: "https://qyapi.weixin.qq.com/cgi-bin/service/get_provider_token",
+	}
+
+	config := &oauth2.Config{
+		Scopes:       []string{"snsapi_login"},
+		Endpoint:     endpoint,
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectUrl,
+	}
+
+	return config
+}
+
+// GetAuthURL 生成企业微信第三方应用扫码登录授权跳转URL
+// 参数:
+//   - state: 防CSRF的状态参数
+//   - opts: 授权URL构建选项
+// 返回:
+//   - string: 授权URL
+func (idp *WeComIdProvider) GetAuthURL(state string, opts ...AuthOption) string {
+	o := newAuthOptions(idp.Config, opts)
+
+	params := url.Values{}
+	params.Set("appid", idp.Config.ClientID)
+	params.Set("redirect_uri", o.redirectUrl)
+	params.Set("state", state)
+	params.Set("usertype", "member")
+
+	return buildAuthURL(idp.Config.Endpoint.AuthURL, params, o)
+}
+
+// Capabilities 获取企业微信第三方应用登录的能力描述
+// 返回:
+//   - Capabilities: 能力描述
+func (idp *WeComIdProvider) Capabilities() Capabilities {
+	return idp.capabilities(Capabilities{
+		QRCodeLogin: true,
+	})
+}
+
+// WeComProviderToken 企业微信第三方应用访问令牌结构体
+type WeComProviderToken struct {
+	Errcode             int    `json:"errcode"`              // 错误码
+	Errmsg              string `json:"errmsg"`               // 错误信息
+	ProviderAccessToken string `json:"provider_access_token"` // 第三方应用访问令牌
+	ExpiresIn           int    `json:"expires_in"`           // 访问令牌的有效时间，单位是秒
+}
+
+// GetToken 通过授权码获取企业微信第三方应用访问令牌
+// 参数:
+//   - code: 企业微信返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+// 详细文档: https://work.weixin.qq.com/api/doc/90001/90143/91125
+func (idp *WeComIdProvider) GetToken(code string) (*oauth2.Token, error) {
+	return idp.GetTokenContext(context.Background(), code)
+}
+
+// GetTokenContext 通过授权码获取企业微信第三方应用访问令牌，请求受上下文控制
+// 参数:
+//   - ctx: 请求上下文，用于取消和超时控制
+//   - code: 企业微信返回的授权码
+// 返回:
+//   - *oauth2.Token: OAuth2访问令牌
+//   - error: 错误信息
+func (idp *WeComIdProvider) GetTokenContext(ctx context.Context, code string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := idp.getToken(ctx, code)
+	idp.finishOperation(ctx, OpToken, start, err)
+	return token, err
+}
+
+// getToken 使用授权码获取令牌，见GetTokenContext
+func (idp *WeComIdProvider) getToken(ctx context.Context, code string) (*oauth2.Token, error) {
+	pTokenParams := &struct {
+		CorpId         string `json:"corpid"`
+		ProviderSecret string `json:"provider_secret"`
+	}{idp.Config.ClientID, idp.Config.ClientSecret}
+	// 获取服务商凭证不消耗授权码，可以安全重试
+	data, err := idp.postWithBody(withIdempotent(ctx), OpToken, pTokenParams, idp.Config.Endpoint.TokenURL, errcodeCheck(IDP_WECOM, OpToken))
+	if err != nil {
+		return nil, err
+	}
+	pToken := &WeComProviderToken{}
+	err = json.Unmarshal(data, pToken)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken: pToken.ProviderAccessToken,
+		Expiry:      time.Unix(time.Now().Unix()+int64(pToken.ExpiresIn), 0),
+	}
+
+	raw := make(map[string]interface{})
+	raw["code"] = code
+	token = token.WithExtra(raw)
+
+	return idp.checkToken(OpToken, token)
+}
+
+type WeComUserInfo struct {
+	Errcode  int    `json:"errcode"`
+	Errmsg   string `json:"errmsg"`
+	Usertype int    `json:"usertype"`
+	UserInfo struct {
+		Userid     string `json:"userid"`
+		OpenUserid string `json:"open_userid"`
+		Name       string `json:"name"`
+		Avatar     string `json:"avatar"`
+	} `json:"user_info"`
+	CorpInfo struct {
+		Corpid string `json:"corpid"`
+	} `json:"corp_info"`
+	Agent []struct {
+		Agentid  int `json:"agentid"`
+		AuthType int `json:"auth_type"`
+	} `json:"agent"`
+	AuthInfo struct {
+		Department []struct {
+			Id       int  `json:"id"`
+			Writable bool `json:"writable"`
+		} `json:"department"`
+	} `json:"auth_info"`
+}
+
+// GetUserInfo use WeComProviderToken gotten before return WeComUserInfo
+// get more detail via: https://work.weixin.qq.com/api/doc/90001/90143/91125
+func (idp *WeComIdProvider) GetUserInfo(token *oauth2.Token) (*UserInfo, error) {
+	return idp.GetUserInfoContext(context.Background(), token)
+}
+
+// GetUserInfoContext is the context-aware variant of GetUserInfo, the request is
+// cancelled when ctx is done
+func (idp *WeComIdProvider) GetUserInfoContext(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	start := time.Now()
+	userInfo, err := idp.getUserInfo(ctx, token)
+	idp.finishOperation(ctx, OpUserInfo, start, err)
+	return userInfo, err
+}
+
+// getUserInfo 获取用户信息，见GetUserInfoContext
+func (idp *WeComIdProvider) getUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error) {
+	accessToken := token.AccessToken
+	code, _ := token.Extra("code").(string)
+	if code == "" {
+		return nil, newProviderErrorf(IDP_WECOM, OpUserInfo, nil, "令牌中缺少授权码，请使用GetToken返回的令牌")
+	}
+
+	requestBody := &struct {
+		AuthCode string `json:"auth_code"`
+	}{code}
+	data, err := idp.postWithBody(ctx, OpUserInfo, requestBody, fmt.Sprintf("%s?access_token=%s", idp.resolveUserInfoUrl("https://qyapi.weixin.qq.com/cgi-bin/service/get_login_info"), accessToken), errcodeCheck(IDP_WECOM, OpUserInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	wecomUserInfo := WeComUserInfo{}
+	err = json.Unmarshal(data, &wecomUserInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo := UserInfo{
+		Id:          wecomUserInfo.UserInfo.OpenUserid,
+		Username:    wecomUserInfo.UserInfo.Name,
+		DisplayName: wecomUserInfo.UserInfo.Name,
+		AvatarUrl:   wecomUserInfo.UserInfo.Avatar,
+		Identity: idp.identity(wecomUserInfo.CorpInfo.Corpid,
+			IdentityKey{Kind: "open_userid", Scope: IdentityScopeDeveloper, Value: wecomUserInfo.UserInfo.OpenUserid},
+			IdentityKey{Kind: "userid", Scope: IdentityScopeTenant, Value: wecomUserInfo.UserInfo.Userid},
+		),
+	}
+
+	if err = idp.completeUserInfo(&userInfo, data); err != nil {
+		return nil, err
+	}
+
+	return &userInfo, nil
+}
+
+func (idp *WeComIdProvider) postWithBody(ctx context.Context, endpoint string, body interface{}, url string, check responseCheck) ([]byte, error) {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	r := strings.NewReader(string(bs))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
+	_, data, err := idp.doRequest(idp.Client, req, endpoint, check)
+	return data, err
+}